@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	MAX_TAGS_PER_UPDATE        = 20
+	MAX_IDS_PER_UPDATE         = 1000
+	BULK_TAG_CONFIRM_THRESHOLD = 100   // updates above this need "confirm": true
+	BULK_TAG_MAX_DOCS          = 10000 // updates above this are always rejected
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// retagScript adds params.add to and removes params.remove from the tags of
+// every matched post.
+const retagScript = `
+if (ctx._source.tags == null) { ctx._source.tags = new ArrayList(); }
+for (t in params.add) { if (!ctx._source.tags.contains(t)) { ctx._source.tags.add(t); } }
+ctx._source.tags.removeAll(params.remove);
+ctx._source.updated_at = params.now;
+`
+
+// Area selects posts within Range km of a point.
+type Area struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Range float64 `json:"range"`
+}
+
+// RetagRequest is the body of POST /admin/posts/tags. Exactly one of Ids and
+// Area selects the posts.
+type RetagRequest struct {
+	Ids     []string `json:"ids"`
+	Area    *Area    `json:"area"`
+	Add     []string `json:"add"`
+	Remove  []string `json:"remove"`
+	Confirm bool     `json:"confirm"`
+}
+
+type RetagResult struct {
+	Matched int64 `json:"matched"`
+	Updated int64 `json:"updated"`
+}
+
+func (req *RetagRequest) validate() error {
+	if (len(req.Ids) == 0) == (req.Area == nil) {
+		return errors.New("Exactly one of ids or area is required")
+	}
+	if len(req.Ids) > MAX_IDS_PER_UPDATE {
+		return fmt.Errorf("At most %d ids can be updated at once", MAX_IDS_PER_UPDATE)
+	}
+	if req.Area != nil && req.Area.Range <= 0 {
+		return errors.New("Area range should be a positive number of km")
+	}
+	if len(req.Add) == 0 && len(req.Remove) == 0 {
+		return errors.New("Nothing to add or remove")
+	}
+	if len(req.Add)+len(req.Remove) > MAX_TAGS_PER_UPDATE {
+		return fmt.Errorf("At most %d tags can be changed at once", MAX_TAGS_PER_UPDATE)
+	}
+	for _, tag := range append(append([]string{}, req.Add...), req.Remove...) {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("Invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+func (req *RetagRequest) query() elastic.Query {
+	if req.Area != nil {
+		return newGeoDistanceQuery(req.Area.Lat, req.Area.Lon, fmt.Sprintf("%gkm", req.Area.Range))
+	}
+	return elastic.NewIdsQuery().Ids(req.Ids...)
+}
+
+// handleRetagPosts lets admins add or remove tags across many posts at once.
+func handleRetagPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for retagging posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+
+	var req RetagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid retag request %v.\n", err)
+		return
+	}
+
+	client := esClient
+
+	start := time.Now()
+	matched, err := client.Count(POST_INDEX).Query(req.query()).Do(context.Background())
+	observeQuery(context.Background(), "count", sinceMillis(start), map[string]interface{}{"ids": len(req.Ids), "area": req.Area})
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count posts to retag %v.\n", err)
+		return
+	}
+	if matched > BULK_TAG_MAX_DOCS {
+		http.Error(w, fmt.Sprintf("Query matches %d posts, more than the limit of %d", matched, BULK_TAG_MAX_DOCS), http.StatusBadRequest)
+		return
+	}
+	if matched > BULK_TAG_CONFIRM_THRESHOLD && !req.Confirm {
+		http.Error(w, fmt.Sprintf("Query matches %d posts, resend with \"confirm\": true to update them", matched), http.StatusBadRequest)
+		return
+	}
+
+	add, remove := req.Add, req.Remove
+	if add == nil {
+		add = []string{}
+	}
+	if remove == nil {
+		remove = []string{}
+	}
+	script := elastic.NewScript(retagScript).Lang("painless").Params(map[string]interface{}{
+		"add":    add,
+		"remove": remove,
+		"now":    time.Now().UTC().Format(time.RFC3339Nano),
+	})
+
+	resp, err := client.UpdateByQuery(POST_INDEX).
+		Query(req.query()).
+		Script(script).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(context.Background())
+	if err != nil {
+		http.Error(w, "Failed to update posts in ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to retag posts %v.\n", err)
+		return
+	}
+	observeQuery(context.Background(), "update_by_query", resp.Took, map[string]interface{}{"ids": len(req.Ids), "area": req.Area})
+
+	result := &RetagResult{Matched: matched, Updated: resp.Updated}
+	writeAudit(claims.Username, "retag_posts", map[string]interface{}{
+		"ids":     req.Ids,
+		"area":    req.Area,
+		"add":     req.Add,
+		"remove":  req.Remove,
+		"matched": result.Matched,
+		"updated": result.Updated,
+	})
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to parse result into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse result into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
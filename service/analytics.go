@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Product analytics. With an ANALYTICS_SINK, an event is recorded for
+// every post created and every search performed, and streamed in batches
+// to "bigquery", the BIGQUERY_TABLE of BIGQUERY_DATASET in
+// BIGQUERY_PROJECT, partitioned by day, or to "log", the service log. The
+// events are sent in the background every ANALYTICS_FLUSH_INTERVAL, or
+// once ANALYTICS_BATCH_SIZE are waiting; they are dropped when
+// ANALYTICS_QUEUE are. The variables are loaded from the ServiceConfig at
+// startup.
+var (
+	ANALYTICS_SINK   = "none"
+	BIGQUERY_PROJECT = ""
+	BIGQUERY_DATASET = ""
+	BIGQUERY_TABLE   = "events"
+)
+
+var ANALYTICS_SINKS = []string{"none", "bigquery", "log"}
+
+const (
+	ANALYTICS_FLUSH_INTERVAL = 5 * time.Second
+	ANALYTICS_BATCH_SIZE     = 500
+	ANALYTICS_QUEUE          = 10000
+	ANALYTICS_TIMEOUT        = 30 * time.Second
+	ANALYTICS_PRECISION      = 2
+)
+
+// Types of AnalyticsEvent.
+const (
+	EVENT_POST_CREATED     = "post_created"
+	EVENT_SEARCH_PERFORMED = "search_performed"
+)
+
+// AnalyticsEvent is one row of the analytics table. Searched points are
+// rounded to ANALYTICS_PRECISION decimals, about a kilometer, so the table
+// doesn't track where users are.
+type AnalyticsEvent struct {
+	Id        string    `json:"event_id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	User      string    `json:"user,omitempty"`
+	PostId    string    `json:"post_id,omitempty"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	RangeKm   float64   `json:"range_km,omitempty"`
+	Place     string    `json:"place,omitempty"`
+	City      string    `json:"city,omitempty"`
+	MediaType string    `json:"media_type,omitempty"`
+	Lang      string    `json:"lang,omitempty"`
+	Results   int64     `json:"results,omitempty"`
+}
+
+// EventSink stores analytics events.
+type EventSink interface {
+	Write(ctx context.Context, events []*AnalyticsEvent) error
+}
+
+// Analytics batches events for its sink.
+type Analytics struct {
+	sink   EventSink
+	events chan *AnalyticsEvent
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// analytics is the Analytics in use, nil for "none". It is set up by
+// setupAnalytics.
+var analytics *Analytics
+
+func setupAnalytics(ctx context.Context) error {
+	var sink EventSink
+	switch ANALYTICS_SINK {
+	case "none":
+		analytics = nil
+		return nil
+	case "bigquery":
+		bq, err := newBigQuerySink(ctx, BIGQUERY_PROJECT, BIGQUERY_DATASET, BIGQUERY_TABLE)
+		if err != nil {
+			return err
+		}
+		sink = bq
+	case "log":
+		sink = logSink{}
+	default:
+		return fmt.Errorf("unknown analytics sink %q", ANALYTICS_SINK)
+	}
+	analytics = newAnalytics(sink, ANALYTICS_FLUSH_INTERVAL)
+	fmt.Printf("Analytics events go to %s\n", ANALYTICS_SINK)
+	return nil
+}
+
+func newAnalytics(sink EventSink, flushInterval time.Duration) *Analytics {
+	an := &Analytics{sink: sink, events: make(chan *AnalyticsEvent, ANALYTICS_QUEUE), done: make(chan struct{})}
+	go an.run(flushInterval)
+	return an
+}
+
+func (an *Analytics) run(flushInterval time.Duration) {
+	defer close(an.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*AnalyticsEvent
+	for {
+		select {
+		case e, ok := <-an.events:
+			if !ok {
+				an.flush(batch)
+				return
+			}
+			if batch = append(batch, e); len(batch) >= ANALYTICS_BATCH_SIZE {
+				an.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			an.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush writes batch to the sink. Analytics are best effort: a batch the
+// sink fails on is dropped.
+func (an *Analytics) flush(batch []*AnalyticsEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ANALYTICS_TIMEOUT)
+	defer cancel()
+	if err := an.sink.Write(ctx, batch); err != nil {
+		fmt.Printf("Failed to write %d analytics events %v.\n", len(batch), err)
+	}
+}
+
+// Stop writes the waiting events.
+func (an *Analytics) Stop() {
+	an.mu.Lock()
+	an.closed = true
+	close(an.events)
+	an.mu.Unlock()
+	<-an.done
+}
+
+// track queues e, unless the queue is full or stopped.
+func (an *Analytics) track(e *AnalyticsEvent) {
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	if an.closed {
+		return
+	}
+	select {
+	case an.events <- e:
+	default:
+		fmt.Printf("Analytics queue is full, dropped %s event\n", e.Type)
+	}
+}
+
+// trackEvent records e, if analytics are enabled.
+func trackEvent(e *AnalyticsEvent) {
+	if analytics == nil {
+		return
+	}
+	e.Id = uuid.New()
+	e.Timestamp = time.Now().UTC()
+	analytics.track(e)
+}
+
+// trackPostCreated records the creation of p.
+func trackPostCreated(p *Post) {
+	trackEvent(&AnalyticsEvent{
+		Type:      EVENT_POST_CREATED,
+		User:      p.User,
+		PostId:    p.Id,
+		Lat:       roundCoordinate(p.Location.Lat),
+		Lon:       roundCoordinate(p.Location.Lon),
+		City:      p.City,
+		MediaType: p.MediaType,
+		Lang:      p.Lang,
+	})
+}
+
+// trackSearch records the search q of viewer, which matched results posts.
+func trackSearch(q *GeoQuery, viewer string, results int64) {
+	e := &AnalyticsEvent{
+		Type:    EVENT_SEARCH_PERFORMED,
+		User:    viewer,
+		Lat:     roundCoordinate(q.Lat),
+		Lon:     roundCoordinate(q.Lon),
+		Place:   q.Place,
+		Results: results,
+	}
+	if km, err := parseKm(q.Distance); err == nil && q.BBox == nil {
+		e.RangeKm = km
+	}
+	trackEvent(e)
+}
+
+func roundCoordinate(v float64) float64 {
+	scale := math.Pow(10, ANALYTICS_PRECISION)
+	return math.Round(v*scale) / scale
+}
+
+// logSink writes events to the service log, one JSON object per line.
+type logSink struct{}
+
+func (logSink) Write(ctx context.Context, events []*AnalyticsEvent) error {
+	for _, e := range events {
+		js, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("analytics %s\n", js)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// analyticsSchema are the columns of the events table, those of
+// AnalyticsEvent.
+var analyticsSchema = []*bigquery.TableFieldSchema{
+	{Name: "event_id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "type", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "timestamp", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "user", Type: "STRING"},
+	{Name: "post_id", Type: "STRING"},
+	{Name: "lat", Type: "FLOAT"},
+	{Name: "lon", Type: "FLOAT"},
+	{Name: "range_km", Type: "FLOAT"},
+	{Name: "place", Type: "STRING"},
+	{Name: "city", Type: "STRING"},
+	{Name: "media_type", Type: "STRING"},
+	{Name: "lang", Type: "STRING"},
+	{Name: "results", Type: "INTEGER"},
+}
+
+// bigQuerySink streams events into a BigQuery table partitioned by the
+// day of their timestamp, with the application default credentials. The
+// table is created in the dataset if it doesn't exist.
+type bigQuerySink struct {
+	service *bigquery.Service
+	project string
+	dataset string
+	table   string
+}
+
+func newBigQuerySink(ctx context.Context, project, dataset, table string) (*bigQuerySink, error) {
+	service, err := bigquery.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery: %v", err)
+	}
+	s := &bigQuerySink{service: service, project: project, dataset: dataset, table: table}
+	if err := s.ensureTable(ctx); err != nil {
+		return nil, fmt.Errorf("bigquery table %s.%s: %v", dataset, table, err)
+	}
+	return s, nil
+}
+
+func (s *bigQuerySink) ensureTable(ctx context.Context) error {
+	_, err := s.service.Tables.Get(s.project, s.dataset, s.table).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); !ok || gerr.Code != http.StatusNotFound {
+		return err
+	}
+	_, err = s.service.Tables.Insert(s.project, s.dataset, &bigquery.Table{
+		TableReference:   &bigquery.TableReference{ProjectId: s.project, DatasetId: s.dataset, TableId: s.table},
+		Schema:           &bigquery.TableSchema{Fields: analyticsSchema},
+		TimePartitioning: &bigquery.TimePartitioning{Type: "DAY", Field: "timestamp"},
+	}).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+		// another instance created it
+		return nil
+	}
+	return err
+}
+
+func (s *bigQuerySink) Write(ctx context.Context, events []*AnalyticsEvent) error {
+	rows := make([]*bigquery.TableDataInsertAllRequestRows, 0, len(events))
+	for _, e := range events {
+		js, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		var row map[string]bigquery.JsonValue
+		if err := json.Unmarshal(js, &row); err != nil {
+			return err
+		}
+		// the event id lets BigQuery drop rows sent twice
+		rows = append(rows, &bigquery.TableDataInsertAllRequestRows{InsertId: e.Id, Json: row})
+	}
+
+	resp, err := s.service.Tabledata.InsertAll(s.project, s.dataset, s.table, &bigquery.TableDataInsertAllRequest{
+		Rows: rows,
+	}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if len(resp.InsertErrors) > 0 {
+		var reasons []string
+		for _, insertErr := range resp.InsertErrors {
+			for _, e := range insertErr.Errors {
+				reasons = append(reasons, e.Message)
+			}
+		}
+		return fmt.Errorf("%d rows rejected: %s", len(resp.InsertErrors), strings.Join(reasons, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is an EventSink that keeps the batches written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][]*AnalyticsEvent
+}
+
+func (s *recordingSink) Write(ctx context.Context, events []*AnalyticsEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func TestAnalyticsFlushesOnStop(t *testing.T) {
+	sink := &recordingSink{}
+	analytics = newAnalytics(sink, time.Hour)
+	defer func() { analytics = nil }()
+
+	trackPostCreated(&Post{Id: "p1", User: "rosa", Location: Location{Lat: 37.123456, Lon: -122.987654}, City: "Oakland"})
+	trackSearch(&GeoQuery{Lat: 37.4449, Lon: -122.1611, Distance: "5km"}, "rosa", 3)
+	analytics.Stop()
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 2 {
+		t.Fatalf("batches = %v, want one of two events", sink.batches)
+	}
+	created, searched := sink.batches[0][0], sink.batches[0][1]
+	if created.Type != EVENT_POST_CREATED || created.PostId != "p1" || created.City != "Oakland" {
+		t.Errorf("post event = %+v", created)
+	}
+	if created.Lat != 37.12 || created.Lon != -122.99 {
+		t.Errorf("post event at %v,%v, want 37.12,-122.99", created.Lat, created.Lon)
+	}
+	if searched.Type != EVENT_SEARCH_PERFORMED || searched.User != "rosa" || searched.RangeKm != 5 || searched.Results != 3 {
+		t.Errorf("search event = %+v", searched)
+	}
+	if created.Id == "" || created.Id == searched.Id || created.Timestamp.IsZero() {
+		t.Errorf("events need distinct ids and a timestamp: %+v, %+v", created, searched)
+	}
+}
+
+func TestTrackEventDisabled(t *testing.T) {
+	analytics = nil
+	// nothing to record to, and nothing should panic
+	trackPostCreated(&Post{Id: "p1"})
+}
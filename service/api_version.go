@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API versions of the response contract. Clients that don't ask for a
+// version get API_V1 so existing integrations keep working unchanged.
+const (
+	API_V1 = 1 // bare JSON arrays
+	API_V2 = 2 // paginated envelopes
+
+	DEFAULT_API_VERSION = API_V1
+	LATEST_API_VERSION  = API_V2
+
+	API_VERSION_HEADER = "X-API-Version"
+	API_MEDIA_TYPE     = "application/vnd.circus.v"
+)
+
+// apiVersion negotiates the response version of a request. The `v` query
+// parameter wins over an Accept header of the form
+// application/vnd.circus.v2+json; unknown or unsupported versions fall back
+// to DEFAULT_API_VERSION.
+func apiVersion(r *http.Request) int {
+	if val := r.URL.Query().Get("v"); val != "" {
+		return supportedVersion(strings.TrimPrefix(val, "v"))
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		if strings.HasPrefix(mediaType, API_MEDIA_TYPE) {
+			return supportedVersion(strings.TrimSuffix(strings.TrimPrefix(mediaType, API_MEDIA_TYPE), "+json"))
+		}
+	}
+
+	return DEFAULT_API_VERSION
+}
+
+func supportedVersion(val string) int {
+	version, err := strconv.Atoi(val)
+	if err != nil || version < API_V1 || version > LATEST_API_VERSION {
+		return DEFAULT_API_VERSION
+	}
+	return version
+}
+
+// setAPIVersion tells the client which contract the response follows.
+func setAPIVersion(w http.ResponseWriter, version int) {
+	w.Header().Set(API_VERSION_HEADER, strconv.Itoa(version))
+	w.Header().Add("Vary", "Accept")
+}
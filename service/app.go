@@ -0,0 +1,60 @@
+package main
+
+import "context"
+
+// App holds the backends shared by the handlers. newApp builds them from
+// the configuration; an App built from other implementations, such as the
+// memory PostStore, serves the same routes.
+type App struct {
+	Blobs BlobStore
+	Posts PostStore
+	Live  *Broadcaster
+	Geo   Geocoder
+	// Images analyzes new images, nil when IMAGE_ANALYZER is "none".
+	Images ImageAnalyzer
+	// Uploads stores media in the background, nil unless
+	// ASYNC_MEDIA_UPLOAD is set.
+	Uploads *MediaUploader
+	// Cache holds recent search results, nil unless REDIS_URL is set.
+	Cache SearchCache
+	// Ingest carries new posts to the consumers that index them, nil when
+	// INGEST_QUEUE is "none".
+	Ingest PostQueue
+	// Quota limits how often users post, nil when POST_DAILY_LIMIT and
+	// POST_COOLDOWN are zero.
+	Quota PostQuota
+}
+
+func newApp(ctx context.Context) (*App, error) {
+	blobs, err := newBlobStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blobs = &instrumentedBlobStore{BlobStore: &resilientBlobStore{BlobStore: blobs}, backend: STORAGE_BACKEND}
+	mediaSigner = blobs
+	posts, err := newPostStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images, err := newImageAnalyzer()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newSearchCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	geo, err := newGeocoder()
+	if err != nil {
+		return nil, err
+	}
+	ingest, err := newPostQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := newPostQuota(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &App{Blobs: blobs, Posts: posts, Live: newBroadcaster(), Geo: geo, Images: images, Cache: cache, Ingest: ingest, Quota: quota}, nil
+}
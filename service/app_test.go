@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// The handler tests run the routes of an App built from fakes: the memory
+// PostStore, memBlobStore and staticGeocoder. Code that still reaches
+// esClient directly, such as likes and media refs, talks to fakeES, which
+// answers every search with no hits.
+
+func TestMain(m *testing.M) {
+	es := httptest.NewServer(http.HandlerFunc(fakeES))
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+	)
+	if err != nil {
+		fmt.Printf("Failed to create ElasticSearch client %v.\n", err)
+		os.Exit(1)
+	}
+	esClient = client
+
+	code := m.Run()
+	es.Close()
+	os.Exit(code)
+}
+
+// fakeES is an empty ElasticSearch: searches find nothing, bulk requests
+// succeed and everything else is acknowledged.
+func fakeES(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		io.WriteString(w, `{"took":1,"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`)
+	case strings.HasSuffix(r.URL.Path, "/_bulk"):
+		io.WriteString(w, `{"took":1,"errors":false,"items":[]}`)
+	case strings.HasSuffix(r.URL.Path, "/_count"):
+		io.WriteString(w, `{"count":0}`)
+	default:
+		io.WriteString(w, `{"acknowledged":true}`)
+	}
+}
+
+// memBlobStore is a BlobStore in memory.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memBlobStore) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := checkSize(opts, int64(len(data))); err != nil {
+		return "", 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = data
+	return "https://media.test/" + key, int64(len(data)), nil
+}
+
+func (s *memBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("no object %q", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memBlobStore) SignedURL(key string) (string, error) {
+	return "https://media.test/" + key + "?signed", nil
+}
+
+func (s *memBlobStore) Check(ctx context.Context) error {
+	return nil
+}
+
+func (s *memBlobStore) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[key]
+	return ok
+}
+
+// failingPuts is a BlobStore whose puts of keys starting with prefix fail.
+type failingPuts struct {
+	BlobStore
+	prefix string
+}
+
+func (s failingPuts) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	if strings.HasPrefix(key, s.prefix) {
+		return "", 0, errors.New("put failed")
+	}
+	return s.BlobStore.Put(ctx, key, r, opts)
+}
+
+// staticGeocoder resolves the places it knows, and names the locations
+// within 50km of one after it, as their city.
+type staticGeocoder map[string]Location
+
+func (g staticGeocoder) Forward(ctx context.Context, place string) (*Location, error) {
+	loc, ok := g[place]
+	if !ok {
+		return nil, errPlaceNotFound
+	}
+	return &loc, nil
+}
+
+func (g staticGeocoder) Reverse(ctx context.Context, loc Location) (*Place, error) {
+	for name, l := range g {
+		if haversineKm(loc.Lat, loc.Lon, l.Lat, l.Lon) <= 50 {
+			return &Place{City: name}, nil
+		}
+	}
+	return nil, errPlaceNotFound
+}
+
+// testServer is an App built from fakes and serving its routes.
+type testServer struct {
+	*App
+	posts   *memoryPostStore
+	blobs   *memBlobStore
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &testServer{posts: newMemoryPostStore(), blobs: newMemBlobStore()}
+	s.App = &App{
+		Blobs: s.blobs,
+		Posts: s.posts,
+		Live:  newBroadcaster(),
+		Geo:   staticGeocoder{"San Francisco": {Lat: 37.7749, Lon: -122.4194}},
+	}
+	// every server gets its own rate limit buckets
+	routeLimitersMu.Lock()
+	routeLimiters = make(map[string]*routeLimiter)
+	routeLimitersMu.Unlock()
+	s.handler = s.routes()
+	return s
+}
+
+// do serves r and returns the recorded response.
+func (s *testServer) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// tokenFor issues an access token for username with the user role.
+func tokenFor(t *testing.T, username string) string {
+	t.Helper()
+	token, err := newAccessToken(&User{Username: username, Role: ROLE_USER}, time.Minute)
+	if err != nil {
+		t.Fatalf("newAccessToken: %v", err)
+	}
+	return token
+}
+
+// authorized returns r carrying a token for username.
+func authorized(t *testing.T, r *http.Request, username string) *http.Request {
+	r.Header.Set("Authorization", "Bearer "+tokenFor(t, username))
+	return r
+}
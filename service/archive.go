@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Archival of old posts. When the archival flag is on, a background job moves posts older
+// than ARCHIVE_AFTER_DAYS out of the post index into newline-delimited JSON
+// objects in the blob store, one object per batch, and records each object
+// in the archive index. With ARCHIVE_MEDIA the posts' images are moved to
+// private archive objects as well; otherwise they stay where they are.
+// Admins can restore a time range back into the post index; restored posts
+// are marked and not archived again.
+const (
+	ENABLE_ARCHIVAL       = false
+	ARCHIVE_AFTER_DAYS    = 365
+	ARCHIVE_INTERVAL      = 24 * time.Hour
+	ARCHIVE_BATCH_SIZE    = 500
+	ARCHIVE_OBJECT_PREFIX = "archive-posts-"
+	ARCHIVE_MEDIA_PREFIX  = "archive-media-"
+
+	ARCHIVE_INDEX = "archive"
+)
+
+var ARCHIVE_MEDIA = false
+
+const ARCHIVE_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "key": {
+                "type": "keyword"
+            },
+            "from": {
+                "type": "date"
+            },
+            "to": {
+                "type": "date"
+            },
+            "created_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// ArchiveObject describes one archive object in the blob store. From and To
+// bound the timestamps of the posts it holds.
+type ArchiveObject struct {
+	Key       string    `json:"key"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Posts     int64     `json:"posts"`
+	Bytes     int64     `json:"bytes"`
+	Media     int64     `json:"media"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ArchiveRecord is one line of an archive object.
+type ArchiveRecord struct {
+	Post Post `json:"post"`
+	// MediaKeys are the archive keys the post's media was moved to.
+	MediaKeys map[string]string `json:"media_keys,omitempty"`
+}
+
+// ArchiveRun reports one archival run or restore.
+type ArchiveRun struct {
+	Objects int64 `json:"objects"`
+	Posts   int64 `json:"posts"`
+	Bytes   int64 `json:"bytes"`
+	Media   int64 `json:"media"`
+	Failed  int64 `json:"failed"`
+	TookMs  int64 `json:"took_ms"`
+}
+
+// startArchiver runs archival every ARCHIVE_INTERVAL while the archival
+// flag, which defaults to ENABLE_ARCHIVAL, is on.
+func (a *App) startArchiver() {
+	go func() {
+		ticker := time.NewTicker(ARCHIVE_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if !flags.Enabled(FLAG_ARCHIVAL) {
+				continue
+			}
+			cutoff := now.AddDate(0, 0, -ARCHIVE_AFTER_DAYS)
+			if _, err := a.archivePosts(context.Background(), cutoff); err != nil {
+				fmt.Printf("Failed to archive posts %v.\n", err)
+			}
+		}
+	}()
+}
+
+// archivePosts archives every post published before cutoff.
+func (a *App) archivePosts(ctx context.Context, cutoff time.Time) (*ArchiveRun, error) {
+	client := esClient
+
+	start := time.Now()
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewRangeQuery("timestamp").Lt(cutoff)).
+		MustNot(elastic.NewTermQuery("restored", true))
+
+	run := &ArchiveRun{}
+	scroll := client.Scroll(POST_INDEX).Query(query).Size(ARCHIVE_BATCH_SIZE).KeepAlive("5m")
+	defer scroll.Clear(ctx)
+	for batch := 0; ; batch++ {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return run, err
+		}
+		posts := decodePosts(searchResult)
+		if len(posts) == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s%d-%d.ndjson", ARCHIVE_OBJECT_PREFIX, start.Unix(), batch)
+		if err := a.archiveBatch(ctx, client, key, posts, run); err != nil {
+			return run, err
+		}
+	}
+
+	run.TookMs = sinceMillis(start)
+	stats.recordArchive(start, run)
+	fmt.Printf("Archived %d posts into %d objects (%d bytes, %d media) in %dms\n",
+		run.Posts, run.Objects, run.Bytes, run.Media, run.TookMs)
+	return run, nil
+}
+
+// archiveBatch writes posts to the archive object key and only then
+// deletes them from the post index, so a failure never loses a post. Their
+// media is copied first and the originals are deleted last, once the posts
+// no longer point at them.
+func (a *App) archiveBatch(ctx context.Context, client *elastic.Client, key string, posts []Post, run *ArchiveRun) (err error) {
+	object := &ArchiveObject{Key: key, CreatedAt: time.Now().UTC()}
+	moved := make(map[string]map[string]string) // by post id
+	defer func() {
+		if err != nil {
+			// the posts keep their original media
+			for _, keys := range moved {
+				a.deleteBlobs(ctx, keys, false)
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, p := range posts {
+		record := &ArchiveRecord{Post: p}
+		if ARCHIVE_MEDIA {
+			record.MediaKeys = a.archiveMedia(ctx, &p)
+			moved[p.Id] = record.MediaKeys
+			object.Media += int64(len(record.MediaKeys))
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+		if object.From.IsZero() || p.Timestamp.Before(object.From) {
+			object.From = p.Timestamp
+		}
+		if p.Timestamp.After(object.To) {
+			object.To = p.Timestamp
+		}
+	}
+	object.Posts = int64(len(posts))
+
+	_, size, err := a.Blobs.Put(ctx, key, &buf, &PutOptions{ContentType: "application/x-ndjson", Private: true})
+	if err != nil {
+		return err
+	}
+	object.Bytes = size
+	if _, err := client.Index().Index(ARCHIVE_INDEX).Id(key).BodyJson(object).Do(ctx); err != nil {
+		return err
+	}
+
+	bulk := client.Bulk()
+	for _, p := range posts {
+		bulk.Add(elastic.NewBulkDeleteRequest().
+			Index(POST_INDEX).
+			Id(p.Id).
+			Routing(postRouting(&p, p.Id)))
+		if ARCHIVE_MEDIA {
+			for _, mediaKey := range mediaKeys(&p) {
+				bulk.Add(elastic.NewBulkDeleteRequest().Index(MEDIA_REF_INDEX).Id(mediaKey))
+			}
+		}
+	}
+	resp, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	// the posts ES failed to delete still point at their original media
+	for _, item := range resp.Failed() {
+		if item.Index == POST_INDEX {
+			a.deleteBlobs(ctx, moved[item.Id], false)
+			delete(moved, item.Id)
+		}
+	}
+	for _, keys := range moved {
+		a.deleteBlobs(ctx, keys, true)
+	}
+
+	run.Objects++
+	run.Posts += object.Posts
+	run.Bytes += object.Bytes
+	run.Media += object.Media
+	run.Failed += int64(len(resp.Failed()))
+	return nil
+}
+
+// archiveMedia copies the media of p to private archive objects and
+// returns the original to archive key mapping. Media that can't be copied
+// is left in place; archiveBatch deletes the originals.
+func (a *App) archiveMedia(ctx context.Context, p *Post) map[string]string {
+	moved := make(map[string]string)
+	for _, key := range mediaKeys(p) {
+		archiveKey := ARCHIVE_MEDIA_PREFIX + key
+		if _, err := a.copyBlob(ctx, key, archiveKey, &PutOptions{Private: true}); err != nil {
+			fmt.Printf("Failed to archive media %s of post %s %v.\n", key, p.Id, err)
+			continue
+		}
+		moved[key] = archiveKey
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	return moved
+}
+
+// deleteBlobs deletes the originals of moved, or their archive copies.
+func (a *App) deleteBlobs(ctx context.Context, moved map[string]string, originals bool) {
+	for key, archiveKey := range moved {
+		if !originals {
+			key = archiveKey
+		}
+		if err := a.Blobs.Delete(ctx, key); err != nil {
+			fmt.Printf("Failed to delete media %s %v.\n", key, err)
+		}
+	}
+}
+
+func (a *App) copyBlob(ctx context.Context, from, to string, opts *PutOptions) (string, error) {
+	rc, err := a.Blobs.Get(ctx, from)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	url, _, err := a.Blobs.Put(ctx, to, rc, opts)
+	return url, err
+}
+
+// restorePosts puts the archived posts published between from and to back
+// into the post index. Archive objects are kept.
+func (a *App) restorePosts(ctx context.Context, from, to time.Time) (*ArchiveRun, error) {
+	client := esClient
+
+	start := time.Now()
+	objects, err := listArchiveObjects(ctx, client, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &ArchiveRun{}
+	for _, object := range objects {
+		if err := a.restoreObject(ctx, client, object, from, to, run); err != nil {
+			return run, err
+		}
+	}
+
+	run.TookMs = sinceMillis(start)
+	fmt.Printf("Restored %d posts from %d archive objects (%d bytes, %d media) in %dms\n",
+		run.Posts, run.Objects, run.Bytes, run.Media, run.TookMs)
+	return run, nil
+}
+
+func (a *App) restoreObject(ctx context.Context, client *elastic.Client, object *ArchiveObject, from, to time.Time, run *ArchiveRun) error {
+	rc, err := a.Blobs.Get(ctx, object.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var restored []Post
+	scanner := bufio.NewScanner(rc)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record ArchiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("archive object %s: %v", object.Key, err)
+		}
+		p := record.Post
+		if p.Timestamp.Before(from) || p.Timestamp.After(to) {
+			continue
+		}
+		for key, archiveKey := range record.MediaKeys {
+			url, err := a.copyBlob(ctx, archiveKey, key, nil)
+			if err != nil {
+				fmt.Printf("Failed to restore media %s of post %s %v.\n", key, p.Id, err)
+				continue
+			}
+			setMediaURL(&p, key, url)
+			run.Media++
+		}
+		p.Restored = true
+		restored = append(restored, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(restored) == 0 {
+		return nil
+	}
+
+	bulk := client.Bulk()
+	for i := range restored {
+		p := &restored[i]
+		bulk.Add(elastic.NewBulkIndexRequest().
+			Index(POST_INDEX).
+			Id(p.Id).
+			Routing(postRouting(p, p.Id)).
+			Doc(p))
+		bulk.Add(newMediaRefRequests(p)...)
+	}
+	resp, err := bulk.Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	run.Objects++
+	run.Posts += int64(len(restored))
+	run.Bytes += object.Bytes
+	run.Failed += int64(len(resp.Failed()))
+	return nil
+}
+
+// listArchiveObjects returns the archive objects holding posts between from
+// and to, oldest first.
+func listArchiveObjects(ctx context.Context, client *elastic.Client, from, to time.Time) ([]*ArchiveObject, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewRangeQuery("from").Lte(to),
+		elastic.NewRangeQuery("to").Gte(from),
+	)
+
+	var objects []*ArchiveObject
+	scroll := client.Scroll(ARCHIVE_INDEX).Query(query).Sort("from", true).Size(ARCHIVE_BATCH_SIZE).KeepAlive("1m")
+	defer scroll.Clear(ctx)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var object ArchiveObject
+			if hit.Source == nil || json.Unmarshal(hit.Source, &object) != nil {
+				continue
+			}
+			objects = append(objects, &object)
+		}
+	}
+	return objects, nil
+}
+
+// parseArchiveRange reads the from and to query parameters, RFC 3339
+// timestamps. A missing bound is open.
+func parseArchiveRange(r *http.Request) (time.Time, time.Time, error) {
+	from := time.Time{}
+	to := time.Now().UTC()
+	if val := r.URL.Query().Get("from"); val != "" {
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return from, to, err
+		}
+		from = t
+	}
+	if val := r.URL.Query().Get("to"); val != "" {
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return from, to, err
+		}
+		to = t
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to is before from")
+	}
+	return from, to, nil
+}
+
+// handleListArchive lists the archive objects between from and to.
+func handleListArchive(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for listing archives")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	from, to, err := parseArchiveRange(r)
+	if err != nil {
+		http.Error(w, "Invalid archive range", http.StatusBadRequest)
+		return
+	}
+
+	client := esClient
+	objects, err := listArchiveObjects(r.Context(), client, from, to)
+	if err != nil {
+		http.Error(w, "Failed to list archives", http.StatusInternalServerError)
+		fmt.Printf("Failed to list archives %v.\n", err)
+		return
+	}
+
+	if objects == nil {
+		objects = []*ArchiveObject{}
+	}
+	js, err := json.Marshal(objects)
+	if err != nil {
+		http.Error(w, "Failed to parse archives into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse archives into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleRestoreArchive restores the archived posts between from and to.
+func (a *App) handleRestoreArchive(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for restoring archives")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+	from, to, err := parseArchiveRange(r)
+	if err != nil {
+		http.Error(w, "Invalid archive range", http.StatusBadRequest)
+		return
+	}
+
+	run, err := a.restorePosts(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, "Failed to restore archives", http.StatusInternalServerError)
+		fmt.Printf("Failed to restore archives %v.\n", err)
+		return
+	}
+	writeAudit(claims.Username, "restore_archive", map[string]interface{}{
+		"from":  from.Format(time.RFC3339),
+		"to":    to.Format(time.RFC3339),
+		"posts": run.Posts,
+	})
+
+	js, err := json.Marshal(run)
+	if err != nil {
+		http.Error(w, "Failed to parse result into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse result into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestArchiveBatchKeepsMediaOnFailure(t *testing.T) {
+	ARCHIVE_MEDIA = true
+	defer func() { ARCHIVE_MEDIA = false }()
+	s := newTestServer(t)
+	ctx := context.Background()
+	if _, _, err := s.blobs.Put(ctx, "cat.png", bytes.NewReader(testPNG(t)), nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Blobs = failingPuts{BlobStore: s.blobs, prefix: ARCHIVE_OBJECT_PREFIX}
+
+	posts := []Post{{Id: "p1", User: "hal", MediaKey: "cat.png", Timestamp: time.Now()}}
+	key := ARCHIVE_OBJECT_PREFIX + "1-0.ndjson"
+	if err := s.archiveBatch(ctx, esClient, key, posts, &ArchiveRun{}); err == nil {
+		t.Fatal("archiveBatch with a failing put = nil, want the error")
+	}
+	if !s.blobs.has("cat.png") {
+		t.Error("the original media was deleted though the post was not archived")
+	}
+	if s.blobs.has(ARCHIVE_MEDIA_PREFIX + "cat.png") {
+		t.Error("the archive copy of the media was left behind")
+	}
+}
@@ -0,0 +1,976 @@
+// gRPC API of the Around service, served on GRPC_ADDR next to the HTTP API
+// and backed by the same operations.
+//
+// Regenerate around.pb.go and around_grpc.pb.go after editing, see the
+// go:generate line in grpc.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: around.proto
+
+package main
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LatLon struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Lat           float64                `protobuf:"fixed64,1,opt,name=lat,proto3" json:"lat,omitempty"`
+	Lon           float64                `protobuf:"fixed64,2,opt,name=lon,proto3" json:"lon,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LatLon) Reset() {
+	*x = LatLon{}
+	mi := &file_around_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LatLon) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LatLon) ProtoMessage() {}
+
+func (x *LatLon) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LatLon.ProtoReflect.Descriptor instead.
+func (*LatLon) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LatLon) GetLat() float64 {
+	if x != nil {
+		return x.Lat
+	}
+	return 0
+}
+
+func (x *LatLon) GetLon() float64 {
+	if x != nil {
+		return x.Lon
+	}
+	return 0
+}
+
+type ThumbnailInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Width         int32                  `protobuf:"varint,2,opt,name=width,proto3" json:"width,omitempty"`
+	Height        int32                  `protobuf:"varint,3,opt,name=height,proto3" json:"height,omitempty"`
+	Url           string                 `protobuf:"bytes,4,opt,name=url,proto3" json:"url,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ThumbnailInfo) Reset() {
+	*x = ThumbnailInfo{}
+	mi := &file_around_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ThumbnailInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ThumbnailInfo) ProtoMessage() {}
+
+func (x *ThumbnailInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ThumbnailInfo.ProtoReflect.Descriptor instead.
+func (*ThumbnailInfo) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ThumbnailInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ThumbnailInfo) GetWidth() int32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *ThumbnailInfo) GetHeight() int32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *ThumbnailInfo) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+type PostInfo struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Id           string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	User         string                 `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	Message      string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Location     *LatLon                `protobuf:"bytes,4,opt,name=location,proto3" json:"location,omitempty"`
+	Url          string                 `protobuf:"bytes,5,opt,name=url,proto3" json:"url,omitempty"`
+	MediaType    string                 `protobuf:"bytes,6,opt,name=media_type,json=mediaType,proto3" json:"media_type,omitempty"`
+	Thumbnails   []*ThumbnailInfo       `protobuf:"bytes,7,rep,name=thumbnails,proto3" json:"thumbnails,omitempty"`
+	Timestamp    *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	UpdatedAt    *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	Tags         []string               `protobuf:"bytes,10,rep,name=tags,proto3" json:"tags,omitempty"`
+	Status       string                 `protobuf:"bytes,11,opt,name=status,proto3" json:"status,omitempty"`
+	Lang         string                 `protobuf:"bytes,12,opt,name=lang,proto3" json:"lang,omitempty"`
+	Masked       bool                   `protobuf:"varint,13,opt,name=masked,proto3" json:"masked,omitempty"`
+	FuzzLocation bool                   `protobuf:"varint,14,opt,name=fuzz_location,json=fuzzLocation,proto3" json:"fuzz_location,omitempty"`
+	// only set for the author of a post with a fuzzed location
+	ExactLocation *LatLon `protobuf:"bytes,15,opt,name=exact_location,json=exactLocation,proto3" json:"exact_location,omitempty"`
+	// meters from the search point, search results only
+	Distance  float64 `protobuf:"fixed64,16,opt,name=distance,proto3" json:"distance,omitempty"`
+	Likes     int64   `protobuf:"varint,17,opt,name=likes,proto3" json:"likes,omitempty"`
+	LikedByMe bool    `protobuf:"varint,18,opt,name=liked_by_me,json=likedByMe,proto3" json:"liked_by_me,omitempty"`
+	// parsed from the message, lowercased and without the #
+	Hashtags      []string `protobuf:"bytes,19,rep,name=hashtags,proto3" json:"hashtags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PostInfo) Reset() {
+	*x = PostInfo{}
+	mi := &file_around_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PostInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PostInfo) ProtoMessage() {}
+
+func (x *PostInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PostInfo.ProtoReflect.Descriptor instead.
+func (*PostInfo) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PostInfo) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *PostInfo) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *PostInfo) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *PostInfo) GetLocation() *LatLon {
+	if x != nil {
+		return x.Location
+	}
+	return nil
+}
+
+func (x *PostInfo) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *PostInfo) GetMediaType() string {
+	if x != nil {
+		return x.MediaType
+	}
+	return ""
+}
+
+func (x *PostInfo) GetThumbnails() []*ThumbnailInfo {
+	if x != nil {
+		return x.Thumbnails
+	}
+	return nil
+}
+
+func (x *PostInfo) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *PostInfo) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+func (x *PostInfo) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *PostInfo) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *PostInfo) GetLang() string {
+	if x != nil {
+		return x.Lang
+	}
+	return ""
+}
+
+func (x *PostInfo) GetMasked() bool {
+	if x != nil {
+		return x.Masked
+	}
+	return false
+}
+
+func (x *PostInfo) GetFuzzLocation() bool {
+	if x != nil {
+		return x.FuzzLocation
+	}
+	return false
+}
+
+func (x *PostInfo) GetExactLocation() *LatLon {
+	if x != nil {
+		return x.ExactLocation
+	}
+	return nil
+}
+
+func (x *PostInfo) GetDistance() float64 {
+	if x != nil {
+		return x.Distance
+	}
+	return 0
+}
+
+func (x *PostInfo) GetLikes() int64 {
+	if x != nil {
+		return x.Likes
+	}
+	return 0
+}
+
+func (x *PostInfo) GetLikedByMe() bool {
+	if x != nil {
+		return x.LikedByMe
+	}
+	return false
+}
+
+func (x *PostInfo) GetHashtags() []string {
+	if x != nil {
+		return x.Hashtags
+	}
+	return nil
+}
+
+type CreatePostRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Message      string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	Location     *LatLon                `protobuf:"bytes,2,opt,name=location,proto3" json:"location,omitempty"`
+	Lang         string                 `protobuf:"bytes,3,opt,name=lang,proto3" json:"lang,omitempty"`
+	Draft        bool                   `protobuf:"varint,4,opt,name=draft,proto3" json:"draft,omitempty"`
+	FuzzLocation bool                   `protobuf:"varint,5,opt,name=fuzz_location,json=fuzzLocation,proto3" json:"fuzz_location,omitempty"`
+	// Types that are valid to be assigned to Media:
+	//
+	//	*CreatePostRequest_Image
+	//	*CreatePostRequest_Video
+	Media         isCreatePostRequest_Media `protobuf_oneof:"media"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreatePostRequest) Reset() {
+	*x = CreatePostRequest{}
+	mi := &file_around_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreatePostRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreatePostRequest) ProtoMessage() {}
+
+func (x *CreatePostRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreatePostRequest.ProtoReflect.Descriptor instead.
+func (*CreatePostRequest) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CreatePostRequest) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *CreatePostRequest) GetLocation() *LatLon {
+	if x != nil {
+		return x.Location
+	}
+	return nil
+}
+
+func (x *CreatePostRequest) GetLang() string {
+	if x != nil {
+		return x.Lang
+	}
+	return ""
+}
+
+func (x *CreatePostRequest) GetDraft() bool {
+	if x != nil {
+		return x.Draft
+	}
+	return false
+}
+
+func (x *CreatePostRequest) GetFuzzLocation() bool {
+	if x != nil {
+		return x.FuzzLocation
+	}
+	return false
+}
+
+func (x *CreatePostRequest) GetMedia() isCreatePostRequest_Media {
+	if x != nil {
+		return x.Media
+	}
+	return nil
+}
+
+func (x *CreatePostRequest) GetImage() []byte {
+	if x != nil {
+		if x, ok := x.Media.(*CreatePostRequest_Image); ok {
+			return x.Image
+		}
+	}
+	return nil
+}
+
+func (x *CreatePostRequest) GetVideo() []byte {
+	if x != nil {
+		if x, ok := x.Media.(*CreatePostRequest_Video); ok {
+			return x.Video
+		}
+	}
+	return nil
+}
+
+type isCreatePostRequest_Media interface {
+	isCreatePostRequest_Media()
+}
+
+type CreatePostRequest_Image struct {
+	Image []byte `protobuf:"bytes,6,opt,name=image,proto3,oneof"`
+}
+
+type CreatePostRequest_Video struct {
+	Video []byte `protobuf:"bytes,7,opt,name=video,proto3,oneof"`
+}
+
+func (*CreatePostRequest_Image) isCreatePostRequest_Media() {}
+
+func (*CreatePostRequest_Video) isCreatePostRequest_Media() {}
+
+type SearchRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Location *LatLon                `protobuf:"bytes,1,opt,name=location,proto3" json:"location,omitempty"`
+	// in km, defaults to the configured search distance
+	Range  float64 `protobuf:"fixed64,2,opt,name=range,proto3" json:"range,omitempty"`
+	Offset int32   `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+	// defaults to 20, at most 100
+	Limit int32 `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	// optional bounds on when the posts were created, inclusive
+	Since         *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=since,proto3" json:"since,omitempty"`
+	Until         *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=until,proto3" json:"until,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchRequest) Reset() {
+	*x = SearchRequest{}
+	mi := &file_around_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchRequest) ProtoMessage() {}
+
+func (x *SearchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchRequest.ProtoReflect.Descriptor instead.
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SearchRequest) GetLocation() *LatLon {
+	if x != nil {
+		return x.Location
+	}
+	return nil
+}
+
+func (x *SearchRequest) GetRange() float64 {
+	if x != nil {
+		return x.Range
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetOffset() int32 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetSince() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Since
+	}
+	return nil
+}
+
+func (x *SearchRequest) GetUntil() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Until
+	}
+	return nil
+}
+
+type SearchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Total         int64                  `protobuf:"varint,1,opt,name=total,proto3" json:"total,omitempty"`
+	Posts         []*PostInfo            `protobuf:"bytes,2,rep,name=posts,proto3" json:"posts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchResponse) Reset() {
+	*x = SearchResponse{}
+	mi := &file_around_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchResponse) ProtoMessage() {}
+
+func (x *SearchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchResponse.ProtoReflect.Descriptor instead.
+func (*SearchResponse) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SearchResponse) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *SearchResponse) GetPosts() []*PostInfo {
+	if x != nil {
+		return x.Posts
+	}
+	return nil
+}
+
+type SignupRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
+	Age           int64                  `protobuf:"varint,3,opt,name=age,proto3" json:"age,omitempty"`
+	Gender        string                 `protobuf:"bytes,4,opt,name=gender,proto3" json:"gender,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignupRequest) Reset() {
+	*x = SignupRequest{}
+	mi := &file_around_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignupRequest) ProtoMessage() {}
+
+func (x *SignupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignupRequest.ProtoReflect.Descriptor instead.
+func (*SignupRequest) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SignupRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *SignupRequest) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+func (x *SignupRequest) GetAge() int64 {
+	if x != nil {
+		return x.Age
+	}
+	return 0
+}
+
+func (x *SignupRequest) GetGender() string {
+	if x != nil {
+		return x.Gender
+	}
+	return ""
+}
+
+type SignupResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignupResponse) Reset() {
+	*x = SignupResponse{}
+	mi := &file_around_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignupResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignupResponse) ProtoMessage() {}
+
+func (x *SignupResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignupResponse.ProtoReflect.Descriptor instead.
+func (*SignupResponse) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{7}
+}
+
+type LoginRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginRequest) Reset() {
+	*x = LoginRequest{}
+	mi := &file_around_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginRequest) ProtoMessage() {}
+
+func (x *LoginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginRequest.ProtoReflect.Descriptor instead.
+func (*LoginRequest) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *LoginRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *LoginRequest) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+type LoginResponse struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	AccessToken  string                 `protobuf:"bytes,1,opt,name=access_token,json=accessToken,proto3" json:"access_token,omitempty"`
+	RefreshToken string                 `protobuf:"bytes,2,opt,name=refresh_token,json=refreshToken,proto3" json:"refresh_token,omitempty"`
+	// seconds until the access token expires
+	ExpiresIn     int64 `protobuf:"varint,3,opt,name=expires_in,json=expiresIn,proto3" json:"expires_in,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginResponse) Reset() {
+	*x = LoginResponse{}
+	mi := &file_around_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginResponse) ProtoMessage() {}
+
+func (x *LoginResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_around_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginResponse.ProtoReflect.Descriptor instead.
+func (*LoginResponse) Descriptor() ([]byte, []int) {
+	return file_around_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *LoginResponse) GetAccessToken() string {
+	if x != nil {
+		return x.AccessToken
+	}
+	return ""
+}
+
+func (x *LoginResponse) GetRefreshToken() string {
+	if x != nil {
+		return x.RefreshToken
+	}
+	return ""
+}
+
+func (x *LoginResponse) GetExpiresIn() int64 {
+	if x != nil {
+		return x.ExpiresIn
+	}
+	return 0
+}
+
+var File_around_proto protoreflect.FileDescriptor
+
+const file_around_proto_rawDesc = "" +
+	"\n" +
+	"\faround.proto\x12\taround.v1\x1a\x1fgoogle/protobuf/timestamp.proto\",\n" +
+	"\x06LatLon\x12\x10\n" +
+	"\x03lat\x18\x01 \x01(\x01R\x03lat\x12\x10\n" +
+	"\x03lon\x18\x02 \x01(\x01R\x03lon\"c\n" +
+	"\rThumbnailInfo\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
+	"\x05width\x18\x02 \x01(\x05R\x05width\x12\x16\n" +
+	"\x06height\x18\x03 \x01(\x05R\x06height\x12\x10\n" +
+	"\x03url\x18\x04 \x01(\tR\x03url\"\xfc\x04\n" +
+	"\bPostInfo\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04user\x18\x02 \x01(\tR\x04user\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage\x12-\n" +
+	"\blocation\x18\x04 \x01(\v2\x11.around.v1.LatLonR\blocation\x12\x10\n" +
+	"\x03url\x18\x05 \x01(\tR\x03url\x12\x1d\n" +
+	"\n" +
+	"media_type\x18\x06 \x01(\tR\tmediaType\x128\n" +
+	"\n" +
+	"thumbnails\x18\a \x03(\v2\x18.around.v1.ThumbnailInfoR\n" +
+	"thumbnails\x128\n" +
+	"\ttimestamp\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x129\n" +
+	"\n" +
+	"updated_at\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\x12\x12\n" +
+	"\x04tags\x18\n" +
+	" \x03(\tR\x04tags\x12\x16\n" +
+	"\x06status\x18\v \x01(\tR\x06status\x12\x12\n" +
+	"\x04lang\x18\f \x01(\tR\x04lang\x12\x16\n" +
+	"\x06masked\x18\r \x01(\bR\x06masked\x12#\n" +
+	"\rfuzz_location\x18\x0e \x01(\bR\ffuzzLocation\x128\n" +
+	"\x0eexact_location\x18\x0f \x01(\v2\x11.around.v1.LatLonR\rexactLocation\x12\x1a\n" +
+	"\bdistance\x18\x10 \x01(\x01R\bdistance\x12\x14\n" +
+	"\x05likes\x18\x11 \x01(\x03R\x05likes\x12\x1e\n" +
+	"\vliked_by_me\x18\x12 \x01(\bR\tlikedByMe\x12\x1a\n" +
+	"\bhashtags\x18\x13 \x03(\tR\bhashtags\"\xe4\x01\n" +
+	"\x11CreatePostRequest\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\x12-\n" +
+	"\blocation\x18\x02 \x01(\v2\x11.around.v1.LatLonR\blocation\x12\x12\n" +
+	"\x04lang\x18\x03 \x01(\tR\x04lang\x12\x14\n" +
+	"\x05draft\x18\x04 \x01(\bR\x05draft\x12#\n" +
+	"\rfuzz_location\x18\x05 \x01(\bR\ffuzzLocation\x12\x16\n" +
+	"\x05image\x18\x06 \x01(\fH\x00R\x05image\x12\x16\n" +
+	"\x05video\x18\a \x01(\fH\x00R\x05videoB\a\n" +
+	"\x05media\"\xe6\x01\n" +
+	"\rSearchRequest\x12-\n" +
+	"\blocation\x18\x01 \x01(\v2\x11.around.v1.LatLonR\blocation\x12\x14\n" +
+	"\x05range\x18\x02 \x01(\x01R\x05range\x12\x16\n" +
+	"\x06offset\x18\x03 \x01(\x05R\x06offset\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x05R\x05limit\x120\n" +
+	"\x05since\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\x05since\x120\n" +
+	"\x05until\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\x05until\"Q\n" +
+	"\x0eSearchResponse\x12\x14\n" +
+	"\x05total\x18\x01 \x01(\x03R\x05total\x12)\n" +
+	"\x05posts\x18\x02 \x03(\v2\x13.around.v1.PostInfoR\x05posts\"q\n" +
+	"\rSignupRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x02 \x01(\tR\bpassword\x12\x10\n" +
+	"\x03age\x18\x03 \x01(\x03R\x03age\x12\x16\n" +
+	"\x06gender\x18\x04 \x01(\tR\x06gender\"\x10\n" +
+	"\x0eSignupResponse\"F\n" +
+	"\fLoginRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x02 \x01(\tR\bpassword\"v\n" +
+	"\rLoginResponse\x12!\n" +
+	"\faccess_token\x18\x01 \x01(\tR\vaccessToken\x12#\n" +
+	"\rrefresh_token\x18\x02 \x01(\tR\frefreshToken\x12\x1d\n" +
+	"\n" +
+	"expires_in\x18\x03 \x01(\x03R\texpiresIn2\x83\x02\n" +
+	"\x06Around\x12?\n" +
+	"\n" +
+	"CreatePost\x12\x1c.around.v1.CreatePostRequest\x1a\x13.around.v1.PostInfo\x12=\n" +
+	"\x06Search\x12\x18.around.v1.SearchRequest\x1a\x19.around.v1.SearchResponse\x12=\n" +
+	"\x06Signup\x12\x18.around.v1.SignupRequest\x1a\x19.around.v1.SignupResponse\x12:\n" +
+	"\x05Login\x12\x17.around.v1.LoginRequest\x1a\x18.around.v1.LoginResponseB\x15Z\x13around/service;mainb\x06proto3"
+
+var (
+	file_around_proto_rawDescOnce sync.Once
+	file_around_proto_rawDescData []byte
+)
+
+func file_around_proto_rawDescGZIP() []byte {
+	file_around_proto_rawDescOnce.Do(func() {
+		file_around_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_around_proto_rawDesc), len(file_around_proto_rawDesc)))
+	})
+	return file_around_proto_rawDescData
+}
+
+var file_around_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_around_proto_goTypes = []any{
+	(*LatLon)(nil),                // 0: around.v1.LatLon
+	(*ThumbnailInfo)(nil),         // 1: around.v1.ThumbnailInfo
+	(*PostInfo)(nil),              // 2: around.v1.PostInfo
+	(*CreatePostRequest)(nil),     // 3: around.v1.CreatePostRequest
+	(*SearchRequest)(nil),         // 4: around.v1.SearchRequest
+	(*SearchResponse)(nil),        // 5: around.v1.SearchResponse
+	(*SignupRequest)(nil),         // 6: around.v1.SignupRequest
+	(*SignupResponse)(nil),        // 7: around.v1.SignupResponse
+	(*LoginRequest)(nil),          // 8: around.v1.LoginRequest
+	(*LoginResponse)(nil),         // 9: around.v1.LoginResponse
+	(*timestamppb.Timestamp)(nil), // 10: google.protobuf.Timestamp
+}
+var file_around_proto_depIdxs = []int32{
+	0,  // 0: around.v1.PostInfo.location:type_name -> around.v1.LatLon
+	1,  // 1: around.v1.PostInfo.thumbnails:type_name -> around.v1.ThumbnailInfo
+	10, // 2: around.v1.PostInfo.timestamp:type_name -> google.protobuf.Timestamp
+	10, // 3: around.v1.PostInfo.updated_at:type_name -> google.protobuf.Timestamp
+	0,  // 4: around.v1.PostInfo.exact_location:type_name -> around.v1.LatLon
+	0,  // 5: around.v1.CreatePostRequest.location:type_name -> around.v1.LatLon
+	0,  // 6: around.v1.SearchRequest.location:type_name -> around.v1.LatLon
+	10, // 7: around.v1.SearchRequest.since:type_name -> google.protobuf.Timestamp
+	10, // 8: around.v1.SearchRequest.until:type_name -> google.protobuf.Timestamp
+	2,  // 9: around.v1.SearchResponse.posts:type_name -> around.v1.PostInfo
+	3,  // 10: around.v1.Around.CreatePost:input_type -> around.v1.CreatePostRequest
+	4,  // 11: around.v1.Around.Search:input_type -> around.v1.SearchRequest
+	6,  // 12: around.v1.Around.Signup:input_type -> around.v1.SignupRequest
+	8,  // 13: around.v1.Around.Login:input_type -> around.v1.LoginRequest
+	2,  // 14: around.v1.Around.CreatePost:output_type -> around.v1.PostInfo
+	5,  // 15: around.v1.Around.Search:output_type -> around.v1.SearchResponse
+	7,  // 16: around.v1.Around.Signup:output_type -> around.v1.SignupResponse
+	9,  // 17: around.v1.Around.Login:output_type -> around.v1.LoginResponse
+	14, // [14:18] is the sub-list for method output_type
+	10, // [10:14] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_around_proto_init() }
+func file_around_proto_init() {
+	if File_around_proto != nil {
+		return
+	}
+	file_around_proto_msgTypes[3].OneofWrappers = []any{
+		(*CreatePostRequest_Image)(nil),
+		(*CreatePostRequest_Video)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_around_proto_rawDesc), len(file_around_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_around_proto_goTypes,
+		DependencyIndexes: file_around_proto_depIdxs,
+		MessageInfos:      file_around_proto_msgTypes,
+	}.Build()
+	File_around_proto = out.File
+	file_around_proto_goTypes = nil
+	file_around_proto_depIdxs = nil
+}
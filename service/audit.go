@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+// The audit index is append-only: entries are created and never updated or
+// deleted by the service. Besides the admin actions recorded with
+// writeAudit, every authenticated request that may change something is
+// recorded with its caller, route, IP and status by auditRequests, for
+// abuse investigations through GET /admin/audit.
+const (
+	AUDIT_INDEX = "audit"
+)
+
+const AUDIT_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "actor": {
+                "type": "keyword"
+            },
+            "action": {
+                "type": "keyword"
+            },
+            "method": {
+                "type": "keyword"
+            },
+            "path": {
+                "type": "keyword"
+            },
+            "ip": {
+                "type": "keyword"
+            },
+            "status": {
+                "type": "integer"
+            },
+            "request_id": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            },
+            "detail": {
+                "type": "object",
+                "enabled": false
+            }
+        }
+    }
+}`
+
+// AuditEntry records who did what to which documents. Entries of requests
+// have the route as their action, like "DELETE /post/{id}", and the
+// request fields set.
+type AuditEntry struct {
+	Id        string                 `json:"id,omitempty"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Method    string                 `json:"method,omitempty"`
+	Path      string                 `json:"path,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	Status    int                    `json:"status,omitempty"`
+	RequestId string                 `json:"request_id,omitempty"`
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+type AuditLogPage struct {
+	Total   int64         `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Entries []*AuditEntry `json:"entries"`
+}
+
+// writeAudit appends an entry to the audit index. Auditing never fails the
+// action it records, so errors are only logged.
+func writeAudit(actor, action string, detail map[string]interface{}) {
+	appendAudit(&AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Detail: detail,
+	})
+}
+
+func appendAudit(entry *AuditEntry) {
+	entry.Timestamp = time.Now().UTC()
+
+	client := esClient
+
+	_, err := client.Index().
+		Index(AUDIT_INDEX).
+		Id(uuid.New()).
+		OpType("create").
+		BodyJson(entry).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to write audit entry %s by %s %v.\n", entry.Action, entry.Actor, err)
+		return
+	}
+	fmt.Printf("Audit: %s by %s\n", entry.Action, entry.Actor)
+}
+
+// isMutating tells whether a request of the given method may change
+// something.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// auditRequests records the mutating requests h serves once they are
+// answered. The JWT middleware wraps the handlers of requests with a valid
+// token in it, so anonymous requests aren't recorded.
+func auditRequests(h http.Handler, claims *Claims) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r.Method) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		requestId, _ := r.Context().Value(requestIDKey{}).(string)
+		appendAudit(&AuditEntry{
+			Actor:     claims.Username,
+			Action:    r.Method + " " + route,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			IP:        clientIP(r),
+			Status:    rec.status,
+			RequestId: requestId,
+		})
+	})
+}
+
+// handleAuditLog lists audit entries, newest first, optionally only those
+// of an actor, action, ip or status, and between since and until, both
+// RFC 3339 times.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for the audit log")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	query := elastic.NewBoolQuery()
+	for _, field := range []string{"actor", "action", "ip"} {
+		if val := r.URL.Query().Get(field); val != "" {
+			query = query.Filter(elastic.NewTermQuery(field, val))
+		}
+	}
+	if val := r.URL.Query().Get("status"); val != "" {
+		status, err := strconv.Atoi(val)
+		if err != nil {
+			http.Error(w, "status should be an HTTP status code", http.StatusBadRequest)
+			return
+		}
+		query = query.Filter(elastic.NewTermQuery("status", status))
+	}
+	since, err := parseAuditTime(r, "since")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseAuditTime(r, "until")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !since.IsZero() || !until.IsZero() {
+		timeRange := elastic.NewRangeQuery("timestamp")
+		if !since.IsZero() {
+			timeRange = timeRange.Gte(since)
+		}
+		if !until.IsZero() {
+			timeRange = timeRange.Lt(until)
+		}
+		query = query.Filter(timeRange)
+	}
+
+	client := esClient
+	searchResult, err := client.Search().
+		Index(AUDIT_INDEX).
+		TrackTotalHits(true).
+		Query(query).
+		Sort("timestamp", false).
+		From(offset).
+		Size(limit).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read audit log %v.\n", err)
+		return
+	}
+
+	page := &AuditLogPage{
+		Total:   searchResult.TotalHits(),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: []*AuditEntry{},
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var entry AuditEntry
+		if hit.Source == nil || json.Unmarshal(hit.Source, &entry) != nil {
+			continue
+		}
+		entry.Id = hit.Id
+		page.Entries = append(page.Entries, &entry)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse audit log into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse audit log into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// parseAuditTime reads the RFC 3339 time of the query parameter param,
+// zero when it is absent.
+func parseAuditTime(r *http.Request, param string) (time.Time, error) {
+	val := r.URL.Query().Get(param)
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s should be an RFC 3339 time", param)
+	}
+	return t.UTC(), nil
+}
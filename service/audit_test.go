@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// recordAudit points esClient at fakeES, recording the audit entries
+// written, until the test ends.
+func recordAudit(t *testing.T) func() []AuditEntry {
+	t.Helper()
+	var mu sync.Mutex
+	var entries []AuditEntry
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/"+AUDIT_INDEX+"/") {
+			var entry AuditEntry
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &entry); err != nil {
+				t.Errorf("audit entry %s: %v", body, err)
+			}
+			if r.URL.Query().Get("op_type") != "create" {
+				t.Errorf("audit entry written with %s, want op_type=create", r.URL)
+			}
+			mu.Lock()
+			entries = append(entries, entry)
+			mu.Unlock()
+		}
+		fakeES(w, r)
+	}))
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatalf("elastic.NewClient: %v", err)
+	}
+	saved := esClient
+	esClient = client
+	t.Cleanup(func() {
+		esClient = saved
+		es.Close()
+	})
+	return func() []AuditEntry {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]AuditEntry(nil), entries...)
+	}
+}
+
+func TestAuditRequests(t *testing.T) {
+	s := newTestServer(t)
+	entries := recordAudit(t)
+
+	r := httptest.NewRequest("DELETE", "/devices/abc", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	w := s.do(authorized(t, r, "sloane"))
+
+	got := entries()
+	if len(got) != 1 {
+		t.Fatalf("audit entries = %+v, want one", got)
+	}
+	e := got[0]
+	if e.Actor != "sloane" || e.Action != "DELETE /devices/{token}" || e.Path != "/devices/abc" || e.Status != w.Code {
+		t.Errorf("audit entry = %+v, status %d", e, w.Code)
+	}
+	if e.RequestId == "" || e.RequestId != w.Header().Get(REQUEST_ID_HEADER) || e.Timestamp.IsZero() {
+		t.Errorf("audit entry = %+v, want the request id and a timestamp", e)
+	}
+
+	s.do(authorized(t, httptest.NewRequest("GET", "/notifications", nil), "sloane"))
+	s.do(httptest.NewRequest("DELETE", "/devices/abc", nil))
+	if got := entries(); len(got) != 1 {
+		t.Errorf("audit entries = %+v, want reads and anonymous requests left out", got)
+	}
+}
+
+func TestHandleAuditLog(t *testing.T) {
+	s := newTestServer(t)
+	admin, err := newAccessToken(&User{Username: "root", Role: ROLE_ADMIN}, time.Minute)
+	if err != nil {
+		t.Fatalf("newAccessToken: %v", err)
+	}
+
+	for target, want := range map[string]int{
+		"/admin/audit?actor=sloane&since=2026-01-01T00:00:00Z": http.StatusOK,
+		"/admin/audit?since=yesterday":                         http.StatusBadRequest,
+		"/admin/audit?status=ok":                               http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer "+admin)
+		if w := s.do(r); w.Code != want {
+			t.Errorf("GET %s = %d, want %d: %s", target, w.Code, want, w.Body)
+		}
+	}
+	if w := s.do(authorized(t, httptest.NewRequest("GET", "/admin/audit", nil), "sloane")); w.Code != http.StatusForbidden {
+		t.Errorf("GET /admin/audit as a user = %d, want 403", w.Code)
+	}
+}
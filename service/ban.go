@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/olivere/elastic/v7"
+)
+
+// Banned users are kept in the ban index and every instance reloads them
+// each BAN_REFRESH_INTERVAL, like feature flags. Their tokens are rejected
+// by the JWT middleware and the gRPC interceptor, and they can neither log
+// in nor refresh a token.
+const (
+	BAN_INDEX            = "ban"
+	BAN_REFRESH_INTERVAL = 30 * time.Second
+)
+
+const BAN_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "username": {
+                "type": "keyword"
+            },
+            "banned_by": {
+                "type": "keyword"
+            },
+            "banned_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+var errUserBanned = errors.New("This account is banned")
+
+// Ban is a stored ban; its document id is the username.
+type Ban struct {
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	BannedBy string    `json:"banned_by"`
+	BannedAt time.Time `json:"banned_at"`
+}
+
+// Bans holds the bans loaded from the ban index.
+type Bans struct {
+	mu    sync.RWMutex
+	users map[string]*Ban
+}
+
+var bans = &Bans{users: make(map[string]*Ban)}
+
+// Banned reports whether username is banned.
+func (b *Bans) Banned(username string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.users[username]
+	return ok
+}
+
+// load replaces the bans with the ones stored in the ban index.
+func (b *Bans) load() error {
+	client := esClient
+
+	ctx := context.Background()
+	users := make(map[string]*Ban)
+	scroll := client.Scroll(BAN_INDEX).Size(100).KeepAlive("1m")
+	defer scroll.Clear(ctx)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var ban Ban
+			if hit.Source == nil || json.Unmarshal(hit.Source, &ban) != nil {
+				continue
+			}
+			users[ban.Username] = &ban
+		}
+	}
+
+	b.mu.Lock()
+	b.users = users
+	b.mu.Unlock()
+	return nil
+}
+
+// add stores a ban and applies it locally right away.
+func (b *Bans) add(ban *Ban) error {
+	client := esClient
+	_, err := client.Index().
+		Index(BAN_INDEX).
+		Id(ban.Username).
+		BodyJson(ban).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.users[ban.Username] = ban
+	b.mu.Unlock()
+	return nil
+}
+
+// remove lifts the ban of username, returning false if there was none.
+func (b *Bans) remove(username string) (bool, error) {
+	client := esClient
+	_, err := client.Delete().
+		Index(BAN_INDEX).
+		Id(username).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil && !elastic.IsNotFound(err) {
+		return false, err
+	}
+
+	b.mu.Lock()
+	delete(b.users, username)
+	b.mu.Unlock()
+	return err == nil, nil
+}
+
+// startBanRefresher loads the bans now and every BAN_REFRESH_INTERVAL.
+func startBanRefresher() {
+	if err := bans.load(); err != nil {
+		fmt.Printf("Failed to load bans %v.\n", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(BAN_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := bans.load(); err != nil {
+				fmt.Printf("Failed to load bans %v.\n", err)
+			}
+		}
+	}()
+}
+
+// jwtValidationKey returns the key a token is signed with, refusing the
+// tokens of banned users so they fail validation wherever they are used.
+func jwtValidationKey(token *jwt.Token) (interface{}, error) {
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if username, _ := claims["username"].(string); bans.Banned(username) {
+			return nil, errUserBanned
+		}
+	}
+	return signingKeys.key(token)
+}
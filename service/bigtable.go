@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/option"
+)
+
+// With ENABLE_BIGTABLE, new and edited posts are copied to BIGTABLE_TABLE
+// of BIGTABLE_INSTANCE in BIGTABLE_PROJECT, and deleted ones tombstoned,
+// for analysis, with the service account key file BIGTABLE_CREDENTIALS
+// or the application default credentials. Writes never hold up a
+// request: BIGTABLE_WORKERS apply them in the background, retried like
+// ElasticSearch calls, and a write is dropped when BIGTABLE_QUEUE are
+// already waiting. The variables are loaded from the ServiceConfig at
+// startup.
+var (
+	BIGTABLE_PROJECT     = "around-229020"
+	BIGTABLE_INSTANCE    = "around-post"
+	BIGTABLE_TABLE       = "post"
+	BIGTABLE_CREDENTIALS = ""
+)
+
+const (
+	BIGTABLE_WORKERS = 2
+	BIGTABLE_QUEUE   = 1000
+	BIGTABLE_TIMEOUT = 10 * time.Second
+)
+
+var bigtableBreaker = newCircuitBreaker("bigtable")
+
+// bigTableWrite is a mutation of the row of one post.
+type bigTableWrite struct {
+	row string
+	mut *bigtable.Mutation
+}
+
+// BigTableWriter applies writes to the table in the background.
+type BigTableWriter struct {
+	apply  func(ctx context.Context, row string, mut *bigtable.Mutation) error
+	close  func() error
+	writes chan bigTableWrite
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// bigTable is the writer in use, nil unless ENABLE_BIGTABLE. It is set up
+// by setupBigTable.
+var bigTable *BigTableWriter
+
+// setupBigTable connects to BigTable, once for the life of the service,
+// if ENABLE_BIGTABLE is set.
+func setupBigTable(ctx context.Context) error {
+	if !ENABLE_BIGTABLE {
+		bigTable = nil
+		return nil
+	}
+	var opts []option.ClientOption
+	if BIGTABLE_CREDENTIALS != "" {
+		opts = append(opts, option.WithCredentialsFile(BIGTABLE_CREDENTIALS))
+	}
+	client, err := bigtable.NewClient(ctx, BIGTABLE_PROJECT, BIGTABLE_INSTANCE, opts...)
+	if err != nil {
+		return err
+	}
+	table := client.Open(BIGTABLE_TABLE)
+	bigTable = newBigTableWriter(func(ctx context.Context, row string, mut *bigtable.Mutation) error {
+		return table.Apply(ctx, row, mut)
+	}, client.Close)
+	bigTable.start(BIGTABLE_WORKERS)
+	fmt.Printf("BigTable writes started to %s/%s\n", BIGTABLE_INSTANCE, BIGTABLE_TABLE)
+	return nil
+}
+
+func newBigTableWriter(apply func(ctx context.Context, row string, mut *bigtable.Mutation) error, close func() error) *BigTableWriter {
+	return &BigTableWriter{apply: apply, close: close, writes: make(chan bigTableWrite, BIGTABLE_QUEUE)}
+}
+
+func (w *BigTableWriter) start(workers int) {
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for write := range w.writes {
+				w.write(write)
+			}
+		}()
+	}
+}
+
+// Stop finishes the queued writes and closes the client.
+func (w *BigTableWriter) Stop() {
+	w.mu.Lock()
+	w.closed = true
+	close(w.writes)
+	w.mu.Unlock()
+	w.wg.Wait()
+	if err := w.close(); err != nil {
+		fmt.Printf("Failed to close BigTable client %v.\n", err)
+	}
+}
+
+// enqueue hands write to a worker, or drops it when the queue is full or
+// stopped.
+func (w *BigTableWriter) enqueue(write bigTableWrite) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		fmt.Printf("BigTable writer is stopped, dropped write of %s\n", write.row)
+		return
+	}
+	select {
+	case w.writes <- write:
+	default:
+		fmt.Printf("BigTable queue is full, dropped write of %s\n", write.row)
+	}
+}
+
+func (w *BigTableWriter) write(write bigTableWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), BIGTABLE_TIMEOUT)
+	defer cancel()
+	// the cells carry the time they were queued at, so retries are
+	// idempotent
+	err := withRetry(ctx, bigtableBreaker, RETRY_ATTEMPTS, func() error {
+		return w.apply(ctx, write.row, write.mut)
+	})
+	if err != nil {
+		fmt.Printf("Failed to write post %s to BigTable %v.\n", write.row, err)
+		return
+	}
+	fmt.Printf("Post is saved to BigTable: %s\n", write.row)
+}
+
+// saveToBigTable queues the copy of the post p, of the given id.
+func saveToBigTable(p *Post, id string) {
+	if bigTable == nil {
+		return
+	}
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("post", "user", t, []byte(p.User))
+	mut.Set("post", "message", t, []byte(p.Message))
+	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
+	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
+	bigTable.enqueue(bigTableWrite{row: id, mut: mut})
+}
+
+// tombstoneBigTable queues marking the row of a deleted post rather than
+// removing it, so the history stays available for analysis.
+func tombstoneBigTable(id string) {
+	if bigTable == nil {
+		return
+	}
+	mut := bigtable.NewMutation()
+	t := bigtable.Now()
+	mut.Set("post", "deleted", t, []byte(time.Now().UTC().Format(time.RFC3339)))
+	bigTable.enqueue(bigTableWrite{row: id, mut: mut})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBigTableWriter(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	closed := false
+	w := newBigTableWriter(func(ctx context.Context, row string, mut *bigtable.Mutation) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[row]++
+		switch {
+		case row == "flaky" && attempts[row] == 1:
+			return status.Error(codes.Unavailable, "try again")
+		case row == "denied":
+			return status.Error(codes.PermissionDenied, "no")
+		}
+		return nil
+	}, func() error {
+		closed = true
+		return nil
+	})
+	w.start(2)
+
+	for _, row := range []string{"ok", "flaky", "denied"} {
+		w.enqueue(bigTableWrite{row: row, mut: bigtable.NewMutation()})
+	}
+	w.Stop()
+
+	if attempts["ok"] != 1 || attempts["flaky"] != 2 || attempts["denied"] != 1 {
+		t.Errorf("attempts = %v, want transient failures retried only", attempts)
+	}
+	if !closed {
+		t.Error("Stop didn't close the client")
+	}
+	// writes after Stop are dropped rather than panicking
+	w.enqueue(bigTableWrite{row: "late", mut: bigtable.NewMutation()})
+}
+
+func TestIsTransientGRPC(t *testing.T) {
+	for err, want := range map[error]bool{
+		status.Error(codes.Unavailable, ""):       true,
+		status.Error(codes.ResourceExhausted, ""): true,
+		status.Error(codes.NotFound, ""):          false,
+		errors.New("bad row"):                     false,
+	} {
+		if got := isTransient(err); got != want {
+			t.Errorf("isTransient(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Blob storage backend, one of STORAGE_BACKENDS. The backend and its
+// settings are loaded from the ServiceConfig at startup.
+var (
+	STORAGE_BACKEND = "gcs"
+
+	S3_BUCKET = "around-post-image"
+	S3_REGION = "us-east-1"
+
+	LOCAL_STORAGE_DIR = "./data/media"
+	LOCAL_MEDIA_URL   = "http://localhost:8080" + LOCAL_MEDIA_PATH
+)
+
+var STORAGE_BACKENDS = []string{"gcs", "s3", "local"}
+
+const LOCAL_MEDIA_PATH = "/media/" // where the local backend's files are served
+
+// With SIGNED_MEDIA_URLS, media is stored private and clients get URLs
+// signed for SIGNED_URL_EXPIRY each time they read a post. Otherwise media
+// is world-readable, which buckets with uniform access or disabled ACLs
+// refuse. Both are loaded from the ServiceConfig at startup.
+var (
+	SIGNED_MEDIA_URLS = true
+	SIGNED_URL_EXPIRY = 15 * time.Minute
+)
+
+// PutOptions describe the object being stored.
+type PutOptions struct {
+	ContentType string
+	// Size is the number of bytes the reader is expected to yield, or 0 if
+	// unknown. A short read fails the Put and nothing is kept.
+	Size int64
+	// Private objects are not world-readable, e.g. archives.
+	Private bool
+}
+
+// public reports whether the object is made world-readable.
+func (o *PutOptions) public() bool {
+	return !SIGNED_MEDIA_URLS && (o == nil || !o.Private)
+}
+
+// BlobStore stores post media. Keys are flat object names such as the post
+// id.
+type BlobStore interface {
+	// Put stores the content of r under key and returns the URL clients use
+	// to fetch it and the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (url string, size int64, err error)
+	// Get opens key for reading; the caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a time-limited URL to read key.
+	SignedURL(key string) (string, error)
+	// Check verifies that the backend is reachable.
+	Check(ctx context.Context) error
+}
+
+// newBlobStore returns the backend selected by STORAGE_BACKEND.
+func newBlobStore(ctx context.Context) (BlobStore, error) {
+	switch STORAGE_BACKEND {
+	case "gcs":
+		return newGCSStore(ctx, BUCKET_NAME)
+	case "s3":
+		return newS3Store(ctx, S3_BUCKET, S3_REGION)
+	case "local":
+		return newLocalStore(LOCAL_STORAGE_DIR, LOCAL_MEDIA_URL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", STORAGE_BACKEND)
+	}
+}
+
+// checkSize reports a truncated or oversized upload.
+func checkSize(opts *PutOptions, written int64) error {
+	if opts != nil && opts.Size > 0 && written != opts.Size {
+		return fmt.Errorf("short upload: got %d of %d bytes", written, opts.Size)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
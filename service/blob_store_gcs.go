@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// gcsStore keeps media in a Google Cloud Storage bucket, as world-readable
+// objects unless SIGNED_MEDIA_URLS is set.
+type gcsStore struct {
+	client *storage.Client
+	bucket string
+}
+
+func newGCSStore(ctx context.Context, bucket string) (*gcsStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Bucket(bucket).Attrs(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &gcsStore{client: client, bucket: bucket}, nil
+}
+
+// Put streams r to GCS under ctx, so a client disconnect aborts the upload.
+// The object is only finalized when every expected byte was copied:
+// canceling the writer's context before Close discards the partial upload.
+func (s *gcsStore) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	object := s.client.Bucket(s.bucket).Object(key)
+	wc := object.NewWriter(ctx)
+	if opts != nil && opts.ContentType != "" {
+		wc.ContentType = opts.ContentType
+	}
+	written, err := io.Copy(wc, r)
+	if err == nil {
+		err = checkSize(opts, written)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		wc.Close()
+		return "", 0, err
+	}
+
+	if err := wc.Close(); err != nil {
+		return "", 0, err
+	}
+	if opts.public() {
+		if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+			return "", 0, err
+		}
+	}
+
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	fmt.Printf("Image is saved to GCS: %s\n", attrs.MediaLink)
+	return attrs.MediaLink, attrs.Size, nil
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.Bucket(s.bucket).Object(key).NewReader(ctx)
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	err := s.client.Bucket(s.bucket).Object(key).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+
+	fmt.Printf("Image is deleted from GCS: %s\n", key)
+	return nil
+}
+
+func (s *gcsStore) Check(ctx context.Context) error {
+	_, err := s.client.Bucket(s.bucket).Attrs(ctx)
+	return err
+}
+
+func (s *gcsStore) SignedURL(key string) (string, error) {
+	return s.client.Bucket(s.bucket).SignedURL(key, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(SIGNED_URL_EXPIRY),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStore keeps media on the local disk for development. The files are
+// served by the service itself under LOCAL_MEDIA_PATH, private ones
+// included.
+type localStore struct {
+	dir     string
+	baseURL string
+}
+
+func newLocalStore(dir, baseURL string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStore{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/") + "/"}, nil
+}
+
+func (s *localStore) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *localStore) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// write to a temporary file first so readers never see a partial file
+	tmp, err := os.CreateTemp(s.dir, "."+key+".*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		err = checkSize(opts, size)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+
+	fmt.Printf("Image is saved to %s\n", path)
+	return s.baseURL + url.PathEscape(key), size, nil
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Printf("Image is deleted from %s\n", path)
+	return nil
+}
+
+func (s *localStore) Check(ctx context.Context) error {
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+// SignedURL returns the plain URL; local files are not access controlled.
+func (s *localStore) SignedURL(key string) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	return s.baseURL + url.PathEscape(key), nil
+}
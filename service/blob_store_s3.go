@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Store keeps media in an AWS S3 bucket. Credentials come from the usual
+// AWS environment variables, shared config or instance role.
+type s3Store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	presign  *s3.PresignClient
+	bucket   string
+}
+
+func newS3Store(ctx context.Context, bucket, region string) (*s3Store, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg)
+	return &s3Store{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		presign:  s3.NewPresignClient(client),
+		bucket:   bucket,
+	}, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	body := &countingReader{r: r}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if opts != nil && opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	// objects are private by default; buckets with ACLs disabled reject
+	// any other canned ACL
+	if opts.public() {
+		input.ACL = types.ObjectCannedACLPublicRead
+	}
+
+	// the uploader streams in parts, so r doesn't need to be seekable; a
+	// canceled ctx aborts the multipart upload
+	result, err := s.uploader.Upload(ctx, input)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := checkSize(opts, body.n); err != nil {
+		s.Delete(context.Background(), key)
+		return "", 0, err
+	}
+
+	fmt.Printf("Image is saved to S3: %s\n", result.Location)
+	return result.Location, body.n, nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Image is deleted from S3: %s\n", key)
+	return nil
+}
+
+func (s *s3Store) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
+
+func (s *s3Store) SignedURL(key string) (string, error) {
+	req, err := s.presign.PresignGetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(SIGNED_URL_EXPIRY))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// disconnectingReader returns data and then fails as a dropped connection
+// does.
+type disconnectingReader struct {
+	r io.Reader
+}
+
+func (d *disconnectingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestCheckSize(t *testing.T) {
+	if err := checkSize(&PutOptions{Size: 10}, 10); err != nil {
+		t.Errorf("checkSize of a complete upload = %v", err)
+	}
+	if err := checkSize(nil, 10); err != nil {
+		t.Errorf("checkSize without a declared size = %v", err)
+	}
+	if err := checkSize(&PutOptions{Size: 10}, 4); err == nil || !strings.Contains(err.Error(), "short upload") {
+		t.Errorf("checkSize of 4 of 10 bytes = %v, want a short upload", err)
+	}
+}
+
+func TestLocalStorePutShortRead(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newLocalStore(dir, "http://media.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 100)
+	tests := []struct {
+		name string
+		r    io.Reader
+		want error
+	}{
+		{"disconnect", &disconnectingReader{bytes.NewReader(data[:40])}, io.ErrUnexpectedEOF},
+		{"short body", bytes.NewReader(data[:40]), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := store.Put(context.Background(), "cat.png", tt.r, &PutOptions{Size: int64(len(data))})
+			if err == nil {
+				t.Fatal("Put of 40 of 100 bytes = nil, want an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Put = %v, want %v", err, tt.want)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("Put left %s behind", entries[0].Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Blocks and mutes are kept in their own index, one document per edge
+// like follows. Both leave the posts of the target out of the searches of
+// the user; a blocked user also can't comment on the posts of, or message,
+// the user who blocked them.
+const (
+	BLOCK_INDEX = "block"
+
+	BLOCK_KIND_BLOCK = "block"
+	BLOCK_KIND_MUTE  = "mute"
+
+	// MAX_BLOCKED caps how many users one user can block and mute, which
+	// bounds the terms query leaving their posts out.
+	MAX_BLOCKED = 1000
+)
+
+// blockedAs is the past tense of each kind, for messages.
+var blockedAs = map[string]string{
+	BLOCK_KIND_BLOCK: "blocked",
+	BLOCK_KIND_MUTE:  "muted",
+}
+
+const BLOCK_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "user": {
+                "type": "keyword"
+            },
+            "target": {
+                "type": "keyword"
+            },
+            "kind": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Block records that User blocked or muted Target. Its document id is
+// blockId.
+type Block struct {
+	User      string    `json:"user"`
+	Target    string    `json:"target"`
+	Kind      string    `json:"kind"` // BLOCK_KIND_BLOCK or BLOCK_KIND_MUTE
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// blockId is the document id of a block or mute. Usernames can't contain
+// ':'.
+func blockId(kind, user, target string) string {
+	return kind + ":" + user + ":" + target
+}
+
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	addBlock(w, r, BLOCK_KIND_BLOCK)
+}
+
+func handleUnblock(w http.ResponseWriter, r *http.Request) {
+	removeBlock(w, r, BLOCK_KIND_BLOCK)
+}
+
+func handleMute(w http.ResponseWriter, r *http.Request) {
+	addBlock(w, r, BLOCK_KIND_MUTE)
+}
+
+func handleUnmute(w http.ResponseWriter, r *http.Request) {
+	removeBlock(w, r, BLOCK_KIND_MUTE)
+}
+
+// addBlock lets the caller block or mute a user. Doing it twice is a
+// no-op.
+func addBlock(w http.ResponseWriter, r *http.Request, kind string) {
+	fmt.Printf("Received one request for a %s\n", kind)
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	target := mux.Vars(r)["username"]
+	if target == claims.Username {
+		http.Error(w, "You can't "+kind+" yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(target); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read user from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", target, err)
+		return
+	}
+
+	count, err := countBlocked(r.Context(), claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to read blocks from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count blocks of %s %v.\n", claims.Username, err)
+		return
+	}
+	if count >= MAX_BLOCKED {
+		http.Error(w, "You can block and mute at most "+strconv.Itoa(MAX_BLOCKED)+" users", http.StatusConflict)
+		return
+	}
+
+	b := &Block{User: claims.Username, Target: target, Kind: kind, Timestamp: time.Now().UTC()}
+	if err := saveBlock(r.Context(), b); err != nil {
+		http.Error(w, "Failed to save block to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save %s of %s by %s %v.\n", kind, target, claims.Username, err)
+		return
+	}
+	fmt.Printf("%s %s %s\n", claims.Username, blockedAs[kind], target)
+
+	w.Write([]byte(target + " is " + blockedAs[kind] + "."))
+}
+
+// removeBlock lifts the caller's block or mute of a user, if any.
+func removeBlock(w http.ResponseWriter, r *http.Request, kind string) {
+	fmt.Printf("Received one request for lifting a %s\n", kind)
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	target := mux.Vars(r)["username"]
+	client := esClient
+	_, err := client.Delete().
+		Index(BLOCK_INDEX).
+		Id(blockId(kind, claims.Username, target)).
+		Refresh("wait_for").
+		Do(r.Context())
+	if err != nil && !elastic.IsNotFound(err) {
+		http.Error(w, "Failed to delete block from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete %s of %s by %s %v.\n", kind, target, claims.Username, err)
+		return
+	}
+
+	w.Write([]byte(target + " is no longer " + blockedAs[kind] + "."))
+}
+
+// saveBlock stores b. It applies to searches before it returns.
+func saveBlock(ctx context.Context, b *Block) error {
+	client := esClient
+
+	_, err := client.Index().
+		Index(BLOCK_INDEX).
+		Id(blockId(b.Kind, b.User, b.Target)).
+		BodyJson(b).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+func countBlocked(ctx context.Context, user string) (int64, error) {
+	client := esClient
+
+	return client.Count(BLOCK_INDEX).
+		Query(elastic.NewTermQuery("user", user)).
+		Do(ctx)
+}
+
+// hiddenUsers returns the users user blocked or muted, whose posts are
+// left out of their searches, feeds and live updates.
+func hiddenUsers(ctx context.Context, user string) ([]string, error) {
+	if user == "" {
+		return nil, nil
+	}
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(BLOCK_INDEX).
+		Query(elastic.NewTermQuery("user", user)).
+		Size(MAX_BLOCKED).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var hidden []string
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var b Block
+			if hit.Source == nil || json.Unmarshal(hit.Source, &b) != nil || seen[b.Target] {
+				continue
+			}
+			seen[b.Target] = true
+			hidden = append(hidden, b.Target)
+		}
+	}
+	return hidden, nil
+}
+
+// excludeUsers leaves the posts of users, see hiddenUsers, out of query.
+func excludeUsers(query *elastic.BoolQuery, users []string) *elastic.BoolQuery {
+	if len(users) == 0 {
+		return query
+	}
+	terms := make([]interface{}, len(users))
+	for i, u := range users {
+		terms[i] = u
+	}
+	return query.MustNot(elastic.NewTermsQuery("user", terms...))
+}
+
+// readHiddenUsers returns the users whose posts the caller doesn't want to
+// see. On failure it writes the response.
+func readHiddenUsers(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	viewer := viewerName(r)
+	hidden, err := hiddenUsers(r.Context(), viewer)
+	if err != nil {
+		http.Error(w, "Failed to read blocks from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read blocks of %s %v.\n", viewer, err)
+		return nil, false
+	}
+	return hidden, true
+}
+
+// isBlocked reports whether user blocked target.
+func isBlocked(ctx context.Context, user, target string) (bool, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(BLOCK_INDEX).
+		Id(blockId(BLOCK_KIND_BLOCK, user, target)).
+		FetchSource(false).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return result.Found, nil
+}
+
+// refuseBlocked writes a 403 and returns true when owner blocked the
+// caller, who wants to reach them by doing what.
+func refuseBlocked(w http.ResponseWriter, r *http.Request, owner, caller, what string) bool {
+	blocked, err := isBlocked(r.Context(), owner, caller)
+	if err != nil {
+		http.Error(w, "Failed to read blocks from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read block of %s by %s %v.\n", caller, owner, err)
+		return true
+	}
+	if blocked {
+		http.Error(w, "You can't "+what+" this user", http.StatusForbidden)
+		fmt.Printf("%s is blocked by %s\n", caller, owner)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestSearchExcludesHiddenUsers(t *testing.T) {
+	s := newTestServer(t)
+	for _, user := range []string{"fay", "gus"} {
+		fields := map[string]string{"message": "hi from " + user, "lat": "37.5", "lon": "-122.1"}
+		if w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), user)); w.Code != http.StatusOK {
+			t.Fatalf("POST /post by %s = %d %s", user, w.Code, w.Body)
+		}
+	}
+
+	q := &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km", Exclude: []string{"gus"}}
+	posts, total, err := s.posts.Search(httptest.NewRequest("GET", "/", nil).Context(), q)
+	if err != nil || total != 1 || len(posts) != 1 || posts[0].User != "fay" {
+		t.Errorf("Search excluding gus = %+v, %d, %v, want the post of fay", posts, total, err)
+	}
+}
+
+func TestGeoQueryExclude(t *testing.T) {
+	q := &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km", Exclude: []string{"gus"}}
+	src, err := q.query().Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(js), `"must_not":{"terms":{"user":["gus"]}}`) {
+		t.Errorf("query = %s, want the posts of gus left out", js)
+	}
+	if q.excludes(&Post{User: "fay"}) || !q.excludes(&Post{User: "gus"}) {
+		t.Error("excludes doesn't match Exclude")
+	}
+}
+
+func TestBlockYourself(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/user/fay/block", "/user/fay/mute"} {
+		r := httptest.NewRequest("POST", path, nil)
+		if w := s.do(authorized(t, r, "fay")); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s by fay = %d %s, want 400", path, w.Code, w.Body)
+		}
+	}
+}
+
+// blockES is fakeES where fay muted gus, which records the post searches.
+type blockES struct {
+	mu       sync.Mutex
+	searches []string
+}
+
+func (e *blockES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/" + BLOCK_INDEX + "/_search":
+		source, _ := json.Marshal(&Block{User: "fay", Target: "gus", Kind: BLOCK_KIND_MUTE})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"hits": map[string]interface{}{
+				"hits": []map[string]interface{}{{"_index": BLOCK_INDEX, "_id": "mute:fay:gus", "_source": json.RawMessage(source)}},
+			},
+		})
+		return
+	case "/" + POST_INDEX + "/_search":
+		body, _ := ioutil.ReadAll(r.Body)
+		e.mu.Lock()
+		e.searches = append(e.searches, string(body))
+		e.mu.Unlock()
+	}
+	fakeES(w, r)
+}
+
+func TestReadsExcludeHiddenUsers(t *testing.T) {
+	e := &blockES{}
+	es := httptest.NewServer(e)
+	defer es.Close()
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := esClient
+	esClient = client
+	defer func() { esClient = saved }()
+
+	s := newTestServer(t)
+	for _, path := range []string{
+		"/search/text?q=hi",
+		"/search/tag/hello",
+		"/trending?lat=37.5&lon=-122.1",
+		"/feed",
+		"/posts?users=gus,hal",
+		"/posts/delta?since=0&lat=37.5&lon=-122.1",
+	} {
+		e.mu.Lock()
+		e.searches = nil
+		e.mu.Unlock()
+		if w := s.do(authorized(t, httptest.NewRequest("GET", path, nil), "fay")); w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", path, w.Code, w.Body)
+		}
+		e.mu.Lock()
+		if len(e.searches) != 1 || !strings.Contains(e.searches[0], `{"terms":{"user":["gus"]}}`) {
+			t.Errorf("GET %s searched %v, want the posts of gus left out", path, e.searches)
+		}
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	e.searches = nil
+	e.mu.Unlock()
+	if _, err := readChannelPostsFromES(context.Background(), "c1", []string{"gus"}, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.searches) != 1 || !strings.Contains(e.searches[0], `{"terms":{"user":["gus"]}}`) {
+		t.Errorf("channel posts searched %v, want the posts of gus left out", e.searches)
+	}
+}
+
+func TestUnblockMessage(t *testing.T) {
+	s := newTestServer(t)
+	for path, want := range map[string]string{
+		"/user/gus/block": "gus is no longer blocked.",
+		"/user/gus/mute":  "gus is no longer muted.",
+	} {
+		w := s.do(authorized(t, httptest.NewRequest("DELETE", path, nil), "fay"))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("DELETE %s = %d %q, want %q", path, w.Code, w.Body, want)
+		}
+	}
+}
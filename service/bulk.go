@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// Bulk creation of posts, for import tools and bots. A request holds up to
+// MAX_BULK_POSTS posts without media or with the URL of an image hosted
+// elsewhere, and they are saved with one bulk request. Their places are
+// named BULK_GEOCODE_CONCURRENCY at a time, for up to BULK_GEOCODE_LIMIT in
+// all; the posts left are saved without.
+const (
+	MAX_BULK_POSTS           = 1000
+	MAX_BULK_BYTES           = 10 << 20
+	MAX_MEDIA_URL_CHARS      = 2048
+	BULK_GEOCODE_CONCURRENCY = 4
+	BULK_GEOCODE_LIMIT       = 10 * time.Second
+)
+
+// BulkPost is one post of a bulk request. Url, when set, is stored as is:
+// the image is neither fetched, analyzed nor thumbnailed.
+type BulkPost struct {
+	Message      string  `json:"message"`
+	Lang         string  `json:"lang"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	Url          string  `json:"url"`
+	Draft        bool    `json:"draft"`
+	FuzzLocation bool    `json:"fuzz_location"`
+}
+
+// BulkResult is the outcome of one post of a bulk request: its id when it
+// was saved, an error otherwise.
+type BulkResult struct {
+	Id     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (a *App) handleBulkPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for bulk posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var in []BulkPost
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_BULK_BYTES)
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request should be at most %d bytes", MAX_BULK_BYTES), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		}
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+	if len(in) == 0 || len(in) > MAX_BULK_POSTS {
+		http.Error(w, "posts should be between 1 and "+strconv.Itoa(MAX_BULK_POSTS), http.StatusBadRequest)
+		return
+	}
+
+	results, err := a.createPosts(r.Context(), claims.Username, in)
+	if err != nil {
+		writeServiceError(w, err, "Failed to save posts")
+		fmt.Printf("Failed to save %d posts of %s %v.\n", len(in), claims.Username, err)
+		return
+	}
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, "Failed to parse results into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse results into JSON format %v.\n", err)
+		return
+	}
+	w.Write(js)
+}
+
+// createPosts validates and saves the posts of user at once, then publishes
+// them. A post failing validation doesn't stop the others; results are in
+// the order of in. The valid posts are charged to the post quota together,
+// and refused together when they don't fit in it.
+func (a *App) createPosts(ctx context.Context, user string, in []BulkPost) ([]BulkResult, error) {
+	results := make([]BulkResult, len(in))
+	var ids []string
+	var posts []*Post
+	var indexes []int
+	now := time.Now().UTC()
+	for i := range in {
+		p, err := newBulkPost(user, &in[i], now)
+		if err != nil {
+			results[i] = BulkResult{Status: err.Status, Error: err.Message}
+			continue
+		}
+		p.Id = uuid.New()
+		ids = append(ids, p.Id)
+		posts = append(posts, p)
+		indexes = append(indexes, i)
+	}
+	if len(posts) == 0 {
+		return results, nil
+	}
+	if err := a.takePostQuota(ctx, user, len(posts), now); err != nil {
+		return nil, err
+	}
+
+	// posts close to each other share a cached lookup
+	geoCtx, cancel := context.WithTimeout(ctx, BULK_GEOCODE_LIMIT)
+	var g errgroup.Group
+	g.SetLimit(BULK_GEOCODE_CONCURRENCY)
+	for _, p := range posts {
+		p := p
+		g.Go(func() error {
+			a.enrichPlace(geoCtx, p)
+			return nil
+		})
+	}
+	g.Wait()
+	cancel()
+
+	errs, err := a.Posts.SaveAll(ctx, ids, posts)
+	if err != nil {
+		return nil, err
+	}
+	saved := 0
+	for j, p := range posts {
+		i := indexes[j]
+		if errs[j] != nil {
+			logFor(ctx).Error("failed to save post to ElasticSearch", "user", user, "err", errs[j])
+			results[i] = BulkResult{Status: http.StatusInternalServerError, Error: "Failed to save post"}
+			continue
+		}
+		results[i] = BulkResult{Id: p.Id, Status: http.StatusCreated}
+		saved++
+
+		if p.Status == STATUS_PUBLISHED {
+			out := []Post{*p}
+			signMediaURLs(out)
+			a.Live.Publish(out[0])
+			a.invalidateSearchCache(ctx, p)
+		}
+		if ENABLE_BIGTABLE {
+			saveToBigTable(p, p.Id)
+		}
+		trackPostCreated(p)
+	}
+	logFor(ctx).Info("saved bulk posts", "user", user, "posts", len(in), "saved", saved)
+	return results, nil
+}
+
+// newBulkPost builds the post of user described by in, created at now.
+func newBulkPost(user string, in *BulkPost, now time.Time) (*Post, *ServiceError) {
+	if in.Message == "" && in.Url == "" {
+		return nil, serviceError(http.StatusBadRequest, "message or url is required")
+	}
+	if err := validateLocation(Location{Lat: in.Lat, Lon: in.Lon}); err != nil {
+		return nil, err
+	}
+	lang := normalizeLang(in.Lang)
+	message, masked, ok := screenText(in.Message, lang)
+	if !ok {
+		return nil, serviceError(http.StatusBadRequest, "Sorry, the post contains filtered words. Please edit again. ")
+	}
+
+	p := &Post{
+		User:     user,
+		Message:  message,
+		Masked:   masked,
+		Hashtags: extractHashtags(message),
+		Location: Location{
+			Lat: in.Lat,
+			Lon: in.Lon,
+		},
+		Timestamp: now,
+		UpdatedAt: now,
+		Status:    STATUS_PUBLISHED,
+		Lang:      lang,
+	}
+	if in.Draft {
+		p.Status = STATUS_DRAFT
+	}
+	if in.FuzzLocation {
+		exact := p.Location
+		p.FuzzLocation = true
+		p.ExactLocation = &exact
+		p.Location = fuzzLocation(exact, LOCATION_FUZZ_RADIUS_METERS)
+	}
+
+	if in.Url != "" {
+		u, err := url.Parse(in.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(in.Url) > MAX_MEDIA_URL_CHARS {
+			return nil, serviceError(http.StatusBadRequest, "url should be an http(s) URL of at most "+strconv.Itoa(MAX_MEDIA_URL_CHARS)+" characters")
+		}
+		p.Url = in.Url
+		p.MediaType = MEDIA_IMAGE
+		p.External = true
+	}
+	return p, nil
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+// Channels are location-based communities, such as a campus, a stadium or
+// a neighborhood: a name and a circle around a center. A post may belong to
+// a channel whose circle holds its location, and GET /channel/{id}/posts
+// lists them. Anyone signed in creates channels; their owner and admins
+// edit and delete them.
+const (
+	CHANNEL_INDEX = "channel"
+
+	MAX_CHANNEL_NAME_CHARS        = 60
+	MAX_CHANNEL_DESCRIPTION_CHARS = 500
+	MIN_CHANNEL_RADIUS_KM         = 0.05
+	MAX_CHANNEL_RADIUS_KM         = 50
+	// MAX_CHANNELS_AT caps the channels GET /channels returns for a point.
+	MAX_CHANNELS_AT = 100
+)
+
+// Error codes of posts naming a channel they can't belong to.
+const (
+	ERR_INVALID_CHANNEL = "invalid_channel"
+	ERR_OUTSIDE_CHANNEL = "outside_channel"
+)
+
+var errChannelNotFound = errors.New("Channel does not exist")
+
+const CHANNEL_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "name": {
+                "type": "text",
+                "fields": {
+                    "keyword": {
+                        "type": "keyword"
+                    }
+                }
+            },
+            "center": {
+                "type": "geo_point"
+            },
+            "radius_km": {
+                "type": "float"
+            },
+            "owner": {
+                "type": "keyword"
+            },
+            "created_at": {
+                "type": "date"
+            },
+            "updated_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+type Channel struct {
+	Id          string    `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Center      Location  `json:"center"`
+	RadiusKm    float64   `json:"radius_km"`
+	Owner       string    `json:"owner"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ChannelInput is the body of POST /channels and PUT /channel/{id}.
+type ChannelInput struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Center      *Location `json:"center"`
+	RadiusKm    float64   `json:"radius_km"`
+}
+
+type ChannelList struct {
+	Channels []*Channel `json:"channels"`
+}
+
+// contains reports whether loc is within the circle of c.
+func (c *Channel) contains(loc Location) bool {
+	return haversineKm(c.Center.Lat, c.Center.Lon, loc.Lat, loc.Lon) <= c.RadiusKm
+}
+
+// validate trims in and checks it describes a channel.
+func (in *ChannelInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	switch {
+	case in.Name == "":
+		return errors.New("name is required")
+	case utf8.RuneCountInString(in.Name) > MAX_CHANNEL_NAME_CHARS:
+		return fmt.Errorf("name should be at most %d characters", MAX_CHANNEL_NAME_CHARS)
+	case utf8.RuneCountInString(in.Description) > MAX_CHANNEL_DESCRIPTION_CHARS:
+		return fmt.Errorf("description should be at most %d characters", MAX_CHANNEL_DESCRIPTION_CHARS)
+	case in.Center == nil:
+		return errors.New("center is required")
+	case in.RadiusKm < MIN_CHANNEL_RADIUS_KM || in.RadiusKm > MAX_CHANNEL_RADIUS_KM:
+		return fmt.Errorf("radius_km should be between %g and %g", MIN_CHANNEL_RADIUS_KM, float64(MAX_CHANNEL_RADIUS_KM))
+	}
+	if err := validateLocation(*in.Center); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readChannelInput decodes and validates the body of r. On failure it
+// writes the response and returns nil.
+func readChannelInput(w http.ResponseWriter, r *http.Request) *ChannelInput {
+	var in ChannelInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Cannot decode channel data from client", http.StatusBadRequest)
+		fmt.Printf("Cannot decode channel data from client %v.\n", err)
+		return nil
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return &in
+}
+
+// channelOfPost checks that a post at loc may belong to the channel id and
+// returns it.
+func channelOfPost(ctx context.Context, id string, loc Location) (*Channel, error) {
+	c, err := getChannel(ctx, id)
+	if err == errChannelNotFound {
+		return nil, invalidParam(ERR_INVALID_CHANNEL, "channel does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.contains(loc) {
+		return nil, invalidParam(ERR_OUTSIDE_CHANNEL, fmt.Sprintf("the post is outside of channel %s", c.Name))
+	}
+	return c, nil
+}
+
+// handleCreateChannel creates a channel owned by the caller.
+func handleCreateChannel(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for creating a channel")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	in := readChannelInput(w, r)
+	if in == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	c := &Channel{
+		Id:          uuid.New(),
+		Name:        in.Name,
+		Description: in.Description,
+		Center:      *in.Center,
+		RadiusKm:    in.RadiusKm,
+		Owner:       claims.Username,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := saveChannel(r.Context(), c); err != nil {
+		http.Error(w, "Failed to save channel to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save channel %v.\n", err)
+		return
+	}
+	fmt.Printf("Created channel %s by %s\n", c.Id, claims.Username)
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "Failed to parse channel into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse channel into JSON format %v.\n", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handleChannel returns one channel.
+func handleChannel(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for a channel")
+	w.Header().Set("Content-Type", "application/json")
+
+	c := readableChannel(w, r)
+	if c == nil {
+		return
+	}
+	js, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "Failed to parse channel into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse channel into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleChannelsAt lists the channels whose circle holds lat and lon,
+// nearest center first.
+func handleChannelsAt(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for channels")
+	w.Header().Set("Content-Type", "application/json")
+
+	loc, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lon"))
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+
+	channels, err := readChannelsAt(r.Context(), loc)
+	if err != nil {
+		http.Error(w, "Failed to read channels from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read channels %v.\n", err)
+		return
+	}
+
+	js, err := json.Marshal(&ChannelList{Channels: channels})
+	if err != nil {
+		http.Error(w, "Failed to parse channels into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse channels into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleUpdateChannel replaces the name, description and circle of a
+// channel. Posts already in it stay, even outside the new circle.
+func handleUpdateChannel(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for updating a channel")
+	w.Header().Set("Content-Type", "application/json")
+
+	c := ownedChannel(w, r, "edit")
+	if c == nil {
+		return
+	}
+	in := readChannelInput(w, r)
+	if in == nil {
+		return
+	}
+
+	c.Name, c.Description, c.Center, c.RadiusKm = in.Name, in.Description, *in.Center, in.RadiusKm
+	c.UpdatedAt = time.Now().UTC()
+	if err := saveChannel(r.Context(), c); err != nil {
+		http.Error(w, "Failed to save channel to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to update channel %s %v.\n", c.Id, err)
+		return
+	}
+	fmt.Printf("Updated channel %s\n", c.Id)
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "Failed to parse channel into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse channel into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleDeleteChannel deletes a channel. Its posts are kept, outside of any
+// channel.
+func handleDeleteChannel(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for deleting a channel")
+	w.Header().Set("Content-Type", "text/plain")
+
+	c := ownedChannel(w, r, "delete")
+	if c == nil {
+		return
+	}
+
+	client := esClient
+	if _, err := client.Delete().Index(CHANNEL_INDEX).Id(c.Id).Refresh("wait_for").Do(r.Context()); err != nil && !elastic.IsNotFound(err) {
+		http.Error(w, "Failed to delete channel from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete channel %s %v.\n", c.Id, err)
+		return
+	}
+	fmt.Printf("Deleted channel %s\n", c.Id)
+
+	w.Write([]byte("Channel deleted successfully."))
+}
+
+// handleChannelPosts lists the posts of a channel, newest first.
+func handleChannelPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for channel posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+	c := readableChannel(w, r)
+	if c == nil {
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readChannelPostsFromES(r.Context(), c.Id, hidden, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read posts of channel %s %v.\n", c.Id, err)
+		return
+	}
+	redactPosts(page.Posts, viewerName(r))
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// readableChannel returns the channel of the request. On failure it
+// writes the response.
+func readableChannel(w http.ResponseWriter, r *http.Request) *Channel {
+	id := mux.Vars(r)["id"]
+	c, err := getChannel(r.Context(), id)
+	if err != nil {
+		if err == errChannelNotFound {
+			http.Error(w, "Channel does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read channel from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read channel %s %v.\n", id, err)
+		return nil
+	}
+	return c
+}
+
+// ownedChannel returns the channel of the request if the caller owns it or
+// is an admin. On failure it writes the response.
+func ownedChannel(w http.ResponseWriter, r *http.Request, action string) *Channel {
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return nil
+	}
+	c := readableChannel(w, r)
+	if c == nil {
+		return nil
+	}
+	if c.Owner != claims.Username && !claims.IsAdmin() {
+		http.Error(w, "Only the owner can "+action+" a channel", http.StatusForbidden)
+		fmt.Printf("%s tried to %s channel %s of %s\n", claims.Username, action, c.Id, c.Owner)
+		return nil
+	}
+	return c
+}
+
+func saveChannel(ctx context.Context, c *Channel) error {
+	client := esClient
+
+	_, err := client.Index().
+		Index(CHANNEL_INDEX).
+		Id(c.Id).
+		BodyJson(c).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+func getChannel(ctx context.Context, id string) (*Channel, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(CHANNEL_INDEX).
+		Id(id).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errChannelNotFound
+		}
+		return nil, err
+	}
+	if !result.Found || result.Source == nil {
+		return nil, errChannelNotFound
+	}
+
+	var c Channel
+	if err := json.Unmarshal(result.Source, &c); err != nil {
+		return nil, err
+	}
+	c.Id = result.Id
+	return &c, nil
+}
+
+// readChannelsAt returns the channels holding loc. Only the channels
+// centered within MAX_CHANNEL_RADIUS_KM can, and those are checked one by
+// one against their own radius.
+func readChannelsAt(ctx context.Context, loc Location) ([]*Channel, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(CHANNEL_INDEX).
+		Query(elastic.NewGeoDistanceQuery("center").
+			Lat(loc.Lat).
+			Lon(loc.Lon).
+			Distance(strconv.Itoa(MAX_CHANNEL_RADIUS_KM) + "km")).
+		Size(MAX_RESULT_WINDOW).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"channels_at": loc})
+
+	channels := []*Channel{}
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var c Channel
+			if hit.Source == nil || json.Unmarshal(hit.Source, &c) != nil {
+				continue
+			}
+			c.Id = hit.Id
+			if c.contains(loc) {
+				channels = append(channels, &c)
+			}
+		}
+	}
+	sort.SliceStable(channels, func(i, j int) bool {
+		return haversineKm(loc.Lat, loc.Lon, channels[i].Center.Lat, channels[i].Center.Lon) <
+			haversineKm(loc.Lat, loc.Lon, channels[j].Center.Lat, channels[j].Center.Lon)
+	})
+	if len(channels) > MAX_CHANNELS_AT {
+		channels = channels[:MAX_CHANNELS_AT]
+	}
+	return channels, nil
+}
+
+func readChannelPostsFromES(ctx context.Context, id string, hidden []string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(publicPostsQuery(excludeUsers(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("channel", id)), hidden))).
+		SortBy(elastic.NewFieldSort("timestamp").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"channel": id, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if screenPost(&p) {
+			page.Posts = append(page.Posts, p)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChannelContains(t *testing.T) {
+	c := &Channel{Center: Location{Lat: 37.4275, Lon: -122.1697}, RadiusKm: 2}
+	if !c.contains(Location{Lat: 37.43, Lon: -122.17}) {
+		t.Error("contains a point 300m from the center = false")
+	}
+	if c.contains(Location{Lat: 37.5, Lon: -122.1697}) {
+		t.Error("contains a point 8km from the center = true")
+	}
+}
+
+func TestChannelInputValidate(t *testing.T) {
+	center := &Location{Lat: 37.4275, Lon: -122.1697}
+	for _, in := range []ChannelInput{
+		{Name: " ", Center: center, RadiusKm: 1},
+		{Name: strings.Repeat("x", MAX_CHANNEL_NAME_CHARS+1), Center: center, RadiusKm: 1},
+		{Name: "campus", Description: strings.Repeat("x", MAX_CHANNEL_DESCRIPTION_CHARS+1), Center: center, RadiusKm: 1},
+		{Name: "campus", RadiusKm: 1},
+		{Name: "campus", Center: center},
+		{Name: "campus", Center: center, RadiusKm: MAX_CHANNEL_RADIUS_KM + 1},
+		{Name: "campus", Center: &Location{Lat: 123, Lon: -122.1697}, RadiusKm: 1},
+		{Name: "campus", Center: &Location{Lat: 37.4275, Lon: 200}, RadiusKm: 1},
+	} {
+		if err := in.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", in)
+		}
+	}
+	in := ChannelInput{Name: " campus ", Center: center, RadiusKm: 1}
+	if err := in.validate(); err != nil || in.Name != "campus" {
+		t.Errorf("validate = %v, name %q", err, in.Name)
+	}
+}
+
+func TestCreateChannelInvalid(t *testing.T) {
+	s := newTestServer(t)
+	r := httptest.NewRequest("POST", "/channels", strings.NewReader(`{"name":"campus","center":{"lat":37.4,"lon":-122.1},"radius_km":500}`))
+	if w := s.do(authorized(t, r, "bea")); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /channels with a 500km radius = %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestPostUnknownChannel(t *testing.T) {
+	s := newTestServer(t)
+	fields := map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1", "channel": "nope"}
+	w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "bea"))
+	var body APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest || body.Code != ERR_INVALID_CHANNEL {
+		t.Errorf("POST /post with an unknown channel = %d %s, want 400 with code %s", w.Code, w.Body, ERR_INVALID_CHANNEL)
+	}
+}
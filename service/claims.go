@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Error codes returned with a 401 when a token is signed correctly but its
+// claims can't be used.
+const (
+	ERR_MISSING_TOKEN      = "missing_token"
+	ERR_INVALID_CLAIMS     = "invalid_claims"
+	ERR_MISSING_CLAIM      = "missing_claim"
+	ERR_INVALID_CLAIM_TYPE = "invalid_claim_type"
+
+	ERR_FORBIDDEN = "forbidden"
+)
+
+// Claims are the custom claims the service puts into every token it issues.
+type Claims struct {
+	Username string
+	Role     string
+}
+
+func (c *Claims) IsAdmin() bool {
+	return c.Role == ROLE_ADMIN
+}
+
+// ClaimsError describes why the claims of a request could not be read.
+type ClaimsError struct {
+	Code  string
+	Claim string
+}
+
+func (e *ClaimsError) Error() string {
+	switch e.Code {
+	case ERR_MISSING_TOKEN:
+		return "No token found on the request"
+	case ERR_MISSING_CLAIM:
+		return fmt.Sprintf("Token is missing the %q claim", e.Claim)
+	case ERR_INVALID_CLAIM_TYPE:
+		return fmt.Sprintf("Token claim %q has the wrong type", e.Claim)
+	default:
+		return "Token claims are malformed"
+	}
+}
+
+// claimsFromRequest extracts the claims the JWT middleware stored on the
+// request context, checking the presence and type of every claim instead of
+// trusting the token format.
+func claimsFromRequest(r *http.Request) (*Claims, error) {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok || token == nil {
+		return nil, &ClaimsError{Code: ERR_MISSING_TOKEN}
+	}
+	return claimsFromToken(token)
+}
+
+// claimsKey holds the claims of callers of the gRPC and GraphQL APIs, which
+// don't see the request the JWT middleware stores its token in.
+type claimsKey struct{}
+
+// claimsFromContext returns the claims stored under claimsKey, nil for
+// anonymous callers.
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// claimsFromToken reads the claims of a validated token.
+func claimsFromToken(token *jwt.Token) (*Claims, error) {
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, &ClaimsError{Code: ERR_INVALID_CLAIMS}
+	}
+
+	username, err := stringClaim(mapClaims, "username", true)
+	if err != nil {
+		return nil, err
+	}
+	if !usernamePattern.MatchString(username) {
+		return nil, &ClaimsError{Code: ERR_INVALID_CLAIMS, Claim: "username"}
+	}
+
+	// tokens issued before roles existed carry no role claim
+	role, err := stringClaim(mapClaims, "role", false)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		role = ROLE_USER
+	}
+
+	return &Claims{Username: username, Role: role}, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string, required bool) (string, error) {
+	raw, ok := claims[name]
+	if !ok || raw == nil {
+		if required {
+			return "", &ClaimsError{Code: ERR_MISSING_CLAIM, Claim: name}
+		}
+		return "", nil
+	}
+
+	value, ok := raw.(string)
+	if !ok {
+		return "", &ClaimsError{Code: ERR_INVALID_CLAIM_TYPE, Claim: name}
+	}
+	if required && value == "" {
+		return "", &ClaimsError{Code: ERR_MISSING_CLAIM, Claim: name}
+	}
+	return value, nil
+}
+
+// viewerName returns the username of the caller, or "" when the request
+// carries no usable token.
+func viewerName(r *http.Request) string {
+	claims, err := claimsFromRequest(r)
+	if err != nil {
+		return ""
+	}
+	return claims.Username
+}
+
+// requireClaims returns the caller's claims, or writes a 401 with a specific
+// error code and returns nil when they are absent or malformed.
+func requireClaims(w http.ResponseWriter, r *http.Request) *Claims {
+	claims, err := claimsFromRequest(r)
+	if err != nil {
+		code := ERR_INVALID_CLAIMS
+		if claimsErr, ok := err.(*ClaimsError); ok {
+			code = claimsErr.Code
+		}
+		writeAPIError(w, http.StatusUnauthorized, code, err.Error())
+		fmt.Printf("Rejected token claims %v.\n", err)
+		return nil
+	}
+	return claims
+}
+
+// requireAdmin is requireClaims for admin-only handlers; callers without the
+// admin role get a 403.
+func requireAdmin(w http.ResponseWriter, r *http.Request) *Claims {
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return nil
+	}
+	if !claims.IsAdmin() {
+		writeAPIError(w, http.StatusForbidden, ERR_FORBIDDEN, "Admin role required")
+		fmt.Printf("Rejected non-admin %s.\n", claims.Username)
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestRequireClaims(t *testing.T) {
+	exp := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   int
+		code   string // of the APIError, "" when not checked
+	}{
+		{"valid", jwt.MapClaims{"username": "alice", "exp": exp}, http.StatusOK, ""},
+		{"missing username", jwt.MapClaims{"exp": exp}, http.StatusUnauthorized, ERR_MISSING_CLAIM},
+		{"empty username", jwt.MapClaims{"username": "", "exp": exp}, http.StatusUnauthorized, ERR_MISSING_CLAIM},
+		{"numeric username", jwt.MapClaims{"username": 42, "exp": exp}, http.StatusUnauthorized, ERR_INVALID_CLAIM_TYPE},
+		{"numeric role", jwt.MapClaims{"username": "alice", "role": 1, "exp": exp}, http.StatusUnauthorized, ERR_INVALID_CLAIM_TYPE},
+		{"missing exp", jwt.MapClaims{"username": "alice"}, http.StatusUnauthorized, ""},
+		{"string exp", jwt.MapClaims{"username": "alice", "exp": "tomorrow"}, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := signingKeys.sign(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *Claims
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = requireClaims(w, r)
+			})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			newJWTMiddleware(false).Handler(next).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && (got == nil || got.Username != "alice" || got.Role != ROLE_USER) {
+				t.Errorf("claims = %+v, want alice with the user role", got)
+			}
+			if tt.code != "" {
+				var body APIError
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != tt.code {
+					t.Errorf("body %s, want code %s", w.Body, tt.code)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimsFromRequestWithoutToken(t *testing.T) {
+	_, err := claimsFromRequest(httptest.NewRequest("GET", "/", nil))
+	if claimsErr, ok := err.(*ClaimsError); !ok || claimsErr.Code != ERR_MISSING_TOKEN {
+		t.Errorf("claimsFromRequest without a token = %v, want %s", err, ERR_MISSING_TOKEN)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+const (
+	CLIENT_INDEX = "client"
+
+	CLIENT_VERSION_HEADER     = "X-Client-Version"
+	MIN_CLIENT_VERSION_HEADER = "X-Min-Client-Version"
+
+	// Fraction of requests whose client version is recorded.
+	CLIENT_VERSION_SAMPLE_RATE = 0.1
+	// Clients older than this get 426 Upgrade Required; "" disables the check.
+	MIN_CLIENT_VERSION = ""
+
+	DEFAULT_CLIENT_STATS_HOURS = 24
+	MAX_CLIENT_STATS_HOURS     = 24 * 30
+	MAX_CLIENT_VERSIONS        = 100
+)
+
+const CLIENT_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "version": {
+                "type": "keyword"
+            },
+            "path": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// ClientSample is one sampled request of a client version.
+type ClientSample struct {
+	Version   string    `json:"version"`
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ClientVersionCount is one row of GET /stats/clients.
+type ClientVersionCount struct {
+	Version  string `json:"version"`
+	Requests int64  `json:"sampled_requests"`
+}
+
+type ClientStats struct {
+	Hours      int                   `json:"hours"`
+	SampleRate float64               `json:"sample_rate"`
+	Versions   []*ClientVersionCount `json:"versions"`
+}
+
+// clientVersionMiddleware samples the X-Client-Version header of every
+// request and turns away clients below MIN_CLIENT_VERSION.
+func clientVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := strings.TrimSpace(r.Header.Get(CLIENT_VERSION_HEADER))
+		if version == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if MIN_CLIENT_VERSION != "" {
+			w.Header().Set(MIN_CLIENT_VERSION_HEADER, MIN_CLIENT_VERSION)
+			if compareVersions(version, MIN_CLIENT_VERSION) < 0 {
+				writeAPIError(w, http.StatusUpgradeRequired, "upgrade_required",
+					fmt.Sprintf("Client version %s is no longer supported, please upgrade to %s or newer", version, MIN_CLIENT_VERSION))
+				return
+			}
+		}
+
+		if rand.Float64() < CLIENT_VERSION_SAMPLE_RATE {
+			go saveClientSample(&ClientSample{
+				Version:   version,
+				Path:      r.URL.Path,
+				Timestamp: time.Now().UTC(),
+			})
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compareVersions compares dotted version strings numerically, returning
+// -1, 0 or 1. Missing or non-numeric components count as 0.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func saveClientSample(sample *ClientSample) {
+	client := esClient
+
+	_, err := client.Index().
+		Index(CLIENT_INDEX).
+		Id(uuid.New()).
+		BodyJson(sample).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to save client sample %v.\n", err)
+	}
+}
+
+// handleClientStats summarizes the client versions seen over the last
+// `hours` hours.
+func handleClientStats(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for client stats")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+
+	hours := DEFAULT_CLIENT_STATS_HOURS
+	if val := r.URL.Query().Get("hours"); val != "" {
+		var err error
+		hours, err = strconv.Atoi(val)
+		if err != nil || hours <= 0 || hours > MAX_CLIENT_STATS_HOURS {
+			http.Error(w, fmt.Sprintf("hours should be between 1 and %d", MAX_CLIENT_STATS_HOURS), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := readClientStatsFromES(hours)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read client stats %v.\n", err)
+		return
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to parse stats into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse stats into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func readClientStatsFromES(hours int) (*ClientStats, error) {
+	client := esClient
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	searchResult, err := client.Search().
+		Index(CLIENT_INDEX).
+		Query(elastic.NewRangeQuery("timestamp").Gte(since)).
+		Aggregation("versions", elastic.NewTermsAggregation().Field("version").Size(MAX_CLIENT_VERSIONS)).
+		Size(0).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "aggregation", searchResult.TookInMillis, map[string]interface{}{"hours": hours})
+
+	result := &ClientStats{
+		Hours:      hours,
+		SampleRate: CLIENT_VERSION_SAMPLE_RATE,
+		Versions:   []*ClientVersionCount{},
+	}
+	if agg, found := searchResult.Aggregations.Terms("versions"); found {
+		for _, bucket := range agg.Buckets {
+			result.Versions = append(result.Versions, &ClientVersionCount{
+				Version:  fmt.Sprint(bucket.Key),
+				Requests: bucket.DocCount,
+			})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+const (
+	COMMENT_INDEX = "comment"
+
+	MAX_COMMENT_CHARS = 1000
+)
+
+var errCommentNotFound = errors.New("Comment does not exist")
+
+const COMMENT_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "post_id": {
+                "type": "keyword"
+            },
+            "parent_id": {
+                "type": "keyword"
+            },
+            "user": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Comment is a message on a post. A reply names the comment it answers in
+// ParentId; clients build the threads from the flat list.
+type Comment struct {
+	Id        string    `json:"id,omitempty"`
+	PostId    string    `json:"post_id"`
+	ParentId  string    `json:"parent_id,omitempty"`
+	User      string    `json:"user"`
+	Message   string    `json:"message"`
+	Masked    bool      `json:"masked,omitempty"` // filtered words were replaced
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewComment is the body of POST /post/{id}/comment.
+type NewComment struct {
+	Message  string `json:"message"`
+	ParentId string `json:"parent_id"`
+}
+
+type CommentPage struct {
+	Total    int64      `json:"total"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Comments []*Comment `json:"comments"`
+}
+
+// readablePost returns the post with id if viewer may see it, see
+// visibleTo. On failure it writes the response.
+func (a *App) readablePost(w http.ResponseWriter, r *http.Request, id, viewer string) *Post {
+	p, err := a.Posts.Get(r.Context(), id)
+	if err == nil && !p.visibleTo(viewer) {
+		err = errPostNotFound
+	}
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return nil
+	}
+	return p
+}
+
+// handleComment adds the caller's comment, or reply, to a post.
+func (a *App) handleComment(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for commenting on a post")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var req NewComment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cannot decode comment data from client", http.StatusBadRequest)
+		fmt.Printf("Cannot decode comment data from client %v.\n", err)
+		return
+	}
+	message := strings.TrimSpace(req.Message)
+	if message == "" {
+		http.Error(w, "Comment is empty", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(message) > MAX_COMMENT_CHARS {
+		http.Error(w, fmt.Sprintf("Comment should be at most %d characters", MAX_COMMENT_CHARS), http.StatusBadRequest)
+		return
+	}
+
+	postId := mux.Vars(r)["id"]
+	p := a.readablePost(w, r, postId, claims.Username)
+	if p == nil {
+		return
+	}
+	if refuseBlocked(w, r, p.User, claims.Username, "comment on the posts of") {
+		return
+	}
+
+	if req.ParentId != "" {
+		parent, err := getComment(r.Context(), req.ParentId)
+		if err == errCommentNotFound || (err == nil && parent.PostId != postId) {
+			http.Error(w, "Parent comment does not exist on this post", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read comment from ElasticSearch", http.StatusInternalServerError)
+			fmt.Printf("Failed to read comment %s %v.\n", req.ParentId, err)
+			return
+		}
+	}
+
+	// filter spam, in the language of the post
+	message, masked, ok := screenText(message, p.Lang)
+	if !ok {
+		http.Error(w, "Sorry, the comment contains filtered words. Please edit again. ", http.StatusBadRequest)
+		fmt.Printf("Comment of %s on post %s rejected by spam filter\n", claims.Username, postId)
+		return
+	}
+
+	c := &Comment{
+		Id:        uuid.New(),
+		PostId:    postId,
+		ParentId:  req.ParentId,
+		User:      claims.Username,
+		Message:   message,
+		Masked:    masked,
+		Timestamp: time.Now().UTC(),
+	}
+	if err := saveComment(r.Context(), c); err != nil {
+		http.Error(w, "Failed to save comment to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save comment on post %s %v.\n", postId, err)
+		return
+	}
+	fmt.Printf("Saved comment %s on post %s\n", c.Id, postId)
+	bumpEngagement(r.Context(), p, FIELD_COMMENT_COUNT, 1)
+	notify(p.User, claims.Username, NOTIFY_COMMENT, postId)
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "Failed to parse comment into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse comment into JSON format %v.\n", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handleComments lists the comments of a post, oldest first.
+func (a *App) handleComments(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for comments")
+	w.Header().Set("Content-Type", "application/json")
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, fmt.Sprintf("offset+limit should be at most %d", MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	postId := mux.Vars(r)["id"]
+	if a.readablePost(w, r, postId, viewerName(r)) == nil {
+		return
+	}
+
+	page, err := readCommentsFromES(r.Context(), postId, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read comments from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read comments of post %s %v.\n", postId, err)
+		return
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse comments into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse comments into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleDeleteComment removes one of the caller's comments. Replies to it
+// are kept.
+func handleDeleteComment(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for deleting a comment")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	c, err := getComment(r.Context(), id)
+	if err != nil {
+		if err == errCommentNotFound {
+			http.Error(w, "Comment does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read comment from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read comment %s %v.\n", id, err)
+		return
+	}
+
+	if c.User != claims.Username {
+		http.Error(w, "Only the author can delete a comment", http.StatusForbidden)
+		fmt.Printf("%s tried to delete comment %s of %s\n", claims.Username, id, c.User)
+		return
+	}
+
+	client := esClient
+	if _, err := client.Delete().Index(COMMENT_INDEX).Id(id).Do(r.Context()); err != nil {
+		if elastic.IsNotFound(err) {
+			// deleted concurrently, and counted then
+			w.Write([]byte("Comment deleted successfully."))
+			return
+		}
+		http.Error(w, "Failed to delete comment from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete comment %s %v.\n", id, err)
+		return
+	}
+	fmt.Printf("Deleted comment %s\n", id)
+	if p, err := getPostFromES(c.PostId); err == nil {
+		bumpEngagement(r.Context(), p, FIELD_COMMENT_COUNT, -1)
+	} else if err != errPostNotFound {
+		fmt.Printf("Failed to read post %s %v.\n", c.PostId, err)
+	}
+
+	w.Write([]byte("Comment deleted successfully."))
+}
+
+func saveComment(ctx context.Context, c *Comment) error {
+	client := esClient
+
+	_, err := client.Index().
+		Index(COMMENT_INDEX).
+		Id(c.Id).
+		BodyJson(c).
+		Do(ctx)
+	return err
+}
+
+func getComment(ctx context.Context, id string) (*Comment, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(COMMENT_INDEX).
+		Id(id).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errCommentNotFound
+		}
+		return nil, err
+	}
+	if !result.Found || result.Source == nil {
+		return nil, errCommentNotFound
+	}
+
+	var c Comment
+	if err := json.Unmarshal(result.Source, &c); err != nil {
+		return nil, err
+	}
+	c.Id = result.Id
+	return &c, nil
+}
+
+func readCommentsFromES(ctx context.Context, postId string, offset, limit int) (*CommentPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(COMMENT_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Sort("timestamp", true).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"comments": postId})
+
+	page := &CommentPage{
+		Total:    searchResult.TotalHits(),
+		Offset:   offset,
+		Limit:    limit,
+		Comments: []*Comment{},
+	}
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var c Comment
+			if hit.Source == nil || json.Unmarshal(hit.Source, &c) != nil {
+				continue
+			}
+			c.Id = hit.Id
+			page.Comments = append(page.Comments, &c)
+		}
+	}
+	return page, nil
+}
+
+// deleteComments drops the comments of a deleted post; failures are only
+// logged.
+func deleteComments(postId string) {
+	client := esClient
+
+	_, err := client.DeleteByQuery(COMMENT_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to delete comments of post %s %v.\n", postId, err)
+	}
+}
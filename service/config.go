@@ -0,0 +1,1118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const REDACTED = "[redacted]"
+
+// CONFIG_ENV_PREFIX prefixes the environment variables that override the
+// config file, e.g. AROUND_ES_URL.
+const CONFIG_ENV_PREFIX = "AROUND_"
+
+// ServiceConfig holds the settings that differ between deployments. The defaults
+// are the development values below. A config file passed with --config
+// (or AROUND_CONFIG) overrides them, and AROUND_* environment variables
+// override the file. The file is YAML; JSON, being valid YAML, works too.
+type ServiceConfig struct {
+	ESURL      string `yaml:"es_url"`
+	BucketName string `yaml:"bucket_name"`
+	SigningKey string `yaml:"signing_key"`
+	// SigningKeys, or those in SigningKeysFile, sign tokens by key id,
+	// the first signing new ones. SigningKey then only verifies tokens
+	// without a key id.
+	SigningKeys     []SigningKey `yaml:"signing_keys"`
+	SigningKeysFile string       `yaml:"signing_keys_file"`
+	Distance        string       `yaml:"distance"`
+	EnableBigtable  bool         `yaml:"enable_bigtable"`
+	// PublicRead lets visitors without a token use the read endpoints.
+	PublicRead bool `yaml:"public_read"`
+	// BigtableProject, BigtableInstance and BigtableTable locate the copy
+	// of the posts, written with the key in BigtableCredentials or the
+	// application default credentials.
+	BigtableProject     string `yaml:"bigtable_project"`
+	BigtableInstance    string `yaml:"bigtable_instance"`
+	BigtableTable       string `yaml:"bigtable_table"`
+	BigtableCredentials string `yaml:"bigtable_credentials"`
+	// StorageBackend selects where media is kept: "gcs" in BucketName,
+	// "s3" in S3Bucket, or "local" under LocalStorageDir, served back at
+	// LocalMediaURL.
+	StorageBackend  string `yaml:"storage_backend"`
+	S3Bucket        string `yaml:"s3_bucket"`
+	S3Region        string `yaml:"s3_region"`
+	LocalStorageDir string `yaml:"local_storage_dir"`
+	LocalMediaURL   string `yaml:"local_media_url"`
+	// SignedMediaURLs keeps media private and hands out URLs signed for
+	// SignedURLExpiry, a duration such as "15m".
+	SignedMediaURLs bool   `yaml:"signed_media_urls"`
+	SignedURLExpiry string `yaml:"signed_url_expiry"`
+	// AsyncMediaUpload indexes new posts before their media is stored,
+	// which MediaUploadWorkers then do in the background.
+	AsyncMediaUpload   bool `yaml:"async_media_upload"`
+	MediaUploadWorkers int  `yaml:"media_upload_workers"`
+	// IngestQueue, "pubsub" or "memory", has new posts indexed by
+	// IngestWorkers consumers rather than by the request. The pubsub queue
+	// publishes to PubSubTopic and consumes PubSubSubscription of
+	// PubSubProject.
+	IngestQueue        string `yaml:"ingest_queue"`
+	IngestWorkers      int    `yaml:"ingest_workers"`
+	PubSubProject      string `yaml:"pubsub_project"`
+	PubSubTopic        string `yaml:"pubsub_topic"`
+	PubSubSubscription string `yaml:"pubsub_subscription"`
+	// PostStoreBackend selects where posts are indexed: "elasticsearch"
+	// at ESURL, "opensearch" at OpenSearchURL, or "memory".
+	PostStoreBackend string `yaml:"post_store_backend"`
+	OpenSearchURL    string `yaml:"opensearch_url"`
+	// IndexCodec, "default" or "best_compression", is the codec the post
+	// index is created with.
+	IndexCodec string `yaml:"index_codec"`
+	// CORSAllowedOrigins are the browser origins allowed to call the API,
+	// or "*" for any.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	// ModerationEngine selects how user-written text is judged:
+	// "wordlist" or "regex" rules read from ModerationSource, a file or
+	// gs://bucket/object reloaded when it changes, or "perspective" scores
+	// from ModerationAPIURL, flagged from ModerationThreshold.
+	ModerationEngine    string  `yaml:"moderation_engine"`
+	ModerationSource    string  `yaml:"moderation_source"`
+	ModerationAPIURL    string  `yaml:"moderation_api_url"`
+	ModerationAPIKey    string  `yaml:"moderation_api_key"`
+	ModerationThreshold float64 `yaml:"moderation_threshold"`
+	// ImageAnalyzer selects how new images are checked: "vision" with the
+	// Cloud Vision API at VisionAPIURL, or "none".
+	ImageAnalyzer string `yaml:"image_analyzer"`
+	VisionAPIURL  string `yaml:"vision_api_url"`
+	VisionAPIKey  string `yaml:"vision_api_key"`
+	// Geocoder selects who resolves place names and names the places of
+	// new posts: "nominatim", or "google" with GoogleMapsAPIKey.
+	Geocoder         string `yaml:"geocoder"`
+	GoogleMapsAPIKey string `yaml:"google_maps_api_key"`
+	// Mailer selects how mail is sent: "smtp" through SMTPAddr, "sendgrid"
+	// with SendGridAPIKey, or "none". With a mailer, signups verify their
+	// email address at VerifyURL before they can log in, and reset links
+	// lead to PasswordResetURL.
+	Mailer           string `yaml:"mailer"`
+	MailFrom         string `yaml:"mail_from"`
+	SMTPAddr         string `yaml:"smtp_addr"`
+	SMTPUsername     string `yaml:"smtp_username"`
+	SMTPPassword     string `yaml:"smtp_password"`
+	SendGridAPIKey   string `yaml:"sendgrid_api_key"`
+	VerifyURL        string `yaml:"verify_url"`
+	PasswordResetURL string `yaml:"password_reset_url"`
+	// OAuthBaseURL is the public address of the service, to which Google
+	// and GitHub send users back after login. Each provider is enabled by
+	// its client id and secret.
+	OAuthBaseURL       string `yaml:"oauth_base_url"`
+	GoogleClientID     string `yaml:"google_client_id"`
+	GoogleClientSecret string `yaml:"google_client_secret"`
+	GitHubClientID     string `yaml:"github_client_id"`
+	GitHubClientSecret string `yaml:"github_client_secret"`
+	// FCMProjectID enables pushes to Android devices through the Firebase
+	// project, with the application default credentials. APNSKeyFile, the
+	// .p8 key APNSKeyID of the Apple team APNSTeamID, enables pushes to iOS
+	// devices of the app APNSTopic, through the development server with
+	// APNSSandbox. PushWorkers send them.
+	FCMProjectID string `yaml:"fcm_project_id"`
+	APNSKeyFile  string `yaml:"apns_key_file"`
+	APNSKeyID    string `yaml:"apns_key_id"`
+	APNSTeamID   string `yaml:"apns_team_id"`
+	APNSTopic    string `yaml:"apns_topic"`
+	APNSSandbox  bool   `yaml:"apns_sandbox"`
+	PushWorkers  int    `yaml:"push_workers"`
+	// AnalyticsSink selects where post and search events go: "bigquery",
+	// the BigQueryTable of BigQueryDataset in BigQueryProject, "log", or
+	// "none".
+	AnalyticsSink   string `yaml:"analytics_sink"`
+	BigQueryProject string `yaml:"bigquery_project"`
+	BigQueryDataset string `yaml:"bigquery_dataset"`
+	BigQueryTable   string `yaml:"bigquery_table"`
+	// RetryAttempts bounds the calls made to ElasticSearch or the blob store
+	// while they fail transiently, waiting from RetryMinBackoff doubling up
+	// to RetryMaxBackoff in between. BreakerFailures transient failures in
+	// a row stop calls to the dependency for BreakerOpenDuration.
+	RetryAttempts       int    `yaml:"retry_attempts"`
+	RetryMinBackoff     string `yaml:"retry_min_backoff"`
+	RetryMaxBackoff     string `yaml:"retry_max_backoff"`
+	BreakerFailures     int    `yaml:"breaker_failures"`
+	BreakerOpenDuration string `yaml:"breaker_open_duration"`
+	// MaxUploadBytes caps the body of a post, MaxImageBytes its image.
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+	MaxImageBytes  int64 `yaml:"max_image_bytes"`
+	// RedisURL, a redis:// or rediss:// URL, enables caching searches for
+	// SearchCacheTTL.
+	RedisURL       string `yaml:"redis_url"`
+	SearchCacheTTL string `yaml:"search_cache_ttl"`
+	// PostDailyLimit caps the posts of a user per UTC day, and
+	// PostCooldown, a duration such as "30s", is the least time between
+	// two; 0 disables either.
+	PostDailyLimit int    `yaml:"post_daily_limit"`
+	PostCooldown   string `yaml:"post_cooldown"`
+	// Flags replaces the defaults of feature flags by name, e.g. live:
+	// false. Overrides set with POST /admin/flags/{name} still win.
+	Flags map[string]bool `yaml:"flags"`
+}
+
+// Settings loaded from the ServiceConfig at startup.
+var (
+	ES_URL          = "http://34.73.54.29:9200" // your ElasticSearch endpoint
+	BUCKET_NAME     = "zhida-post-around-image" // your GCS bucket name
+	DISTANCE        = "200km"                   // default search range
+	ENABLE_BIGTABLE = false                     // Big table are currently closed due to extreme high cost
+)
+
+func defaultConfig() *ServiceConfig {
+	return &ServiceConfig{
+		ESURL:          ES_URL,
+		BucketName:     BUCKET_NAME,
+		SigningKey:     SECRET,
+		Distance:       DISTANCE,
+		EnableBigtable: ENABLE_BIGTABLE,
+		PublicRead:     PUBLIC_READ,
+
+		BigtableProject:     BIGTABLE_PROJECT,
+		BigtableInstance:    BIGTABLE_INSTANCE,
+		BigtableTable:       BIGTABLE_TABLE,
+		BigtableCredentials: BIGTABLE_CREDENTIALS,
+
+		StorageBackend:  STORAGE_BACKEND,
+		S3Bucket:        S3_BUCKET,
+		S3Region:        S3_REGION,
+		LocalStorageDir: LOCAL_STORAGE_DIR,
+		LocalMediaURL:   LOCAL_MEDIA_URL,
+
+		SignedMediaURLs: SIGNED_MEDIA_URLS,
+		SignedURLExpiry: SIGNED_URL_EXPIRY.String(),
+
+		AsyncMediaUpload:   ASYNC_MEDIA_UPLOAD,
+		MediaUploadWorkers: MEDIA_UPLOAD_WORKERS,
+		IngestQueue:        INGEST_QUEUE,
+		IngestWorkers:      INGEST_WORKERS,
+		PubSubProject:      PUBSUB_PROJECT,
+		PubSubTopic:        PUBSUB_TOPIC,
+		PubSubSubscription: PUBSUB_SUBSCRIPTION,
+
+		PostStoreBackend: POST_STORE_BACKEND,
+		OpenSearchURL:    OPENSEARCH_URL,
+		IndexCodec:       INDEX_CODEC,
+
+		ModerationEngine:    MODERATION_ENGINE,
+		ModerationSource:    MODERATION_SOURCE,
+		ModerationAPIURL:    MODERATION_API_URL,
+		ModerationAPIKey:    MODERATION_API_KEY,
+		ModerationThreshold: MODERATION_THRESHOLD,
+
+		ImageAnalyzer: IMAGE_ANALYZER,
+		VisionAPIURL:  VISION_API_URL,
+		VisionAPIKey:  VISION_API_KEY,
+
+		Geocoder:         GEOCODER,
+		GoogleMapsAPIKey: GOOGLE_MAPS_API_KEY,
+
+		Mailer:           MAILER,
+		MailFrom:         MAIL_FROM,
+		SMTPAddr:         SMTP_ADDR,
+		SMTPUsername:     SMTP_USERNAME,
+		SMTPPassword:     SMTP_PASSWORD,
+		SendGridAPIKey:   SENDGRID_API_KEY,
+		VerifyURL:        VERIFY_URL,
+		PasswordResetURL: PASSWORD_RESET_URL,
+
+		OAuthBaseURL:       OAUTH_BASE_URL,
+		GoogleClientID:     GOOGLE_CLIENT_ID,
+		GoogleClientSecret: GOOGLE_CLIENT_SECRET,
+		GitHubClientID:     GITHUB_CLIENT_ID,
+		GitHubClientSecret: GITHUB_CLIENT_SECRET,
+
+		FCMProjectID: FCM_PROJECT_ID,
+		APNSKeyFile:  APNS_KEY_FILE,
+		APNSKeyID:    APNS_KEY_ID,
+		APNSTeamID:   APNS_TEAM_ID,
+		APNSTopic:    APNS_TOPIC,
+		APNSSandbox:  APNS_SANDBOX,
+		PushWorkers:  PUSH_WORKERS,
+
+		AnalyticsSink:   ANALYTICS_SINK,
+		BigQueryProject: BIGQUERY_PROJECT,
+		BigQueryDataset: BIGQUERY_DATASET,
+		BigQueryTable:   BIGQUERY_TABLE,
+
+		RetryAttempts:       RETRY_ATTEMPTS,
+		RetryMinBackoff:     RETRY_MIN_BACKOFF.String(),
+		RetryMaxBackoff:     RETRY_MAX_BACKOFF.String(),
+		BreakerFailures:     BREAKER_FAILURES,
+		BreakerOpenDuration: BREAKER_OPEN_DURATION.String(),
+
+		CORSAllowedOrigins: CORS_ALLOWED_ORIGINS,
+		MaxUploadBytes:     MAX_UPLOAD_BYTES,
+		MaxImageBytes:      MAX_IMAGE_BYTES,
+
+		RedisURL:       REDIS_URL,
+		SearchCacheTTL: SEARCH_CACHE_TTL.String(),
+		PostDailyLimit: POST_DAILY_LIMIT,
+		PostCooldown:   POST_COOLDOWN.String(),
+	}
+}
+
+// loadConfig reads the config file at path, if any, applies the
+// environment and validates the result.
+func loadConfig(path string) (*ServiceConfig, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ServiceConfig) applyEnv() error {
+	if val, ok := lookupConfigEnv("ES_URL"); ok {
+		c.ESURL = val
+	}
+	if val, ok := lookupConfigEnv("BUCKET_NAME"); ok {
+		c.BucketName = val
+	}
+	if val, ok := lookupConfigEnv("SIGNING_KEY"); ok {
+		c.SigningKey = val
+	}
+	if val, ok := lookupConfigEnv("SIGNING_KEYS"); ok {
+		// id:key,id:key
+		c.SigningKeys = nil
+		for _, pair := range strings.Split(val, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("%sSIGNING_KEYS: %q should be id:key", CONFIG_ENV_PREFIX, pair)
+			}
+			c.SigningKeys = append(c.SigningKeys, SigningKey{ID: parts[0], Key: parts[1]})
+		}
+	}
+	if val, ok := lookupConfigEnv("SIGNING_KEYS_FILE"); ok {
+		c.SigningKeysFile = val
+	}
+	if val, ok := lookupConfigEnv("DISTANCE"); ok {
+		c.Distance = val
+	}
+	if val, ok := lookupConfigEnv("PUBLIC_READ"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%sPUBLIC_READ: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.PublicRead = enabled
+	}
+	if val, ok := lookupConfigEnv("STORAGE_BACKEND"); ok {
+		c.StorageBackend = val
+	}
+	if val, ok := lookupConfigEnv("S3_BUCKET"); ok {
+		c.S3Bucket = val
+	}
+	if val, ok := lookupConfigEnv("S3_REGION"); ok {
+		c.S3Region = val
+	}
+	if val, ok := lookupConfigEnv("LOCAL_STORAGE_DIR"); ok {
+		c.LocalStorageDir = val
+	}
+	if val, ok := lookupConfigEnv("LOCAL_MEDIA_URL"); ok {
+		c.LocalMediaURL = val
+	}
+	if val, ok := lookupConfigEnv("SIGNED_MEDIA_URLS"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%sSIGNED_MEDIA_URLS: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.SignedMediaURLs = enabled
+	}
+	if val, ok := lookupConfigEnv("SIGNED_URL_EXPIRY"); ok {
+		c.SignedURLExpiry = val
+	}
+	if val, ok := lookupConfigEnv("ASYNC_MEDIA_UPLOAD"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%sASYNC_MEDIA_UPLOAD: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.AsyncMediaUpload = enabled
+	}
+	if val, ok := lookupConfigEnv("MEDIA_UPLOAD_WORKERS"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sMEDIA_UPLOAD_WORKERS: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.MediaUploadWorkers = n
+	}
+	if val, ok := lookupConfigEnv("INGEST_QUEUE"); ok {
+		c.IngestQueue = val
+	}
+	if val, ok := lookupConfigEnv("INGEST_WORKERS"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sINGEST_WORKERS: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.IngestWorkers = n
+	}
+	if val, ok := lookupConfigEnv("PUBSUB_PROJECT"); ok {
+		c.PubSubProject = val
+	}
+	if val, ok := lookupConfigEnv("PUBSUB_TOPIC"); ok {
+		c.PubSubTopic = val
+	}
+	if val, ok := lookupConfigEnv("PUBSUB_SUBSCRIPTION"); ok {
+		c.PubSubSubscription = val
+	}
+	if val, ok := lookupConfigEnv("POST_STORE_BACKEND"); ok {
+		c.PostStoreBackend = val
+	}
+	if val, ok := lookupConfigEnv("OPENSEARCH_URL"); ok {
+		c.OpenSearchURL = val
+	}
+	if val, ok := lookupConfigEnv("INDEX_CODEC"); ok {
+		c.IndexCodec = val
+	}
+	if val, ok := lookupConfigEnv("MODERATION_ENGINE"); ok {
+		c.ModerationEngine = val
+	}
+	if val, ok := lookupConfigEnv("MODERATION_SOURCE"); ok {
+		c.ModerationSource = val
+	}
+	if val, ok := lookupConfigEnv("MODERATION_API_URL"); ok {
+		c.ModerationAPIURL = val
+	}
+	if val, ok := lookupConfigEnv("MODERATION_API_KEY"); ok {
+		c.ModerationAPIKey = val
+	}
+	if val, ok := lookupConfigEnv("MODERATION_THRESHOLD"); ok {
+		threshold, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("%sMODERATION_THRESHOLD: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.ModerationThreshold = threshold
+	}
+	if val, ok := lookupConfigEnv("IMAGE_ANALYZER"); ok {
+		c.ImageAnalyzer = val
+	}
+	if val, ok := lookupConfigEnv("VISION_API_URL"); ok {
+		c.VisionAPIURL = val
+	}
+	if val, ok := lookupConfigEnv("VISION_API_KEY"); ok {
+		c.VisionAPIKey = val
+	}
+	if val, ok := lookupConfigEnv("GEOCODER"); ok {
+		c.Geocoder = val
+	}
+	if val, ok := lookupConfigEnv("GOOGLE_MAPS_API_KEY"); ok {
+		c.GoogleMapsAPIKey = val
+	}
+	if val, ok := lookupConfigEnv("MAILER"); ok {
+		c.Mailer = val
+	}
+	if val, ok := lookupConfigEnv("MAIL_FROM"); ok {
+		c.MailFrom = val
+	}
+	if val, ok := lookupConfigEnv("SMTP_ADDR"); ok {
+		c.SMTPAddr = val
+	}
+	if val, ok := lookupConfigEnv("SMTP_USERNAME"); ok {
+		c.SMTPUsername = val
+	}
+	if val, ok := lookupConfigEnv("SMTP_PASSWORD"); ok {
+		c.SMTPPassword = val
+	}
+	if val, ok := lookupConfigEnv("SENDGRID_API_KEY"); ok {
+		c.SendGridAPIKey = val
+	}
+	if val, ok := lookupConfigEnv("VERIFY_URL"); ok {
+		c.VerifyURL = val
+	}
+	if val, ok := lookupConfigEnv("PASSWORD_RESET_URL"); ok {
+		c.PasswordResetURL = val
+	}
+	if val, ok := lookupConfigEnv("OAUTH_BASE_URL"); ok {
+		c.OAuthBaseURL = val
+	}
+	if val, ok := lookupConfigEnv("GOOGLE_CLIENT_ID"); ok {
+		c.GoogleClientID = val
+	}
+	if val, ok := lookupConfigEnv("GOOGLE_CLIENT_SECRET"); ok {
+		c.GoogleClientSecret = val
+	}
+	if val, ok := lookupConfigEnv("GITHUB_CLIENT_ID"); ok {
+		c.GitHubClientID = val
+	}
+	if val, ok := lookupConfigEnv("GITHUB_CLIENT_SECRET"); ok {
+		c.GitHubClientSecret = val
+	}
+	if val, ok := lookupConfigEnv("FCM_PROJECT_ID"); ok {
+		c.FCMProjectID = val
+	}
+	if val, ok := lookupConfigEnv("APNS_KEY_FILE"); ok {
+		c.APNSKeyFile = val
+	}
+	if val, ok := lookupConfigEnv("APNS_KEY_ID"); ok {
+		c.APNSKeyID = val
+	}
+	if val, ok := lookupConfigEnv("APNS_TEAM_ID"); ok {
+		c.APNSTeamID = val
+	}
+	if val, ok := lookupConfigEnv("APNS_TOPIC"); ok {
+		c.APNSTopic = val
+	}
+	if val, ok := lookupConfigEnv("APNS_SANDBOX"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%sAPNS_SANDBOX: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.APNSSandbox = enabled
+	}
+	if val, ok := lookupConfigEnv("PUSH_WORKERS"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sPUSH_WORKERS: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.PushWorkers = n
+	}
+	if val, ok := lookupConfigEnv("ANALYTICS_SINK"); ok {
+		c.AnalyticsSink = val
+	}
+	if val, ok := lookupConfigEnv("BIGQUERY_PROJECT"); ok {
+		c.BigQueryProject = val
+	}
+	if val, ok := lookupConfigEnv("BIGQUERY_DATASET"); ok {
+		c.BigQueryDataset = val
+	}
+	if val, ok := lookupConfigEnv("BIGQUERY_TABLE"); ok {
+		c.BigQueryTable = val
+	}
+	if val, ok := lookupConfigEnv("RETRY_ATTEMPTS"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sRETRY_ATTEMPTS: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.RetryAttempts = n
+	}
+	if val, ok := lookupConfigEnv("RETRY_MIN_BACKOFF"); ok {
+		c.RetryMinBackoff = val
+	}
+	if val, ok := lookupConfigEnv("RETRY_MAX_BACKOFF"); ok {
+		c.RetryMaxBackoff = val
+	}
+	if val, ok := lookupConfigEnv("BREAKER_FAILURES"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sBREAKER_FAILURES: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.BreakerFailures = n
+	}
+	if val, ok := lookupConfigEnv("BREAKER_OPEN_DURATION"); ok {
+		c.BreakerOpenDuration = val
+	}
+	if val, ok := lookupConfigEnv("CORS_ALLOWED_ORIGINS"); ok {
+		c.CORSAllowedOrigins = nil
+		for _, origin := range strings.Split(val, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORSAllowedOrigins = append(c.CORSAllowedOrigins, origin)
+			}
+		}
+	}
+	if val, ok := lookupConfigEnv("ENABLE_BIGTABLE"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%sENABLE_BIGTABLE: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.EnableBigtable = enabled
+	}
+	if val, ok := lookupConfigEnv("BIGTABLE_PROJECT"); ok {
+		c.BigtableProject = val
+	}
+	if val, ok := lookupConfigEnv("BIGTABLE_INSTANCE"); ok {
+		c.BigtableInstance = val
+	}
+	if val, ok := lookupConfigEnv("BIGTABLE_TABLE"); ok {
+		c.BigtableTable = val
+	}
+	if val, ok := lookupConfigEnv("BIGTABLE_CREDENTIALS"); ok {
+		c.BigtableCredentials = val
+	}
+	if val, ok := lookupConfigEnv("MAX_UPLOAD_BYTES"); ok {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%sMAX_UPLOAD_BYTES: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.MaxUploadBytes = n
+	}
+	if val, ok := lookupConfigEnv("MAX_IMAGE_BYTES"); ok {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%sMAX_IMAGE_BYTES: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.MaxImageBytes = n
+	}
+	if val, ok := lookupConfigEnv("REDIS_URL"); ok {
+		c.RedisURL = val
+	}
+	if val, ok := lookupConfigEnv("SEARCH_CACHE_TTL"); ok {
+		c.SearchCacheTTL = val
+	}
+	if val, ok := lookupConfigEnv("POST_DAILY_LIMIT"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%sPOST_DAILY_LIMIT: %v", CONFIG_ENV_PREFIX, err)
+		}
+		c.PostDailyLimit = n
+	}
+	if val, ok := lookupConfigEnv("POST_COOLDOWN"); ok {
+		c.PostCooldown = val
+	}
+	if val, ok := lookupConfigEnv("FLAGS"); ok {
+		// e.g. live=false,heatmap=true
+		for _, pair := range strings.Split(val, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("%sFLAGS: %q should be name=true or name=false", CONFIG_ENV_PREFIX, pair)
+			}
+			enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return fmt.Errorf("%sFLAGS: %q should be name=true or name=false", CONFIG_ENV_PREFIX, pair)
+			}
+			if c.Flags == nil {
+				c.Flags = make(map[string]bool)
+			}
+			c.Flags[strings.TrimSpace(parts[0])] = enabled
+		}
+	}
+	return nil
+}
+
+func lookupConfigEnv(name string) (string, bool) {
+	val, ok := os.LookupEnv(CONFIG_ENV_PREFIX + name)
+	return strings.TrimSpace(val), ok
+}
+
+func (c *ServiceConfig) validate() error {
+	u, err := url.Parse(c.ESURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("es_url %q is not an http(s) URL", c.ESURL)
+	}
+	switch c.StorageBackend {
+	case "gcs":
+		if c.BucketName == "" {
+			return fmt.Errorf("bucket_name is required with the gcs storage backend")
+		}
+	case "s3":
+		if c.S3Bucket == "" || c.S3Region == "" {
+			return fmt.Errorf("s3_bucket and s3_region are required with the s3 storage backend")
+		}
+	case "local":
+		if c.LocalStorageDir == "" {
+			return fmt.Errorf("local_storage_dir is required with the local storage backend")
+		}
+		if u, err := url.Parse(c.LocalMediaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("local_media_url %q is not an http(s) URL", c.LocalMediaURL)
+		}
+	default:
+		return fmt.Errorf("storage_backend %q should be one of %s", c.StorageBackend, strings.Join(STORAGE_BACKENDS, ", "))
+	}
+	// V4 signatures are valid for at most 7 days
+	if expiry, err := time.ParseDuration(c.SignedURLExpiry); err != nil || expiry < time.Minute || expiry > 7*24*time.Hour {
+		return fmt.Errorf("signed_url_expiry %q should be a duration between 1m and 168h", c.SignedURLExpiry)
+	}
+	if c.MediaUploadWorkers < 1 {
+		return fmt.Errorf("media_upload_workers should be at least 1")
+	}
+	if c.EnableBigtable && (c.BigtableProject == "" || c.BigtableInstance == "" || c.BigtableTable == "") {
+		return fmt.Errorf("bigtable_project, bigtable_instance and bigtable_table are required with enable_bigtable")
+	}
+	if c.IngestWorkers < 0 {
+		return fmt.Errorf("ingest_workers should not be negative")
+	}
+	switch c.IngestQueue {
+	case "none":
+	case "memory":
+		if c.IngestWorkers < 1 {
+			return fmt.Errorf("ingest_workers should be at least 1 with the memory ingest queue")
+		}
+	case "pubsub":
+		if c.PubSubProject == "" || c.PubSubTopic == "" {
+			return fmt.Errorf("pubsub_project and pubsub_topic are required with the pubsub ingest queue")
+		}
+		if c.IngestWorkers > 0 && c.PubSubSubscription == "" {
+			return fmt.Errorf("pubsub_subscription is required for ingest_workers to consume")
+		}
+	default:
+		return fmt.Errorf("ingest_queue %q should be one of %s", c.IngestQueue, strings.Join(INGEST_QUEUES, ", "))
+	}
+	if c.IngestQueue != "none" && c.AsyncMediaUpload {
+		return fmt.Errorf("async_media_upload can't be combined with an ingest_queue")
+	}
+	switch c.PostStoreBackend {
+	case "elasticsearch", "memory":
+	case "opensearch":
+		if u, err := url.Parse(c.OpenSearchURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("opensearch_url %q is not an http(s) URL", c.OpenSearchURL)
+		}
+	default:
+		return fmt.Errorf("post_store_backend %q should be one of %s", c.PostStoreBackend, strings.Join(POST_STORE_BACKENDS, ", "))
+	}
+	switch c.IndexCodec {
+	case "default", "best_compression":
+	default:
+		return fmt.Errorf("index_codec %q should be one of %s", c.IndexCodec, strings.Join(INDEX_CODECS, ", "))
+	}
+	switch c.ModerationEngine {
+	case "wordlist":
+	case "regex":
+		if c.ModerationSource == "" {
+			return fmt.Errorf("moderation_source is required with the regex moderation engine")
+		}
+	case "perspective":
+		if u, err := url.Parse(c.ModerationAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("moderation_api_url %q is not an http(s) URL", c.ModerationAPIURL)
+		}
+		if c.ModerationThreshold <= 0 || c.ModerationThreshold > 1 {
+			return fmt.Errorf("moderation_threshold %g should be above 0 and at most 1", c.ModerationThreshold)
+		}
+	default:
+		return fmt.Errorf("moderation_engine %q should be one of %s", c.ModerationEngine, strings.Join(MODERATION_ENGINES, ", "))
+	}
+	switch c.ImageAnalyzer {
+	case "none":
+	case "vision":
+		if u, err := url.Parse(c.VisionAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("vision_api_url %q is not an http(s) URL", c.VisionAPIURL)
+		}
+		if c.VisionAPIKey == "" {
+			return fmt.Errorf("vision_api_key is required with the vision image analyzer")
+		}
+	default:
+		return fmt.Errorf("image_analyzer %q should be one of %s", c.ImageAnalyzer, strings.Join(IMAGE_ANALYZERS, ", "))
+	}
+	switch c.Geocoder {
+	case "nominatim":
+	case "google":
+		if c.GoogleMapsAPIKey == "" {
+			return fmt.Errorf("google_maps_api_key is required with the google geocoder")
+		}
+	default:
+		return fmt.Errorf("geocoder %q should be one of %s", c.Geocoder, strings.Join(GEOCODERS, ", "))
+	}
+	switch c.Mailer {
+	case "none":
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			return fmt.Errorf("smtp_addr %q should be host:port", c.SMTPAddr)
+		}
+	case "sendgrid":
+		if c.SendGridAPIKey == "" {
+			return fmt.Errorf("sendgrid_api_key is required with the sendgrid mailer")
+		}
+	default:
+		return fmt.Errorf("mailer %q should be one of %s", c.Mailer, strings.Join(MAILERS, ", "))
+	}
+	if c.Mailer != "none" {
+		if err := validateEmail(c.MailFrom); err != nil {
+			return fmt.Errorf("mail_from %q should be an email address", c.MailFrom)
+		}
+		if u, err := url.Parse(c.VerifyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			return fmt.Errorf("verify_url %q is not an http(s) URL without a query", c.VerifyURL)
+		}
+		if u, err := url.Parse(c.PasswordResetURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			return fmt.Errorf("password_reset_url %q is not an http(s) URL without a query", c.PasswordResetURL)
+		}
+	}
+	if (c.GoogleClientID == "") != (c.GoogleClientSecret == "") {
+		return fmt.Errorf("google_client_id and google_client_secret should be set together")
+	}
+	if (c.GitHubClientID == "") != (c.GitHubClientSecret == "") {
+		return fmt.Errorf("github_client_id and github_client_secret should be set together")
+	}
+	if c.GoogleClientID != "" || c.GitHubClientID != "" {
+		if u, err := url.Parse(c.OAuthBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("oauth_base_url %q is not an http(s) URL", c.OAuthBaseURL)
+		}
+	}
+	if c.APNSKeyFile != "" && (c.APNSKeyID == "" || c.APNSTeamID == "" || c.APNSTopic == "") {
+		return fmt.Errorf("apns_key_id, apns_team_id and apns_topic are required with apns_key_file")
+	}
+	if c.PushWorkers < 1 {
+		return fmt.Errorf("push_workers should be at least 1")
+	}
+	switch c.AnalyticsSink {
+	case "none", "log":
+	case "bigquery":
+		if c.BigQueryProject == "" || c.BigQueryDataset == "" || c.BigQueryTable == "" {
+			return fmt.Errorf("bigquery_project, bigquery_dataset and bigquery_table are required with the bigquery analytics sink")
+		}
+	default:
+		return fmt.Errorf("analytics_sink %q should be one of %s", c.AnalyticsSink, strings.Join(ANALYTICS_SINKS, ", "))
+	}
+	if c.SigningKey == "" && len(c.SigningKeys) == 0 && c.SigningKeysFile == "" {
+		return fmt.Errorf("signing_key, signing_keys or signing_keys_file is required")
+	}
+	if err := validateSigningKeys(c.SigningKeys); err != nil {
+		return fmt.Errorf("signing_keys: %v", err)
+	}
+	if !strings.HasSuffix(c.Distance, "km") {
+		return fmt.Errorf("distance %q should be in km, e.g. 200km", c.Distance)
+	}
+	if km, err := parseKm(c.Distance); err != nil || km <= 0 {
+		return fmt.Errorf("distance %q should be a positive number of km", c.Distance)
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("cors_allowed_origins: %q should be * or a scheme://host[:port] origin", origin)
+		}
+	}
+	if c.RetryAttempts < 1 || c.BreakerFailures < 1 {
+		return fmt.Errorf("retry_attempts and breaker_failures should be at least 1")
+	}
+	minBackoff, err := time.ParseDuration(c.RetryMinBackoff)
+	if err != nil || minBackoff <= 0 {
+		return fmt.Errorf("retry_min_backoff %q should be a positive duration", c.RetryMinBackoff)
+	}
+	if maxBackoff, err := time.ParseDuration(c.RetryMaxBackoff); err != nil || maxBackoff < minBackoff {
+		return fmt.Errorf("retry_max_backoff %q should be a duration of at least retry_min_backoff", c.RetryMaxBackoff)
+	}
+	if open, err := time.ParseDuration(c.BreakerOpenDuration); err != nil || open <= 0 {
+		return fmt.Errorf("breaker_open_duration %q should be a positive duration", c.BreakerOpenDuration)
+	}
+	if c.MaxUploadBytes <= 0 || c.MaxImageBytes <= 0 {
+		return fmt.Errorf("max_upload_bytes and max_image_bytes should be positive")
+	}
+	if c.MaxImageBytes > c.MaxUploadBytes {
+		return fmt.Errorf("max_image_bytes %d exceeds max_upload_bytes %d", c.MaxImageBytes, c.MaxUploadBytes)
+	}
+	if c.RedisURL != "" {
+		if u, err := url.Parse(c.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			return fmt.Errorf("redis_url %q is not a redis(s) URL", c.RedisURL)
+		}
+	}
+	if ttl, err := time.ParseDuration(c.SearchCacheTTL); err != nil || ttl <= 0 {
+		return fmt.Errorf("search_cache_ttl %q should be a positive duration", c.SearchCacheTTL)
+	}
+	if c.PostDailyLimit < 0 {
+		return fmt.Errorf("post_daily_limit should not be negative")
+	}
+	if cooldown, err := time.ParseDuration(c.PostCooldown); err != nil || cooldown < 0 {
+		return fmt.Errorf("post_cooldown %q should be a duration, 0s for none", c.PostCooldown)
+	}
+	for name := range c.Flags {
+		if _, known := defaultFlags[name]; !known {
+			return fmt.Errorf("flags: unknown flag %q, should be one of %s", name, strings.Join(flagNames(), ", "))
+		}
+	}
+	if c.legacySigningKey() == SECRET {
+		fmt.Println("Warning: using the default signing key; set signing_key in production")
+	}
+	return nil
+}
+
+// apply makes c the configuration of the service.
+func (c *ServiceConfig) apply() {
+	ES_URL = c.ESURL
+	BUCKET_NAME = c.BucketName
+	DISTANCE = c.Distance
+	ENABLE_BIGTABLE = c.EnableBigtable
+	PUBLIC_READ = c.PublicRead
+	BIGTABLE_PROJECT = c.BigtableProject
+	BIGTABLE_INSTANCE = c.BigtableInstance
+	BIGTABLE_TABLE = c.BigtableTable
+	BIGTABLE_CREDENTIALS = c.BigtableCredentials
+	STORAGE_BACKEND = c.StorageBackend
+	S3_BUCKET = c.S3Bucket
+	S3_REGION = c.S3Region
+	LOCAL_STORAGE_DIR = c.LocalStorageDir
+	LOCAL_MEDIA_URL = c.LocalMediaURL
+	SIGNED_MEDIA_URLS = c.SignedMediaURLs
+	SIGNED_URL_EXPIRY, _ = time.ParseDuration(c.SignedURLExpiry)
+	ASYNC_MEDIA_UPLOAD = c.AsyncMediaUpload
+	MEDIA_UPLOAD_WORKERS = c.MediaUploadWorkers
+	INGEST_QUEUE = c.IngestQueue
+	INGEST_WORKERS = c.IngestWorkers
+	PUBSUB_PROJECT = c.PubSubProject
+	PUBSUB_TOPIC = c.PubSubTopic
+	PUBSUB_SUBSCRIPTION = c.PubSubSubscription
+	POST_STORE_BACKEND = c.PostStoreBackend
+	OPENSEARCH_URL = c.OpenSearchURL
+	INDEX_CODEC = c.IndexCodec
+	MODERATION_ENGINE = c.ModerationEngine
+	MODERATION_SOURCE = c.ModerationSource
+	MODERATION_API_URL = c.ModerationAPIURL
+	MODERATION_API_KEY = c.ModerationAPIKey
+	MODERATION_THRESHOLD = c.ModerationThreshold
+	IMAGE_ANALYZER = c.ImageAnalyzer
+	VISION_API_URL = c.VisionAPIURL
+	VISION_API_KEY = c.VisionAPIKey
+	GEOCODER = c.Geocoder
+	GOOGLE_MAPS_API_KEY = c.GoogleMapsAPIKey
+	MAILER = c.Mailer
+	MAIL_FROM = c.MailFrom
+	SMTP_ADDR = c.SMTPAddr
+	SMTP_USERNAME = c.SMTPUsername
+	SMTP_PASSWORD = c.SMTPPassword
+	SENDGRID_API_KEY = c.SendGridAPIKey
+	VERIFY_URL = c.VerifyURL
+	PASSWORD_RESET_URL = c.PasswordResetURL
+	OAUTH_BASE_URL = c.OAuthBaseURL
+	GOOGLE_CLIENT_ID = c.GoogleClientID
+	GOOGLE_CLIENT_SECRET = c.GoogleClientSecret
+	GITHUB_CLIENT_ID = c.GitHubClientID
+	GITHUB_CLIENT_SECRET = c.GitHubClientSecret
+	FCM_PROJECT_ID = c.FCMProjectID
+	APNS_KEY_FILE = c.APNSKeyFile
+	APNS_KEY_ID = c.APNSKeyID
+	APNS_TEAM_ID = c.APNSTeamID
+	APNS_TOPIC = c.APNSTopic
+	APNS_SANDBOX = c.APNSSandbox
+	PUSH_WORKERS = c.PushWorkers
+	ANALYTICS_SINK = c.AnalyticsSink
+	BIGQUERY_PROJECT = c.BigQueryProject
+	BIGQUERY_DATASET = c.BigQueryDataset
+	BIGQUERY_TABLE = c.BigQueryTable
+	RETRY_ATTEMPTS = c.RetryAttempts
+	RETRY_MIN_BACKOFF, _ = time.ParseDuration(c.RetryMinBackoff)
+	RETRY_MAX_BACKOFF, _ = time.ParseDuration(c.RetryMaxBackoff)
+	BREAKER_FAILURES = c.BreakerFailures
+	BREAKER_OPEN_DURATION, _ = time.ParseDuration(c.BreakerOpenDuration)
+	SIGNING_KEYS_FILE = c.SigningKeysFile
+	signingKeys.set(c.SigningKeys, c.legacySigningKey())
+	CORS_ALLOWED_ORIGINS = c.CORSAllowedOrigins
+	MAX_UPLOAD_BYTES = c.MaxUploadBytes
+	MAX_IMAGE_BYTES = c.MaxImageBytes
+	REDIS_URL = c.RedisURL
+	SEARCH_CACHE_TTL, _ = time.ParseDuration(c.SearchCacheTTL)
+	POST_DAILY_LIMIT = c.PostDailyLimit
+	POST_COOLDOWN, _ = time.ParseDuration(c.PostCooldown)
+	for name, enabled := range c.Flags {
+		defaultFlags[name] = enabled
+	}
+}
+
+// legacySigningKey is the key of tokens without a key id. Once keys with
+// an id are set up, the default key is no longer trusted.
+func (c *ServiceConfig) legacySigningKey() string {
+	if (len(c.SigningKeys) > 0 || c.SigningKeysFile != "") && c.SigningKey == SECRET {
+		return ""
+	}
+	return c.SigningKey
+}
+
+// effectiveConfig describes the configuration the running service uses.
+// Secrets are never included: the signing key and credential paths are
+// replaced with REDACTED and passwords are stripped from URLs.
+func effectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"elasticsearch": map[string]interface{}{
+			"url":                 redactURL(ES_URL),
+			"post_index":          POST_INDEX,
+			"user_index":          USER_INDEX,
+			"index_codec":         INDEX_CODEC,
+			"routing_mode":        ROUTING_MODE,
+			"slow_query_ms":       SLOW_QUERY_THRESHOLD_MS,
+			"write_batching":      ENABLE_WRITE_BATCHING,
+			"write_batch_size":    WRITE_BATCH_MAX_SIZE,
+			"write_batch_delay":   WRITE_BATCH_MAX_DELAY.String(),
+			"forcemerge":          ENABLE_FORCEMERGE,
+			"forcemerge_interval": FORCEMERGE_INTERVAL.String(),
+		},
+		"storage": map[string]interface{}{
+			"backend":           STORAGE_BACKEND,
+			"gcs_bucket":        BUCKET_NAME,
+			"s3_bucket":         S3_BUCKET,
+			"s3_region":         S3_REGION,
+			"local_dir":         LOCAL_STORAGE_DIR,
+			"local_media_url":   LOCAL_MEDIA_URL,
+			"signed_urls":       SIGNED_MEDIA_URLS,
+			"signed_url_expiry": SIGNED_URL_EXPIRY.String(),
+			"async_upload":      ASYNC_MEDIA_UPLOAD,
+			"upload_workers":    MEDIA_UPLOAD_WORKERS,
+		},
+		"ingest": map[string]interface{}{
+			"queue":               INGEST_QUEUE,
+			"workers":             INGEST_WORKERS,
+			"pubsub_project":      PUBSUB_PROJECT,
+			"pubsub_topic":        PUBSUB_TOPIC,
+			"pubsub_subscription": PUBSUB_SUBSCRIPTION,
+		},
+		"posts": map[string]interface{}{
+			"store_backend":      POST_STORE_BACKEND,
+			"opensearch_url":     redactURL(OPENSEARCH_URL),
+			"default_distance":   DISTANCE,
+			"geo_distance_type":  GEO_DISTANCE_TYPE,
+			"geo_plane_fastpath": ENABLE_GEO_PLANE_FAST_PATH,
+			"fuzz_radius_meters": LOCATION_FUZZ_RADIUS_METERS,
+			"filter_mode":        FILTER_MODE,
+			"heatmap_max_cells":  HEATMAP_MAX_BUCKETS,
+		},
+		"search_cache": map[string]interface{}{
+			"redis_url": redactURL(REDIS_URL),
+			"ttl":       SEARCH_CACHE_TTL.String(),
+		},
+		"post_quota": map[string]interface{}{
+			"daily_limit": POST_DAILY_LIMIT,
+			"cooldown":    POST_COOLDOWN.String(),
+		},
+		"moderation": map[string]interface{}{
+			"engine":    MODERATION_ENGINE,
+			"source":    MODERATION_SOURCE,
+			"api_url":   redactURL(MODERATION_API_URL),
+			"api_key":   REDACTED,
+			"threshold": MODERATION_THRESHOLD,
+		},
+		"resilience": map[string]interface{}{
+			"retry_attempts":        RETRY_ATTEMPTS,
+			"retry_min_backoff":     RETRY_MIN_BACKOFF.String(),
+			"retry_max_backoff":     RETRY_MAX_BACKOFF.String(),
+			"breaker_failures":      BREAKER_FAILURES,
+			"breaker_open_duration": BREAKER_OPEN_DURATION.String(),
+		},
+		"images": map[string]interface{}{
+			"analyzer":       IMAGE_ANALYZER,
+			"vision_api_url": redactURL(VISION_API_URL),
+			"vision_api_key": REDACTED,
+		},
+		"mail": map[string]interface{}{
+			"mailer":             MAILER,
+			"from":               MAIL_FROM,
+			"smtp_addr":          SMTP_ADDR,
+			"smtp_username":      SMTP_USERNAME,
+			"smtp_password":      REDACTED,
+			"sendgrid_api_key":   REDACTED,
+			"verify_url":         VERIFY_URL,
+			"password_reset_url": PASSWORD_RESET_URL,
+		},
+		"oauth": map[string]interface{}{
+			"base_url":             OAUTH_BASE_URL,
+			"google_client_id":     GOOGLE_CLIENT_ID,
+			"google_client_secret": REDACTED,
+			"github_client_id":     GITHUB_CLIENT_ID,
+			"github_client_secret": REDACTED,
+		},
+		"push": map[string]interface{}{
+			"fcm_project_id": FCM_PROJECT_ID,
+			"apns_key_file":  APNS_KEY_FILE,
+			"apns_key_id":    APNS_KEY_ID,
+			"apns_team_id":   APNS_TEAM_ID,
+			"apns_topic":     APNS_TOPIC,
+			"apns_sandbox":   APNS_SANDBOX,
+			"workers":        PUSH_WORKERS,
+			"nearby_range":   PUSH_NEARBY_RANGE,
+		},
+		"analytics": map[string]interface{}{
+			"sink":             ANALYTICS_SINK,
+			"bigquery_project": BIGQUERY_PROJECT,
+			"bigquery_dataset": BIGQUERY_DATASET,
+			"bigquery_table":   BIGQUERY_TABLE,
+		},
+		"limits": map[string]interface{}{
+			"default_page_size":   DEFAULT_PAGE_SIZE,
+			"max_page_size":       MAX_PAGE_SIZE,
+			"max_users_per_query": MAX_USERS_PER_QUERY,
+			"bulk_tag_max_docs":   BULK_TAG_MAX_DOCS,
+			"max_delta_batch":     MAX_DELTA_BATCH,
+			"max_upload_bytes":    MAX_UPLOAD_BYTES,
+			"max_image_bytes":     MAX_IMAGE_BYTES,
+			"max_image_dimension": MAX_IMAGE_DIMENSION,
+		},
+		"geocoding": map[string]interface{}{
+			"geocoder":            GEOCODER,
+			"url":                 redactURL(GEOCODER_URL),
+			"google_maps_api_key": REDACTED,
+			"cache_ttl":           GEOCODE_CACHE_TTL.String(),
+		},
+		"archive": map[string]interface{}{
+			"enabled":    ENABLE_ARCHIVAL,
+			"after_days": ARCHIVE_AFTER_DAYS,
+			"interval":   ARCHIVE_INTERVAL.String(),
+			"media":      ARCHIVE_MEDIA,
+		},
+		"flags": flags.states(),
+		"cors": map[string]interface{}{
+			"allowed_origins": CORS_ALLOWED_ORIGINS,
+			"allowed_methods": CORS_ALLOWED_METHODS,
+			"allowed_headers": CORS_ALLOWED_HEADERS,
+		},
+		"features": map[string]interface{}{
+			"bigtable":    ENABLE_BIGTABLE,
+			"public_read": PUBLIC_READ,
+		},
+		"bigtable": map[string]interface{}{
+			"project":     BIGTABLE_PROJECT,
+			"instance":    BIGTABLE_INSTANCE,
+			"table":       BIGTABLE_TABLE,
+			"credentials": BIGTABLE_CREDENTIALS,
+		},
+		"clients": map[string]interface{}{
+			"min_version": MIN_CLIENT_VERSION,
+			"sample_rate": CLIENT_VERSION_SAMPLE_RATE,
+		},
+		"auth": signingKeysConfig(),
+	}
+}
+
+// signingKeysConfig describes the signing keys by id only.
+func signingKeysConfig() map[string]interface{} {
+	active, ids := signingKeys.ids()
+	sort.Strings(ids)
+	return map[string]interface{}{
+		"signing_key":        REDACTED,
+		"signing_key_ids":    ids,
+		"active_signing_key": active,
+		"signing_keys_file":  SIGNING_KEYS_FILE,
+	}
+}
+
+// redactURL removes the password from a URL with credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return REDACTED
+	}
+	if u.User != nil {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// handleConfig returns the sanitized effective configuration to admins.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for config")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+
+	js, err := json.Marshal(effectiveConfig())
+	if err != nil {
+		http.Error(w, "Failed to parse config into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse config into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestConfigFlags checks the loaded flags only: apply would change the
+// defaults of the other tests.
+func TestConfigFlags(t *testing.T) {
+	t.Setenv(CONFIG_ENV_PREFIX+"FLAGS", "heatmap=false, archival=true")
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{FLAG_HEATMAP: false, FLAG_ARCHIVAL: true}
+	if !reflect.DeepEqual(c.Flags, want) {
+		t.Errorf("flags = %v, want %v", c.Flags, want)
+	}
+
+	for _, val := range []string{"teleport=true", "heatmap", "heatmap=maybe"} {
+		t.Setenv(CONFIG_ENV_PREFIX+"FLAGS", val)
+		if _, err := loadConfig(""); err == nil {
+			t.Errorf("%sFLAGS=%s loaded, want an error", CONFIG_ENV_PREFIX, val)
+		}
+	}
+}
+
+func TestConfigPublicRead(t *testing.T) {
+	t.Setenv(CONFIG_ENV_PREFIX+"PUBLIC_READ", "true")
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.PublicRead {
+		t.Errorf("%sPUBLIC_READ=true loaded public_read %v", CONFIG_ENV_PREFIX, c.PublicRead)
+	}
+
+	t.Setenv(CONFIG_ENV_PREFIX+"PUBLIC_READ", "sometimes")
+	if _, err := loadConfig(""); err == nil {
+		t.Errorf("%sPUBLIC_READ=sometimes loaded, want an error", CONFIG_ENV_PREFIX)
+	}
+}
+
+// TestPublicReadRoutes checks that the routes use the loaded public_read.
+func TestPublicReadRoutes(t *testing.T) {
+	saved := PUBLIC_READ
+	t.Cleanup(func() { PUBLIC_READ = saved })
+
+	for _, public := range []bool{false, true} {
+		PUBLIC_READ = public
+		s := newTestServer(t)
+		w := s.do(httptest.NewRequest("GET", "/search?lat=37.5&lon=-122.1", nil))
+		if got := w.Code != http.StatusUnauthorized; got != public {
+			t.Errorf("public_read %v: GET /search without a token = %d", public, w.Code)
+		}
+	}
+}
+
+func TestConfigIndexCodec(t *testing.T) {
+	saved := INDEX_CODEC
+	t.Cleanup(func() { INDEX_CODEC = saved })
+
+	t.Setenv(CONFIG_ENV_PREFIX+"INDEX_CODEC", "best_compression")
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	INDEX_CODEC = c.IndexCodec
+	// the post index, also when migrated, is created with postMapping
+	if !strings.Contains(postMapping(), `"index.codec": "best_compression"`) {
+		t.Errorf("postMapping() = %s, want the configured codec", postMapping())
+	}
+
+	t.Setenv(CONFIG_ENV_PREFIX+"INDEX_CODEC", "lz4")
+	if _, err := loadConfig(""); err == nil {
+		t.Errorf("%sINDEX_CODEC=lz4 loaded, want an error", CONFIG_ENV_PREFIX)
+	}
+}
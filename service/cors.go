@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is handled for the whole router by corsMiddleware. Allowed origins
+// come from the cors_allowed_origins setting ("*" allows any origin);
+// the methods and headers browsers may use are below.
+const (
+	CORS_ALLOWED_METHODS = "GET,POST,PUT,DELETE,OPTIONS"
+	CORS_ALLOWED_HEADERS = "Content-Type,Authorization,Accept,X-Client-Version,X-Request-ID"
+	CORS_EXPOSED_HEADERS = "X-API-Version,X-Total-Count,X-Request-ID,X-Min-Client-Version,Retry-After"
+	CORS_MAX_AGE         = 10 * time.Minute
+)
+
+// CORS_ALLOWED_ORIGINS is set from the configuration at startup.
+var CORS_ALLOWED_ORIGINS = []string{"*"}
+
+// corsMiddleware adds the CORS headers to every response and answers
+// preflight requests itself. It wraps the router rather than being a mux
+// middleware, since the router rejects OPTIONS on routes that don't list
+// it before any mux middleware runs.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := corsAllowedOrigin(origin)
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+			if allowed != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed != "" {
+				w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+				w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORS_MAX_AGE/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for
+// origin, or "" if it is not allowed.
+func corsAllowedOrigin(origin string) string {
+	for _, allowed := range CORS_ALLOWED_ORIGINS {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
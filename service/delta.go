@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// MAX_DELTA_BATCH caps how many changed posts one /posts/delta call returns;
+// clients follow the continuation token for the rest.
+const MAX_DELTA_BATCH = 200
+
+// Delta is the response of GET /posts/delta. Clients store HighWaterMark
+// once HasMore is false and pass it as `since` on their next sync.
+// Deleted lists the posts moved to the trash since then, which clients
+// should drop; a client that doesn't sync for TRASH_RETENTION may miss
+// them once they are purged.
+type Delta struct {
+	Posts         []Post      `json:"posts"`
+	Deleted       []Tombstone `json:"deleted"`
+	HighWaterMark time.Time   `json:"high_water_mark"`
+	HasMore       bool        `json:"has_more"`
+	Continuation  string      `json:"continuation,omitempty"`
+}
+
+// Tombstone is a deleted post in a Delta.
+type Tombstone struct {
+	Id        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// deltaCursor is the position after the last returned post, ordered by
+// (updated_at, id) so posts updated in the same millisecond aren't lost
+// between batches.
+type deltaCursor struct {
+	UpdatedAt int64  `json:"u"`
+	Id        string `json:"i"`
+}
+
+// parseTimeParam reads the query parameter name, which accepts RFC 3339
+// timestamps and epoch milliseconds.
+func parseTimeParam(name, val string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+		return t, nil
+	}
+	millis, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New(name + " should be an RFC 3339 timestamp or epoch milliseconds")
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC(), nil
+}
+
+func encodeCursor(c *deltaCursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(val string) (*deltaCursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, errors.New("Invalid continuation token")
+	}
+	var c deltaCursor
+	if err := json.Unmarshal(js, &c); err != nil || c.Id == "" {
+		return nil, errors.New("Invalid continuation token")
+	}
+	return &c, nil
+}
+
+// handlePostsDelta returns the posts in an area created, changed or deleted
+// after `since`, oldest change first.
+func handlePostsDelta(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for posts delta")
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	since, err := parseTimeParam("since", query.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cursor *deltaCursor
+	if val := query.Get("continuation"); val != "" {
+		if cursor, err = decodeCursor(val); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	loc, err := parseLocation(query.Get("lat"), query.Get("lon"))
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+	ran, err := rangeParam(r)
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	delta, err := readDeltaFromES(loc.Lat, loc.Lon, ran, hidden, since, cursor)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+	redactPosts(delta.Posts, viewerName(r))
+	signMediaURLs(delta.Posts)
+
+	js, err := json.Marshal(delta)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func readDeltaFromES(lat, lon float64, ran string, hidden []string, since time.Time, cursor *deltaCursor) (*Delta, error) {
+	client := esClient
+
+	// the public posts and, as tombstones, the deleted ones that were
+	// public before, of the authors the caller didn't hide
+	query := excludeUsers(elastic.NewBoolQuery().
+		Filter(newGeoDistanceQuery(lat, lon, ran)).
+		Filter(elastic.NewRangeQuery("updated_at").Gt(since.Format(time.RFC3339Nano))).
+		Should(
+			publicPostsQuery(elastic.NewMatchAllQuery()),
+			elastic.NewBoolQuery().
+				Filter(elastic.NewExistsQuery("deleted_at")).
+				MustNot(
+					elastic.NewTermQuery("status", STATUS_DRAFT),
+					elastic.NewTermQuery("status", STATUS_SCHEDULED),
+				),
+		).
+		MinimumNumberShouldMatch(1), hidden)
+
+	search := client.Search().
+		Index(POST_INDEX).
+		Query(query).
+		Sort("updated_at", true).
+		Sort("id", true).
+		Size(MAX_DELTA_BATCH)
+	if cursor != nil {
+		search = search.SearchAfter(cursor.UpdatedAt, cursor.Id)
+	}
+
+	searchResult, err := search.Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "search", searchResult.TookInMillis, map[string]interface{}{"lat": lat, "lon": lon, "range": ran, "since": since})
+
+	delta := &Delta{Posts: []Post{}, Deleted: []Tombstone{}, HighWaterMark: since}
+	for _, p := range decodePosts(searchResult) {
+		if p.DeletedAt != nil {
+			delta.Deleted = append(delta.Deleted, Tombstone{Id: p.Id, DeletedAt: *p.DeletedAt})
+			continue
+		}
+		// filter spam
+		if screenPost(&p) {
+			delta.Posts = append(delta.Posts, p)
+		}
+	}
+
+	var hits []*elastic.SearchHit
+	if searchResult.Hits != nil {
+		hits = searchResult.Hits.Hits
+	}
+	if len(hits) > 0 {
+		last := hits[len(hits)-1]
+		var lastPost Post
+		if last.Source != nil && json.Unmarshal(last.Source, &lastPost) == nil && lastPost.UpdatedAt.After(since) {
+			delta.HighWaterMark = lastPost.UpdatedAt
+		}
+		if len(hits) == MAX_DELTA_BATCH {
+			delta.HasMore = true
+			delta.Continuation = encodeCursor(&deltaCursor{
+				UpdatedAt: lastPost.UpdatedAt.UnixNano() / int64(time.Millisecond),
+				Id:        last.Id,
+			})
+		}
+	}
+	return delta, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// handleMyPosts lists the caller's own posts, drafts included.
+func handleMyPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for my posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+
+	page, err := readPostsByUsersFromES([]string{claims.Username}, true, nil, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// handleDrafts lists the caller's drafts, most recently updated first.
+func handleDrafts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for drafts")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	page, err := readDraftsFromES(claims.Username, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read drafts from ElasticSearch %v.\n", err)
+		return
+	}
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+func readDraftsFromES(user string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewBoolQuery().
+			Filter(
+				elastic.NewTermQuery("user", user),
+				elastic.NewTermQuery("status", STATUS_DRAFT)).
+			MustNot(elastic.NewExistsQuery("deleted_at"))).
+		SortBy(elastic.NewFieldSort("updated_at").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "drafts", searchResult.TookInMillis, map[string]interface{}{"user": user, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  decodePosts(searchResult),
+	}
+	if page.Posts == nil {
+		page.Posts = []Post{}
+	}
+	return page, nil
+}
+
+// handlePublishPost makes one of the caller's drafts visible to everyone.
+func (a *App) handlePublishPost(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for publishing a post")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err == nil && p.DeletedAt != nil {
+		// in the trash, restore it first
+		err = errPostNotFound
+	}
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return
+	}
+
+	if p.User != claims.Username {
+		http.Error(w, "Only the author can publish a post", http.StatusForbidden)
+		fmt.Printf("%s tried to publish post %s of %s\n", claims.Username, id, p.User)
+		return
+	}
+
+	if p.Status != STATUS_DRAFT && p.Status != STATUS_SCHEDULED {
+		w.Write([]byte("Post is already published."))
+		return
+	}
+
+	// scheduled posts are published now instead
+	p.Status = STATUS_PUBLISHED
+	p.PublishAt = nil
+	p.UpdatedAt = time.Now().UTC()
+	if err := a.Posts.Save(r.Context(), id, p); err != nil {
+		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to publish post %s %v.\n", id, err)
+		return
+	}
+	fmt.Printf("Published post %s\n", id)
+	a.announcePost(r.Context(), p)
+
+	w.Write([]byte("Post published successfully."))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// The ElasticSearch client is created once at startup and shared by every
+// request; it keeps a pool of HTTP connections to the cluster. Failed
+// requests are retried with exponential backoff, and a background health
+// check takes unreachable nodes out of rotation.
+const (
+	ES_CONNECT_ATTEMPTS        = 10
+	ES_RETRY_MIN_BACKOFF       = 100 * time.Millisecond
+	ES_RETRY_MAX_BACKOFF       = 5 * time.Second
+	ES_HEALTHCHECK_INTERVAL    = 30 * time.Second
+	ES_MAX_IDLE_CONNS_PER_HOST = 32
+)
+
+// esClient is the shared client, set by connectES.
+var esClient *elastic.Client
+
+// connectES creates the shared client, waiting with backoff for the
+// cluster to come up.
+func connectES() (*elastic.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = ES_MAX_IDLE_CONNS_PER_HOST
+
+	backoff := elastic.NewExponentialBackoff(ES_RETRY_MIN_BACKOFF, ES_RETRY_MAX_BACKOFF)
+	var lastErr error
+	for attempt := 1; attempt <= ES_CONNECT_ATTEMPTS; attempt++ {
+		client, err := elastic.NewClient(
+			elastic.SetURL(ES_URL),
+			elastic.SetSniff(false),
+			elastic.SetHttpClient(&http.Client{Transport: transport}),
+			elastic.SetRetrier(elastic.NewBackoffRetrier(backoff)),
+			elastic.SetHealthcheck(true),
+			elastic.SetHealthcheckInterval(ES_HEALTHCHECK_INTERVAL),
+		)
+		if err == nil {
+			esClient = client
+			return client, nil
+		}
+		lastErr = err
+
+		wait, _ := backoff.Next(attempt)
+		fmt.Printf("Failed to connect to ElasticSearch at %s (attempt %d/%d) %v.\n", ES_URL, attempt, ES_CONNECT_ATTEMPTS, err)
+		time.Sleep(wait)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// POST_PROPERTIES are the fields of the post mapping, shared by the
+// PostStore backends.
+const POST_PROPERTIES = `{
+    "user": {
+        "type": "keyword"
+    },
+    "location": {
+        "type": "geo_point"
+    },
+    "city": {
+        "type": "keyword"
+    },
+    "neighborhood": {
+        "type": "keyword"
+    },
+    "id": {
+        "type": "keyword"
+    },
+    "timestamp": {
+        "type": "date"
+    },
+    "updated_at": {
+        "type": "date"
+    },
+    "expires_at": {
+        "type": "date"
+    },
+    "deleted_at": {
+        "type": "date"
+    },
+    "publish_at": {
+        "type": "date"
+    },
+    "channel": {
+        "type": "keyword"
+    },
+    "tags": {
+        "type": "keyword"
+    },
+    "hashtags": {
+        "type": "keyword"
+    },
+    "status": {
+        "type": "keyword"
+    },
+    "lang": {
+        "type": "keyword"
+    },
+    "media_type": {
+        "type": "keyword"
+    },
+    "restored": {
+        "type": "boolean"
+    },
+    "masked": {
+        "type": "boolean"
+    },
+    "hidden": {
+        "type": "boolean"
+    },
+    "labels": {
+        "type": "keyword"
+    },
+    "faces": {
+        "type": "integer"
+    },
+    "like_count": {
+        "type": "long"
+    },
+    "comment_count": {
+        "type": "long"
+    },
+    "image_flags": {
+        "type": "keyword"
+    },
+    "external": {
+        "type": "boolean"
+    },
+    "media_state": {
+        "type": "keyword"
+    },
+    "exact_location": {
+        "type": "object",
+        "enabled": false
+    },
+    "thumbnails": {
+        "type": "object",
+        "enabled": false
+    },
+    "images": {
+        "type": "object",
+        "enabled": false
+    }
+}`
+
+// postMapping is the body the post index is created with.
+func postMapping() string {
+	return `{
+            "settings": {
+                "index.codec": "` + INDEX_CODEC + `"
+            },
+            "mappings": {
+                "properties": ` + POST_PROPERTIES + `
+            }
+		}`
+}
+
+// esIndex is an index the service keeps in ElasticSearch and the body it is
+// created with, "" for dynamic mappings.
+type esIndex struct {
+	name    string
+	mapping string
+}
+
+// esIndexes lists the indexes createIndexIfNotExist creates and
+// migrateIndexes copies.
+func esIndexes() []esIndex {
+	return []esIndex{
+		{POST_INDEX, postMapping()},
+		{USER_INDEX, ""},
+		{AUDIT_INDEX, AUDIT_MAPPING},
+		{CLIENT_INDEX, CLIENT_MAPPING},
+		{NOTIFICATION_INDEX, NOTIFICATION_MAPPING},
+		{MEDIA_REF_INDEX, MEDIA_REF_MAPPING},
+		{ARCHIVE_INDEX, ARCHIVE_MAPPING},
+		{FLAG_INDEX, ""},
+		{REFRESH_TOKEN_INDEX, REFRESH_TOKEN_MAPPING},
+		{LIKE_INDEX, LIKE_MAPPING},
+		{COMMENT_INDEX, COMMENT_MAPPING},
+		{CHANNEL_INDEX, CHANNEL_MAPPING},
+		{MESSAGE_INDEX, MESSAGE_MAPPING},
+		{CONVERSATION_INDEX, CONVERSATION_MAPPING},
+		{FOLLOW_INDEX, FOLLOW_MAPPING},
+		{BLOCK_INDEX, BLOCK_MAPPING},
+		{BAN_INDEX, BAN_MAPPING},
+		{MODERATION_INDEX, MODERATION_MAPPING},
+		{REPORT_INDEX, REPORT_MAPPING},
+		{UPLOAD_INDEX, UPLOAD_MAPPING},
+		{OAUTH_IDENTITY_INDEX, OAUTH_IDENTITY_MAPPING},
+		{DEVICE_INDEX, DEVICE_MAPPING},
+	}
+}
+
+func createIndexIfNotExist() {
+	client := esClient
+
+	// the codec of an existing post index can't change in place
+	exists, err := client.IndexExists(POST_INDEX).Do(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if exists {
+		checkIndexCodec(client, POST_INDEX)
+		updatePostMapping(client)
+	}
+
+	for _, index := range esIndexes() {
+		createIndexIfMissing(client, index.name, index.mapping)
+	}
+}
+
+// checkIndexCodec warns when an existing index was created with a codec
+// other than the configured INDEX_CODEC, since the codec can't be changed
+// in place.
+func checkIndexCodec(client *elastic.Client, index string) {
+	resp, err := client.IndexGetSettings(index).Name("index.codec").Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to read settings of index %s %v.\n", index, err)
+		return
+	}
+
+	// resp is keyed by the concrete index, which differs from index once it
+	// is an alias, see migrateIndexes
+	codec := "default"
+	for _, settings := range resp {
+		if indexSettings, ok := settings.Settings["index"].(map[string]interface{}); ok {
+			if val, ok := indexSettings["codec"].(string); ok {
+				codec = val
+			}
+		}
+	}
+	if codec != INDEX_CODEC {
+		fmt.Printf("Index %s uses codec %q but index_codec is %q; reindex it to apply the new codec\n", index, codec, INDEX_CODEC)
+	}
+}
+
+// updatePostMapping adds fields added to POST_PROPERTIES since the post
+// index was created, so they aren't mapped dynamically on first write.
+func updatePostMapping(client *elastic.Client) {
+	_, err := client.PutMapping().
+		Index(POST_INDEX).
+		BodyString(`{"properties": ` + POST_PROPERTIES + `}`).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to update mapping of index %s %v.\n", POST_INDEX, err)
+	}
+}
+
+// createIndexIfMissing creates index with the optional mapping body unless
+// it already exists.
+func createIndexIfMissing(client *elastic.Client, index, mapping string) {
+	exists, err := client.IndexExists(index).Do(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if exists {
+		return
+	}
+
+	service := client.CreateIndex(index)
+	if mapping != "" {
+		service = service.Body(mapping)
+	}
+	if _, err := service.Do(context.Background()); err != nil {
+		panic(err)
+	}
+}
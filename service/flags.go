@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Feature flags gate features at runtime. Every flag has a default below,
+// which the flags of the ServiceConfig replace at startup; admins override
+// it with POST /admin/flags/{name}. Overrides are stored in
+// the flag index and every instance reloads them each FLAG_REFRESH_INTERVAL,
+// so a change reaches the whole fleet without a redeploy.
+const (
+	FLAG_LIVE         = "live"         // SSE stream on /live
+	FLAG_PLACE_SEARCH = "place_search" // place= on /search
+	FLAG_HEATMAP      = "heatmap"      // /heatmap
+	FLAG_ARCHIVAL     = "archival"     // background archival of old posts
+
+	FLAG_INDEX            = "flag"
+	FLAG_REFRESH_INTERVAL = 30 * time.Second
+)
+
+var defaultFlags = map[string]bool{
+	FLAG_LIVE:         true,
+	FLAG_PLACE_SEARCH: true,
+	FLAG_HEATMAP:      true,
+	FLAG_ARCHIVAL:     ENABLE_ARCHIVAL,
+}
+
+// flagNames returns the names of the known flags, sorted.
+func flagNames() []string {
+	names := make([]string, 0, len(defaultFlags))
+	for name := range defaultFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FlagOverride is a stored override; its document id is the flag name.
+type FlagOverride struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FlagState is the JSON shape of a flag in GET /admin/flags.
+type FlagState struct {
+	Name     string        `json:"name"`
+	Enabled  bool          `json:"enabled"`
+	Default  bool          `json:"default"`
+	Override *FlagOverride `json:"override,omitempty"`
+}
+
+// FeatureFlags holds the overrides loaded from the flag index.
+type FeatureFlags struct {
+	mu        sync.RWMutex
+	overrides map[string]*FlagOverride
+}
+
+var flags = &FeatureFlags{overrides: make(map[string]*FlagOverride)}
+
+// Enabled reports whether the flag name is on. Unknown flags are off.
+func (f *FeatureFlags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if o, ok := f.overrides[name]; ok {
+		return o.Enabled
+	}
+	return defaultFlags[name]
+}
+
+func (f *FeatureFlags) states() []*FlagState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var states []*FlagState
+	for name, def := range defaultFlags {
+		state := &FlagState{Name: name, Enabled: def, Default: def}
+		if o, ok := f.overrides[name]; ok {
+			state.Enabled = o.Enabled
+			state.Override = o
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// load replaces the overrides with the ones stored in the flag index.
+func (f *FeatureFlags) load() error {
+	client := esClient
+
+	ctx := context.Background()
+	overrides := make(map[string]*FlagOverride)
+	scroll := client.Scroll(FLAG_INDEX).Size(100).KeepAlive("1m")
+	defer scroll.Clear(ctx)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var o FlagOverride
+			if hit.Source == nil || json.Unmarshal(hit.Source, &o) != nil {
+				continue
+			}
+			if _, known := defaultFlags[o.Name]; known {
+				overrides[o.Name] = &o
+			}
+		}
+	}
+
+	f.mu.Lock()
+	f.overrides = overrides
+	f.mu.Unlock()
+	return nil
+}
+
+// set stores an override and applies it locally right away.
+func (f *FeatureFlags) set(o *FlagOverride) error {
+	client := esClient
+	_, err := client.Index().
+		Index(FLAG_INDEX).
+		Id(o.Name).
+		BodyJson(o).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.overrides[o.Name] = o
+	f.mu.Unlock()
+	return nil
+}
+
+// startFlagRefresher loads the overrides now and every FLAG_REFRESH_INTERVAL.
+func startFlagRefresher() {
+	if err := flags.load(); err != nil {
+		fmt.Printf("Failed to load feature flags %v.\n", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(FLAG_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := flags.load(); err != nil {
+				fmt.Printf("Failed to load feature flags %v.\n", err)
+			}
+		}
+	}()
+}
+
+// requireFlag writes 503 and returns false when the flag name is off.
+func requireFlag(w http.ResponseWriter, name string) bool {
+	if flags.Enabled(name) {
+		return true
+	}
+	http.Error(w, "This feature is currently disabled", http.StatusServiceUnavailable)
+	return false
+}
+
+func handleGetFlags(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for feature flags")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+
+	js, err := json.Marshal(flags.states())
+	if err != nil {
+		http.Error(w, "Failed to parse flags into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse flags into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleSetFlag overrides one flag with a body such as {"enabled": false}.
+func handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for updating a feature flag")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if _, known := defaultFlags[name]; !known {
+		http.Error(w, "Unknown feature flag", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	o := &FlagOverride{Name: name, Enabled: *body.Enabled, UpdatedBy: claims.Username, UpdatedAt: time.Now().UTC()}
+	if err := flags.set(o); err != nil {
+		http.Error(w, "Failed to save feature flag", http.StatusInternalServerError)
+		fmt.Printf("Failed to save feature flag %s %v.\n", name, err)
+		return
+	}
+
+	writeAudit(claims.Username, "set_flag", map[string]interface{}{"name": name, "enabled": o.Enabled})
+	w.Write([]byte("Feature flag updated successfully."))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// The follow graph is kept in its own index, one document per edge.
+const (
+	FOLLOW_INDEX = "follow"
+
+	// MAX_FOLLOWING caps how many users one user can follow, which bounds
+	// the terms query of the feed.
+	MAX_FOLLOWING = 1000
+)
+
+const FOLLOW_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "follower": {
+                "type": "keyword"
+            },
+            "followee": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Follow records that Follower follows Followee. Its document id is
+// followId.
+type Follow struct {
+	Follower  string    `json:"follower"`
+	Followee  string    `json:"followee"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// followId is the document id of a follow edge. Usernames can't contain
+// ':'.
+func followId(follower, followee string) string {
+	return follower + ":" + followee
+}
+
+// handleFollow lets the caller follow a user. Following twice is a no-op.
+func handleFollow(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for following a user")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	followee := mux.Vars(r)["username"]
+	if followee == claims.Username {
+		http.Error(w, "You can't follow yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(followee); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read user from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", followee, err)
+		return
+	}
+
+	count, err := countFollowing(r.Context(), claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to read follows from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count follows of %s %v.\n", claims.Username, err)
+		return
+	}
+	if count >= MAX_FOLLOWING {
+		http.Error(w, "You can follow at most "+strconv.Itoa(MAX_FOLLOWING)+" users", http.StatusConflict)
+		return
+	}
+
+	created, err := saveFollow(r.Context(), &Follow{Follower: claims.Username, Followee: followee, Timestamp: time.Now().UTC()})
+	if err != nil {
+		http.Error(w, "Failed to save follow to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save follow of %s by %s %v.\n", followee, claims.Username, err)
+		return
+	}
+	if created {
+		fmt.Printf("%s followed %s\n", claims.Username, followee)
+		notify(followee, claims.Username, NOTIFY_FOLLOW, "")
+	}
+
+	w.Write([]byte("Followed " + followee + "."))
+}
+
+// handleUnfollow stops the caller following a user, if they did.
+func handleUnfollow(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for unfollowing a user")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	followee := mux.Vars(r)["username"]
+	client := esClient
+	_, err := client.Delete().
+		Index(FOLLOW_INDEX).
+		Id(followId(claims.Username, followee)).
+		Refresh("wait_for").
+		Do(r.Context())
+	if err != nil && !elastic.IsNotFound(err) {
+		http.Error(w, "Failed to delete follow from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete follow of %s by %s %v.\n", followee, claims.Username, err)
+		return
+	}
+
+	w.Write([]byte("Unfollowed " + followee + "."))
+}
+
+// saveFollow stores f and reports whether it is new. It is visible to the
+// feed before it returns.
+func saveFollow(ctx context.Context, f *Follow) (bool, error) {
+	client := esClient
+
+	_, err := client.Index().
+		Index(FOLLOW_INDEX).
+		Id(followId(f.Follower, f.Followee)).
+		OpType("create").
+		BodyJson(f).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func countFollowing(ctx context.Context, user string) (int64, error) {
+	client := esClient
+
+	return client.Count(FOLLOW_INDEX).
+		Query(elastic.NewTermQuery("follower", user)).
+		Do(ctx)
+}
+
+// readFollowing returns the users user follows.
+func readFollowing(ctx context.Context, user string) ([]string, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(FOLLOW_INDEX).
+		Query(elastic.NewTermQuery("follower", user)).
+		Size(MAX_FOLLOWING).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var following []string
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var f Follow
+			if hit.Source == nil || json.Unmarshal(hit.Source, &f) != nil {
+				continue
+			}
+			following = append(following, f.Followee)
+		}
+	}
+	return following, nil
+}
+
+// handleFeed returns the newest posts of the users the caller follows, and
+// their own. With lat and lon (and optionally range) posts near that point
+// are merged in.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for the feed")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	var nearby elastic.Query
+	if r.URL.Query().Get("lat") != "" || r.URL.Query().Get("lon") != "" {
+		lat, errLat := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		lon, errLon := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+		if errLat != nil || errLon != nil {
+			http.Error(w, "lat and lon should both be numbers", http.StatusBadRequest)
+			return
+		}
+		ran, err := rangeParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		nearby = newGeoDistanceQuery(lat, lon, ran)
+	}
+
+	following, err := readFollowing(r.Context(), claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to read follows from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read follows of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readFeedFromES(r.Context(), claims.Username, following, nearby, hidden, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read feed of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	redactPosts(page.Posts, claims.Username)
+	signMediaURLs(page.Posts)
+	if err := annotateLikes(r.Context(), page.Posts, claims.Username); err != nil {
+		fmt.Printf("Failed to read likes %v.\n", err)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// readFeedFromES returns the newest published posts written by user or any
+// of following, or matching nearby if set, but not by any of hidden.
+func readFeedFromES(ctx context.Context, user string, following []string, nearby elastic.Query, hidden []string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	authors := make([]interface{}, 0, len(following)+1)
+	authors = append(authors, user)
+	for _, followee := range following {
+		authors = append(authors, followee)
+	}
+	sources := elastic.NewBoolQuery().
+		Should(elastic.NewTermsQuery("user", authors...)).
+		MinimumNumberShouldMatch(1)
+	if nearby != nil {
+		sources.Should(nearby)
+	}
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(publicPostsQuery(excludeUsers(sources, hidden))).
+		SortBy(elastic.NewFieldSort("timestamp").Desc().Missing("_last")).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"feed": user, "following": len(following), "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if screenPost(&p) {
+			page.Posts = append(page.Posts, p)
+		}
+	}
+	return page, nil
+}
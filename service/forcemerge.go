@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Periodic force-merge of the post index. Merging segments down after a
+// write-heavy period keeps read latency stable, but it is I/O heavy, so it
+// is off by default and only runs inside the low-traffic window (UTC hours,
+// start inclusive, end exclusive).
+const (
+	ENABLE_FORCEMERGE            = false
+	FORCEMERGE_INTERVAL          = 24 * time.Hour
+	FORCEMERGE_CHECK_INTERVAL    = 10 * time.Minute
+	FORCEMERGE_MAX_NUM_SEGMENTS  = 1
+	FORCEMERGE_WINDOW_START_HOUR = 3
+	FORCEMERGE_WINDOW_END_HOUR   = 5
+)
+
+// startForcemergeScheduler checks every FORCEMERGE_CHECK_INTERVAL whether a
+// merge is due and we are inside the low-traffic window, and runs one if so.
+func startForcemergeScheduler() {
+	if !ENABLE_FORCEMERGE {
+		return
+	}
+	fmt.Printf("Force-merge scheduler started, every %v between %02d:00 and %02d:00 UTC\n",
+		FORCEMERGE_INTERVAL, FORCEMERGE_WINDOW_START_HOUR, FORCEMERGE_WINDOW_END_HOUR)
+
+	go func() {
+		ticker := time.NewTicker(FORCEMERGE_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			lastRun, _ := stats.lastForcemerge()
+			if !inForcemergeWindow(now) || now.Sub(lastRun) < FORCEMERGE_INTERVAL {
+				continue
+			}
+			if err := forcemergePostIndex(); err != nil {
+				fmt.Printf("Failed to force-merge index %s %v.\n", POST_INDEX, err)
+			}
+		}
+	}()
+}
+
+func inForcemergeWindow(t time.Time) bool {
+	hour := t.UTC().Hour()
+	if FORCEMERGE_WINDOW_START_HOUR <= FORCEMERGE_WINDOW_END_HOUR {
+		return hour >= FORCEMERGE_WINDOW_START_HOUR && hour < FORCEMERGE_WINDOW_END_HOUR
+	}
+	// window wraps around midnight
+	return hour >= FORCEMERGE_WINDOW_START_HOUR || hour < FORCEMERGE_WINDOW_END_HOUR
+}
+
+func forcemergePostIndex() error {
+	client := esClient
+
+	start := time.Now()
+	fmt.Printf("Force-merge of index %s started\n", POST_INDEX)
+	_, err := client.Forcemerge(POST_INDEX).
+		MaxNumSegments(FORCEMERGE_MAX_NUM_SEGMENTS).
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	took := time.Since(start)
+	stats.recordForcemerge(start, took)
+	fmt.Printf("Force-merge of index %s finished in %v\n", POST_INDEX, took)
+	return nil
+}
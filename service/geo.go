@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Geo-distance query tuning.
+//
+// ElasticSearch computes distances either along the earth's surface ("arc",
+// exact but slower) or on a flat projection ("plane", much faster but
+// increasingly wrong over long distances and near the poles). We default to
+// arc for correctness. Enabling the plane fast path switches to plane only
+// for searches whose radius is at most GEO_PLANE_MAX_RANGE_KM, where the
+// error is well under a percent for city-scale searches.
+//
+// The validation method decides what happens to out-of-range coordinates in
+// the query: STRICT rejects them, COERCE normalizes them and
+// IGNORE_MALFORMED accepts them as is.
+const (
+	GEO_DISTANCE_TYPE          = "arc"
+	ENABLE_GEO_PLANE_FAST_PATH = false
+	GEO_PLANE_MAX_RANGE_KM     = 50.0
+	GEO_VALIDATION_METHOD      = "STRICT"
+)
+
+// geoDistanceQuery extends elastic.GeoDistanceQuery with the
+// validation_method option the client doesn't expose.
+type geoDistanceQuery struct {
+	*elastic.GeoDistanceQuery
+	validationMethod string
+}
+
+func (q *geoDistanceQuery) Source() (interface{}, error) {
+	src, err := q.GeoDistanceQuery.Source()
+	if err != nil {
+		return nil, err
+	}
+	if q.validationMethod != "" {
+		if source, ok := src.(map[string]interface{}); ok {
+			if params, ok := source["geo_distance"].(map[string]interface{}); ok {
+				params["validation_method"] = q.validationMethod
+			}
+		}
+	}
+	return src, nil
+}
+
+// newGeoDistanceQuery builds the query for posts within ran (e.g. "20km")
+// of lat/lon, tuned by the settings above.
+func newGeoDistanceQuery(lat, lon float64, ran string) elastic.Query {
+	query := elastic.NewGeoDistanceQuery("location").
+		Distance(ran).
+		Lat(lat).
+		Lon(lon).
+		DistanceType(geoDistanceType(ran))
+
+	return &geoDistanceQuery{GeoDistanceQuery: query, validationMethod: GEO_VALIDATION_METHOD}
+}
+
+func geoDistanceType(ran string) string {
+	if !ENABLE_GEO_PLANE_FAST_PATH {
+		return GEO_DISTANCE_TYPE
+	}
+	km, err := parseKm(ran)
+	if err != nil || km > GEO_PLANE_MAX_RANGE_KM {
+		return GEO_DISTANCE_TYPE
+	}
+	return "plane"
+}
+
+// parseKm parses a distance such as "20km" into km.
+func parseKm(ran string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(ran, "km"), 64)
+}
+
+// MAX_RANGE_KM bounds the range of a search; half the circumference of the
+// earth already covers all of it.
+const MAX_RANGE_KM = 20038.0
+
+var errInvalidRange = invalidParam(ERR_INVALID_RANGE, fmt.Sprintf("range should be a positive distance in m, km or mi, e.g. 500m or 3mi, of at most %gkm", MAX_RANGE_KM))
+
+// parseRange parses a range such as "500m", "20km" or "3mi", in km when it
+// has no unit, into the distance queries take, in km.
+func parseRange(val string) (string, error) {
+	val = strings.ToLower(strings.TrimSpace(val))
+	toKm := func(n float64) float64 { return n }
+	switch {
+	case strings.HasSuffix(val, "km"):
+		val = strings.TrimSuffix(val, "km")
+	case strings.HasSuffix(val, "mi"):
+		val = strings.TrimSuffix(val, "mi")
+		toKm = func(n float64) float64 { return n * 1.609344 }
+	case strings.HasSuffix(val, "m"):
+		val = strings.TrimSuffix(val, "m")
+		toKm = func(n float64) float64 { return n / 1000 }
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n <= 0 {
+		return "", errInvalidRange
+	}
+	km := toKm(n)
+	if km > MAX_RANGE_KM {
+		return "", errInvalidRange
+	}
+	return strconv.FormatFloat(km, 'f', -1, 64) + "km", nil
+}
+
+// rangeParam reads the optional range query parameter of r, DISTANCE when
+// it is missing.
+func rangeParam(r *http.Request) (string, error) {
+	if val := r.URL.Query().Get("range"); val != "" {
+		return parseRange(val)
+	}
+	return DISTANCE, nil
+}
+
+// BoundingBox is a map viewport. A box whose MinLon exceeds its MaxLon
+// crosses the antimeridian.
+type BoundingBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// parseBBox parses a "minLat,minLon,maxLat,maxLon" bounding box.
+func parseBBox(val string) (*BoundingBox, error) {
+	invalid := fmt.Errorf("bbox should be minLat,minLon,maxLat,maxLon")
+	parts := strings.Split(val, ",")
+	if len(parts) != 4 {
+		return nil, invalid
+	}
+	var coords [4]float64
+	for i, part := range parts {
+		c, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(c) {
+			return nil, invalid
+		}
+		coords[i] = c
+	}
+	b := &BoundingBox{MinLat: coords[0], MinLon: coords[1], MaxLat: coords[2], MaxLon: coords[3]}
+	if b.MinLat < -90 || b.MaxLat > 90 || b.MinLat >= b.MaxLat {
+		return nil, fmt.Errorf("bbox latitudes should be within -90 and 90, minLat below maxLat")
+	}
+	if b.MinLon < -180 || b.MinLon > 180 || b.MaxLon < -180 || b.MaxLon > 180 || b.MinLon == b.MaxLon {
+		return nil, fmt.Errorf("bbox longitudes should be distinct and within -180 and 180")
+	}
+	return b, nil
+}
+
+// query is the geo_bounding_box query of b.
+func (b *BoundingBox) query() elastic.Query {
+	return elastic.NewGeoBoundingBoxQuery("location").
+		TopLeft(b.MaxLat, b.MinLon).
+		BottomRight(b.MinLat, b.MaxLon)
+}
+
+// lonSpan is the width of b in degrees of longitude.
+func (b *BoundingBox) lonSpan() float64 {
+	if b.MinLon > b.MaxLon {
+		return b.MaxLon + 360 - b.MinLon
+	}
+	return b.MaxLon - b.MinLon
+}
+
+// contains reports whether b holds lat/lon.
+func (b *BoundingBox) contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon > b.MaxLon {
+		return lon >= b.MinLon || lon <= b.MaxLon
+	}
+	return lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// center returns the middle of b, which results are sorted around.
+func (b *BoundingBox) center() (float64, float64) {
+	lon := b.MinLon + b.lonSpan()/2
+	if lon > 180 {
+		lon -= 360
+	}
+	return (b.MinLat + b.MaxLat) / 2, lon
+}
+
+// radiusKm is the distance from the center of b to its farthest corner, a
+// circle covering b.
+func (b *BoundingBox) radiusKm() float64 {
+	lat, lon := b.center()
+	radius := 0.0
+	for _, cornerLat := range []float64{b.MinLat, b.MaxLat} {
+		for _, cornerLon := range []float64{b.MinLon, b.MaxLon} {
+			radius = math.Max(radius, haversineKm(lat, lon, cornerLat, cornerLon))
+		}
+	}
+	return radius
+}
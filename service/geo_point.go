@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnmarshalJSON reads a location in any of the forms ElasticSearch accepts
+// for a geo_point:
+//
+//   - an object: {"lat": 41.12, "lon": -71.34}, numbers or numeric strings
+//   - an array in GeoJSON order: [-71.34, 41.12]
+//   - a string: "41.12,-71.34", a geohash such as "drm3btev3e86" or
+//     WKT "POINT (-71.34 41.12)"
+//
+// Anything else, including missing coordinates or out-of-range values, is
+// an error instead of silently decoding to 0,0.
+func (l *Location) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return fmt.Errorf("geo_point: missing location")
+	}
+
+	var lat, lon float64
+	var err error
+	switch data[0] {
+	case '{':
+		lat, lon, err = parseGeoPointObject(data)
+	case '[':
+		lat, lon, err = parseGeoPointArray(data)
+	case '"':
+		var s string
+		if err = json.Unmarshal(data, &s); err == nil {
+			lat, lon, err = parseGeoPointString(s)
+		}
+	default:
+		err = fmt.Errorf("geo_point: unexpected %s", data)
+	}
+	if err != nil {
+		return err
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return fmt.Errorf("geo_point: %v,%v out of range", lat, lon)
+	}
+
+	l.Lat, l.Lon = lat, lon
+	return nil
+}
+
+func parseGeoPointObject(data []byte) (float64, float64, error) {
+	var obj struct {
+		Lat *json.Number `json:"lat"`
+		Lon *json.Number `json:"lon"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return 0, 0, fmt.Errorf("geo_point: %v", err)
+	}
+	if obj.Lat == nil || obj.Lon == nil {
+		return 0, 0, fmt.Errorf("geo_point: object %s needs lat and lon", data)
+	}
+	lat, err := obj.Lat.Float64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("geo_point: invalid lat %q", obj.Lat.String())
+	}
+	lon, err := obj.Lon.Float64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("geo_point: invalid lon %q", obj.Lon.String())
+	}
+	return lat, lon, nil
+}
+
+func parseGeoPointArray(data []byte) (float64, float64, error) {
+	var coords []float64
+	if err := json.Unmarshal(data, &coords); err != nil {
+		return 0, 0, fmt.Errorf("geo_point: %v", err)
+	}
+	// an optional third value is the elevation
+	if len(coords) != 2 && len(coords) != 3 {
+		return 0, 0, fmt.Errorf("geo_point: array %s needs lon and lat", data)
+	}
+	return coords[1], coords[0], nil
+}
+
+func parseGeoPointString(s string) (float64, float64, error) {
+	s = strings.TrimSpace(s)
+	if upper := strings.ToUpper(s); strings.HasPrefix(upper, "POINT") {
+		inner := strings.TrimSpace(s[len("POINT"):])
+		if !strings.HasPrefix(inner, "(") || !strings.HasSuffix(inner, ")") {
+			return 0, 0, fmt.Errorf("geo_point: invalid WKT %q", s)
+		}
+		fields := strings.Fields(inner[1 : len(inner)-1])
+		if len(fields) != 2 && len(fields) != 3 {
+			return 0, 0, fmt.Errorf("geo_point: invalid WKT %q", s)
+		}
+		lon, err1 := strconv.ParseFloat(fields[0], 64)
+		lat, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("geo_point: invalid WKT %q", s)
+		}
+		return lat, lon, nil
+	}
+
+	if parts := strings.Split(s, ","); len(parts) == 2 || len(parts) == 3 {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("geo_point: invalid %q", s)
+		}
+		return lat, lon, nil
+	}
+
+	if s == "" {
+		return 0, 0, fmt.Errorf("geo_point: empty string")
+	}
+	return decodeGeohash(strings.ToLower(s))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestLocationUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name, input string
+		lat, lon    float64
+		wantErr     bool
+	}{
+		{"object", `{"lat": 41.12, "lon": -71.34}`, 41.12, -71.34, false},
+		{"object strings", `{"lat": "41.12", "lon": "-71.34"}`, 41.12, -71.34, false},
+		{"array", `[-71.34, 41.12]`, 41.12, -71.34, false},
+		{"array elevation", `[-71.34, 41.12, 10]`, 41.12, -71.34, false},
+		{"string", `"41.12,-71.34"`, 41.12, -71.34, false},
+		{"string spaces", `" 41.12 , -71.34 "`, 41.12, -71.34, false},
+		{"geohash", `"drm3btev3e86"`, 41.12, -71.34, false},
+		{"geohash upper", `"DRM3BTEV3E86"`, 41.12, -71.34, false},
+		{"wkt", `"POINT (-71.34 41.12)"`, 41.12, -71.34, false},
+		{"wkt lower", `"point(-71.34 41.12)"`, 41.12, -71.34, false},
+		{"null", `null`, 0, 0, true},
+		{"missing lat", `{"lon": -71.34}`, 0, 0, true},
+		{"missing lon", `{"lat": 41.12}`, 0, 0, true},
+		{"bad lat string", `{"lat": "north", "lon": -71.34}`, 0, 0, true},
+		{"short array", `[-71.34]`, 0, 0, true},
+		{"empty string", `""`, 0, 0, true},
+		{"bad geohash", `"drm3bta"`, 0, 0, true},
+		{"bad wkt", `"POINT -71.34 41.12"`, 0, 0, true},
+		{"number", `41.12`, 0, 0, true},
+		{"lat out of range", `{"lat": 91, "lon": 0}`, 0, 0, true},
+		{"lon out of range", `{"lat": 0, "lon": -181}`, 0, 0, true},
+		{"array out of range", `[200, 10]`, 0, 0, true},
+		{"string out of range", `"-95,10"`, 0, 0, true},
+	}
+	for _, tt := range tests {
+		var l Location
+		err := json.Unmarshal([]byte(tt.input), &l)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: Unmarshal(%s) = %+v, want error", tt.name, tt.input, l)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unmarshal(%s): %v", tt.name, tt.input, err)
+			continue
+		}
+		if math.Abs(l.Lat-tt.lat) > 1e-6 || math.Abs(l.Lon-tt.lon) > 1e-6 {
+			t.Errorf("%s: Unmarshal(%s) = %v,%v, want %v,%v", tt.name, tt.input, l.Lat, l.Lon, tt.lat, tt.lon)
+		}
+	}
+}
+
+func TestGeohashRoundTrip(t *testing.T) {
+	points := []struct{ lat, lon float64 }{
+		{41.12, -71.34},
+		{37.7749, -122.4194},
+		{-33.8688, 151.2093},
+		{0, 0},
+		{89.99, 179.99},
+		{-89.99, -179.99},
+	}
+	for _, precision := range []int{1, 5, 9, 12} {
+		latErr, lonErr := geohashCellDegrees(precision)
+		for _, p := range points {
+			hash := encodeGeohash(p.lat, p.lon, precision)
+			if len(hash) != precision {
+				t.Fatalf("encodeGeohash(%v, %v, %d) = %q", p.lat, p.lon, precision, hash)
+			}
+			lat, lon, err := decodeGeohash(hash)
+			if err != nil {
+				t.Fatalf("decodeGeohash(%q): %v", hash, err)
+			}
+			// the center of the cell is at most half a cell away
+			if math.Abs(lat-p.lat) > latErr/2 || math.Abs(lon-p.lon) > lonErr/2 {
+				t.Errorf("decodeGeohash(%q) = %v,%v, want within half a cell of %v,%v", hash, lat, lon, p.lat, p.lon)
+			}
+			if again := encodeGeohash(lat, lon, precision); again != hash {
+				t.Errorf("encodeGeohash of the center of %q = %q", hash, again)
+			}
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geocoding turns a place name typed by a user ("Times Square") into
+// coordinates for the normal geo-distance search and, the other way round,
+// names the city and neighborhood of new posts so they can be searched by
+// place. GEOCODER selects the provider, one of GEOCODERS: "nominatim" for a
+// Nominatim compatible API at GEOCODER_URL, or "google" for the Google Maps
+// Geocoding API with GOOGLE_MAPS_API_KEY; both are loaded from the
+// ServiceConfig at startup. Results, including places that could not be
+// resolved, are cached for GEOCODE_CACHE_TTL; reverse lookups are cached
+// for points REVERSE_GEOCODE_PRECISION decimals apart, about 100m.
+var (
+	GEOCODER            = "nominatim"
+	GOOGLE_MAPS_API_KEY = ""
+)
+
+var GEOCODERS = []string{"nominatim", "google"}
+
+// PLACE_SEARCH_RANGE is the range of a search by place that doesn't give
+// one: the whole world, the place alone selects the posts.
+var PLACE_SEARCH_RANGE = strconv.FormatFloat(MAX_RANGE_KM, 'f', -1, 64) + "km"
+
+const (
+	GEOCODER_URL               = "https://nominatim.openstreetmap.org"
+	GOOGLE_GEOCODE_URL         = "https://maps.googleapis.com/maps/api/geocode/json"
+	GEOCODER_USER_AGENT        = "circus-geocoder"
+	GEOCODE_TIMEOUT            = 5 * time.Second
+	GEOCODE_CACHE_TTL          = 24 * time.Hour
+	GEOCODE_CACHE_MAX          = 10000
+	MAX_PLACE_QUERY_CHARS      = 200
+	REVERSE_GEOCODE_PRECISION  = 3
+	REVERSE_GEOCODE_POST_LIMIT = 2 * time.Second // spent naming the place of a new post
+)
+
+var errPlaceNotFound = errors.New("place not found")
+
+// Place names the area around a location. Either name may be empty.
+type Place struct {
+	City         string
+	Neighborhood string
+}
+
+// Geocoder resolves a place name to a location, and a location to the
+// place around it.
+type Geocoder interface {
+	Forward(ctx context.Context, place string) (*Location, error)
+	Reverse(ctx context.Context, loc Location) (*Place, error)
+}
+
+type geocodeEntry struct {
+	loc     *Location // nil when the place could not be resolved
+	place   *Place    // of reverse lookups, nil when nothing was found
+	expires time.Time
+}
+
+// cachingGeocoder memoizes the answers of another Geocoder.
+type cachingGeocoder struct {
+	next    Geocoder
+	mu      sync.Mutex
+	entries map[string]geocodeEntry
+	places  map[string]geocodeEntry // reverse lookups
+}
+
+// newGeocoder returns the provider selected by GEOCODER behind a cache.
+func newGeocoder() (Geocoder, error) {
+	client := &http.Client{Timeout: GEOCODE_TIMEOUT}
+	var next Geocoder
+	switch GEOCODER {
+	case "nominatim":
+		next = &nominatimGeocoder{url: GEOCODER_URL, client: client}
+	case "google":
+		next = &googleGeocoder{url: GOOGLE_GEOCODE_URL, key: GOOGLE_MAPS_API_KEY, client: client}
+	default:
+		return nil, fmt.Errorf("unknown geocoder %q", GEOCODER)
+	}
+	return &cachingGeocoder{
+		next:    next,
+		entries: make(map[string]geocodeEntry),
+		places:  make(map[string]geocodeEntry),
+	}, nil
+}
+
+func (g *cachingGeocoder) Forward(ctx context.Context, place string) (*Location, error) {
+	key := strings.ToLower(strings.Join(strings.Fields(place), " "))
+
+	g.mu.Lock()
+	e, ok := g.entries[key]
+	g.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		if e.loc == nil {
+			return nil, errPlaceNotFound
+		}
+		return e.loc, nil
+	}
+
+	loc, err := g.next.Forward(ctx, place)
+	if err != nil && err != errPlaceNotFound {
+		// Don't cache provider failures, the next request may succeed.
+		return nil, err
+	}
+
+	g.mu.Lock()
+	g.store(g.entries, key, geocodeEntry{loc: loc})
+	g.mu.Unlock()
+	return loc, err
+}
+
+func (g *cachingGeocoder) Reverse(ctx context.Context, loc Location) (*Place, error) {
+	scale := math.Pow(10, REVERSE_GEOCODE_PRECISION)
+	loc = Location{Lat: math.Round(loc.Lat*scale) / scale, Lon: math.Round(loc.Lon*scale) / scale}
+	key := strconv.FormatFloat(loc.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(loc.Lon, 'f', -1, 64)
+
+	g.mu.Lock()
+	e, ok := g.places[key]
+	g.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		if e.place == nil {
+			return nil, errPlaceNotFound
+		}
+		return e.place, nil
+	}
+
+	place, err := g.next.Reverse(ctx, loc)
+	if err != nil && err != errPlaceNotFound {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	g.store(g.places, key, geocodeEntry{place: place})
+	g.mu.Unlock()
+	return place, err
+}
+
+// store caches e under key in entries, unless entries is full of fresh
+// entries. The caller holds g.mu.
+func (g *cachingGeocoder) store(entries map[string]geocodeEntry, key string, e geocodeEntry) {
+	if len(entries) >= GEOCODE_CACHE_MAX {
+		evictExpired(entries)
+	}
+	if len(entries) < GEOCODE_CACHE_MAX {
+		e.expires = time.Now().Add(GEOCODE_CACHE_TTL)
+		entries[key] = e
+	}
+}
+
+// evictExpired drops stale entries. The caller holds the lock of entries.
+func evictExpired(entries map[string]geocodeEntry) {
+	now := time.Now()
+	for k, e := range entries {
+		if now.After(e.expires) {
+			delete(entries, k)
+		}
+	}
+}
+
+// nominatimGeocoder queries a Nominatim compatible API.
+type nominatimGeocoder struct {
+	url    string
+	client *http.Client
+}
+
+func (g *nominatimGeocoder) Forward(ctx context.Context, place string) (*Location, error) {
+	params := url.Values{}
+	params.Set("q", place)
+	params.Set("format", "json")
+	params.Set("limit", "1")
+
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := g.get(ctx, "/search", params, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errPlaceNotFound
+	}
+	lat, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return nil, err
+	}
+	lon, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Location{Lat: lat, Lon: lon}, nil
+}
+
+func (g *nominatimGeocoder) Reverse(ctx context.Context, loc Location) (*Place, error) {
+	params := url.Values{}
+	params.Set("lat", strconv.FormatFloat(loc.Lat, 'f', -1, 64))
+	params.Set("lon", strconv.FormatFloat(loc.Lon, 'f', -1, 64))
+	params.Set("format", "json")
+	params.Set("zoom", "16")
+	params.Set("addressdetails", "1")
+
+	var result struct {
+		Error   string            `json:"error"`
+		Address map[string]string `json:"address"`
+	}
+	if err := g.get(ctx, "/reverse", params, &result); err != nil {
+		return nil, err
+	}
+	place := &Place{
+		City:         firstOf(result.Address, "city", "town", "village", "municipality"),
+		Neighborhood: firstOf(result.Address, "suburb", "city_district", "neighbourhood", "quarter"),
+	}
+	if result.Error != "" || *place == (Place{}) {
+		return nil, errPlaceNotFound
+	}
+	return place, nil
+}
+
+// get decodes the JSON answer of the endpoint at path into v.
+func (g *nominatimGeocoder) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", g.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", GEOCODER_USER_AGENT)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// firstOf returns the first of keys set in fields.
+func firstOf(fields map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if fields[key] != "" {
+			return fields[key]
+		}
+	}
+	return ""
+}
+
+// googleGeocoder queries the Google Maps Geocoding API.
+type googleGeocoder struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+// googleGeocodeResponse is the part of a Geocoding API answer we read.
+type googleGeocodeResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+	Results      []struct {
+		AddressComponents []struct {
+			LongName string   `json:"long_name"`
+			Types    []string `json:"types"`
+		} `json:"address_components"`
+		Geometry struct {
+			Location struct {
+				Lat float64 `json:"lat"`
+				Lng float64 `json:"lng"`
+			} `json:"location"`
+		} `json:"geometry"`
+	} `json:"results"`
+}
+
+func (g *googleGeocoder) Forward(ctx context.Context, place string) (*Location, error) {
+	params := url.Values{}
+	params.Set("address", place)
+	resp, err := g.get(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	loc := resp.Results[0].Geometry.Location
+	return &Location{Lat: loc.Lat, Lon: loc.Lng}, nil
+}
+
+func (g *googleGeocoder) Reverse(ctx context.Context, loc Location) (*Place, error) {
+	params := url.Values{}
+	params.Set("latlng", strconv.FormatFloat(loc.Lat, 'f', -1, 64)+","+strconv.FormatFloat(loc.Lon, 'f', -1, 64))
+	resp, err := g.get(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// the results go from the most precise address to the country
+	names := make(map[string]string)
+	for _, result := range resp.Results {
+		for _, c := range result.AddressComponents {
+			for _, t := range c.Types {
+				if names[t] == "" {
+					names[t] = c.LongName
+				}
+			}
+		}
+	}
+	place := &Place{
+		City:         firstOf(names, "locality", "postal_town"),
+		Neighborhood: firstOf(names, "sublocality_level_1", "sublocality", "neighborhood"),
+	}
+	if *place == (Place{}) {
+		return nil, errPlaceNotFound
+	}
+	return place, nil
+}
+
+// get calls the API with params and checks that it found something.
+func (g *googleGeocoder) get(ctx context.Context, params url.Values) (*googleGeocodeResponse, error) {
+	params.Set("key", g.key)
+	req, err := http.NewRequest("GET", g.url+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+
+	var result googleGeocodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	switch result.Status {
+	case "OK":
+		if len(result.Results) == 0 {
+			return nil, errPlaceNotFound
+		}
+		return &result, nil
+	case "ZERO_RESULTS":
+		return nil, errPlaceNotFound
+	default:
+		return nil, fmt.Errorf("geocoder returned %s: %s", result.Status, result.ErrorMessage)
+	}
+}
+
+// enrichPlace names the city and neighborhood of the new post p from its
+// indexed location, fuzzed if the author asked to. The post is saved
+// without them when the geocoder fails or takes longer than
+// REVERSE_GEOCODE_POST_LIMIT.
+func (a *App) enrichPlace(ctx context.Context, p *Post) {
+	ctx, cancel := context.WithTimeout(ctx, REVERSE_GEOCODE_POST_LIMIT)
+	defer cancel()
+	place, err := a.Geo.Reverse(ctx, p.Location)
+	if err != nil {
+		if err != errPlaceNotFound {
+			logFor(ctx).Warn("failed to reverse geocode post", "err", err)
+		}
+		return
+	}
+	p.City, p.Neighborhood = place.City, place.Neighborhood
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNominatimReverse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/reverse" || r.URL.Query().Get("lat") != "40.6782" {
+			t.Errorf("request %s", r.URL)
+		}
+		w.Write([]byte(`{"address": {"neighbourhood": "Park Slope", "suburb": "Brooklyn", "city": "New York", "country": "United States"}}`))
+	}))
+	defer server.Close()
+
+	g := &nominatimGeocoder{url: server.URL, client: server.Client()}
+	place, err := g.Reverse(context.Background(), Location{Lat: 40.6782, Lon: -73.9442})
+	if err != nil || *place != (Place{City: "New York", Neighborhood: "Brooklyn"}) {
+		t.Errorf("Reverse = %+v, %v", place, err)
+	}
+}
+
+func TestGoogleReverse(t *testing.T) {
+	status := "OK"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("latlng") != "40.6782,-73.9442" || r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": status,
+			"results": []interface{}{map[string]interface{}{
+				"address_components": []interface{}{
+					map[string]interface{}{"long_name": "Crown Heights", "types": []string{"neighborhood", "political"}},
+					map[string]interface{}{"long_name": "Brooklyn", "types": []string{"political", "sublocality", "sublocality_level_1"}},
+					map[string]interface{}{"long_name": "New York", "types": []string{"locality", "political"}},
+				},
+			}},
+		})
+	}))
+	defer server.Close()
+
+	g := &googleGeocoder{url: server.URL, key: "test-key", client: server.Client()}
+	place, err := g.Reverse(context.Background(), Location{Lat: 40.6782, Lon: -73.9442})
+	if err != nil || *place != (Place{City: "New York", Neighborhood: "Brooklyn"}) {
+		t.Errorf("Reverse = %+v, %v", place, err)
+	}
+
+	status = "ZERO_RESULTS"
+	if _, err := g.Reverse(context.Background(), Location{Lat: 40.6782, Lon: -73.9442}); err != errPlaceNotFound {
+		t.Errorf("err = %v, want errPlaceNotFound", err)
+	}
+}
+
+// countingGeocoder counts the reverse lookups it answers.
+type countingGeocoder struct {
+	staticGeocoder
+	reversed int
+}
+
+func (g *countingGeocoder) Reverse(ctx context.Context, loc Location) (*Place, error) {
+	g.reversed++
+	return g.staticGeocoder.Reverse(ctx, loc)
+}
+
+func TestCachingGeocoderReverse(t *testing.T) {
+	next := &countingGeocoder{staticGeocoder: staticGeocoder{"San Francisco": {Lat: 37.7749, Lon: -122.4194}}}
+	g := &cachingGeocoder{next: next, entries: map[string]geocodeEntry{}, places: map[string]geocodeEntry{}}
+	ctx := context.Background()
+
+	for _, loc := range []Location{{Lat: 37.77491, Lon: -122.41941}, {Lat: 37.77489, Lon: -122.41938}} {
+		if place, err := g.Reverse(ctx, loc); err != nil || place.City != "San Francisco" {
+			t.Errorf("Reverse(%v) = %+v, %v", loc, place, err)
+		}
+	}
+	// not found is cached too
+	for i := 0; i < 2; i++ {
+		if _, err := g.Reverse(ctx, Location{Lat: 0, Lon: 0}); err != errPlaceNotFound {
+			t.Errorf("err = %v, want errPlaceNotFound", err)
+		}
+	}
+	if next.reversed != 2 {
+		t.Errorf("%d lookups, want 2", next.reversed)
+	}
+}
+
+func TestHandlePostPlace(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "hello", "lat": "37.78", "lon": "-122.41"}, testPNG(t))
+
+	w := s.do(authorized(t, r, "frank"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if p.City != "San Francisco" {
+		t.Errorf("city = %q, want San Francisco", p.City)
+	}
+	if got := searchIds(t, s, "place=San+Francisco"); len(got) != 1 || got[0] != p.Id {
+		t.Errorf("ids = %v, want [%s]", got, p.Id)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+//go:generate go run github.com/99designs/gqlgen generate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// The GraphQL API (schema.graphqls) lets clients fetch posts together with
+// their authors in one round trip. Like the gRPC API it shares the service
+// layer, tokens and rate limits with the HTTP API.
+const (
+	ENABLE_GRAPHQL = true
+
+	// GRAPHQL_MAX_COMPLEXITY bounds the fields one query may resolve, so a
+	// deeply nested query can't fan out into thousands of lookups.
+	GRAPHQL_MAX_COMPLEXITY = 500
+)
+
+type clientIPKey struct{}
+
+type graphqlResolver struct {
+	app *App
+}
+
+type queryResolver struct{ *graphqlResolver }
+type mutationResolver struct{ *graphqlResolver }
+type postResolver struct{ *graphqlResolver }
+
+func (g *graphqlResolver) Query() QueryResolver       { return queryResolver{g} }
+func (g *graphqlResolver) Mutation() MutationResolver { return mutationResolver{g} }
+func (g *graphqlResolver) Post() PostResolver         { return postResolver{g} }
+
+// newGraphQLHandler serves the schema over GET and POST, and multipart
+// requests for uploads. It expects the optional JWT middleware in front.
+func (a *App) newGraphQLHandler() http.Handler {
+	srv := handler.New(NewExecutableSchema(Config{Resolvers: &graphqlResolver{app: a}}))
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{
+		MaxUploadSize: MAX_UPLOAD_BYTES,
+		MaxMemory:     MAX_UPLOAD_MEMORY,
+	})
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.FixedComplexityLimit(GRAPHQL_MAX_COMPLEXITY))
+	srv.SetErrorPresenter(graphqlError)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Println("Received one request for GraphQL")
+
+		ctx := context.WithValue(r.Context(), clientIPKey{}, clientIP(r))
+		// the middleware lets anonymous callers through, resolvers decide
+		if r.Context().Value("user") != nil {
+			claims := requireClaims(w, r)
+			if claims == nil {
+				return
+			}
+			ctx = context.WithValue(ctx, claimsKey{}, claims)
+		}
+		srv.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// graphqlError converts an error of a resolver into a GraphQL error, with
+// the HTTP status of service errors as the "status" extension.
+func graphqlError(ctx context.Context, err error) *gqlerror.Error {
+	var gqlErr *gqlerror.Error
+	if errors.As(err, &gqlErr) {
+		return gqlErr
+	}
+
+	var serr *ServiceError
+	if !errors.As(err, &serr) {
+		logFor(ctx).Error("GraphQL resolver failed", "err", err)
+		return gqlerror.ErrorPathf(graphql.GetPath(ctx), "Internal error")
+	}
+	gqlErr = gqlerror.ErrorPathf(graphql.GetPath(ctx), "%s", serr.Message)
+	gqlErr.Extensions = map[string]interface{}{"status": serr.Status}
+	return gqlErr
+}
+
+// graphqlRateLimit applies the rateLimits route name to the caller.
+func graphqlRateLimit(ctx context.Context, name string) error {
+	l := limiterFor(name)
+	if l == nil {
+		return nil
+	}
+	var user string
+	if claims := claimsFromContext(ctx); claims != nil {
+		user = claims.Username
+	}
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	if ok, retry := l.allow(ip, user, time.Now()); !ok {
+		return serviceError(http.StatusTooManyRequests, fmt.Sprintf("Too many requests, retry in %s", retry.Round(time.Second)))
+	}
+	return nil
+}
+
+// graphqlViewer returns the caller, who may only be anonymous when the
+// service allows public reads.
+func graphqlViewer(ctx context.Context) (string, error) {
+	if claims := claimsFromContext(ctx); claims != nil {
+		return claims.Username, nil
+	}
+	if !PUBLIC_READ {
+		return "", serviceError(http.StatusUnauthorized, "A token is required")
+	}
+	return "", nil
+}
+
+// graphqlPage checks the offset and limit arguments like parsePagination.
+func graphqlPage(offset, limit *int) (int, int, error) {
+	o, l := 0, DEFAULT_PAGE_SIZE
+	if offset != nil {
+		o = *offset
+	}
+	if limit != nil {
+		l = *limit
+	}
+	if l <= 0 || l > MAX_PAGE_SIZE {
+		return 0, 0, serviceError(http.StatusBadRequest, "limit should be between 1 and "+strconv.Itoa(MAX_PAGE_SIZE))
+	}
+	if o < 0 {
+		return 0, 0, serviceError(http.StatusBadRequest, "offset should be a non-negative integer")
+	}
+	if o+l > MAX_RESULT_WINDOW {
+		return 0, 0, serviceError(http.StatusBadRequest, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW))
+	}
+	return o, l, nil
+}
+
+func (g queryResolver) Post(ctx context.Context, id string) (*Post, error) {
+	viewer, err := graphqlViewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := g.app.Posts.Get(ctx, id)
+	if err == errPostNotFound || (err == nil && !p.visibleTo(viewer)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []Post{*p}
+	redactPosts(posts, viewer)
+	signMediaURLs(posts)
+	if err := annotateLikes(ctx, posts, viewer); err != nil {
+		logFor(ctx).Warn("failed to read likes", "err", err)
+	}
+	return &posts[0], nil
+}
+
+func (g queryResolver) Search(ctx context.Context, lat float64, lon float64, rangeArg *float64, since *time.Time, until *time.Time, offset *int, limit *int) (*PostPage, error) {
+	viewer, err := graphqlViewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o, l, err := graphqlPage(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &GeoQuery{Lat: lat, Lon: lon, Distance: DISTANCE, Offset: o, Limit: l}
+	if rangeArg != nil {
+		q.Distance = fmt.Sprintf("%gkm", *rangeArg)
+	}
+	if since != nil {
+		q.Since = *since
+	}
+	if until != nil {
+		q.Until = *until
+	}
+	posts, total, err := g.app.searchPosts(ctx, q, viewer)
+	if err != nil {
+		return nil, err
+	}
+	return &PostPage{Total: total, Offset: o, Limit: l, Posts: posts}, nil
+}
+
+func (g queryResolver) PostsByUsers(ctx context.Context, users []string, offset *int, limit *int) (*PostPage, error) {
+	viewer, err := graphqlViewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o, l, err := graphqlPage(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	users, err = parseUsers(users)
+	if err != nil {
+		return nil, serviceError(http.StatusBadRequest, err.Error())
+	}
+
+	hidden, err := hiddenUsers(ctx, viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := readPostsByUsersFromES(users, false, hidden, o, l)
+	if err != nil {
+		return nil, err
+	}
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+	if err := annotateLikes(ctx, page.Posts, viewer); err != nil {
+		logFor(ctx).Warn("failed to read likes", "err", err)
+	}
+	return page, nil
+}
+
+func (g queryResolver) User(ctx context.Context, username string) (*PublicProfile, error) {
+	if _, err := graphqlViewer(ctx); err != nil {
+		return nil, err
+	}
+	return g.profile(ctx, username)
+}
+
+func (g postResolver) Author(ctx context.Context, obj *Post) (*PublicProfile, error) {
+	return g.profile(ctx, obj.User)
+}
+
+// profile returns the public profile of username, nil if there is no such
+// user.
+func (g *graphqlResolver) profile(ctx context.Context, username string) (*PublicProfile, error) {
+	user, err := getUser(username)
+	if err == errUserNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &PublicProfile{
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		Bio:         user.Bio,
+	}
+	profile.PostCount, err = g.app.Posts.Count(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (g mutationResolver) CreatePost(ctx context.Context, input CreatePostInput) (*Post, error) {
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		return nil, serviceError(http.StatusUnauthorized, "A token is required")
+	}
+	if err := graphqlRateLimit(ctx, "post"); err != nil {
+		return nil, err
+	}
+	if input.Image != nil && input.Video != nil {
+		return nil, serviceError(http.StatusBadRequest, "A post carries either an image or a video")
+	}
+
+	in := &NewPost{
+		User:    claims.Username,
+		Message: input.Message,
+		Lat:     input.Lat,
+		Lon:     input.Lon,
+	}
+	if input.Lang != nil {
+		in.Lang = *input.Lang
+	}
+	in.Lang = normalizeLang(in.Lang)
+	if input.Draft != nil {
+		in.Draft = *input.Draft
+	}
+	if input.FuzzLocation != nil {
+		in.FuzzLocation = *input.FuzzLocation
+	}
+	if input.Image != nil {
+		in.MediaType, in.Media, in.MediaSize = MEDIA_IMAGE, input.Image.File, input.Image.Size
+	} else if input.Video != nil {
+		in.MediaType, in.Media, in.MediaSize = MEDIA_VIDEO, input.Video.File, input.Video.Size
+	}
+
+	return g.app.createPost(ctx, in)
+}
+
+func (g mutationResolver) Signup(ctx context.Context, input SignupInput) (bool, error) {
+	if err := graphqlRateLimit(ctx, "signup"); err != nil {
+		return false, err
+	}
+
+	user := User{Username: input.Username, Password: input.Password}
+	if input.Age != nil {
+		user.Age = int64(*input.Age)
+	}
+	if input.Gender != nil {
+		user.Gender = *input.Gender
+	}
+	if err := signup(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (g mutationResolver) Login(ctx context.Context, username string, password string) (*TokenPair, error) {
+	if err := graphqlRateLimit(ctx, "login"); err != nil {
+		return nil, err
+	}
+
+	account, err := login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return newTokenPair(account)
+}
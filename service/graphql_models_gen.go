@@ -0,0 +1,32 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package main
+
+import (
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// A new post carries either an image or a video.
+type CreatePostInput struct {
+	Message      string          `json:"message"`
+	Lat          float64         `json:"lat"`
+	Lon          float64         `json:"lon"`
+	Lang         *string         `json:"lang,omitempty"`
+	Draft        *bool           `json:"draft,omitempty"`
+	FuzzLocation *bool           `json:"fuzzLocation,omitempty"`
+	Image        *graphql.Upload `json:"image,omitempty"`
+	Video        *graphql.Upload `json:"video,omitempty"`
+}
+
+type Mutation struct {
+}
+
+type Query struct {
+}
+
+type SignupInput struct {
+	Username string  `json:"username"`
+	Password string  `json:"password"`
+	Age      *int    `json:"age,omitempty"`
+	Gender   *string `json:"gender,omitempty"`
+}
@@ -0,0 +1,318 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative around.proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC API (around.proto) offers the core operations to internal
+// services and mobile clients. It shares the service layer, tokens and rate
+// limits with the HTTP API.
+const (
+	ENABLE_GRPC = true
+	GRPC_ADDR   = ":9090"
+)
+
+// grpcRateLimits maps methods to the rateLimits route they share.
+var grpcRateLimits = map[string]string{
+	"/around.v1.Around/CreatePost": "post",
+	"/around.v1.Around/Signup":     "signup",
+	"/around.v1.Around/Login":      "login",
+}
+
+type grpcServer struct {
+	UnimplementedAroundServer
+	app *App
+}
+
+// startGRPC serves the gRPC API on GRPC_ADDR in the background.
+func (a *App) startGRPC() (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", GRPC_ADDR)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(
+		// leave room for the other fields of a post next to its media
+		grpc.MaxRecvMsgSize(int(MAX_UPLOAD_BYTES)+1<<20),
+		grpc.UnaryInterceptor(grpcInterceptor),
+	)
+	RegisterAroundServer(server, &grpcServer{app: a})
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			logger.Error("gRPC server stopped", "err", err)
+		}
+	}()
+	logger.Info("serving gRPC", "addr", GRPC_ADDR)
+	return server, nil
+}
+
+// stopGRPC lets in-flight calls finish for up to timeout, then cuts them.
+func stopGRPC(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.Stop()
+	}
+}
+
+// grpcInterceptor does for every call what the HTTP middleware does for
+// requests: assign a request id, authenticate, rate limit and log.
+func grpcInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := firstMetadata(md, strings.ToLower(REQUEST_ID_HEADER))
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.New()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(REQUEST_ID_HEADER), id))
+
+	start := time.Now()
+	resp, err := func() (interface{}, error) {
+		claims, err := grpcClaims(md)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		var user string
+		if claims != nil {
+			ctx = context.WithValue(ctx, claimsKey{}, claims)
+			user = claims.Username
+		}
+
+		if l := limiterFor(grpcRateLimits[info.FullMethod]); l != nil {
+			if ok, retry := l.allow(peerIP(ctx), user, time.Now()); !ok {
+				return nil, status.Errorf(codes.ResourceExhausted, "Too many requests, retry in %s", retry.Round(time.Second))
+			}
+		}
+		return handler(ctx, req)
+	}()
+
+	logFor(ctx).Info("rpc",
+		"method", info.FullMethod,
+		"code", status.Code(err).String(),
+		"took_ms", sinceMillis(start))
+	return resp, err
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcClaims validates the bearer token in md, if any, like the HTTP JWT
+// middleware does.
+func grpcClaims(md metadata.MD) (*Claims, error) {
+	auth := firstMetadata(md, "authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil, fmt.Errorf("Authorization should be \"Bearer <token>\"")
+	}
+
+	token, err := parseToken(parts[1], jwtValidationKey)
+	if errors.Is(err, errUserBanned) {
+		return nil, errUserBanned
+	}
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return claimsFromToken(token)
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcError converts an error of the service layer into a gRPC status.
+func grpcError(ctx context.Context, err error) error {
+	serr, ok := err.(*ServiceError)
+	if !ok {
+		logFor(ctx).Error("rpc failed", "err", err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+
+	code := codes.Unknown
+	switch serr.Status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, serr.Message)
+}
+
+func (s *grpcServer) CreatePost(ctx context.Context, req *CreatePostRequest) (*PostInfo, error) {
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Error(codes.Unauthenticated, "A token is required")
+	}
+
+	in := &NewPost{
+		User:         claims.Username,
+		Message:      req.GetMessage(),
+		Lang:         normalizeLang(req.GetLang()),
+		Lat:          req.GetLocation().GetLat(),
+		Lon:          req.GetLocation().GetLon(),
+		Draft:        req.GetDraft(),
+		FuzzLocation: req.GetFuzzLocation(),
+	}
+	switch media := req.GetMedia().(type) {
+	case *CreatePostRequest_Image:
+		in.MediaType, in.Media, in.MediaSize = MEDIA_IMAGE, bytes.NewReader(media.Image), int64(len(media.Image))
+	case *CreatePostRequest_Video:
+		in.MediaType, in.Media, in.MediaSize = MEDIA_VIDEO, bytes.NewReader(media.Video), int64(len(media.Video))
+	}
+
+	p, err := s.app.createPost(ctx, in)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return postToProto(p), nil
+}
+
+func (s *grpcServer) Search(ctx context.Context, req *SearchRequest) (*SearchResponse, error) {
+	var viewer string
+	if claims := claimsFromContext(ctx); claims != nil {
+		viewer = claims.Username
+	} else if !PUBLIC_READ {
+		return nil, status.Error(codes.Unauthenticated, "A token is required")
+	}
+
+	q := &GeoQuery{
+		Lat:      req.GetLocation().GetLat(),
+		Lon:      req.GetLocation().GetLon(),
+		Distance: DISTANCE,
+		Offset:   int(req.GetOffset()),
+		Limit:    int(req.GetLimit()),
+	}
+	if req.GetRange() != 0 {
+		q.Distance = fmt.Sprintf("%gkm", req.GetRange())
+	}
+	if req.GetSince() != nil {
+		q.Since = req.GetSince().AsTime()
+	}
+	if req.GetUntil() != nil {
+		q.Until = req.GetUntil().AsTime()
+	}
+	if q.Limit == 0 {
+		q.Limit = DEFAULT_PAGE_SIZE
+	}
+
+	posts, total, err := s.app.searchPosts(ctx, q, viewer)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	resp := &SearchResponse{Total: total}
+	for i := range posts {
+		resp.Posts = append(resp.Posts, postToProto(&posts[i]))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Signup(ctx context.Context, req *SignupRequest) (*SignupResponse, error) {
+	err := signup(User{
+		Username: req.GetUsername(),
+		Password: req.GetPassword(),
+		Age:      req.GetAge(),
+		Gender:   req.GetGender(),
+	})
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &SignupResponse{}, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
+	account, err := login(req.GetUsername(), req.GetPassword())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	pair, err := newTokenPair(account)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &LoginResponse{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+	}, nil
+}
+
+func postToProto(p *Post) *PostInfo {
+	info := &PostInfo{
+		Id:           p.Id,
+		User:         p.User,
+		Message:      p.Message,
+		Location:     &LatLon{Lat: p.Location.Lat, Lon: p.Location.Lon},
+		Url:          p.Url,
+		MediaType:    p.MediaType,
+		Timestamp:    timestamppb.New(p.Timestamp),
+		UpdatedAt:    timestamppb.New(p.UpdatedAt),
+		Tags:         p.Tags,
+		Hashtags:     p.Hashtags,
+		Status:       p.Status,
+		Lang:         p.Lang,
+		Masked:       p.Masked,
+		FuzzLocation: p.FuzzLocation,
+		Likes:        p.Likes,
+		LikedByMe:    p.LikedByMe,
+	}
+	for _, t := range p.Thumbnails {
+		info.Thumbnails = append(info.Thumbnails, &ThumbnailInfo{
+			Name:   t.Name,
+			Width:  int32(t.Width),
+			Height: int32(t.Height),
+			Url:    t.Url,
+		})
+	}
+	if p.ExactLocation != nil {
+		info.ExactLocation = &LatLon{Lat: p.ExactLocation.Lat, Lon: p.ExactLocation.Lon}
+	}
+	if p.Distance != nil {
+		info.Distance = *p.Distance
+	}
+	return info
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Hashtags are parsed out of the message whenever it is written and kept
+// lowercased in the "hashtags" field, apart from the tags admins set.
+const (
+	MAX_HASHTAGS_PER_POST = 10
+	MAX_HASHTAG_CHARS     = 64
+
+	DEFAULT_TRENDING_TAGS = 10
+	MAX_TRENDING_TAGS     = 50
+	// TRENDING_TAGS_WINDOW is how far back posts count towards trending tags.
+	TRENDING_TAGS_WINDOW = 7 * 24 * time.Hour
+)
+
+// hashtagPattern matches a # at the start of the message or after a
+// character that can't be part of a word, so "a#b" and "&#39;" are no tags.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#])#([\p{L}\p{N}_]+)`)
+
+// extractHashtags returns the distinct hashtags of message in order of
+// appearance, lowercased and without the #. Tags of only digits, like #1,
+// and tags longer than MAX_HASHTAG_CHARS are skipped.
+func extractHashtags(message string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, match := range hashtagPattern.FindAllStringSubmatch(message, -1) {
+		tag := strings.ToLower(match[1])
+		if len([]rune(tag)) > MAX_HASHTAG_CHARS || strings.Trim(tag, "0123456789") == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == MAX_HASHTAGS_PER_POST {
+			break
+		}
+	}
+	return tags
+}
+
+// normalizeHashtag turns a tag from a URL, with or without the #, into the
+// form extractHashtags stores.
+func normalizeHashtag(tag string) (string, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	tags := extractHashtags("#" + tag)
+	if len(tags) != 1 || tags[0] != strings.ToLower(tag) {
+		return "", false
+	}
+	return tags[0], true
+}
+
+// TrendingTag is a hashtag and the number of posts using it.
+type TrendingTag struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+type TrendingTags struct {
+	Since time.Time      `json:"since"`
+	Tags  []*TrendingTag `json:"tags"`
+}
+
+// parseOptionalGeo reads lat, lon and the optional range of a search that
+// is only restricted to an area when lat and lon are both given.
+func parseOptionalGeo(r *http.Request) (*GeoQuery, error) {
+	if r.URL.Query().Get("lat") == "" || r.URL.Query().Get("lon") == "" {
+		return nil, nil
+	}
+	lat, err1 := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, err2 := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("lat and lon should be numbers")
+	}
+	ran, err := rangeParam(r)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoQuery{Lat: lat, Lon: lon, Distance: ran}, nil
+}
+
+// handleTagSearch returns the posts tagged with the {tag} hashtag, newest
+// first. lat and lon, when both given, restrict the search to range km
+// (DISTANCE by default) around that point.
+func handleTagSearch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for tag search")
+	w.Header().Set("Content-Type", "application/json")
+
+	tag, ok := normalizeHashtag(mux.Vars(r)["tag"])
+	if !ok {
+		http.Error(w, "Invalid hashtag", http.StatusBadRequest)
+		return
+	}
+	geo, err := parseOptionalGeo(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readTagSearchFromES(tag, geo, hidden, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+
+	viewer := viewerName(r)
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+	if err := annotateLikes(r.Context(), page.Posts, viewer); err != nil {
+		fmt.Printf("Failed to read likes %v.\n", err)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+func readTagSearchFromES(tag string, geo *GeoQuery, hidden []string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("hashtags", tag))
+	if geo != nil {
+		query = query.Filter(newGeoDistanceQuery(geo.Lat, geo.Lon, geo.Distance))
+	}
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(publicPostsQuery(excludeUsers(query, hidden))).
+		SortBy(elastic.NewFieldSort("timestamp").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "tag_search", searchResult.TookInMillis, map[string]interface{}{"tag": tag, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if screenPost(&p) {
+			page.Posts = append(page.Posts, p)
+		}
+	}
+	return page, nil
+}
+
+// handleTrendingTags returns the hashtags used by the most posts of the last
+// TRENDING_TAGS_WINDOW within range km (DISTANCE by default) of lat and lon,
+// which are required.
+func handleTrendingTags(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for trending tags")
+	w.Header().Set("Content-Type", "application/json")
+
+	geo, err := parseOptionalGeo(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if geo == nil {
+		http.Error(w, "lat and lon are required", http.StatusBadRequest)
+		return
+	}
+
+	limit := DEFAULT_TRENDING_TAGS
+	if val := r.URL.Query().Get("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit <= 0 || limit > MAX_TRENDING_TAGS {
+			http.Error(w, "limit should be between 1 and "+strconv.Itoa(MAX_TRENDING_TAGS), http.StatusBadRequest)
+			return
+		}
+	}
+
+	since := time.Now().UTC().Add(-TRENDING_TAGS_WINDOW)
+	trending, err := readTrendingTagsFromES(geo, since, limit)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read trending tags from ElasticSearch %v.\n", err)
+		return
+	}
+
+	js, err := json.Marshal(trending)
+	if err != nil {
+		http.Error(w, "Failed to parse tags into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse tags into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func readTrendingTagsFromES(geo *GeoQuery, since time.Time, limit int) (*TrendingTags, error) {
+	client := esClient
+
+	query := elastic.NewBoolQuery().
+		Filter(newGeoDistanceQuery(geo.Lat, geo.Lon, geo.Distance)).
+		Filter(elastic.NewRangeQuery("timestamp").Gte(since.Format(time.RFC3339Nano)))
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		Query(publicPostsQuery(query)).
+		Aggregation("tags", elastic.NewTermsAggregation().Field("hashtags").Size(limit)).
+		Size(0).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "aggregation", searchResult.TookInMillis, map[string]interface{}{"lat": geo.Lat, "lon": geo.Lon, "range": geo.Distance, "limit": limit})
+
+	trending := &TrendingTags{Since: since, Tags: []*TrendingTag{}}
+	if tags, found := searchResult.Aggregations.Terms("tags"); found {
+		for _, bucket := range tags.Buckets {
+			trending.Tags = append(trending.Tags, &TrendingTag{Tag: fmt.Sprint(bucket.Key), Count: bucket.DocCount})
+		}
+	}
+	return trending, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Kubernetes probes. /healthz only says the process is serving. /readyz
+// also checks ElasticSearch and the blob store, and fails as soon as a
+// shutdown starts so no new traffic is routed here while requests drain.
+const (
+	READY_CHECK_TIMEOUT = 2 * time.Second
+	SHUTDOWN_TIMEOUT    = 30 * time.Second
+)
+
+var shuttingDown atomic.Bool
+
+// serverClosing is closed when a shutdown starts, to end open streams.
+var serverClosing = make(chan struct{})
+
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+func (a *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	readiness := &Readiness{Status: "ok", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			readiness.Status = "unavailable"
+			readiness.Checks[name] = err.Error()
+			return
+		}
+		readiness.Checks[name] = "ok"
+	}
+
+	if shuttingDown.Load() {
+		readiness.Status = "unavailable"
+		readiness.Checks["server"] = "shutting down"
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), READY_CHECK_TIMEOUT)
+		defer cancel()
+		_, _, err := esClient.Ping(ES_URL).Do(ctx)
+		check("elasticsearch", err)
+		check("blob_store", a.Blobs.Check(ctx))
+	}
+
+	if readiness.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
+
+// serve runs server until SIGINT or SIGTERM, then stops accepting
+// connections and waits up to SHUTDOWN_TIMEOUT for requests in flight.
+// Streams such as /live are ended through serverClosing. stops, e.g. of
+// the gRPC server, run alongside the HTTP shutdown.
+func serve(server *http.Server, stops ...func()) {
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logger.Info("shutting down", "signal", sig.String())
+		shuttingDown.Store(true)
+		close(serverClosing)
+
+		var wg sync.WaitGroup
+		for _, stop := range stops {
+			wg.Add(1)
+			go func(stop func()) {
+				defer wg.Done()
+				stop()
+			}(stop)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("shutdown did not finish", "err", err)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	logger.Info("server stopped")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	// HEATMAP_MAX_BUCKETS caps the cells a heatmap may return; requests
+	// estimated to exceed it are rejected instead of truncated.
+	HEATMAP_MAX_BUCKETS       = 2000
+	DEFAULT_HEATMAP_PRECISION = 5
+	MAX_HEATMAP_PRECISION     = 8
+)
+
+// geohashCellKm is the approximate width and height in km of a geohash cell
+// at each precision (index 0 is unused).
+var geohashCellKm = [][2]float64{
+	{0, 0},
+	{5009.4, 4992.6},
+	{1252.3, 624.1},
+	{156.5, 156},
+	{39.1, 19.5},
+	{4.89, 4.89},
+	{1.22, 0.61},
+	{0.153, 0.152},
+	{0.038, 0.019},
+}
+
+// HeatmapCell is one geohash cell of a heatmap.
+type HeatmapCell struct {
+	Geohash string   `json:"geohash"`
+	Count   int64    `json:"count"`
+	Center  Location `json:"center"`
+}
+
+type Heatmap struct {
+	Precision   int            `json:"precision"`
+	BucketCount int            `json:"bucket_count"`
+	Cells       []*HeatmapCell `json:"cells"`
+}
+
+// estimateBuckets is an upper bound on the geohash cells a circle of
+// radius km covers at precision.
+func estimateBuckets(km float64, precision int) int {
+	cell := geohashCellKm[precision]
+	area := math.Pi * km * km
+	return int(math.Ceil(area / (cell[0] * cell[1])))
+}
+
+// handleHeatmap returns post counts per geohash cell around a point.
+func handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for heatmap")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !requireFlag(w, FLAG_HEATMAP) {
+		return
+	}
+
+	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	ran, err := rangeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	km, _ := parseKm(ran)
+
+	precision := DEFAULT_HEATMAP_PRECISION
+	if val := r.URL.Query().Get("precision"); val != "" {
+		precision, err = strconv.Atoi(val)
+		if err != nil || precision < 1 || precision > MAX_HEATMAP_PRECISION {
+			http.Error(w, fmt.Sprintf("precision should be between 1 and %d", MAX_HEATMAP_PRECISION), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if estimate := estimateBuckets(km, precision); estimate > HEATMAP_MAX_BUCKETS {
+		http.Error(w, fmt.Sprintf("A %gkm radius at precision %d covers about %d cells, more than the limit of %d. Zoom in or lower the precision.",
+			km, precision, estimate, HEATMAP_MAX_BUCKETS), http.StatusBadRequest)
+		return
+	}
+
+	heatmap, err := readHeatmapFromES(lat, lon, ran, precision)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read heatmap from ElasticSearch %v.\n", err)
+		return
+	}
+
+	js, err := json.Marshal(heatmap)
+	if err != nil {
+		http.Error(w, "Failed to parse heatmap into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse heatmap into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func readHeatmapFromES(lat, lon float64, ran string, precision int) (*Heatmap, error) {
+	client := esClient
+
+	agg := elastic.NewGeoHashGridAggregation().
+		Field("location").
+		Precision(precision).
+		Size(HEATMAP_MAX_BUCKETS).
+		SubAggregation("center", elastic.NewGeoCentroidAggregation().Field("location"))
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		Query(publicPostsQuery(newGeoDistanceQuery(lat, lon, ran))).
+		Aggregation("cells", agg).
+		Size(0).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "aggregation", searchResult.TookInMillis, map[string]interface{}{"lat": lat, "lon": lon, "range": ran, "precision": precision})
+
+	heatmap := &Heatmap{Precision: precision, Cells: []*HeatmapCell{}}
+	if cells, found := searchResult.Aggregations.GeoHash("cells"); found {
+		for _, bucket := range cells.Buckets {
+			cell := &HeatmapCell{Geohash: fmt.Sprint(bucket.Key), Count: bucket.DocCount}
+			if center, found := bucket.Aggregations.GeoCentroid("center"); found {
+				cell.Center = Location{Lat: center.Location.Latitude, Lon: center.Location.Longitude}
+			}
+			heatmap.Cells = append(heatmap.Cells, cell)
+		}
+	}
+	heatmap.BucketCount = len(heatmap.Cells)
+	return heatmap, nil
+}
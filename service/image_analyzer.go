@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// New images are analyzed by the IMAGE_ANALYZER: "vision" for the Google
+// Cloud Vision API, "none" to skip analysis. Images likely to fall in an
+// IMAGE_REJECT_CATEGORIES category are refused, images that possibly do
+// are stored with the category in image_flags for admins to review, and the
+// detected labels and number of faces are stored with the post.
+var (
+	IMAGE_ANALYZER = "none"
+	VISION_API_URL = "https://vision.googleapis.com/v1/images:annotate"
+	VISION_API_KEY = ""
+)
+
+var IMAGE_ANALYZERS = []string{"none", "vision"}
+
+// Likelihood is how likely an image falls in a category, as rated by
+// SafeSearch.
+type Likelihood int
+
+const (
+	LIKELIHOOD_UNKNOWN Likelihood = iota
+	LIKELIHOOD_VERY_UNLIKELY
+	LIKELIHOOD_UNLIKELY
+	LIKELIHOOD_POSSIBLE
+	LIKELIHOOD_LIKELY
+	LIKELIHOOD_VERY_LIKELY
+)
+
+const (
+	IMAGE_REJECT_LIKELIHOOD = LIKELIHOOD_LIKELY
+	IMAGE_FLAG_LIKELIHOOD   = LIKELIHOOD_POSSIBLE
+)
+
+var IMAGE_REJECT_CATEGORIES = []string{"adult", "violence"}
+var IMAGE_FLAG_CATEGORIES = []string{"adult", "violence", "racy"}
+
+// ImageAnalysis is what an ImageAnalyzer found in an image.
+type ImageAnalysis struct {
+	Labels []string // lowercased
+	Faces  int
+	// Categories maps SafeSearch categories, such as "adult" or
+	// "violence", to how likely the image falls in them.
+	Categories map[string]Likelihood
+}
+
+// ImageAnalyzer detects the content of images.
+type ImageAnalyzer interface {
+	Analyze(ctx context.Context, image io.Reader, size int64) (*ImageAnalysis, error)
+}
+
+func newImageAnalyzer() (ImageAnalyzer, error) {
+	switch IMAGE_ANALYZER {
+	case "none":
+		return nil, nil
+	case "vision":
+		return newVisionAnalyzer(VISION_API_URL, VISION_API_KEY), nil
+	default:
+		return nil, fmt.Errorf("unknown image analyzer %q", IMAGE_ANALYZER)
+	}
+}
+
+// analyzeImage runs the image of p through the App's ImageAnalyzer, if any,
+// and records the result on p. It returns a service error when the image
+// must be rejected. Images are accepted when the analyzer fails, so an
+// outage of the API doesn't stop every post.
+func (a *App) analyzeImage(ctx context.Context, p *Post, image io.ReadSeeker, size int64) error {
+	if a.Images == nil {
+		return nil
+	}
+	analysis, err := a.Images.Analyze(ctx, image, size)
+	if _, seekErr := image.Seek(0, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+	if err != nil {
+		logFor(ctx).Warn("failed to analyze image", "err", err)
+		return nil
+	}
+
+	for _, category := range IMAGE_REJECT_CATEGORIES {
+		if analysis.Categories[category] >= IMAGE_REJECT_LIKELIHOOD {
+			logFor(ctx).Info("image rejected by analyzer", "user", p.User, "category", category)
+			return serviceError(http.StatusUnprocessableEntity, "Sorry, the image isn't allowed. Please choose another one.")
+		}
+	}
+	p.ImageFlags = nil
+	for _, category := range IMAGE_FLAG_CATEGORIES {
+		if analysis.Categories[category] >= IMAGE_FLAG_LIKELIHOOD {
+			p.ImageFlags = append(p.ImageFlags, category)
+		}
+	}
+	sort.Strings(p.ImageFlags)
+	p.Labels = analysis.Labels
+	p.Faces = analysis.Faces
+	return nil
+}
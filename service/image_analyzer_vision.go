@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	VISION_TIMEOUT         = 10 * time.Second
+	VISION_MAX_LABELS      = 10
+	VISION_MIN_LABEL_SCORE = 0.7
+	VISION_MAX_FACES       = 50
+	// VISION_MAX_IMAGE_BYTES keeps the base64 image within the 10MB JSON
+	// request limit of the API; larger images aren't analyzed.
+	VISION_MAX_IMAGE_BYTES = 7 << 20
+)
+
+var visionLikelihoods = map[string]Likelihood{
+	"VERY_UNLIKELY": LIKELIHOOD_VERY_UNLIKELY,
+	"UNLIKELY":      LIKELIHOOD_UNLIKELY,
+	"POSSIBLE":      LIKELIHOOD_POSSIBLE,
+	"LIKELY":        LIKELIHOOD_LIKELY,
+	"VERY_LIKELY":   LIKELIHOOD_VERY_LIKELY,
+}
+
+// visionAnalyzer asks the Cloud Vision API for SafeSearch ratings, labels
+// and faces in one request.
+type visionAnalyzer struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func newVisionAnalyzer(apiURL, key string) *visionAnalyzer {
+	return &visionAnalyzer{url: apiURL, key: key, client: &http.Client{Timeout: VISION_TIMEOUT}}
+}
+
+type visionFeature struct {
+	Type       string `json:"type"`
+	MaxResults int    `json:"maxResults,omitempty"`
+}
+
+type visionImageRequest struct {
+	Image struct {
+		Content string `json:"content"`
+	} `json:"image"`
+	Features []visionFeature `json:"features"`
+}
+
+type visionRequest struct {
+	Requests []*visionImageRequest `json:"requests"`
+}
+
+type visionResponse struct {
+	Responses []struct {
+		SafeSearch       map[string]string `json:"safeSearchAnnotation"`
+		LabelAnnotations []struct {
+			Description string  `json:"description"`
+			Score       float64 `json:"score"`
+		} `json:"labelAnnotations"`
+		FaceAnnotations []json.RawMessage `json:"faceAnnotations"`
+		Error           *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"responses"`
+}
+
+func (v *visionAnalyzer) Analyze(ctx context.Context, image io.Reader, size int64) (*ImageAnalysis, error) {
+	if size > VISION_MAX_IMAGE_BYTES {
+		return nil, fmt.Errorf("image of %d bytes is too large to analyze", size)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(image, VISION_MAX_IMAGE_BYTES+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > VISION_MAX_IMAGE_BYTES {
+		return nil, fmt.Errorf("image is too large to analyze")
+	}
+
+	request := &visionImageRequest{Features: []visionFeature{
+		{Type: "SAFE_SEARCH_DETECTION"},
+		{Type: "LABEL_DETECTION", MaxResults: VISION_MAX_LABELS},
+		{Type: "FACE_DETECTION", MaxResults: VISION_MAX_FACES},
+	}}
+	request.Image.Content = base64.StdEncoding.EncodeToString(data)
+	js, err := json.Marshal(&visionRequest{Requests: []*visionImageRequest{request}})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := v.url
+	if v.key != "" {
+		endpoint += "?key=" + url.QueryEscape(v.key)
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("vision API returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var result visionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Responses) != 1 {
+		return nil, fmt.Errorf("vision API returned %d responses", len(result.Responses))
+	}
+	r := result.Responses[0]
+	if r.Error != nil {
+		return nil, fmt.Errorf("vision API error %d: %s", r.Error.Code, r.Error.Message)
+	}
+
+	analysis := &ImageAnalysis{Faces: len(r.FaceAnnotations), Categories: make(map[string]Likelihood)}
+	for category, likelihood := range r.SafeSearch {
+		analysis.Categories[category] = visionLikelihoods[likelihood]
+	}
+	for _, label := range r.LabelAnnotations {
+		if label.Score >= VISION_MIN_LABEL_SCORE {
+			analysis.Labels = append(analysis.Labels, strings.ToLower(label.Description))
+		}
+	}
+	return analysis, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+)
+
+// Images are stored without their metadata. Cameras and phones record the
+// GPS position of a photo in its EXIF, often more precise than the location
+// the user chose to share, so EXIF, XMP and comments are removed before an
+// image is stored. The EXIF orientation is applied to the pixels first, so
+// photos taken sideways still display upright. Images without an
+// orientation keep their encoded pixels untouched.
+const SANITIZED_JPEG_QUALITY = 90
+
+var errMalformedImage = errors.New("malformed image")
+
+// sanitizeImage strips the metadata of the image in f, of the sniffed
+// contentType, and applies its orientation. It returns the image to store,
+// its size and its content type, which only changes for WebP images that
+// had to be rotated: they are stored as PNG, there is no WebP encoder.
+func sanitizeImage(f io.ReadSeeker, contentType string) (io.ReadSeeker, int64, string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, "", err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var exif []byte
+	switch contentType {
+	case "image/jpeg":
+		data, exif, err = stripJPEG(data)
+	case "image/png":
+		data, exif, err = stripPNG(data)
+	case "image/webp":
+		data, exif, err = stripWebP(data)
+	}
+	// GIF has no EXIF
+	if err != nil {
+		return nil, 0, "", errUnsupportedImage
+	}
+
+	orientation := exifOrientation(exif)
+	if orientation > 1 {
+		if data, contentType, err = orientImage(data, contentType, orientation); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return bytes.NewReader(data), int64(len(data)), contentType, nil
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment segments
+// of a JPEG and returns the EXIF it found. The color profile and the
+// compressed image are kept as they are.
+func stripJPEG(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, errMalformedImage
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	var exif []byte
+	for i := 2; ; {
+		// markers may be padded with fill bytes
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, nil, errMalformedImage
+		}
+		marker := data[i]
+		if marker == 0xD9 || marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			out = append(out, 0xFF, marker)
+			i++
+			if marker == 0xD9 {
+				return out, exif, nil
+			}
+			continue
+		}
+		if i+3 > len(data) {
+			return nil, nil, errMalformedImage
+		}
+		end := i + 1 + int(binary.BigEndian.Uint16(data[i+1:]))
+		if end > len(data) || end < i+3 {
+			return nil, nil, errMalformedImage
+		}
+		segment := data[i+3 : end]
+		switch marker {
+		case 0xE1:
+			if exif == nil && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				exif = segment[6:]
+			}
+		case 0xED, 0xFE:
+		case 0xDA:
+			// the entropy-coded data follows the start of scan up to the end
+			return append(append(out, 0xFF), data[i:]...), exif, nil
+		default:
+			out = append(append(out, 0xFF), data[i:end]...)
+		}
+		i = end
+	}
+}
+
+// strippedPNGChunks are the metadata chunks dropped from PNG images.
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG drops the metadata chunks of a PNG and returns the EXIF it
+// found.
+func stripPNG(data []byte) ([]byte, []byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, nil, errMalformedImage
+	}
+	out := append(make([]byte, 0, len(data)), signature...)
+	var exif []byte
+	for i := len(signature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, nil, errMalformedImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i+12 {
+			return nil, nil, errMalformedImage
+		}
+		kind := string(data[i+4 : i+8])
+		if kind == "eXIf" && exif == nil {
+			exif = data[i+8 : end-4]
+		}
+		if !strippedPNGChunks[kind] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, exif, nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP and returns the EXIF it
+// found.
+func stripWebP(data []byte) ([]byte, []byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, nil, errMalformedImage
+	}
+	out := append(make([]byte, 0, len(data)), data[:12]...)
+	var exif []byte
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, nil, errMalformedImage
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i+8 {
+			return nil, nil, errMalformedImage
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			if exif == nil {
+				exif = bytes.TrimPrefix(data[i+8:i+8+size], []byte("Exif\x00\x00"))
+			}
+		case "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				// clear the EXIF and XMP flags
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, exif, nil
+}
+
+// exifOrientation reads the orientation, 1 to 8, from the first IFD of
+// exif, a TIFF structure. It is 0 when there is none.
+func exifOrientation(exif []byte) int {
+	if len(exif) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return 0
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			return 0
+		}
+		// a SHORT, stored in the first bytes of the value
+		if order.Uint16(exif[entry:]) == 0x0112 && order.Uint16(exif[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(exif[entry+8:])); orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientImage turns the image in data upright according to its EXIF
+// orientation and encodes it again. Images too large to decode, the same
+// bound as thumbnails, are kept as they are.
+func orientImage(data []byte, contentType string, orientation int) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUnsupportedImage
+	}
+	if config.Width*config.Height > THUMBNAIL_MAX_PIXELS {
+		return data, contentType, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUnsupportedImage
+	}
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	dst := orient(src, orientation)
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: SANITIZED_JPEG_QUALITY})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// orient returns a copy of src flipped and rotated as EXIF orientation
+// requires to display it upright.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// the pixel of src shown at x, y
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// exifWithOrientation is a little-endian TIFF structure with an orientation
+// and a made-up GPS position in the image description.
+func exifWithOrientation(orientation uint16) []byte {
+	const description = "GPS 40.7128N 74.0060W\x00"
+	exif := []byte("II\x2a\x00\x08\x00\x00\x00")
+	exif = binary.LittleEndian.AppendUint16(exif, 2)
+	// orientation, a SHORT
+	exif = binary.LittleEndian.AppendUint16(exif, 0x0112)
+	exif = binary.LittleEndian.AppendUint16(exif, 3)
+	exif = binary.LittleEndian.AppendUint32(exif, 1)
+	exif = binary.LittleEndian.AppendUint32(exif, uint32(orientation))
+	// image description, an ASCII string after the IFD
+	exif = binary.LittleEndian.AppendUint16(exif, 0x010E)
+	exif = binary.LittleEndian.AppendUint16(exif, 2)
+	exif = binary.LittleEndian.AppendUint32(exif, uint32(len(description)))
+	exif = binary.LittleEndian.AppendUint32(exif, uint32(len(exif)+8))
+	exif = binary.LittleEndian.AppendUint32(exif, 0)
+	return append(exif, description...)
+}
+
+// halvesImage is 16x8, red on the left and blue on the right.
+func halvesImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 8 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// exifJPEG is halvesImage as a JPEG with the EXIF of orientation.
+func exifJPEG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, halvesImage(), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte("Exif\x00\x00"), exifWithOrientation(orientation)...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte(nil), data[:2]...), append(app1, segment...)...), data[2:]...)
+}
+
+// pngChunk encodes a PNG chunk of kind with data.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(append(chunk, kind...), data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func isBlue(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return b > 0xC000 && r < 0x4000 && g < 0x4000
+}
+
+func TestSanitizeImage(t *testing.T) {
+	t.Run("jpeg keeps its pixels", func(t *testing.T) {
+		data := exifJPEG(t, 1)
+		clean, size, contentType, err := sanitizeImage(bytes.NewReader(data), "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(clean)
+		if contentType != "image/jpeg" || int64(len(out)) != size {
+			t.Errorf("content type %q, size %d of %d bytes", contentType, size, len(out))
+		}
+		if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("GPS")) {
+			t.Error("EXIF kept")
+		}
+		// only the EXIF segment is gone
+		if len(data)-len(out) != len(exifWithOrientation(1))+10 {
+			t.Errorf("%d bytes removed", len(data)-len(out))
+		}
+	})
+
+	t.Run("jpeg is turned upright", func(t *testing.T) {
+		clean, _, _, err := sanitizeImage(bytes.NewReader(exifJPEG(t, 6)), "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(clean)
+		if bytes.Contains(out, []byte("GPS")) {
+			t.Error("EXIF kept")
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// rotated clockwise, the left half is on top
+		if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 {
+			t.Fatalf("bounds = %v, want 8x16", b)
+		}
+		if !isRed(img.At(4, 2)) || !isBlue(img.At(4, 13)) {
+			t.Errorf("top %v, bottom %v, want red over blue", img.At(4, 2), img.At(4, 13))
+		}
+	})
+
+	t.Run("png", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, halvesImage()); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		// after the signature and IHDR
+		var withMeta []byte
+		withMeta = append(withMeta, data[:33]...)
+		withMeta = append(withMeta, pngChunk("eXIf", exifWithOrientation(3))...)
+		withMeta = append(withMeta, pngChunk("tEXt", []byte("Comment\x00taken at home"))...)
+		withMeta = append(withMeta, data[33:]...)
+
+		clean, _, contentType, err := sanitizeImage(bytes.NewReader(withMeta), "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(clean)
+		if bytes.Contains(out, []byte("GPS")) || bytes.Contains(out, []byte("home")) {
+			t.Error("metadata kept")
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil || contentType != "image/png" {
+			t.Fatalf("decode %q: %v", contentType, err)
+		}
+		// rotated by 180 degrees
+		if !isBlue(img.At(2, 4)) || !isRed(img.At(13, 4)) {
+			t.Errorf("left %v, right %v, want blue and red", img.At(2, 4), img.At(13, 4))
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		data := exifJPEG(t, 1)
+		if _, _, _, err := sanitizeImage(bytes.NewReader(data[:20]), "image/jpeg"); err != errUnsupportedImage {
+			t.Errorf("err = %v, want errUnsupportedImage", err)
+		}
+	})
+}
+
+func TestExifOrientation(t *testing.T) {
+	if got := exifOrientation(exifWithOrientation(8)); got != 8 {
+		t.Errorf("orientation = %d, want 8", got)
+	}
+	for _, exif := range [][]byte{nil, []byte("II\x2a\x00\xff\xff\x00\x00"), exifWithOrientation(9)} {
+		if got := exifOrientation(exif); got != 0 {
+			t.Errorf("orientation of %q = %d, want 0", exif, got)
+		}
+	}
+}
+
+func TestHandlePostStripsExif(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "sideways", "lat": "37.5", "lon": "-122.1"}, exifJPEG(t, 6))
+
+	w := s.do(authorized(t, r, "erin"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	stored := s.blobs.blobs[p.MediaKey]
+	if bytes.Contains(stored, []byte("GPS")) {
+		t.Error("stored image kept its EXIF")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stored))
+	if err != nil || config.Width != 8 || config.Height != 16 {
+		t.Errorf("stored image %dx%d, %v, want 8x16", config.Width, config.Height, err)
+	}
+}
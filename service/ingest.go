@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queued post ingestion. With an INGEST_QUEUE, POST /post answers 202 once
+// the media is stored and the post is published to the queue, and
+// INGEST_WORKERS consumers index it, record its media references, start
+// transcoding and write it to BigTable. ElasticSearch or BigTable being
+// down then delays new posts rather than failing them: a message is only
+// acknowledged once the post is indexed, and redelivered otherwise.
+// Instances with no INGEST_WORKERS only publish. The queue is "pubsub",
+// the Cloud Pub/Sub PUBSUB_TOPIC read through PUBSUB_SUBSCRIPTION, or
+// "memory" within the process for development. All are loaded from the
+// ServiceConfig at startup.
+var (
+	INGEST_QUEUE        = "none"
+	INGEST_WORKERS      = 2
+	PUBSUB_PROJECT      = ""
+	PUBSUB_TOPIC        = ""
+	PUBSUB_SUBSCRIPTION = ""
+)
+
+var INGEST_QUEUES = []string{"none", "pubsub", "memory"}
+
+const (
+	// INGEST_RETRY_DELAY is how long a post that failed to be ingested
+	// waits before it is tried again by the memory queue.
+	INGEST_RETRY_DELAY = 5 * time.Second
+	MEMORY_INGEST_SIZE = 1000
+)
+
+// IngestMessage is a new post whose media is stored, to be ingested.
+type IngestMessage struct {
+	Post        *Post  `json:"post"`
+	ContentType string `json:"content_type"` // of the media
+}
+
+// PostQueue carries new posts from the handlers to the consumers.
+type PostQueue interface {
+	Publish(ctx context.Context, msg *IngestMessage) error
+	// Receive passes messages to handle until ctx is done. A message is
+	// acknowledged when handle returns nil, and redelivered otherwise.
+	Receive(ctx context.Context, handle func(context.Context, *IngestMessage) error) error
+}
+
+func newPostQueue(ctx context.Context) (PostQueue, error) {
+	switch INGEST_QUEUE {
+	case "none":
+		return nil, nil
+	case "pubsub":
+		return newPubSubQueue(ctx, PUBSUB_PROJECT, PUBSUB_TOPIC, PUBSUB_SUBSCRIPTION)
+	case "memory":
+		return newMemoryQueue(MEMORY_INGEST_SIZE), nil
+	default:
+		return nil, fmt.Errorf("unknown ingest queue %q", INGEST_QUEUE)
+	}
+}
+
+// queuePost publishes the new post p, whose media of contentType is
+// stored already. The media is deleted if p can't be queued.
+func (a *App) queuePost(ctx context.Context, p *Post, contentType string) (*Post, error) {
+	reqLog := logFor(ctx)
+	if err := a.Ingest.Publish(ctx, &IngestMessage{Post: p, ContentType: contentType}); err != nil {
+		for _, key := range mediaKeys(p) {
+			if err := a.Blobs.Delete(context.Background(), key); err != nil {
+				reqLog.Error("failed to clean up image", "id", p.Id, "key", key, "err", err)
+			}
+		}
+		reqLog.Error("failed to queue post", "id", p.Id, "err", err)
+		return nil, err
+	}
+	reqLog.Info("queued post", "id", p.Id, "user", p.User, "status", p.Status)
+
+	out := []Post{*p}
+	signMediaURLs(out)
+	return &out[0], nil
+}
+
+// ingestPost stores and publishes a post received from the queue.
+func (a *App) ingestPost(ctx context.Context, msg *IngestMessage) error {
+	p := msg.Post
+	if p == nil || p.Id == "" {
+		// redelivering it won't help
+		fmt.Println("Dropped a queued message without a post")
+		return nil
+	}
+	if err := a.Posts.Save(ctx, p.Id, p); err != nil {
+		fmt.Printf("Failed to ingest post %s, it will be retried %v.\n", p.Id, err)
+		return err
+	}
+	fmt.Printf("Ingested post %s\n", p.Id)
+	a.finishPost(ctx, p, msg.ContentType)
+	return nil
+}
+
+// startIngestConsumers starts INGEST_WORKERS consumers of the queue, if
+// any, and returns the function stopping them. The messages being handled
+// are finished first.
+func (a *App) startIngestConsumers() func() {
+	if a.Ingest == nil || INGEST_WORKERS == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < INGEST_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := a.Ingest.Receive(ctx, a.ingestPost); err != nil && ctx.Err() == nil {
+					fmt.Printf("Failed to receive queued posts %v.\n", err)
+					select {
+					case <-time.After(INGEST_RETRY_DELAY):
+					case <-ctx.Done():
+					}
+				}
+			}
+		}()
+	}
+	fmt.Printf("Post ingestion started with %d consumers of the %s queue\n", INGEST_WORKERS, INGEST_QUEUE)
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// memoryQueue is a PostQueue within the process. Its messages are lost on
+// restart.
+type memoryQueue struct {
+	messages chan *IngestMessage
+}
+
+func newMemoryQueue(size int) *memoryQueue {
+	return &memoryQueue{messages: make(chan *IngestMessage, size)}
+}
+
+func (q *memoryQueue) Publish(ctx context.Context, msg *IngestMessage) error {
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return fmt.Errorf("ingest queue is full")
+	}
+}
+
+func (q *memoryQueue) Receive(ctx context.Context, handle func(context.Context, *IngestMessage) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-q.messages:
+			// the shutdown shouldn't cut a post in half
+			if err := handle(context.Background(), msg); err != nil {
+				time.AfterFunc(INGEST_RETRY_DELAY, func() { q.messages <- msg })
+			}
+		}
+	}
+}
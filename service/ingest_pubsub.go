@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// PUBSUB_PULL_SIZE is how many messages one pull returns at most.
+const PUBSUB_PULL_SIZE = 10
+
+// pubSubQueue is a PostQueue on a Cloud Pub/Sub topic and subscription,
+// with the application default credentials. Messages the consumers fail
+// on are redelivered by Pub/Sub, into a dead letter topic if the
+// subscription has one.
+type pubSubQueue struct {
+	service      *pubsub.Service
+	topic        string
+	subscription string
+}
+
+func newPubSubQueue(ctx context.Context, project, topic, subscription string) (*pubSubQueue, error) {
+	service, err := pubsub.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	return &pubSubQueue{
+		service:      service,
+		topic:        "projects/" + project + "/topics/" + topic,
+		subscription: "projects/" + project + "/subscriptions/" + subscription,
+	}, nil
+}
+
+func (q *pubSubQueue) Publish(ctx context.Context, msg *IngestMessage) error {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = q.service.Projects.Topics.Publish(q.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(js),
+			Attributes: map[string]string{"post_id": msg.Post.Id},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
+
+func (q *pubSubQueue) Receive(ctx context.Context, handle func(context.Context, *IngestMessage) error) error {
+	for ctx.Err() == nil {
+		resp, err := q.service.Projects.Subscriptions.Pull(q.subscription, &pubsub.PullRequest{
+			MaxMessages: PUBSUB_PULL_SIZE,
+		}).Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		var acks, nacks []string
+		for _, received := range resp.ReceivedMessages {
+			var msg IngestMessage
+			data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+			if err == nil {
+				err = json.Unmarshal(data, &msg)
+			}
+			if err != nil {
+				// redelivering it won't help
+				fmt.Printf("Dropped malformed message %s %v.\n", received.Message.MessageId, err)
+				acks = append(acks, received.AckId)
+				continue
+			}
+			// the shutdown shouldn't cut a post in half
+			if handle(context.Background(), &msg) != nil {
+				nacks = append(nacks, received.AckId)
+			} else {
+				acks = append(acks, received.AckId)
+			}
+		}
+
+		// answered even when shutting down, so nothing waits for its deadline
+		if len(acks) > 0 {
+			if _, err := q.service.Projects.Subscriptions.Acknowledge(q.subscription, &pubsub.AcknowledgeRequest{AckIds: acks}).Context(context.Background()).Do(); err != nil {
+				return err
+			}
+		}
+		if len(nacks) > 0 {
+			if _, err := q.service.Projects.Subscriptions.ModifyAckDeadline(q.subscription, &pubsub.ModifyAckDeadlineRequest{AckIds: nacks, AckDeadlineSeconds: 0, ForceSendFields: []string{"AckDeadlineSeconds"}}).Context(context.Background()).Do(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
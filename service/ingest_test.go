@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// failingPostStore is a PostStore whose saves fail with err.
+type failingPostStore struct {
+	PostStore
+	err error
+}
+
+func (s *failingPostStore) Save(ctx context.Context, id string, p *Post) error {
+	return s.err
+}
+
+func TestQueuedPostIngestion(t *testing.T) {
+	s := newTestServer(t)
+	s.Ingest = newMemoryQueue(10)
+
+	r := newPostRequest(t, map[string]string{"message": "queued", "lat": "37.5", "lon": "-122.1"}, testPNG(t))
+	w := s.do(authorized(t, r, "quinn"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Id == "" {
+		t.Fatalf("body %s, %v: want the post", w.Body, err)
+	}
+	if !s.blobs.has(p.Id) {
+		t.Error("media isn't stored before the post is queued")
+	}
+	if _, err := s.posts.Get(context.Background(), p.Id); err != errPostNotFound {
+		t.Errorf("Get before ingestion = %v, want errPostNotFound", err)
+	}
+
+	stop := s.startIngestConsumers()
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := s.posts.Get(context.Background(), p.Id)
+		if err == nil {
+			if got.Message != "queued" || got.User != "quinn" {
+				t.Errorf("ingested %+v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the post wasn't ingested")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIngestPostFailure(t *testing.T) {
+	s := newTestServer(t)
+	down := errors.New("elasticsearch is down")
+	s.Posts = &failingPostStore{PostStore: s.posts, err: down}
+
+	if err := s.ingestPost(context.Background(), &IngestMessage{Post: &Post{Id: "p1", User: "quinn"}}); err != down {
+		t.Errorf("ingestPost = %v, want the save error so the post is redelivered", err)
+	}
+	if err := s.ingestPost(context.Background(), &IngestMessage{}); err != nil {
+		t.Errorf("ingestPost without a post = %v, want it dropped", err)
+	}
+}
@@ -0,0 +1,176 @@
+//go:build integration
+
+package main
+
+// Integration tests run the ElasticSearch PostStore and the GCS BlobStore
+// against real servers in Docker, started with testcontainers:
+//
+//	go test -tags integration ./...
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/olivere/elastic/v7"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	ES_TEST_IMAGE       = "docker.elastic.co/elasticsearch/elasticsearch:7.17.22"
+	FAKE_GCS_TEST_IMAGE = "fsouza/fake-gcs-server:1.49"
+)
+
+// startContainer starts req and returns the host address of its port. The
+// test is skipped when Docker isn't available.
+func startContainer(t *testing.T, req testcontainers.ContainerRequest) string {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatalf("start %s: %v", req.Image, err)
+	}
+	t.Cleanup(func() { c.Terminate(context.Background()) })
+
+	// each container exposes one port
+	addr, err := c.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// withElasticSearch points esClient at a fresh ElasticSearch with the
+// service's indexes for the duration of t.
+func withElasticSearch(t *testing.T) {
+	addr := startContainer(t, testcontainers.ContainerRequest{
+		Image:        ES_TEST_IMAGE,
+		ExposedPorts: []string{"9200/tcp"},
+		Env: map[string]string{
+			"discovery.type":         "single-node",
+			"xpack.security.enabled": "false",
+			"ES_JAVA_OPTS":           "-Xms512m -Xmx512m",
+		},
+		WaitingFor: wait.ForHTTP("/_cluster/health?wait_for_status=yellow").
+			WithPort("9200/tcp").
+			WithStartupTimeout(3 * time.Minute),
+	})
+
+	client, err := elastic.NewClient(elastic.SetURL("http://"+addr), elastic.SetSniff(false))
+	if err != nil {
+		t.Fatalf("connect to ElasticSearch: %v", err)
+	}
+	saved := esClient
+	esClient = client
+	t.Cleanup(func() { esClient = saved })
+	createIndexIfNotExist()
+}
+
+func TestESPostStore(t *testing.T) {
+	withElasticSearch(t)
+	ctx := context.Background()
+	store := &esPostStore{}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	posts := map[string]*Post{
+		"near":  {User: "alice", Message: "Ferry building", Location: Location{Lat: 37.7955, Lon: -122.3937}, Timestamp: now, Status: STATUS_PUBLISHED},
+		"draft": {User: "alice", Message: "draft", Location: Location{Lat: 37.7749, Lon: -122.4194}, Timestamp: now, Status: STATUS_DRAFT},
+		"far":   {User: "bob", Message: "Times Square", Location: Location{Lat: 40.758, Lon: -73.9855}, Timestamp: now, Status: STATUS_PUBLISHED},
+	}
+	for id, p := range posts {
+		if err := store.Save(ctx, id, p); err != nil {
+			t.Fatalf("Save %s: %v", id, err)
+		}
+	}
+
+	got, err := store.Get(ctx, "near")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Message != "Ferry building" || !got.Timestamp.Equal(now) {
+		t.Errorf("Get = %+v", got)
+	}
+
+	found, total, err := store.Search(ctx, &GeoQuery{Lat: 37.7749, Lon: -122.4194, Distance: "20km"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if total != 1 || len(found) != 1 || found[0].Id != "near" {
+		t.Errorf("Search = %v (total %d), want [near]", found, total)
+	}
+
+	if count, err := store.Count(ctx, "alice"); err != nil || count != 2 {
+		t.Errorf("Count = %d, %v, want 2", count, err)
+	}
+
+	if err := store.Delete(ctx, "near"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "near"); err != errPostNotFound {
+		t.Errorf("Get after Delete: err = %v, want errPostNotFound", err)
+	}
+}
+
+func TestGCSStore(t *testing.T) {
+	addr := startContainer(t, testcontainers.ContainerRequest{
+		Image:        FAKE_GCS_TEST_IMAGE,
+		ExposedPorts: []string{"4443/tcp"},
+		Cmd:          []string{"-scheme", "http", "-port", "4443"},
+		WaitingFor:   wait.ForHTTP("/storage/v1/b").WithPort("4443/tcp"),
+	})
+	// the storage client talks to STORAGE_EMULATOR_HOST instead of GCS
+	os.Setenv("STORAGE_EMULATOR_HOST", addr)
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Bucket("around-test").Create(ctx, "test", nil); err != nil {
+		t.Fatalf("create bucket: %v", err)
+	}
+
+	store, err := newGCSStore(ctx, "around-test")
+	if err != nil {
+		t.Fatalf("newGCSStore: %v", err)
+	}
+	data := []byte("not really an image")
+	opts := &PutOptions{ContentType: "image/png", Size: int64(len(data)), Private: true}
+	if _, size, err := store.Put(ctx, "post-1", bytes.NewReader(data), opts); err != nil || size != int64(len(data)) {
+		t.Fatalf("Put = %d, %v", size, err)
+	}
+
+	r, err := store.Get(ctx, "post-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+
+	// a short upload keeps nothing
+	short := &PutOptions{ContentType: "image/png", Size: 100, Private: true}
+	if _, _, err := store.Put(ctx, "post-2", bytes.NewReader(data), short); err == nil {
+		t.Error("short Put succeeded")
+	}
+
+	if err := store.Delete(ctx, "post-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "post-1"); err == nil {
+		t.Error("Get after Delete succeeded")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tokenExtractor finds the token of a request, "" when there is none.
+type tokenExtractor func(r *http.Request) (string, error)
+
+// JWTMiddleware validates the bearer token of a request and stores the
+// token in the request context under "user", where claimsFromRequest
+// finds it.
+type JWTMiddleware struct {
+	// optional lets requests without a token through anonymously; an
+	// invalid token is still rejected.
+	optional bool
+	extract  tokenExtractor
+}
+
+func (m *JWTMiddleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS preflights carry no credentials
+		if r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		tokenString, err := m.extract(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if tokenString == "" {
+			if m.optional {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Required authorization token not found", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := parseToken(tokenString, jwtValidationKey)
+		if err != nil {
+			if errors.Is(err, errUserBanned) {
+				http.Error(w, errUserBanned.Error(), http.StatusUnauthorized)
+			} else {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+			}
+			fmt.Printf("Rejected token %v.\n", err)
+			return
+		}
+		next := h
+		// handlers reject unusable claims themselves
+		if claims, err := claimsFromToken(token); err == nil {
+			next = auditRequests(h, claims)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", token)))
+	})
+}
+
+// tokenFromAuthHeader reads an "Authorization: Bearer <token>" header.
+func tokenFromAuthHeader(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", nil
+	}
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return "", errors.New("Authorization header format must be Bearer {token}")
+	}
+	return parts[1], nil
+}
+
+// tokenFromParameter reads the token from the query parameter param.
+func tokenFromParameter(param string) tokenExtractor {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(param), nil
+	}
+}
+
+// firstToken tries extractors in turn until one finds a token.
+func firstToken(extractors ...tokenExtractor) tokenExtractor {
+	return func(r *http.Request) (string, error) {
+		for _, extract := range extractors {
+			token, err := extract(r)
+			if err != nil || token != "" {
+				return token, err
+			}
+		}
+		return "", nil
+	}
+}
+
+// newJWTMiddleware validates the bearer token of a request. With optional
+// set, requests without a token pass through anonymously, but an invalid
+// token, or the token of a banned user, is still rejected.
+func newJWTMiddleware(optional bool) *JWTMiddleware {
+	return &JWTMiddleware{optional: optional, extract: tokenFromAuthHeader}
+}
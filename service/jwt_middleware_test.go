@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTMiddleware(t *testing.T) {
+	expired, _ := signingKeys.sign(jwt.MapClaims{"username": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	noExpiry, _ := signingKeys.sign(jwt.MapClaims{"username": "alice"})
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte("not the signing key"))
+
+	tests := []struct {
+		name     string
+		optional bool
+		header   string
+		want     int
+	}{
+		{"valid", false, "Bearer " + tokenFor(t, "alice"), http.StatusOK},
+		{"missing", false, "", http.StatusUnauthorized},
+		{"missing optional", true, "", http.StatusOK},
+		{"invalid optional", true, "Bearer " + forged, http.StatusUnauthorized},
+		{"not bearer", false, "Basic YWxpY2U6cHc=", http.StatusUnauthorized},
+		{"expired", false, "Bearer " + expired, http.StatusUnauthorized},
+		{"no expiry", false, "Bearer " + noExpiry, http.StatusUnauthorized},
+		{"forged", false, "Bearer " + forged, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user = viewerName(r)
+			})
+			m := newJWTMiddleware(tt.optional)
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			m.Handler(next).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && tt.header != "" && user != "alice" {
+				t.Errorf("user = %q, want alice", user)
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareBannedUser(t *testing.T) {
+	token := tokenFor(t, "mallory")
+	bans.mu.Lock()
+	bans.users["mallory"] = &Ban{Username: "mallory"}
+	bans.mu.Unlock()
+	defer func() {
+		bans.mu.Lock()
+		delete(bans.users, "mallory")
+		bans.mu.Unlock()
+	}()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	newJWTMiddleware(false).Handler(http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Likes are kept in their own index, one document per user and post, so
+// liking is idempotent and never rewrites the post document.
+const (
+	LIKE_INDEX = "like"
+)
+
+const LIKE_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "post_id": {
+                "type": "keyword"
+            },
+            "user": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Like records that User liked post PostId. Its document id is likeId.
+type Like struct {
+	PostId    string    `json:"post_id"`
+	User      string    `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// LikeStatus is the response of liking or unliking a post.
+type LikeStatus struct {
+	PostId string `json:"post_id"`
+	Likes  int64  `json:"likes"`
+	Liked  bool   `json:"liked"`
+}
+
+// likeId is the document id of user's like of a post. Usernames can't
+// contain ':'.
+func likeId(postId, user string) string {
+	return postId + ":" + user
+}
+
+// handleLike lets the caller like a post. Liking a post twice is a no-op.
+func (a *App) handleLike(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for liking a post")
+	a.setLike(w, r, true)
+}
+
+// handleUnlike withdraws the caller's like of a post, if any.
+func (a *App) handleUnlike(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for unliking a post")
+	a.setLike(w, r, false)
+}
+
+func (a *App) setLike(w http.ResponseWriter, r *http.Request, liked bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p := a.readablePost(w, r, id, claims.Username)
+	if p == nil {
+		return
+	}
+
+	if liked {
+		created, err := saveLike(r.Context(), &Like{PostId: id, User: claims.Username, Timestamp: time.Now().UTC()})
+		if err != nil {
+			http.Error(w, "Failed to save like to ElasticSearch", http.StatusInternalServerError)
+			fmt.Printf("Failed to save like of post %s by %s %v.\n", id, claims.Username, err)
+			return
+		}
+		if created {
+			bumpEngagement(r.Context(), p, FIELD_LIKE_COUNT, 1)
+			notify(p.User, claims.Username, NOTIFY_LIKE, id)
+		}
+	} else {
+		deleted, err := deleteLike(r.Context(), id, claims.Username)
+		if err != nil {
+			http.Error(w, "Failed to delete like from ElasticSearch", http.StatusInternalServerError)
+			fmt.Printf("Failed to delete like of post %s by %s %v.\n", id, claims.Username, err)
+			return
+		}
+		if deleted {
+			bumpEngagement(r.Context(), p, FIELD_LIKE_COUNT, -1)
+		}
+	}
+
+	count, err := countLikes(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Failed to count likes", http.StatusInternalServerError)
+		fmt.Printf("Failed to count likes of post %s %v.\n", id, err)
+		return
+	}
+
+	js, err := json.Marshal(&LikeStatus{PostId: id, Likes: count, Liked: liked})
+	if err != nil {
+		http.Error(w, "Failed to parse like into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse like into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// saveLike stores like and reports whether it is new. The write is visible
+// to searches before it returns, so the count that follows includes it.
+func saveLike(ctx context.Context, like *Like) (bool, error) {
+	client := esClient
+
+	_, err := client.Index().
+		Index(LIKE_INDEX).
+		Id(likeId(like.PostId, like.User)).
+		OpType("create").
+		BodyJson(like).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteLike removes user's like of a post and reports whether there was
+// one.
+func deleteLike(ctx context.Context, postId, user string) (bool, error) {
+	client := esClient
+
+	_, err := client.Delete().
+		Index(LIKE_INDEX).
+		Id(likeId(postId, user)).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func countLikes(ctx context.Context, postId string) (int64, error) {
+	client := esClient
+
+	return client.Count(LIKE_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Do(ctx)
+}
+
+// deleteLikes drops the likes of a deleted post; failures are only logged.
+func deleteLikes(postId string) {
+	client := esClient
+
+	_, err := client.DeleteByQuery(LIKE_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to delete likes of post %s %v.\n", postId, err)
+	}
+}
+
+// annotateLikes fills in the like count of posts and whether viewer liked
+// them, with one aggregation over the like index.
+func annotateLikes(ctx context.Context, posts []Post, viewer string) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(posts))
+	for i := range posts {
+		ids[i] = posts[i].Id
+	}
+
+	client := esClient
+	byPost := elastic.NewTermsAggregation().Field("post_id").Size(len(posts))
+	search := client.Search().
+		Index(LIKE_INDEX).
+		Query(elastic.NewTermsQuery("post_id", ids...)).
+		Size(0).
+		Aggregation("likes", byPost)
+	if viewer != "" {
+		search = search.Aggregation("mine", elastic.NewFilterAggregation().
+			Filter(elastic.NewTermQuery("user", viewer)).
+			SubAggregation("posts", byPost))
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return err
+	}
+	observeQuery(ctx, "likes", searchResult.TookInMillis, map[string]interface{}{"posts": len(posts)})
+
+	counts := make(map[string]int64)
+	if agg, found := searchResult.Aggregations.Terms("likes"); found {
+		for _, bucket := range agg.Buckets {
+			if key, ok := bucket.Key.(string); ok {
+				counts[key] = bucket.DocCount
+			}
+		}
+	}
+	mine := make(map[string]bool)
+	if filter, found := searchResult.Aggregations.Filter("mine"); found {
+		if agg, found := filter.Terms("posts"); found {
+			for _, bucket := range agg.Buckets {
+				if key, ok := bucket.Key.(string); ok {
+					mine[key] = true
+				}
+			}
+		}
+	}
+
+	for i := range posts {
+		posts[i].Likes = counts[posts[i].Id]
+		posts[i].LikedByMe = mine[posts[i].Id]
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// LIVE_EVENT_BUFFER is how many new posts may queue up for fan-out before
+	// handlers start dropping them instead of waiting.
+	LIVE_EVENT_BUFFER = 1024
+	// LIVE_SUBSCRIBER_BUFFER is how many posts a slow subscriber may fall
+	// behind before its oldest pending posts are dropped.
+	LIVE_SUBSCRIBER_BUFFER = 16
+)
+
+// Subscriber receives the new posts within RangeKm of a point.
+type Subscriber struct {
+	Lat     float64
+	Lon     float64
+	RangeKm float64
+	C       chan Post
+}
+
+// Broadcaster fans new posts out to live subscribers. Publishing only
+// enqueues; a dedicated goroutine does the fan-out, so post latency doesn't
+// depend on the number of listeners. It also hands direct messages to the
+// inboxes of their recipients connected to this instance.
+type Broadcaster struct {
+	events      chan Post
+	mu          sync.RWMutex
+	subscribers map[*Subscriber]bool
+	inboxes     map[string]map[chan Message]bool
+	dropped     int64
+}
+
+func newBroadcaster() *Broadcaster {
+	b := &Broadcaster{
+		events:      make(chan Post, LIVE_EVENT_BUFFER),
+		subscribers: make(map[*Subscriber]bool),
+		inboxes:     make(map[string]map[chan Message]bool),
+	}
+	go b.run()
+	return b
+}
+
+// Publish queues p for fan-out without blocking.
+func (b *Broadcaster) Publish(p Post) {
+	select {
+	case b.events <- p:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+		fmt.Printf("Live event queue is full, dropped post %s\n", p.Id)
+	}
+}
+
+func (b *Broadcaster) Subscribe(lat, lon, rangeKm float64) *Subscriber {
+	s := &Subscriber{Lat: lat, Lon: lon, RangeKm: rangeKm, C: make(chan Post, LIVE_SUBSCRIBER_BUFFER)}
+	b.mu.Lock()
+	b.subscribers[s] = true
+	b.mu.Unlock()
+	return s
+}
+
+func (b *Broadcaster) Unsubscribe(s *Subscriber) {
+	b.mu.Lock()
+	delete(b.subscribers, s)
+	b.mu.Unlock()
+}
+
+// Listen returns an inbox receiving the direct messages sent to user until
+// Unlisten.
+func (b *Broadcaster) Listen(user string) chan Message {
+	inbox := make(chan Message, LIVE_SUBSCRIBER_BUFFER)
+	b.mu.Lock()
+	if b.inboxes[user] == nil {
+		b.inboxes[user] = make(map[chan Message]bool)
+	}
+	b.inboxes[user][inbox] = true
+	b.mu.Unlock()
+	return inbox
+}
+
+func (b *Broadcaster) Unlisten(user string, inbox chan Message) {
+	b.mu.Lock()
+	delete(b.inboxes[user], inbox)
+	if len(b.inboxes[user]) == 0 {
+		delete(b.inboxes, user)
+	}
+	b.mu.Unlock()
+}
+
+// Send hands m to every inbox of its recipient without blocking, and
+// reports whether the recipient has any. A full inbox misses m, which
+// stays readable with GET /conversations/{id}/messages.
+func (b *Broadcaster) Send(m Message) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for inbox := range b.inboxes[m.Recipient] {
+		select {
+		case inbox <- m:
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+		}
+	}
+	return len(b.inboxes[m.Recipient]) > 0
+}
+
+func (b *Broadcaster) run() {
+	for p := range b.events {
+		b.mu.RLock()
+		for s := range b.subscribers {
+			if haversineKm(s.Lat, s.Lon, p.Location.Lat, p.Location.Lon) <= s.RangeKm {
+				b.deliver(s, p)
+			}
+		}
+		b.mu.RUnlock()
+	}
+}
+
+// deliver hands p to s, dropping the subscriber's oldest pending post when
+// it has fallen LIVE_SUBSCRIBER_BUFFER posts behind.
+func (b *Broadcaster) deliver(s *Subscriber, p Post) {
+	for {
+		select {
+		case s.C <- p:
+			return
+		default:
+		}
+		select {
+		case <-s.C:
+			atomic.AddInt64(&b.dropped, 1)
+		default:
+		}
+	}
+}
+
+// LiveStats is the live section of /stats.
+type LiveStats struct {
+	Subscribers int   `json:"subscribers"`
+	Queued      int   `json:"queued"`
+	Dropped     int64 `json:"dropped"`
+}
+
+func (b *Broadcaster) Stats() *LiveStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return &LiveStats{
+		Subscribers: len(b.subscribers),
+		Queued:      len(b.events),
+		Dropped:     atomic.LoadInt64(&b.dropped),
+	}
+}
+
+// handleLive streams new posts near lat/lon to the client as server-sent
+// events until it disconnects, but not those of the users it blocked or
+// muted when it connected.
+func (a *App) handleLive(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for live posts")
+
+	if !requireFlag(w, FLAG_LIVE) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	ran, err := rangeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	km, _ := parseKm(ran)
+
+	users, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+	hidden := make(map[string]bool, len(users))
+	for _, u := range users {
+		hidden[u] = true
+	}
+
+	viewer := viewerName(r)
+	sub := a.Live.Subscribe(lat, lon, km)
+	defer a.Live.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-serverClosing:
+			return
+		case p := <-sub.C:
+			if hidden[p.User] {
+				continue
+			}
+			posts := []Post{p}
+			redactPosts(posts, viewer)
+			js, err := json.Marshal(posts[0])
+			if err != nil {
+				fmt.Printf("Failed to parse post into JSON format %v.\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: post\ndata: %s\n\n", js)
+			flusher.Flush()
+		}
+	}
+}
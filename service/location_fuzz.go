@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// LOCATION_FUZZ_RADIUS_METERS is how far a fuzzed post may be moved away
+// from where it was really written.
+const LOCATION_FUZZ_RADIUS_METERS = 200.0
+
+const metersPerDegreeLat = 111320.0
+
+// Privacy guarantees of fuzz_location:
+//
+//   - The perturbed coordinate is drawn once, when the post is created, and
+//     stored as the post's indexed location. Every read, search and distance
+//     ranking sees that same coordinate, so repeated queries can't be
+//     averaged to recover the real position of a single post.
+//   - The exact coordinate is kept in exact_location, which is not indexed
+//     and is stripped from every response unless the viewer is the author.
+//
+// Limits: the offset only hides the position within
+// LOCATION_FUZZ_RADIUS_METERS. Many fuzzed posts written from the same place
+// each get an independent offset, so their centroid still converges on the
+// real spot; the message or image may reveal the location too; and the exact
+// coordinate is still stored server-side.
+
+// fuzzLocation returns a point uniformly distributed within radius meters
+// of loc.
+func fuzzLocation(loc Location, radius float64) Location {
+	// sqrt keeps the distribution uniform over the disk instead of
+	// clustering around the center.
+	distance := radius * math.Sqrt(rand.Float64())
+	bearing := 2 * math.Pi * rand.Float64()
+
+	dLat := distance * math.Cos(bearing) / metersPerDegreeLat
+	dLon := 0.0
+	if cosLat := math.Cos(loc.Lat * math.Pi / 180); cosLat > 1e-9 {
+		dLon = distance * math.Sin(bearing) / (metersPerDegreeLat * cosLat)
+	}
+
+	return Location{
+		Lat: math.Max(-90, math.Min(90, loc.Lat+dLat)),
+		Lon: math.Mod(loc.Lon+dLon+540, 360) - 180,
+	}
+}
+
+// redactPosts removes the exact location of fuzzed posts that viewer didn't
+// write.
+func redactPosts(posts []Post, viewer string) {
+	for i := range posts {
+		if posts[i].User != viewer {
+			posts[i].ExactLocation = nil
+		}
+	}
+}
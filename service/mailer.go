@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Mail goes out through the MAILER: "smtp" through the server at SMTP_ADDR,
+// "sendgrid" through the SendGrid API, or "none" to send nothing. Every mail
+// comes from MAIL_FROM. With a mailer, new accounts verify their email
+// address before they can log in.
+var (
+	MAILER           = "none"
+	MAIL_FROM        = ""
+	SMTP_ADDR        = "" // host:port
+	SMTP_USERNAME    = ""
+	SMTP_PASSWORD    = ""
+	SENDGRID_API_KEY = ""
+)
+
+var MAILERS = []string{"none", "smtp", "sendgrid"}
+
+const MAILER_TIMEOUT = 10 * time.Second
+
+// Mailer sends plain text mail.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// mailer is the MAILER in use, nil for "none". It is set up by setupMailer.
+var mailer Mailer
+
+func setupMailer() error {
+	switch MAILER {
+	case "none":
+		mailer = nil
+	case "smtp":
+		mailer = newSMTPMailer(SMTP_ADDR, SMTP_USERNAME, SMTP_PASSWORD, MAIL_FROM)
+	case "sendgrid":
+		mailer = newSendGridMailer(SENDGRID_API_URL, SENDGRID_API_KEY, MAIL_FROM)
+	default:
+		return fmt.Errorf("unknown mailer %q", MAILER)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const SENDGRID_API_URL = "https://api.sendgrid.com/v3/mail/send"
+
+// sendGridMailer sends mail with the SendGrid v3 API.
+type sendGridMailer struct {
+	url    string
+	key    string
+	from   string
+	client *http.Client
+}
+
+func newSendGridMailer(apiURL, key, from string) *sendGridMailer {
+	return &sendGridMailer{url: apiURL, key: key, from: from, client: &http.Client{Timeout: MAILER_TIMEOUT}}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+}
+
+func (m *sendGridMailer) Send(ctx context.Context, to, subject, body string) error {
+	js, err := json.Marshal(&sendGridRequest{
+		Personalizations: []sendGridPersonalization{{To: []sendGridAddress{{Email: to}}}},
+		From:             sendGridAddress{Email: m.from},
+		Subject:          subject,
+		Content:          []sendGridContent{{Type: "text/plain", Value: body}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", m.url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+m.key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// mail is queued with a 202
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("sendgrid returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -2,334 +2,90 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"reflect"
-	"strconv"
-
-	"cloud.google.com/go/bigtable"
-	"cloud.google.com/go/storage"
-	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/gorilla/mux"
-	"github.com/olivere/elastic"
-	"github.com/pborman/uuid"
-	"google.golang.org/api/option"
-)
-
-const (
-	DISTANCE   = "200km"
-	POST_INDEX = "post" // ElasticSearch database
-	POST_TYPE  = "post" // ElasticSearch table
-
-	ES_URL          = "http://34.73.54.29:9200" // your ElasticSearch endpoint
-	BUCKET_NAME     = "zhida-post-around-image" // your GCS bucket name
-	ENABLE_BIGTABLE = false                     // Big table are currently closed due to extreme high cost
+	"os"
 )
 
-type Location struct {
-	Lat float64 `json:"lat"`
-	Lon float64 `json:"lon"`
-}
-
-type Post struct {
-	User     string   `json:"user"`
-	Message  string   `json:"message"`
-	Location Location `json:"location"`
-	Url      string   `json:"url"`
-}
-
 func main() {
-	fmt.Println("Around service, started")
-	createIndexIfNotExist()
-
-	// use jwdmiddleware to help send and protect the token
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return []byte(mySigningKey), nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
-	})
-
-	r := mux.NewRouter()
-
-	r.Handle("/post", jwtMiddleware.Handler(http.HandlerFunc(handlePost))).Methods("POST")
-	r.Handle("/search", jwtMiddleware.Handler(http.HandlerFunc(handleSearch))).Methods("GET")
-	r.Handle("/signup", http.HandlerFunc(handlerRegister)).Methods("POST")
-	r.Handle("/login", http.HandlerFunc(handlerLogin)).Methods("POST")
-
-	http.Handle("/", r)
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-func handlePost(w http.ResponseWriter, r *http.Request) {
-	// Parse from body of request to get a json object.
-	fmt.Println("Received one post request")
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-
-	lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
-	message := r.FormValue("message")
-
-	// filter spam
-	if hasFilteredWord(&message) {
-		http.Error(w, "Sorry, the post contains filtered words. Please edit again. ", http.StatusBadRequest)
-		fmt.Printf("Sorry, the post contains filtered words. Please edit again. \n")
-		return
-	}
-
-	p := &Post{
-		User:    r.FormValue("user"),
-		Message: r.FormValue("message"),
-		Location: Location{
-			Lat: lat,
-			Lon: lon,
-		},
-	}
-
-	id := uuid.New()
-	file, _, err := r.FormFile("image")
+	configPath := flag.String("config", os.Getenv(CONFIG_ENV_PREFIX+"CONFIG"), "path to a YAML or JSON config file")
+	migrate := flag.Bool("migrate", false, "copy indexes created by ElasticSearch 6 into typeless ones, then exit")
+	flag.Parse()
+	config, err := loadConfig(*configPath)
 	if err != nil {
-		http.Error(w, "Image is not available", http.StatusBadRequest)
-		fmt.Printf("Image is not available %v.\n", err)
-		return
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	attrs, err := saveToGCS(file, BUCKET_NAME, id)
-	if err != nil {
-		http.Error(w, "Failed to save image to GCS", http.StatusInternalServerError)
-		fmt.Printf("Failed to save image to GCS %v.\n", err)
-		return
+	config.apply()
+	if _, err := connectES(); err != nil {
+		log.Fatalf("Failed to connect to ElasticSearch: %v", err)
 	}
-	p.Url = attrs.MediaLink
-
-	err = saveToES(p, id)
-	if err != nil {
-		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to save post to ElasticSearch %v.\n", err)
+	if *migrate {
+		if err := migrateIndexes(context.Background()); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		fmt.Println("Migration done")
 		return
 	}
-	fmt.Printf("Saved one post to ElasticSearch: %s\n", p.Message)
 
-	if ENABLE_BIGTABLE {
-		saveToBigTable(p, id)
+	fmt.Println("Around service, started")
+	createIndexIfNotExist()
+	startForcemergeScheduler()
+	startWriteBatcher()
+	startFlagRefresher()
+	startBanRefresher()
+	if err := setupModeration(context.Background()); err != nil {
+		log.Fatalf("Failed to set up moderation: %v", err)
 	}
-
-}
-
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one request for search")
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-
-	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
-	ran := DISTANCE // range is optional
-	if val := r.URL.Query().Get("range"); val != "" {
-		ran = val + "km"
+	if err := setupMailer(); err != nil {
+		log.Fatalf("Failed to set up mailer: %v", err)
 	}
-
-	// Read posts from ElasticSearch
-	posts, err := readFromES(lat, lon, ran)
-	if err != nil {
-		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
-		return
+	if err := setupPush(); err != nil {
+		log.Fatalf("Failed to set up push notifications: %v", err)
 	}
-
-	// convert post to JSON format
-	js, err := json.Marshal(posts)
-	if err != nil {
-		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
-		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
-		return
+	if err := setupBigTable(context.Background()); err != nil {
+		log.Fatalf("Failed to connect to BigTable: %v", err)
 	}
-
-	w.Write(js)
-
-}
-
-/* Elastic Search */
-func createIndexIfNotExist() {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		panic(err)
+	if err := setupAnalytics(context.Background()); err != nil {
+		log.Fatalf("Failed to set up analytics: %v", err)
 	}
-
-	// check if the INDEX(post) exists
-	exists, err := client.IndexExists(POST_INDEX).Do(context.Background())
-	if err != nil {
-		panic(err)
+	setupOAuth()
+	if err := setupSigningKeys(); err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
 	}
 
-	if !exists {
-		mapping := `{
-            "mappings": {
-                "post": {
-                    "properties": {
-                        "location": {
-                            "type": "geo_point"
-                        }
-                    }
-                }
-            }
-		}`
-
-		_, err = client.CreateIndex(POST_INDEX).Body(mapping).Do(context.Background())
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	// check if the INDEX(user) exists
-	exists, err = client.IndexExists(USER_INDEX).Do(context.Background())
+	app, err := newApp(context.Background())
 	if err != nil {
 		panic(err)
 	}
+	app.startArchiver()
+	app.startExpiryReaper()
+	app.startTrashJanitor()
+	app.startScheduler()
+	app.startMediaUploader()
+	app.startUploadSweeper()
 
-	if !exists {
-		_, err = client.CreateIndex(USER_INDEX).Do(context.Background())
-		if err != nil {
-			panic(err)
-		}
-		// } else {
-		// 	_, err = client.DeleteIndex(USER_INDEX).Do(context.Background())
-		// 	if err != nil {
-		// 		panic(err)
-		// 	}
+	var stops []func()
+	if app.Uploads != nil {
+		stops = append(stops, app.Uploads.Stop)
 	}
-}
-
-func saveToES(post *Post, id string) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return err
+	if stop := app.startIngestConsumers(); stop != nil {
+		stops = append(stops, stop)
 	}
-
-	_, err = client.Index().
-		Index(POST_INDEX).
-		Type(POST_TYPE).
-		Id(id).
-		BodyJson(post).
-		Refresh("wait_for").
-		Do(context.Background())
-	if err != nil {
-		return err
+	if bigTable != nil {
+		// after the consumers, which still write to it
+		stops = append(stops, bigTable.Stop)
 	}
-
-	fmt.Printf("Post is saved to index: %s\n", post.Message)
-	return nil
-
-}
-
-func readFromES(lat, lon float64, ran string) ([]Post, error) {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return nil, err
+	if analytics != nil {
+		stops = append(stops, analytics.Stop)
 	}
-
-	query := elastic.NewGeoDistanceQuery("location")
-	query = query.Distance(ran).Lat(lat).Lon(lon)
-
-	searchResult, err := client.Search().
-		Index(POST_INDEX).
-		Query(query).
-		Pretty(true).
-		Do(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
-	// searchResult is of type SearchResult and returns hits, suggestions,
-	// and all kinds of other information from Elasticsearch.
-	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
-
-	// Each is a convenience function that iterates over hits in a search result.
-	// It makes sure you don't need to check for nil values in the response.
-	// However, it ignores errors in serialization. If you want full control
-	// over iterating the hits, see below.
-	var ptyp Post
-	var posts []Post
-	for _, item := range searchResult.Each(reflect.TypeOf(ptyp)) {
-		if p, ok := item.(Post); ok {
-			// filter spam
-			if !hasFilteredWord(&p.Message) {
-				posts = append(posts, p)
-			}
-
+	if ENABLE_GRPC {
+		grpcServer, err := app.startGRPC()
+		if err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
 		}
+		stops = append(stops, func() { stopGRPC(grpcServer, SHUTDOWN_TIMEOUT) })
 	}
-
-	return posts, nil
-}
-
-func saveToGCS(r io.Reader, bucketName, objectName string) (*storage.ObjectAttrs, error) {
-	ctx := context.Background()
-
-	// create a client
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	bucket := client.Bucket(bucketName)
-	if _, err := bucket.Attrs(ctx); err != nil {
-		return nil, err
-	}
-
-	object := bucket.Object(objectName)
-	wc := object.NewWriter(ctx)
-	if _, err := io.Copy(wc, r); err != nil {
-		return nil, err
-	}
-
-	if err := wc.Close(); err != nil {
-		return nil, err
-	}
-	if err = object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-		return nil, err
-	}
-
-	attrs, err := object.Attrs(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Printf("Image is saved to GCS: %s\n", attrs.MediaLink)
-	return attrs, nil
-}
-
-func saveToBigTable(p *Post, id string) {
-	ctx := context.Background()
-	const PROJECT_INSTANCE_ID = "around-229020"
-	const BIGTABLE_NAME = "around-post"
-	const TABLE_NAME = "post"
-
-	bt_client, err := bigtable.NewClient(ctx, PROJECT_INSTANCE_ID, BIGTABLE_NAME, option.WithCredentialsFile("/home/zhida/Downloads/Around-e9f61f68d73e.json"))
-	if err != nil {
-		panic(err)
-		return
-	}
-
-	tbl := bt_client.Open(TABLE_NAME)
-	mut := bigtable.NewMutation()
-	t := bigtable.Now()
-	mut.Set("post", "user", t, []byte(p.User))
-	mut.Set("post", "message", t, []byte(p.Message))
-	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
-	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
-
-	err = tbl.Apply(ctx, id, mut)
-	if err != nil {
-		panic(err)
-		return
-	}
-	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
-
+	serve(&http.Server{Addr: ":8080", Handler: app.routes()}, stops...)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Media types of a post. Posts written before media_type existed are
+// images.
+const (
+	MEDIA_IMAGE = "image"
+	MEDIA_VIDEO = "video"
+)
+
+const (
+	// MAX_UPLOAD_MEMORY is how much of a multipart post is kept in memory;
+	// the rest of the upload, e.g. a large video, is buffered on disk and
+	// streamed from there to the blob store.
+	MAX_UPLOAD_MEMORY = 32 << 20
+
+	// TRANSCODE_WEBHOOK_URL, if set, is sent a TranscodeJob for every
+	// uploaded video, e.g. to produce streaming renditions.
+	TRANSCODE_WEBHOOK_URL = ""
+	TRANSCODE_TIMEOUT     = 10 * time.Second
+)
+
+// TranscodeJob is the body of a transcode webhook call.
+type TranscodeJob struct {
+	PostId      string `json:"post_id"`
+	MediaKey    string `json:"media_key"`
+	Url         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+var transcodeClient = &http.Client{Timeout: TRANSCODE_TIMEOUT}
+
+// sniffVideoType returns the content type of a supported video judging by
+// its first bytes, or "" if it isn't one. MP4 and QuickTime files start
+// with an ISO base media "ftyp" box, WebM with an EBML header.
+func sniffVideoType(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		if string(head[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "video/webm"
+	default:
+		return ""
+	}
+}
+
+// detectVideoType sniffs the video in r and rewinds it.
+func detectVideoType(r io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return sniffVideoType(head[:n]), nil
+}
+
+// fillMediaType sets the media type of posts stored before it was recorded.
+func fillMediaType(p *Post) {
+	if p.MediaType == "" && p.Url != "" {
+		p.MediaType = MEDIA_IMAGE
+	}
+}
+
+// triggerTranscode hands a new video to the transcode webhook. It runs in
+// the background, the original upload is served until renditions exist.
+func triggerTranscode(p *Post, contentType string) {
+	if TRANSCODE_WEBHOOK_URL == "" {
+		return
+	}
+
+	// the transcoder needs a signed URL to fetch a private upload
+	job := []Post{*p}
+	signMediaURLs(job)
+	js, err := json.Marshal(&TranscodeJob{
+		PostId:      p.Id,
+		MediaKey:    p.MediaKey,
+		Url:         job[0].Url,
+		ContentType: contentType,
+	})
+	if err != nil {
+		fmt.Printf("Failed to parse transcode job into JSON format %v.\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TRANSCODE_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, TRANSCODE_WEBHOOK_URL, bytes.NewReader(js))
+	if err != nil {
+		fmt.Printf("Failed to create transcode request %v.\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := transcodeClient.Do(req)
+	if err != nil {
+		fmt.Printf("Failed to trigger transcode of post %s %v.\n", p.Id, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("Failed to trigger transcode of post %s: %s.\n", p.Id, resp.Status)
+		return
+	}
+	fmt.Printf("Triggered transcode of post %s\n", p.Id)
+}
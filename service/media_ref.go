@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// The media reference index maps every blob store key to the post that
+// owns it, so orphan reconciliation and deletes can look a key up directly
+// instead of diffing the whole bucket against the post index. Deleting a
+// post keeps the media another post references. MEDIA_REF_INDEX is an
+// alias once the index has been rebuilt: a rebuild fills a new index named
+// after it and the time, then swaps the alias over.
+const (
+	MEDIA_REF_INDEX = "media_ref"
+
+	MEDIA_REF_BATCH_SIZE = 500
+)
+
+const MEDIA_REF_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "key": {
+                "type": "keyword"
+            },
+            "post_id": {
+                "type": "keyword"
+            }
+        }
+    }
+}`
+
+// MediaRef says that blob Key belongs to post PostId. Its document id is
+// the key.
+type MediaRef struct {
+	Key    string `json:"key"`
+	PostId string `json:"post_id"`
+}
+
+type MediaRefRebuild struct {
+	Posts  int64 `json:"posts"`
+	Refs   int64 `json:"refs"`
+	Failed int64 `json:"failed"`
+	TookMs int64 `json:"took_ms"`
+}
+
+// mediaKeys returns the blob store keys of a post's media, the image
+// first, then its thumbnails, then the other images of a multi-image post
+// and theirs. Posts written before MediaKey existed stored their image
+// under the post id; External images aren't stored at all.
+func mediaKeys(p *Post) []string {
+	var keys []string
+	if p.MediaKey != "" {
+		keys = append(keys, p.MediaKey)
+	} else if p.Url != "" && p.Id != "" && !p.External {
+		keys = append(keys, p.Id)
+	}
+	for _, t := range p.Thumbnails {
+		keys = append(keys, t.Key)
+	}
+	// the first image is the one above
+	for i, image := range p.Images {
+		if i == 0 && image.Key == p.MediaKey {
+			continue
+		}
+		keys = append(keys, image.Key)
+		for _, t := range image.Thumbnails {
+			keys = append(keys, t.Key)
+		}
+	}
+	return keys
+}
+
+// setMediaURL points the image or thumbnail stored under key at url.
+func setMediaURL(p *Post, key, url string) {
+	inImages := false
+	for i := range p.Images {
+		image := &p.Images[i]
+		if image.Key == key {
+			image.Url = url
+			inImages = true
+		}
+		for j := range image.Thumbnails {
+			if image.Thumbnails[j].Key == key {
+				image.Thumbnails[j].Url = url
+				inImages = true
+			}
+		}
+	}
+	for i := range p.Thumbnails {
+		if p.Thumbnails[i].Key == key {
+			p.Thumbnails[i].Url = url
+			return
+		}
+	}
+	if !inImages || key == p.MediaKey {
+		p.Url = url
+	}
+}
+
+func newMediaRefRequests(p *Post) []elastic.BulkableRequest {
+	var requests []elastic.BulkableRequest
+	for _, key := range mediaKeys(p) {
+		requests = append(requests, elastic.NewBulkIndexRequest().
+			Index(MEDIA_REF_INDEX).
+			Id(key).
+			Doc(&MediaRef{Key: key, PostId: p.Id}))
+	}
+	return requests
+}
+
+// saveMediaRefs records the keys of a new post; failures are only logged,
+// a rebuild repairs them.
+func saveMediaRefs(p *Post) {
+	requests := newMediaRefRequests(p)
+	if len(requests) == 0 {
+		return
+	}
+
+	client := esClient
+	if _, err := client.Bulk().Add(requests...).Do(context.Background()); err != nil {
+		fmt.Printf("Failed to save media refs of post %s %v.\n", p.Id, err)
+	}
+}
+
+// lookupMediaRef returns the id of the post owning key, or "" if no post
+// references it.
+func lookupMediaRef(ctx context.Context, key string) (string, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(MEDIA_REF_INDEX).
+		Id(key).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var ref MediaRef
+	if result.Source == nil || json.Unmarshal(result.Source, &ref) != nil {
+		return "", nil
+	}
+	return ref.PostId, nil
+}
+
+// ownedMediaKeys returns the keys of the media of the post p that no other
+// post references, which deleting p may delete. A key whose reference
+// can't be read is kept: an orphan is cheaper than another post's image.
+func ownedMediaKeys(ctx context.Context, p *Post) []string {
+	var owned []string
+	for _, key := range mediaKeys(p) {
+		owner, err := lookupMediaRef(ctx, key)
+		if err != nil {
+			fmt.Printf("Failed to read media ref %s %v.\n", key, err)
+			continue
+		}
+		if owner != "" && owner != p.Id {
+			fmt.Printf("Keeping media %s of post %s, post %s uses it\n", key, p.Id, owner)
+			continue
+		}
+		owned = append(owned, key)
+	}
+	return owned
+}
+
+// rebuildMediaRefs scans every post and indexes its media references into
+// a new index, then points MEDIA_REF_INDEX at it, which drops the stale
+// references of deleted posts. References saved meanwhile still go to the
+// old index, so the posts changed since the start are indexed again after
+// the swap.
+func rebuildMediaRefs() (*MediaRefRebuild, error) {
+	client := esClient
+
+	start := time.Now()
+	ctx := context.Background()
+	index := fmt.Sprintf("%s_%d", MEDIA_REF_INDEX, start.UnixNano()/int64(time.Millisecond))
+	if _, err := client.CreateIndex(index).Body(MEDIA_REF_MAPPING).Do(ctx); err != nil {
+		return nil, err
+	}
+
+	result := &MediaRefRebuild{}
+	if err := indexMediaRefs(ctx, index, elastic.NewMatchAllQuery(), result); err != nil {
+		client.DeleteIndex(index).Do(ctx)
+		return nil, err
+	}
+	if err := swapMediaRefIndex(ctx, index); err != nil {
+		client.DeleteIndex(index).Do(ctx)
+		return nil, err
+	}
+	changed := elastic.NewRangeQuery("updated_at").Gte(start.UTC().Format(time.RFC3339Nano))
+	if err := indexMediaRefs(ctx, index, changed, &MediaRefRebuild{}); err != nil {
+		// a later rebuild picks them up
+		fmt.Printf("Failed to index media refs of posts changed during the rebuild %v.\n", err)
+	}
+
+	result.TookMs = sinceMillis(start)
+	fmt.Printf("Rebuilt %d media refs of %d posts into %s in %dms\n", result.Refs, result.Posts, index, result.TookMs)
+	return result, nil
+}
+
+// swapMediaRefIndex points MEDIA_REF_INDEX at index in one atomic request
+// and deletes the index or indexes it pointed to before.
+func swapMediaRefIndex(ctx context.Context, index string) error {
+	client := esClient
+
+	aliases, err := client.Aliases().Alias(MEDIA_REF_INDEX).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	var old []string
+	if err == nil {
+		old = aliases.IndicesByAlias(MEDIA_REF_INDEX)
+	}
+
+	actions := []elastic.AliasAction{elastic.NewAliasAddAction(MEDIA_REF_INDEX).Index(index)}
+	if len(old) > 0 {
+		actions = append(actions, elastic.NewAliasRemoveAction(MEDIA_REF_INDEX).Index(old...))
+	} else {
+		exists, err := client.IndexExists(MEDIA_REF_INDEX).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			// the index created at startup, which the alias replaces
+			actions = append(actions, elastic.NewAliasRemoveIndexAction(MEDIA_REF_INDEX))
+		}
+	}
+	if _, err := client.Alias().Action(actions...).Do(ctx); err != nil {
+		return err
+	}
+
+	for _, name := range old {
+		if _, err := client.DeleteIndex(name).Do(ctx); err != nil && !elastic.IsNotFound(err) {
+			fmt.Printf("Failed to delete old media ref index %s %v.\n", name, err)
+		}
+	}
+	return nil
+}
+
+// indexMediaRefs indexes the media references of the posts matching query
+// into index, counting them in result.
+func indexMediaRefs(ctx context.Context, index string, query elastic.Query, result *MediaRefRebuild) error {
+	client := esClient
+
+	scroll := client.Scroll(POST_INDEX).Query(query).Size(MEDIA_REF_BATCH_SIZE).KeepAlive("1m")
+	defer scroll.Clear(ctx)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		bulk := client.Bulk().Index(index)
+		for _, p := range decodePosts(searchResult) {
+			result.Posts++
+			bulk.Add(newMediaRefRequests(&p)...)
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		failed := int64(len(resp.Failed()))
+		result.Failed += failed
+		result.Refs += int64(len(resp.Items)) - failed
+	}
+}
+
+// handleRebuildMediaRefs runs a media reference rebuild on demand.
+func handleRebuildMediaRefs(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for rebuilding media refs")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+
+	result, err := rebuildMediaRefs()
+	if err != nil {
+		http.Error(w, "Failed to rebuild media refs", http.StatusInternalServerError)
+		fmt.Printf("Failed to rebuild media refs %v.\n", err)
+		return
+	}
+	writeAudit(claims.Username, "rebuild_media_refs", map[string]interface{}{"posts": result.Posts, "refs": result.Refs})
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to parse result into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse result into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// deleteMediaRefs forgets keys, the media of the deleted post id; failures
+// are only logged, a rebuild repairs them.
+func deleteMediaRefs(id string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	bulk := esClient.Bulk().Index(MEDIA_REF_INDEX)
+	for _, key := range keys {
+		bulk.Add(elastic.NewBulkDeleteRequest().Id(key))
+	}
+	if _, err := bulk.Do(context.Background()); err != nil {
+		fmt.Printf("Failed to delete media refs of post %s %v.\n", id, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// mediaRefES is fakeES holding media refs, which records the requests it
+// gets.
+type mediaRefES struct {
+	mu       sync.Mutex
+	refs     map[string]string
+	requests []string
+}
+
+func (e *mediaRefES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	e.mu.Lock()
+	e.requests = append(e.requests, r.Method+" "+r.URL.Path+" "+string(body))
+	e.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == MEDIA_REF_INDEX && parts[1] == "_doc" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if owner, ok := e.refs[parts[2]]; ok {
+			source, _ := json.Marshal(&MediaRef{Key: parts[2], PostId: owner})
+			json.NewEncoder(w).Encode(map[string]interface{}{"_index": MEDIA_REF_INDEX, "_id": parts[2], "found": true, "_source": json.RawMessage(source)})
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"_index": MEDIA_REF_INDEX, "_id": parts[2], "found": false})
+		}
+	case strings.Contains(r.URL.Path, "_alias") && r.Method == "GET":
+		// MEDIA_REF_INDEX is still the index created at startup
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"alias [media_ref] missing","status":404}`))
+	default:
+		fakeES(w, r)
+	}
+}
+
+func withMediaRefs(t *testing.T, refs map[string]string) *mediaRefES {
+	t.Helper()
+	e := &mediaRefES{refs: refs}
+	es := httptest.NewServer(e)
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := esClient
+	esClient = client
+	t.Cleanup(func() {
+		esClient = saved
+		es.Close()
+	})
+	return e
+}
+
+func TestDeletePostKeepsSharedMedia(t *testing.T) {
+	withMediaRefs(t, map[string]string{"shared.png": "other", "own.png": "gone"})
+	s := newTestServer(t)
+	ctx := context.Background()
+	for _, key := range []string{"shared.png", "own.png", "own-thumb.png"} {
+		if _, _, err := s.blobs.Put(ctx, key, bytes.NewReader([]byte("image")), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &Post{User: "wren", MediaKey: "own.png", Url: "https://media/own.png", Thumbnails: []Thumbnail{{Key: "own-thumb.png"}}, Images: []PostImage{{Key: "own.png"}, {Key: "shared.png"}}}
+	if err := s.posts.Save(ctx, "gone", p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.deletePost(ctx, "gone", p); err != nil {
+		t.Fatal(err)
+	}
+	if !s.blobs.has("shared.png") {
+		t.Error("deleted media another post references")
+	}
+	for _, key := range []string{"own.png", "own-thumb.png"} {
+		if s.blobs.has(key) {
+			t.Errorf("kept %s, which only the deleted post used", key)
+		}
+	}
+}
+
+func TestRebuildMediaRefsSwapsAlias(t *testing.T) {
+	e := withMediaRefs(t, nil)
+	if _, err := rebuildMediaRefs(); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var created, swapped bool
+	for _, req := range e.requests {
+		switch {
+		case strings.HasPrefix(req, "DELETE /"+MEDIA_REF_INDEX+" "):
+			t.Errorf("rebuild deleted the live index: %s", req)
+		case strings.HasPrefix(req, "PUT /"+MEDIA_REF_INDEX+"_"):
+			created = true
+		case strings.HasPrefix(req, "POST /_aliases "):
+			swapped = strings.Contains(req, `"add":{"alias":"`+MEDIA_REF_INDEX+`"`) && strings.Contains(req, `"remove_index":{"index":"`+MEDIA_REF_INDEX+`"}`)
+		}
+	}
+	if !created || !swapped {
+		t.Errorf("requests = %v, want a new versioned index and an alias swap", e.requests)
+	}
+}
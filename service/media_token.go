@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+// Two-phase posting for JSON clients: POST /upload stores an image or
+// video and returns a media token, then POST /post with a JSON body names
+// the token instead of carrying the file. A token is good for one post by
+// the user who uploaded, within UPLOAD_TOKEN_TTL; media of unused tokens
+// is deleted every UPLOAD_SWEEP_INTERVAL.
+const (
+	UPLOAD_INDEX          = "upload"
+	UPLOAD_TOKEN_TTL      = time.Hour
+	UPLOAD_SWEEP_INTERVAL = 10 * time.Minute
+	UPLOAD_SWEEP_BATCH    = 100
+	MAX_JSON_POST_BYTES   = 64 << 10
+)
+
+const UPLOAD_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "user": {
+                "type": "keyword"
+            },
+            "created_at": {
+                "type": "date"
+            },
+            "thumbnails": {
+                "type": "object",
+                "enabled": false
+            }
+        }
+    }
+}`
+
+// Upload is stored media waiting for its post; its document id is the
+// media token.
+type Upload struct {
+	User        string      `json:"user"`
+	MediaType   string      `json:"media_type"`
+	ContentType string      `json:"content_type"`
+	MediaKey    string      `json:"media_key"`
+	Url         string      `json:"url"`
+	Thumbnails  []Thumbnail `json:"thumbnails,omitempty"`
+	Labels      []string    `json:"labels,omitempty"`
+	Faces       int         `json:"faces,omitempty"`
+	ImageFlags  []string    `json:"image_flags,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// UploadResponse is the answer to POST /upload.
+type UploadResponse struct {
+	MediaToken string    `json:"media_token"`
+	MediaType  string    `json:"media_type"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// JSONPost is the JSON body of POST /post.
+type JSONPost struct {
+	Message      string   `json:"message"`
+	Lang         string   `json:"lang"`
+	Lat          *float64 `json:"lat"` // required, like lon
+	Lon          *float64 `json:"lon"`
+	Draft        bool     `json:"draft"`
+	FuzzLocation bool     `json:"fuzz_location"`
+	MediaToken   string   `json:"media_token"`
+	TTL          string   `json:"ttl,omitempty"`        // e.g. "24h", see parsePostTTL
+	PublishAt    string   `json:"publish_at,omitempty"` // RFC 3339, see parsePublishAt
+	Channel      string   `json:"channel,omitempty"`    // id of a channel holding lat and lon
+}
+
+// attach makes the media of u that of p.
+func (u *Upload) attach(p *Post) {
+	p.Url, p.MediaType, p.MediaKey, p.Thumbnails = u.Url, u.MediaType, u.MediaKey, u.Thumbnails
+	p.Labels, p.Faces, p.ImageFlags = u.Labels, u.Faces, u.ImageFlags
+}
+
+func (a *App) handleUpload(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for uploading media")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	if !limitUpload(w, r, MAX_UPLOAD_MEMORY) {
+		return
+	}
+
+	mediaType := MEDIA_VIDEO
+	file, header, err := r.FormFile("video")
+	if err == http.ErrMissingFile {
+		mediaType = MEDIA_IMAGE
+		file, header, err = r.FormFile("image")
+	}
+	if err != nil {
+		http.Error(w, "Image or video is not available", http.StatusBadRequest)
+		fmt.Printf("Media is not available %v.\n", err)
+		return
+	}
+	defer file.Close()
+
+	upload, err := a.storeUpload(r.Context(), claims.Username, mediaType, file, header.Size)
+	if err != nil {
+		writeServiceError(w, err, "Failed to save media")
+		if _, ok := err.(*ServiceError); !ok {
+			fmt.Printf("Failed to save upload of %s %v.\n", claims.Username, err)
+		}
+		return
+	}
+
+	token := uuid.New()
+	client := esClient
+	_, err = client.Index().
+		Index(UPLOAD_INDEX).
+		Id(token).
+		BodyJson(upload).
+		Refresh("wait_for").
+		Do(r.Context())
+	if err != nil {
+		a.deleteUploadMedia(upload)
+		http.Error(w, "Failed to save upload to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save upload of %s %v.\n", claims.Username, err)
+		return
+	}
+	fmt.Printf("Saved upload %s of %s\n", token, claims.Username)
+
+	js, err := json.Marshal(&UploadResponse{
+		MediaToken: token,
+		MediaType:  upload.MediaType,
+		ExpiresAt:  upload.CreatedAt.Add(UPLOAD_TOKEN_TTL),
+	})
+	if err != nil {
+		http.Error(w, "Failed to parse upload into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse upload into JSON format %v.\n", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// storeUpload checks media of mediaType, as createPost does, and stores it
+// with its thumbnails under a new key.
+func (a *App) storeUpload(ctx context.Context, user, mediaType string, media io.ReadSeeker, size int64) (*Upload, error) {
+	var contentType string
+	var err error
+	analyzed := &Post{User: user}
+	switch mediaType {
+	case MEDIA_IMAGE:
+		contentType, err = checkImage(media, size)
+		if err == nil {
+			media, size, contentType, err = sanitizeImage(media, contentType)
+		}
+		if err != nil {
+			if status := imageErrorStatus(err); status != http.StatusInternalServerError {
+				return nil, serviceError(status, err.Error())
+			}
+			return nil, err
+		}
+		if err := a.analyzeImage(ctx, analyzed, media, size); err != nil {
+			return nil, err
+		}
+	case MEDIA_VIDEO:
+		contentType, err = detectVideoType(media)
+		if err != nil {
+			return nil, serviceError(http.StatusBadRequest, "Failed to read video")
+		}
+		if contentType == "" {
+			return nil, serviceError(http.StatusUnsupportedMediaType, "Unsupported video format, upload MP4, QuickTime or WebM")
+		}
+	}
+
+	key := uuid.New()
+	url, _, err := a.Blobs.Put(ctx, key, media, &PutOptions{
+		ContentType: contentType,
+		Size:        size,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("save %s: %v", mediaType, err)
+	}
+	upload := &Upload{
+		User:        user,
+		MediaType:   mediaType,
+		ContentType: contentType,
+		MediaKey:    key,
+		Url:         url,
+		Labels:      analyzed.Labels,
+		Faces:       analyzed.Faces,
+		ImageFlags:  analyzed.ImageFlags,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if mediaType == MEDIA_IMAGE {
+		upload.Thumbnails, err = a.putThumbnails(ctx, key, media)
+		if err != nil {
+			fmt.Printf("Failed to generate thumbnails of %s %v.\n", key, err)
+		}
+	}
+	return upload, nil
+}
+
+// claimUpload returns the upload of token and removes it, so it backs a
+// single post. Unknown, expired and other users' tokens are a 400.
+func claimUpload(ctx context.Context, token, user string) (*Upload, error) {
+	invalid := serviceError(http.StatusBadRequest, "Invalid or expired media token")
+	if token == "" {
+		return nil, invalid
+	}
+
+	client := esClient
+	result, err := client.Get().
+		Index(UPLOAD_INDEX).
+		Id(token).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(result.Source, &upload); err != nil {
+		return nil, err
+	}
+	if upload.User != user || time.Since(upload.CreatedAt) > UPLOAD_TOKEN_TTL {
+		return nil, invalid
+	}
+
+	// only one of concurrent claims deletes the document
+	_, err = client.Delete().
+		Index(UPLOAD_INDEX).
+		Id(token).
+		IfSeqNo(*result.SeqNo).
+		IfPrimaryTerm(*result.PrimaryTerm).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) || elastic.IsConflict(err) {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// deleteUploadMedia deletes the stored media of upload; failures are only
+// logged.
+func (a *App) deleteUploadMedia(upload *Upload) {
+	p := &Post{}
+	upload.attach(p)
+	for _, key := range mediaKeys(p) {
+		if err := a.Blobs.Delete(context.Background(), key); err != nil {
+			fmt.Printf("Failed to delete uploaded media %s %v.\n", key, err)
+		}
+	}
+}
+
+// startUploadSweeper deletes expired uploads and their media every
+// UPLOAD_SWEEP_INTERVAL.
+func (a *App) startUploadSweeper() {
+	go func() {
+		ticker := time.NewTicker(UPLOAD_SWEEP_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if err := a.sweepUploads(context.Background(), now.Add(-UPLOAD_TOKEN_TTL)); err != nil {
+				fmt.Printf("Failed to sweep uploads %v.\n", err)
+			}
+		}
+	}()
+}
+
+// sweepUploads deletes up to UPLOAD_SWEEP_BATCH uploads created before
+// cutoff; the next sweep takes the rest.
+func (a *App) sweepUploads(ctx context.Context, cutoff time.Time) error {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(UPLOAD_INDEX).
+		Query(elastic.NewRangeQuery("created_at").Lt(cutoff)).
+		SeqNoPrimaryTerm(true).
+		Size(UPLOAD_SWEEP_BATCH).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var upload Upload
+		if err := json.Unmarshal(hit.Source, &upload); err != nil {
+			continue
+		}
+		// a concurrent claim wins, its post keeps the media
+		_, err := client.Delete().
+			Index(UPLOAD_INDEX).
+			Id(hit.Id).
+			IfSeqNo(*hit.SeqNo).
+			IfPrimaryTerm(*hit.PrimaryTerm).
+			Do(ctx)
+		if err != nil {
+			if !elastic.IsNotFound(err) && !elastic.IsConflict(err) {
+				fmt.Printf("Failed to delete upload %s %v.\n", hit.Id, err)
+			}
+			continue
+		}
+		a.deleteUploadMedia(&upload)
+	}
+	if n := len(searchResult.Hits.Hits); n > 0 {
+		fmt.Printf("Swept %d expired uploads\n", n)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Asynchronous media uploads. With ASYNC_MEDIA_UPLOAD, a new post is
+// indexed as soon as its media is checked, with media_state "pending" and
+// no url, and one of MEDIA_UPLOAD_WORKERS uploads the media from a
+// temporary copy in the background. The post then gets its url and
+// thumbnails, or media_state "failed" if the upload fails. When the queue
+// is full the upload is done inline, as without the mode. Both are loaded
+// from the ServiceConfig at startup.
+var (
+	ASYNC_MEDIA_UPLOAD   = false
+	MEDIA_UPLOAD_WORKERS = 4
+)
+
+const MEDIA_UPLOAD_QUEUE = 100
+
+// Media states of a post; posts whose media is stored have none.
+const (
+	MEDIA_PENDING = "pending"
+	MEDIA_FAILED  = "failed"
+)
+
+// mediaUpload is the media of a pending post, staged in a temporary file.
+type mediaUpload struct {
+	postId      string
+	mediaType   string
+	contentType string
+	size        int64
+	file        *os.File
+}
+
+// discard removes the staged file.
+func (u *mediaUpload) discard() {
+	u.file.Close()
+	if err := os.Remove(u.file.Name()); err != nil {
+		fmt.Printf("Failed to remove staged media of post %s %v.\n", u.postId, err)
+	}
+}
+
+// MediaUploader is the pool of workers uploading staged media.
+type MediaUploader struct {
+	app     *App
+	uploads chan *mediaUpload
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// startMediaUploader starts the upload workers if ASYNC_MEDIA_UPLOAD is
+// set.
+func (a *App) startMediaUploader() {
+	if !ASYNC_MEDIA_UPLOAD {
+		return
+	}
+	m := &MediaUploader{app: a, uploads: make(chan *mediaUpload, MEDIA_UPLOAD_QUEUE)}
+	for i := 0; i < MEDIA_UPLOAD_WORKERS; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for u := range m.uploads {
+				m.process(u)
+			}
+		}()
+	}
+	a.Uploads = m
+	fmt.Printf("Async media upload started with %d workers\n", MEDIA_UPLOAD_WORKERS)
+}
+
+// Stop finishes the queued uploads; later ones are done inline.
+func (m *MediaUploader) Stop() {
+	m.mu.Lock()
+	m.closed = true
+	close(m.uploads)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// stage copies media of size bytes to a temporary file, since the upload
+// of the request is gone once it is answered.
+func (m *MediaUploader) stage(postId, mediaType, contentType string, media io.ReadSeeker, size int64) (*mediaUpload, error) {
+	if _, err := media.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "around-media-")
+	if err != nil {
+		return nil, err
+	}
+	u := &mediaUpload{postId: postId, mediaType: mediaType, contentType: contentType, size: size, file: f}
+	if _, err := io.Copy(f, media); err != nil {
+		u.discard()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		u.discard()
+		return nil, err
+	}
+	return u, nil
+}
+
+// enqueue hands u to a worker, or returns false when the queue is full or
+// stopped.
+func (m *MediaUploader) enqueue(u *mediaUpload) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	select {
+	case m.uploads <- u:
+		return true
+	default:
+		return false
+	}
+}
+
+// process uploads u and records the outcome on its post. It returns the
+// updated post, or nil when it was deleted, edited or couldn't be saved
+// meanwhile.
+func (m *MediaUploader) process(u *mediaUpload) *Post {
+	defer u.discard()
+	a := m.app
+	ctx := context.Background()
+
+	// media goes under the post id, as in createPost
+	key := u.postId
+	var thumbnails []Thumbnail
+	url, _, putErr := a.Blobs.Put(ctx, key, u.file, &PutOptions{
+		ContentType: u.contentType,
+		Size:        u.size,
+	})
+	if putErr == nil && u.mediaType == MEDIA_IMAGE {
+		var err error
+		thumbnails, err = a.putThumbnails(ctx, key, u.file)
+		if err != nil {
+			fmt.Printf("Failed to generate thumbnails of %s %v.\n", key, err)
+		}
+	}
+	uploaded := &Post{Id: u.postId, Url: url, MediaKey: key, Thumbnails: thumbnails}
+	cleanUp := func() {
+		if putErr != nil {
+			return
+		}
+		for _, key := range mediaKeys(uploaded) {
+			if err := a.Blobs.Delete(ctx, key); err != nil {
+				fmt.Printf("Failed to clean up image %s %v.\n", key, err)
+			}
+		}
+	}
+
+	// the post may have been deleted, or its media replaced, meanwhile
+	p, err := a.Posts.Get(ctx, u.postId)
+	if err != nil || p.MediaState != MEDIA_PENDING {
+		if err != nil && err != errPostNotFound {
+			fmt.Printf("Failed to read post %s %v.\n", u.postId, err)
+		}
+		cleanUp()
+		return nil
+	}
+	p.Id = u.postId
+	if putErr != nil {
+		fmt.Printf("Failed to save %s of post %s %v.\n", u.mediaType, u.postId, putErr)
+		p.MediaState = MEDIA_FAILED
+	} else {
+		p.MediaState = ""
+		p.Url, p.MediaKey, p.Thumbnails = url, key, thumbnails
+	}
+	if err := a.Posts.Save(ctx, u.postId, p); err != nil {
+		fmt.Printf("Failed to save post %s %v.\n", u.postId, err)
+		cleanUp()
+		return nil
+	}
+	if putErr != nil {
+		return p
+	}
+	fmt.Printf("Uploaded %s of post %s\n", u.mediaType, u.postId)
+
+	go saveMediaRefs(p)
+	if p.MediaType == MEDIA_VIDEO {
+		go triggerTranscode(p, u.contentType)
+	}
+	if ENABLE_BIGTABLE {
+		saveToBigTable(p, u.postId)
+	}
+	// the goroutines above still read p
+	out := []Post{*p}
+	signMediaURLs(out)
+	if p.Status == STATUS_PUBLISHED {
+		a.Live.Publish(out[0])
+		a.invalidateSearchCache(ctx, p)
+		notifyNearbyFollowers(p)
+	}
+	return &out[0]
+}
+
+// createPendingPost saves p, whose media is staged in u, and queues the
+// upload.
+func (a *App) createPendingPost(ctx context.Context, p *Post, u *mediaUpload) (*Post, error) {
+	reqLog := logFor(ctx)
+	p.MediaState = MEDIA_PENDING
+	if err := a.Posts.Save(ctx, p.Id, p); err != nil {
+		u.discard()
+		reqLog.Error("failed to save post to ElasticSearch", "id", p.Id, "err", err)
+		return nil, err
+	}
+	reqLog.Info("saved post", "id", p.Id, "user", p.User, "status", p.Status, "media_state", p.MediaState)
+
+	if !a.Uploads.enqueue(u) {
+		reqLog.Warn("media upload queue is full, uploading inline", "id", p.Id)
+		if done := a.Uploads.process(u); done != nil {
+			return done, nil
+		}
+	}
+	out := *p
+	return &out, nil
+}
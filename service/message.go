@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+// Direct messages between two users. Every message is a document of
+// MESSAGE_INDEX; the conversation of the two users is a document of
+// CONVERSATION_INDEX holding its last message and when each member last
+// read it, which unread counts are taken from. Recipients connected to /ws
+// get their messages pushed.
+const (
+	MESSAGE_INDEX      = "message"
+	CONVERSATION_INDEX = "conversation"
+
+	MAX_MESSAGE_CHARS = 2000
+)
+
+var errConversationNotFound = errors.New("Conversation does not exist")
+
+const MESSAGE_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "conversation": {
+                "type": "keyword"
+            },
+            "sender": {
+                "type": "keyword"
+            },
+            "recipient": {
+                "type": "keyword"
+            },
+            "body": {
+                "type": "text"
+            },
+            "sent_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// read_at is keyed by username, so it is kept out of the mapping.
+const CONVERSATION_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "members": {
+                "type": "keyword"
+            },
+            "last_message": {
+                "type": "object",
+                "enabled": false
+            },
+            "read_at": {
+                "type": "object",
+                "enabled": false
+            },
+            "updated_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+type Message struct {
+	Id           string    `json:"id"`
+	Conversation string    `json:"conversation"`
+	Sender       string    `json:"sender"`
+	Recipient    string    `json:"recipient"`
+	Body         string    `json:"body"`
+	Masked       bool      `json:"masked,omitempty"` // filtered words were replaced
+	SentAt       time.Time `json:"sent_at"`
+}
+
+// NewMessage is the body of POST /messages.
+type NewMessage struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+type Conversation struct {
+	Id          string               `json:"id"`
+	Members     []string             `json:"members"`
+	LastMessage *Message             `json:"last_message,omitempty"`
+	ReadAt      map[string]time.Time `json:"read_at,omitempty"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+	Unread      int64                `json:"unread"` // messages to the caller after their last read, listings only
+}
+
+type ConversationPage struct {
+	Total         int64           `json:"total"`
+	Offset        int             `json:"offset"`
+	Limit         int             `json:"limit"`
+	Conversations []*Conversation `json:"conversations"`
+}
+
+type MessagePage struct {
+	Total    int64      `json:"total"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Messages []*Message `json:"messages"`
+}
+
+// conversationId is the id of the conversation of a and b, the same
+// whoever writes first.
+func conversationId(a, b string) string {
+	members := []string{a, b}
+	sort.Strings(members)
+	sum := sha256.Sum256([]byte(strings.Join(members, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// hasMember reports whether user is in c.
+func (c *Conversation) hasMember(user string) bool {
+	for _, m := range c.Members {
+		if m == user {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSendMessage sends a direct message to another user, starting their
+// conversation if needed.
+func (a *App) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for sending a message")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var req NewMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Cannot decode message data from client", http.StatusBadRequest)
+		fmt.Printf("Cannot decode message data from client %v.\n", err)
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		http.Error(w, "Message is empty", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > MAX_MESSAGE_CHARS {
+		http.Error(w, fmt.Sprintf("Message should be at most %d characters", MAX_MESSAGE_CHARS), http.StatusBadRequest)
+		return
+	}
+	if req.To == "" || req.To == claims.Username {
+		http.Error(w, "to should be another user", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(req.To); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read user from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", req.To, err)
+		return
+	}
+	if refuseBlocked(w, r, req.To, claims.Username, "message") {
+		return
+	}
+
+	// filter spam
+	body, masked, ok := screenText(body, "")
+	if !ok {
+		http.Error(w, "Sorry, the message contains filtered words. Please edit again. ", http.StatusBadRequest)
+		fmt.Printf("Message of %s to %s rejected by spam filter\n", claims.Username, req.To)
+		return
+	}
+
+	m := &Message{
+		Id:           uuid.New(),
+		Conversation: conversationId(claims.Username, req.To),
+		Sender:       claims.Username,
+		Recipient:    req.To,
+		Body:         body,
+		Masked:       masked,
+		SentAt:       time.Now().UTC(),
+	}
+	if err := saveMessage(r.Context(), m); err != nil {
+		http.Error(w, "Failed to save message to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save message of %s to %s %v.\n", claims.Username, req.To, err)
+		return
+	}
+	fmt.Printf("Saved message %s in conversation %s\n", m.Id, m.Conversation)
+	a.Live.Send(*m)
+
+	js, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, "Failed to parse message into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse message into JSON format %v.\n", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handleConversations lists the conversations of the caller, most recent
+// message first, with their unread counts.
+func handleConversations(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for conversations")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	page, err := readConversationsFromES(r.Context(), claims.Username, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read conversations from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read conversations of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse conversations into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse conversations into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleConversationMessages lists the messages of a conversation of the
+// caller, newest first. Reading the first page marks it read.
+func handleConversationMessages(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for messages")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	c, err := getConversation(r.Context(), id)
+	if err == nil && !c.hasMember(claims.Username) {
+		// don't tell others' conversations from missing ones
+		err = errConversationNotFound
+	}
+	if err != nil {
+		if err == errConversationNotFound {
+			http.Error(w, "Conversation does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read conversation from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read conversation %s %v.\n", id, err)
+		return
+	}
+
+	page, err := readMessagesFromES(r.Context(), id, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read messages from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read messages of conversation %s %v.\n", id, err)
+		return
+	}
+	if offset == 0 {
+		if err := markConversationRead(r.Context(), id, claims.Username, time.Now().UTC()); err != nil {
+			// the messages are still worth returning
+			fmt.Printf("Failed to mark conversation %s read %v.\n", id, err)
+		}
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse messages into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse messages into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// saveMessage stores m and makes it the last message of its conversation,
+// which it creates on the first message. The sender has read it.
+func saveMessage(ctx context.Context, m *Message) error {
+	client := esClient
+
+	if _, err := client.Index().
+		Index(MESSAGE_INDEX).
+		Id(m.Id).
+		BodyJson(m).
+		Refresh("wait_for").
+		Do(ctx); err != nil {
+		return err
+	}
+
+	members := []string{m.Sender, m.Recipient}
+	sort.Strings(members)
+	_, err := client.Update().
+		Index(CONVERSATION_INDEX).
+		Id(m.Conversation).
+		Doc(map[string]interface{}{
+			"last_message": m,
+			"read_at":      map[string]time.Time{m.Sender: m.SentAt},
+			"updated_at":   m.SentAt,
+		}).
+		Upsert(&Conversation{
+			Id:          m.Conversation,
+			Members:     members,
+			LastMessage: m,
+			ReadAt:      map[string]time.Time{m.Sender: m.SentAt},
+			UpdatedAt:   m.SentAt,
+		}).
+		RetryOnConflict(3).
+		Refresh("wait_for").
+		Do(ctx)
+	return err
+}
+
+func getConversation(ctx context.Context, id string) (*Conversation, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(CONVERSATION_INDEX).
+		Id(id).
+		Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errConversationNotFound
+		}
+		return nil, err
+	}
+	if !result.Found || result.Source == nil {
+		return nil, errConversationNotFound
+	}
+
+	var c Conversation
+	if err := json.Unmarshal(result.Source, &c); err != nil {
+		return nil, err
+	}
+	c.Id = result.Id
+	return &c, nil
+}
+
+// markConversationRead records that user read conversation id at t.
+func markConversationRead(ctx context.Context, id, user string, t time.Time) error {
+	client := esClient
+
+	_, err := client.Update().
+		Index(CONVERSATION_INDEX).
+		Id(id).
+		Doc(map[string]interface{}{"read_at": map[string]time.Time{user: t}}).
+		RetryOnConflict(3).
+		Do(ctx)
+	return err
+}
+
+func readConversationsFromES(ctx context.Context, user string, offset, limit int) (*ConversationPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(CONVERSATION_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewTermQuery("members", user)).
+		Sort("updated_at", false).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"conversations": user, "offset": offset, "limit": limit})
+
+	page := &ConversationPage{
+		Total:         searchResult.TotalHits(),
+		Offset:        offset,
+		Limit:         limit,
+		Conversations: []*Conversation{},
+	}
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var c Conversation
+			if hit.Source == nil || json.Unmarshal(hit.Source, &c) != nil {
+				continue
+			}
+			c.Id = hit.Id
+			page.Conversations = append(page.Conversations, &c)
+		}
+	}
+	if err := countUnread(ctx, user, page.Conversations); err != nil {
+		return nil, err
+	}
+	for _, c := range page.Conversations {
+		// the read times of the other member are theirs
+		readAt, ok := c.ReadAt[user]
+		c.ReadAt = nil
+		if ok {
+			c.ReadAt = map[string]time.Time{user: readAt}
+		}
+	}
+	return page, nil
+}
+
+// countUnread sets the unread count of each conversation: the messages to
+// user sent after they last read it.
+func countUnread(ctx context.Context, user string, conversations []*Conversation) error {
+	if len(conversations) == 0 {
+		return nil
+	}
+	client := esClient
+
+	unread := elastic.NewFiltersAggregation()
+	for _, c := range conversations {
+		q := elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("conversation", c.Id),
+			elastic.NewTermQuery("recipient", user))
+		if readAt, ok := c.ReadAt[user]; ok {
+			q.Filter(elastic.NewRangeQuery("sent_at").Gt(readAt.Format(time.RFC3339Nano)))
+		}
+		unread.FilterWithName(c.Id, q)
+	}
+	searchResult, err := client.Search().
+		Index(MESSAGE_INDEX).
+		Query(elastic.NewTermQuery("recipient", user)).
+		Aggregation("unread", unread).
+		Size(0).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"unread": user, "conversations": len(conversations)})
+
+	agg, ok := searchResult.Aggregations.Filters("unread")
+	if !ok {
+		return nil
+	}
+	for _, c := range conversations {
+		if bucket := agg.NamedBuckets[c.Id]; bucket != nil {
+			c.Unread = bucket.DocCount
+		}
+	}
+	return nil
+}
+
+func readMessagesFromES(ctx context.Context, id string, offset, limit int) (*MessagePage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(MESSAGE_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewTermQuery("conversation", id)).
+		Sort("sent_at", false).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"conversation": id, "offset": offset, "limit": limit})
+
+	page := &MessagePage{
+		Total:    searchResult.TotalHits(),
+		Offset:   offset,
+		Limit:    limit,
+		Messages: []*Message{},
+	}
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var m Message
+			if hit.Source == nil || json.Unmarshal(hit.Source, &m) != nil {
+				continue
+			}
+			page.Messages = append(page.Messages, &m)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConversationId(t *testing.T) {
+	if conversationId("cole", "dana") != conversationId("dana", "cole") {
+		t.Error("conversationId depends on who writes first")
+	}
+	if conversationId("cole", "dana") == conversationId("cole", "eli") {
+		t.Error("conversationId is the same for different members")
+	}
+}
+
+func TestBroadcasterSend(t *testing.T) {
+	b := newBroadcaster()
+	inbox := b.Listen("dana")
+	m := Message{Id: "m1", Sender: "cole", Recipient: "dana", Body: "hi"}
+	if !b.Send(m) {
+		t.Fatal("Send to a listening recipient = false")
+	}
+	select {
+	case got := <-inbox:
+		if got.Id != m.Id {
+			t.Errorf("inbox got %+v, want %+v", got, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("inbox got nothing")
+	}
+	b.Unlisten("dana", inbox)
+	if b.Send(m) {
+		t.Error("Send after Unlisten = true")
+	}
+}
+
+func TestSendMessageInvalid(t *testing.T) {
+	s := newTestServer(t)
+	for body, want := range map[string]int{
+		`{"to":"dana","body":"  "}`: http.StatusBadRequest,
+		`{"to":"dana","body":"` + strings.Repeat("x", MAX_MESSAGE_CHARS+1) + `"}`: http.StatusBadRequest,
+		`{"to":"cole","body":"hi"}`:   http.StatusBadRequest,
+		`{"to":"nobody","body":"hi"}`: http.StatusNotFound,
+	} {
+		r := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		if w := s.do(authorized(t, r, "cole")); w.Code != want {
+			t.Errorf("POST /messages %.40s = %d %s, want %d", body, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestConversationMessagesNotFound(t *testing.T) {
+	s := newTestServer(t)
+	r := httptest.NewRequest("GET", "/conversations/"+conversationId("cole", "dana")+"/messages", nil)
+	if w := s.do(authorized(t, r, "cole")); w.Code != http.StatusNotFound {
+		t.Errorf("GET messages of a missing conversation = %d %s, want 404", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on METRICS_PATH. Routes are labeled by their
+// path template, e.g. /post/{id}, to keep the label set bounded.
+const METRICS_PATH = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	esDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_es_query_duration_seconds",
+		Help:    "ElasticSearch operation latency by operation.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"operation"})
+
+	blobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_blob_upload_duration_seconds",
+		Help:    "Media upload latency by storage backend and result.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"backend", "result"})
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "around_circuit_breaker_state",
+		Help: "Circuit breaker state by dependency: 0 closed, 1 half-open, 2 open.",
+	}, []string{"dependency"})
+
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_circuit_breaker_rejections_total",
+		Help: "Calls failed fast by an open circuit breaker, by dependency.",
+	}, []string{"dependency"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_retries_total",
+		Help: "Calls retried after a transient error, by dependency.",
+	}, []string{"dependency"})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_errors_total",
+		Help: "Errors by source: http (5xx responses), blob (failed uploads and deletes).",
+	}, []string{"source"})
+)
+
+// metricsMiddleware counts and times every routed request.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		if rec.status >= 500 {
+			errorsTotal.WithLabelValues("http").Inc()
+		}
+	})
+}
+
+// instrumentedBlobStore times the uploads of another BlobStore.
+type instrumentedBlobStore struct {
+	BlobStore
+	backend string
+}
+
+func (s *instrumentedBlobStore) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	start := time.Now()
+	url, size, err := s.BlobStore.Put(ctx, key, r, opts)
+	result := "ok"
+	if err != nil {
+		result = "error"
+		errorsTotal.WithLabelValues("blob").Inc()
+	}
+	blobDuration.WithLabelValues(s.backend, result).Observe(time.Since(start).Seconds())
+	return url, size, err
+}
+
+func (s *instrumentedBlobStore) Delete(ctx context.Context, key string) error {
+	err := s.BlobStore.Delete(ctx, key)
+	if err != nil {
+		errorsTotal.WithLabelValues("blob").Inc()
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// MIGRATION_SUFFIX names the typeless copy migrateIndexes makes of an index.
+const MIGRATION_SUFFIX = "_v7"
+
+// migrateIndexes copies every index created with a mapping type (by
+// ElasticSearch 6) into a typeless index, then swaps the old index for an
+// alias of the same name pointing to the copy, so the service needs no
+// change. ElasticSearch 8 refuses to open indexes created by 6, so run it
+// once on ElasticSearch 7 before upgrading. Stop the service first: writes
+// made during the copy are lost.
+//
+// Indexes that don't exist or are already aliases are skipped, so it is safe
+// to run again after a failure.
+func migrateIndexes(ctx context.Context) error {
+	client := esClient
+
+	for _, index := range esIndexes() {
+		exists, err := client.IndexExists(index.name).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			fmt.Printf("Index %s does not exist, skipping\n", index.name)
+			continue
+		}
+		aliases, err := client.Aliases().Alias(index.name).Do(ctx)
+		if err != nil && !elastic.IsNotFound(err) {
+			return err
+		}
+		if err == nil && len(aliases.IndicesByAlias(index.name)) > 0 {
+			fmt.Printf("Index %s is already migrated, skipping\n", index.name)
+			continue
+		}
+
+		if err := migrateIndex(ctx, client, index); err != nil {
+			return fmt.Errorf("migrate %s: %v", index.name, err)
+		}
+	}
+	return nil
+}
+
+func migrateIndex(ctx context.Context, client *elastic.Client, index esIndex) error {
+	target := index.name + MIGRATION_SUFFIX
+	exists, err := client.IndexExists(target).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s exists, delete the copy left by a failed run and retry", target)
+	}
+
+	fmt.Printf("Copying %s to %s\n", index.name, target)
+	create := client.CreateIndex(target)
+	if index.mapping != "" {
+		create = create.Body(index.mapping)
+	}
+	if _, err := create.Do(ctx); err != nil {
+		return err
+	}
+	resp, err := client.Reindex().
+		SourceIndex(index.name).
+		DestinationIndex(target).
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	if len(resp.Failures) > 0 {
+		return fmt.Errorf("%d documents failed to copy to %s", len(resp.Failures), target)
+	}
+
+	before, err := client.Count(index.name).Do(ctx)
+	if err != nil {
+		return err
+	}
+	after, err := client.Count(target).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if before != after {
+		return fmt.Errorf("%s has %d documents but %s has %d, was the service stopped?", index.name, before, target, after)
+	}
+
+	// one atomic request, so index always resolves to either copy
+	_, err = client.Alias().
+		Action(
+			elastic.NewAliasRemoveIndexAction(index.name),
+			elastic.NewAliasAddAction(index.name).Index(target)).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %s, %d documents\n", index.name, after)
+	return nil
+}
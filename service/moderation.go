@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+// Moderation endpoints under /admin let admins review flagged and reported
+// posts, delete any post and ban users. Every moderation action is logged to
+// MODERATION_INDEX, apart from the general audit index.
+const MODERATION_INDEX = "moderation"
+
+const MODERATION_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "actor": {
+                "type": "keyword"
+            },
+            "action": {
+                "type": "keyword"
+            },
+            "target": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            },
+            "detail": {
+                "type": "object",
+                "enabled": false
+            }
+        }
+    }
+}`
+
+// Moderation actions, the "action" of ModerationEntry.
+const (
+	MOD_DELETE_POST = "delete_post"
+	MOD_BAN_USER    = "ban_user"
+	MOD_UNBAN_USER  = "unban_user"
+
+	MOD_HIDE_POST       = "hide_post"
+	MOD_DISMISS_REPORTS = "dismiss_reports"
+)
+
+// ModerationEntry records a moderation action on a post or user, by an
+// admin or by REPORT_SYSTEM_ACTOR.
+type ModerationEntry struct {
+	Id        string                 `json:"id,omitempty"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target"`
+	Reason    string                 `json:"reason,omitempty"`
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+type ModerationLogPage struct {
+	Total   int64              `json:"total"`
+	Offset  int                `json:"offset"`
+	Limit   int                `json:"limit"`
+	Entries []*ModerationEntry `json:"entries"`
+}
+
+// writeModerationLog appends an entry to the moderation log. Like
+// writeAudit it never fails the action it records.
+func writeModerationLog(entry *ModerationEntry) {
+	entry.Timestamp = time.Now().UTC()
+
+	client := esClient
+
+	_, err := client.Index().
+		Index(MODERATION_INDEX).
+		Id(uuid.New()).
+		BodyJson(entry).
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to write moderation log %s of %s by %s %v.\n", entry.Action, entry.Target, entry.Actor, err)
+		return
+	}
+	fmt.Printf("Moderation: %s of %s by %s\n", entry.Action, entry.Target, entry.Actor)
+}
+
+// handleFlaggedPosts lists the posts whose message had filtered words
+// masked, whose image the analyzer flagged or that reports hid, newest
+// first, drafts included, with their report counts.
+func handleFlaggedPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for flagged posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	page, err := readFlaggedPostsFromES(offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read flagged posts from ElasticSearch %v.\n", err)
+		return
+	}
+	signMediaURLs(page.Posts)
+	if err := annotateReports(r.Context(), page.Posts); err != nil {
+		fmt.Printf("Failed to read reports %v.\n", err)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+func readFlaggedPostsFromES(offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewBoolQuery().
+			Should(
+				elastic.NewTermQuery("masked", true),
+				elastic.NewTermQuery("hidden", true),
+				elastic.NewExistsQuery("image_flags")).
+			MinimumNumberShouldMatch(1)).
+		SortBy(elastic.NewFieldSort("timestamp").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "flagged_posts", searchResult.TookInMillis, map[string]interface{}{"offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  decodePosts(searchResult),
+	}
+	if page.Posts == nil {
+		page.Posts = []Post{}
+	}
+	return page, nil
+}
+
+// handleForceDeletePost deletes any post, with an optional
+// {"reason": "..."} body for the moderation log.
+func (a *App) handleForceDeletePost(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for force deleting a post")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+	reason, ok := moderationReason(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err == nil {
+		err = a.deletePost(r.Context(), id, p)
+	}
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to delete post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to force delete post %s %v.\n", id, err)
+		return
+	}
+
+	writeModerationLog(&ModerationEntry{
+		Actor:  claims.Username,
+		Action: MOD_DELETE_POST,
+		Target: id,
+		Reason: reason,
+		Detail: map[string]interface{}{"user": p.User, "message": p.Message},
+	})
+	w.Write([]byte("Post deleted successfully."))
+}
+
+// handleBanUser bans a user, with an optional {"reason": "..."} body.
+func handleBanUser(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for banning a user")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+	reason, ok := moderationReason(w, r)
+	if !ok {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if username == claims.Username {
+		http.Error(w, "Admins can't ban themselves", http.StatusBadRequest)
+		return
+	}
+	if _, err := getUser(username); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", username, err)
+		return
+	}
+
+	ban := &Ban{Username: username, Reason: reason, BannedBy: claims.Username, BannedAt: time.Now().UTC()}
+	if err := bans.add(ban); err != nil {
+		http.Error(w, "Failed to save ban", http.StatusInternalServerError)
+		fmt.Printf("Failed to ban %s %v.\n", username, err)
+		return
+	}
+
+	writeModerationLog(&ModerationEntry{
+		Actor:  claims.Username,
+		Action: MOD_BAN_USER,
+		Target: username,
+		Reason: reason,
+	})
+	w.Write([]byte("User banned successfully."))
+}
+
+// handleUnbanUser lifts the ban of a user.
+func handleUnbanUser(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for unbanning a user")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	found, err := bans.remove(username)
+	if err != nil {
+		http.Error(w, "Failed to remove ban", http.StatusInternalServerError)
+		fmt.Printf("Failed to unban %s %v.\n", username, err)
+		return
+	}
+	if !found {
+		http.Error(w, "User is not banned", http.StatusNotFound)
+		return
+	}
+
+	writeModerationLog(&ModerationEntry{
+		Actor:  claims.Username,
+		Action: MOD_UNBAN_USER,
+		Target: username,
+	})
+	w.Write([]byte("User unbanned successfully."))
+}
+
+// moderationReason reads the optional reason of a moderation request.
+func moderationReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength == 0 {
+		return "", true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return "", false
+	}
+	return body.Reason, true
+}
+
+// handleModerationLog pages through the moderation log, newest first,
+// optionally only the entries of one actor, action or target.
+func handleModerationLog(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for the moderation log")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	query := elastic.NewBoolQuery()
+	for _, field := range []string{"actor", "action", "target"} {
+		if val := r.URL.Query().Get(field); val != "" {
+			query = query.Filter(elastic.NewTermQuery(field, val))
+		}
+	}
+
+	client := esClient
+	searchResult, err := client.Search().
+		Index(MODERATION_INDEX).
+		TrackTotalHits(true).
+		Query(query).
+		Sort("timestamp", false).
+		From(offset).
+		Size(limit).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read moderation log %v.\n", err)
+		return
+	}
+
+	page := &ModerationLogPage{
+		Total:   searchResult.TotalHits(),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: []*ModerationEntry{},
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var entry ModerationEntry
+		if hit.Source == nil || json.Unmarshal(hit.Source, &entry) != nil {
+			continue
+		}
+		entry.Id = hit.Id
+		page.Entries = append(page.Entries, &entry)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse moderation log into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse moderation log into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
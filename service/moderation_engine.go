@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+)
+
+// The moderation engine judges the text users write: post messages,
+// comments, display names and bios. MODERATION_ENGINE selects it:
+// "wordlist" and "regex" match rules loaded from MODERATION_SOURCE, and
+// "perspective" asks an external API to score the text.
+var (
+	MODERATION_ENGINE    = "wordlist"
+	MODERATION_SOURCE    = "" // file path or gs://bucket/object, "" for the built-in word list
+	MODERATION_API_URL   = "https://commentanalyzer.googleapis.com/v1alpha1/comments:analyze"
+	MODERATION_API_KEY   = ""
+	MODERATION_THRESHOLD = 0.8 // score from which the API engine flags text
+)
+
+var MODERATION_ENGINES = []string{"wordlist", "regex", "perspective"}
+
+const (
+	// MODERATION_RELOAD_INTERVAL is how often MODERATION_SOURCE is checked
+	// for changes.
+	MODERATION_RELOAD_INTERVAL = 30 * time.Second
+	MODERATION_TIMEOUT         = 3 * time.Second
+)
+
+// ModerationResult is the judgment of a text.
+type ModerationResult struct {
+	Flagged bool
+	// Matches are the offending parts of the text, empty when the engine
+	// only judges the text as a whole.
+	Matches []string
+}
+
+// Moderation decides whether text breaks the rules.
+type Moderation interface {
+	// Check judges text written in lang, "" when the language is unknown.
+	Check(ctx context.Context, text, lang string) (*ModerationResult, error)
+}
+
+// moderation is the engine in use, set up by setupModeration.
+var moderation Moderation = newWordlistModeration(defaultFilterWords())
+
+// moderationOnRead tells whether stored text is judged again on its way to
+// clients, so rule changes apply to old posts. Only local engines are
+// cheap enough.
+var moderationOnRead = true
+
+// setupModeration creates the MODERATION_ENGINE and, for the engines with
+// rules, starts reloading MODERATION_SOURCE when it changes.
+func setupModeration(ctx context.Context) error {
+	switch MODERATION_ENGINE {
+	case "wordlist":
+		wl := newWordlistModeration(defaultFilterWords())
+		if MODERATION_SOURCE != "" {
+			if err := watchModerationSource(ctx, MODERATION_SOURCE, wl.load); err != nil {
+				return err
+			}
+		}
+		moderation, moderationOnRead = wl, true
+	case "regex":
+		rules := &regexModeration{}
+		if err := watchModerationSource(ctx, MODERATION_SOURCE, rules.load); err != nil {
+			return err
+		}
+		moderation, moderationOnRead = rules, true
+	case "perspective":
+		moderation, moderationOnRead = newPerspectiveModeration(MODERATION_API_URL, MODERATION_API_KEY, MODERATION_THRESHOLD), false
+	default:
+		return fmt.Errorf("unknown moderation engine %q", MODERATION_ENGINE)
+	}
+	fmt.Printf("Moderating text with the %s engine\n", MODERATION_ENGINE)
+	return nil
+}
+
+// checkText judges text with the engine in use. Text is accepted when the
+// engine fails, so an outage of the API doesn't stop every post.
+func checkText(text, lang string) *ModerationResult {
+	ctx, cancel := context.WithTimeout(context.Background(), MODERATION_TIMEOUT)
+	defer cancel()
+	result, err := moderation.Check(ctx, text, lang)
+	if err != nil {
+		fmt.Printf("Failed to moderate text %v.\n", err)
+		return &ModerationResult{}
+	}
+	return result
+}
+
+// maskMatches replaces every match in s with asterisks.
+func maskMatches(s string, matches []string) string {
+	for _, match := range matches {
+		if match != "" {
+			s = strings.Replace(s, match, strings.Repeat("*", utf8.RuneCountInString(match)), -1)
+		}
+	}
+	return s
+}
+
+// watchModerationSource loads the rules at source with load, failing if
+// they can't be read now, and reloads them whenever the source changes.
+func watchModerationSource(ctx context.Context, source string, load func([]byte) error) error {
+	s, err := newModerationSource(ctx, source)
+	if err != nil {
+		return err
+	}
+	data, _, err := s.read(ctx)
+	if err != nil {
+		return fmt.Errorf("read %s: %v", source, err)
+	}
+	if err := load(data); err != nil {
+		return fmt.Errorf("load %s: %v", source, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(MODERATION_RELOAD_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			data, changed, err := s.read(ctx)
+			if err == nil && changed {
+				err = load(data)
+				if err == nil {
+					fmt.Printf("Reloaded moderation rules from %s\n", source)
+				}
+			}
+			if err != nil {
+				// keep the rules loaded last
+				fmt.Printf("Failed to reload moderation rules from %s %v.\n", source, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// moderationSource reads a rules file from disk or GCS, remembering the
+// version it read last.
+type moderationSource struct {
+	mu      sync.Mutex
+	path    string
+	bucket  *storage.BucketHandle
+	object  string
+	version string
+}
+
+func newModerationSource(ctx context.Context, source string) (*moderationSource, error) {
+	if !strings.HasPrefix(source, "gs://") {
+		return &moderationSource{path: source}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("moderation source %q should be gs://bucket/object", source)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &moderationSource{bucket: client.Bucket(parts[0]), object: parts[1]}, nil
+}
+
+// read returns the rules and whether they changed since the last read. An
+// unchanged source isn't downloaded again.
+func (s *moderationSource) read(ctx context.Context) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bucket == nil {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			return nil, false, err
+		}
+		version := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+		if version == s.version {
+			return nil, false, nil
+		}
+		data, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return nil, false, err
+		}
+		s.version = version
+		return data, true, nil
+	}
+
+	object := s.bucket.Object(s.object)
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	version := fmt.Sprint(attrs.Generation)
+	if version == s.version {
+		return nil, false, nil
+	}
+	r, err := object.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	s.version = version
+	return data, true, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// PERSPECTIVE_ATTRIBUTE is the score the API engine asks for.
+const PERSPECTIVE_ATTRIBUTE = "TOXICITY"
+
+// perspectiveModeration flags text the Perspective API, or a service with
+// the same interface, scores at threshold or above. It judges text as a
+// whole, so with FILTER_MODE "mask" flagged text is still rejected.
+type perspectiveModeration struct {
+	url       string
+	key       string
+	threshold float64
+	client    *http.Client
+}
+
+func newPerspectiveModeration(apiURL, key string, threshold float64) *perspectiveModeration {
+	return &perspectiveModeration{
+		url:       apiURL,
+		key:       key,
+		threshold: threshold,
+		client:    &http.Client{Timeout: MODERATION_TIMEOUT},
+	}
+}
+
+type perspectiveRequest struct {
+	Comment struct {
+		Text string `json:"text"`
+	} `json:"comment"`
+	Languages           []string               `json:"languages,omitempty"`
+	RequestedAttributes map[string]interface{} `json:"requestedAttributes"`
+	DoNotStore          bool                   `json:"doNotStore"`
+}
+
+type perspectiveResponse struct {
+	AttributeScores map[string]struct {
+		SummaryScore struct {
+			Value float64 `json:"value"`
+		} `json:"summaryScore"`
+	} `json:"attributeScores"`
+}
+
+func (m *perspectiveModeration) Check(ctx context.Context, text, lang string) (*ModerationResult, error) {
+	if text == "" {
+		return &ModerationResult{}, nil
+	}
+
+	var body perspectiveRequest
+	body.Comment.Text = text
+	if lang != "" {
+		body.Languages = []string{lang}
+	}
+	body.RequestedAttributes = map[string]interface{}{PERSPECTIVE_ATTRIBUTE: struct{}{}}
+	body.DoNotStore = true
+	js, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := m.url
+	if m.key != "" {
+		endpoint += "?key=" + url.QueryEscape(m.key)
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("moderation API returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var scores perspectiveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&scores); err != nil {
+		return nil, err
+	}
+	score, ok := scores.AttributeScores[PERSPECTIVE_ATTRIBUTE]
+	if !ok {
+		return nil, fmt.Errorf("moderation API returned no %s score", PERSPECTIVE_ATTRIBUTE)
+	}
+	return &ModerationResult{Flagged: score.SummaryScore.Value >= m.threshold}, nil
+}
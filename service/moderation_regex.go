@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ModerationRule is one rule of the regex engine. Lang limits it to text of
+// that language; rules without one apply to all text.
+type ModerationRule struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	Lang    string `yaml:"lang"`
+}
+
+type compiledRule struct {
+	ModerationRule
+	re *regexp.Regexp
+}
+
+// regexModeration flags text matching any of its rules, loaded from a YAML
+// (or JSON) list of ModerationRule. Patterns use Go's RE2 syntax; prefix
+// them with (?i) to ignore case.
+type regexModeration struct {
+	mu    sync.RWMutex
+	rules []*compiledRule
+}
+
+func (m *regexModeration) Check(ctx context.Context, text, lang string) (*ModerationResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := &ModerationResult{}
+	for _, rule := range m.rules {
+		if rule.Lang != "" && lang != "" && rule.Lang != lang {
+			continue
+		}
+		if matches := rule.re.FindAllString(text, -1); len(matches) > 0 {
+			result.Flagged = true
+			result.Matches = append(result.Matches, matches...)
+		}
+	}
+	return result, nil
+}
+
+// load replaces the rules with the ones in data. Nothing changes unless
+// every rule compiles.
+func (m *regexModeration) load(data []byte) error {
+	var rules []ModerationRule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	compiled := make([]*compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Lang != "" && !langPattern.MatchString(rule.Lang) {
+			return fmt.Errorf("rule %d %q: invalid language %q", i, rule.Name, rule.Lang)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %d %q: %v", i, rule.Name, err)
+		}
+		compiled = append(compiled, &compiledRule{ModerationRule: rule, re: re})
+	}
+
+	m.mu.Lock()
+	m.rules = compiled
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// UNIVERSAL_FILTER is the key of the word list applied to every language.
+const UNIVERSAL_FILTER = "*"
+
+// defaultFilterWords is the word list used when MODERATION_SOURCE is unset.
+func defaultFilterWords() map[string][]string {
+	return map[string][]string{
+		UNIVERSAL_FILTER: {
+			"fck",
+			"fuck",
+			"Damn",
+		},
+		"es": {
+			"mierda",
+		},
+		"fr": {
+			"merde",
+		},
+	}
+}
+
+// wordlistModeration flags text containing a word of the universal list or
+// of the list of its language. The lists are loaded from a YAML (or JSON)
+// map of language to words, such as {"*": ["word"], "es": ["palabra"]}.
+type wordlistModeration struct {
+	mu    sync.RWMutex
+	words map[string][]string
+}
+
+func newWordlistModeration(words map[string][]string) *wordlistModeration {
+	return &wordlistModeration{words: words}
+}
+
+// Check matches text against the universal list and the list of lang, if
+// there is one. Only an empty lang, text in an undetected language, checks
+// every list.
+func (m *wordlistModeration) Check(ctx context.Context, text, lang string) (*ModerationResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := &ModerationResult{}
+	for listLang, words := range m.words {
+		if lang != "" && listLang != lang && listLang != UNIVERSAL_FILTER {
+			continue
+		}
+		for _, word := range words {
+			if strings.Contains(text, word) {
+				result.Flagged = true
+				result.Matches = append(result.Matches, word)
+			}
+		}
+	}
+	return result, nil
+}
+
+// load replaces every list with the ones in data.
+func (m *wordlistModeration) load(data []byte) error {
+	var words map[string][]string
+	if err := yaml.Unmarshal(data, &words); err != nil {
+		return err
+	}
+	for lang := range words {
+		if lang != UNIVERSAL_FILTER && !langPattern.MatchString(lang) {
+			return fmt.Errorf("invalid language %q", lang)
+		}
+		words[lang] = cleanWords(words[lang])
+	}
+
+	m.mu.Lock()
+	m.words = words
+	m.mu.Unlock()
+	return nil
+}
+
+// lists returns a copy of every list keyed by language.
+func (m *wordlistModeration) lists() map[string][]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lists := make(map[string][]string, len(m.words))
+	for lang, words := range m.words {
+		lists[lang] = append([]string(nil), words...)
+	}
+	return lists
+}
+
+// set replaces the list of lang; an empty list removes the language.
+func (m *wordlistModeration) set(lang string, words []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(words) == 0 {
+		delete(m.words, lang)
+	} else {
+		m.words[lang] = words
+	}
+}
+
+// cleanWords drops blank words and surrounding spaces.
+func cleanWords(words []string) []string {
+	var cleaned []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			cleaned = append(cleaned, word)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWordlistModerationLanguages(t *testing.T) {
+	m := newWordlistModeration(defaultFilterWords())
+	tests := []struct {
+		text, lang string
+		flagged    bool
+	}{
+		{"merde alors", "en", false},
+		{"merde alors", "fr", true},
+		{"merde alors", "", true},
+		{"mierda", "de", false},
+		{"fuck", "en", true},
+		{"fuck", "de", true},
+	}
+	for _, tt := range tests {
+		result, err := m.Check(context.Background(), tt.text, tt.lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Flagged != tt.flagged {
+			t.Errorf("Check(%q, lang=%q) flagged = %v, want %v", tt.text, tt.lang, result.Flagged, tt.flagged)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/pborman/uuid"
+)
+
+const (
+	NOTIFICATION_INDEX = "notification"
+
+	NOTIFY_LIKE    = "like"
+	NOTIFY_COMMENT = "comment"
+	NOTIFY_FOLLOW  = "follow"
+	// NOTIFY_NEARBY_POST tells a follower of Actor that they posted near
+	// the follower's device, see notifyNearbyFollowers.
+	NOTIFY_NEARBY_POST = "nearby_post"
+)
+
+const NOTIFICATION_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "user": {
+                "type": "keyword"
+            },
+            "actor": {
+                "type": "keyword"
+            },
+            "type": {
+                "type": "keyword"
+            },
+            "post_id": {
+                "type": "keyword"
+            },
+            "read": {
+                "type": "boolean"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Notification tells User that Actor did something involving them.
+type Notification struct {
+	Id        string    `json:"id,omitempty"`
+	User      string    `json:"user"`
+	Actor     string    `json:"actor"`
+	Type      string    `json:"type"`
+	PostId    string    `json:"post_id,omitempty"`
+	Read      bool      `json:"read"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type NotificationPage struct {
+	Total         int64           `json:"total"`
+	Unread        int64           `json:"unread"`
+	Offset        int             `json:"offset"`
+	Limit         int             `json:"limit"`
+	Notifications []*Notification `json:"notifications"`
+}
+
+// notify records a notification for user in the background, and pushes it
+// to their devices; callers don't wait for it and failures are only logged.
+// Users aren't notified of their own actions.
+func notify(user, actor, typ, postId string) {
+	if user == actor {
+		return
+	}
+	n := &Notification{
+		User:      user,
+		Actor:     actor,
+		Type:      typ,
+		PostId:    postId,
+		Timestamp: time.Now().UTC(),
+	}
+	go func() {
+		if err := saveNotification(n); err != nil {
+			fmt.Printf("Failed to save %s notification for %s %v.\n", typ, user, err)
+		}
+		if pusher != nil {
+			pusher.enqueue(n)
+		}
+	}()
+}
+
+func saveNotification(n *Notification) error {
+	client := esClient
+
+	_, err := client.Index().
+		Index(NOTIFICATION_INDEX).
+		Id(uuid.New()).
+		BodyJson(n).
+		Do(context.Background())
+	return err
+}
+
+// countUnreadNotifications returns how many notifications user hasn't read.
+func countUnreadNotifications(user string) (int64, error) {
+	client := esClient
+
+	return client.Count(NOTIFICATION_INDEX).
+		Query(unreadNotificationsQuery(user)).
+		Do(context.Background())
+}
+
+func unreadNotificationsQuery(user string) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("user", user)).
+		Filter(elastic.NewTermQuery("read", false))
+}
+
+// handleNotifications lists the caller's notifications, unread first.
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for notifications")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+
+	page, err := readNotificationsFromES(claims.Username, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read notifications of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse notifications into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse notifications into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func readNotificationsFromES(user string, offset, limit int) (*NotificationPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(NOTIFICATION_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewTermQuery("user", user)).
+		Sort("read", true).
+		Sort("timestamp", false).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "search", searchResult.TookInMillis, map[string]interface{}{"notifications": user})
+
+	unread, err := countUnreadNotifications(user)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &NotificationPage{
+		Total:         searchResult.TotalHits(),
+		Unread:        unread,
+		Offset:        offset,
+		Limit:         limit,
+		Notifications: []*Notification{},
+	}
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var n Notification
+			if hit.Source == nil || json.Unmarshal(hit.Source, &n) != nil {
+				continue
+			}
+			n.Id = hit.Id
+			page.Notifications = append(page.Notifications, &n)
+		}
+	}
+	return page, nil
+}
+
+// MarkRead is the body of POST /notifications/read; no ids marks every
+// notification read.
+type MarkRead struct {
+	Ids []string `json:"ids"`
+}
+
+// handleReadNotifications marks the caller's notifications read.
+func handleReadNotifications(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for reading notifications")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var req MarkRead
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+			fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+			return
+		}
+	}
+	if len(req.Ids) > MAX_PAGE_SIZE {
+		http.Error(w, fmt.Sprintf("At most %d ids can be marked at once", MAX_PAGE_SIZE), http.StatusBadRequest)
+		return
+	}
+
+	client := esClient
+
+	// scoped to the caller, so ids of other users' notifications are ignored
+	query := unreadNotificationsQuery(claims.Username)
+	if len(req.Ids) > 0 {
+		query = query.Filter(elastic.NewIdsQuery().Ids(req.Ids...))
+	}
+
+	resp, err := client.UpdateByQuery(NOTIFICATION_INDEX).
+		Query(query).
+		Script(elastic.NewScript("ctx._source.read = true").Lang("painless")).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(context.Background())
+	if err != nil {
+		http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to mark notifications of %s read %v.\n", claims.Username, err)
+		return
+	}
+
+	js, _ := json.Marshal(map[string]int64{"updated": resp.Updated})
+	w.Write(js)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"golang.org/x/oauth2"
+)
+
+// Login with Google or GitHub. GET /auth/{provider}/login redirects to the
+// provider, which sends the user back to /auth/{provider}/callback under
+// OAUTH_BASE_URL, the public address of the service. The callback answers
+// like /login. The provider account is linked to a user in
+// OAUTH_IDENTITY_INDEX: on the first login, to the account whose verified
+// email address the provider vouches for, or else to a new account named
+// after the provider login. A provider is offered once its client id and
+// secret are set.
+var (
+	OAUTH_BASE_URL       = "http://localhost:8080"
+	GOOGLE_CLIENT_ID     = ""
+	GOOGLE_CLIENT_SECRET = ""
+	GITHUB_CLIENT_ID     = ""
+	GITHUB_CLIENT_SECRET = ""
+)
+
+const (
+	OAUTH_IDENTITY_INDEX = "oauth_identity"
+
+	OAUTH_TIMEOUT      = 10 * time.Second
+	OAUTH_STATE_COOKIE = "oauth_state"
+	OAUTH_STATE_TTL    = 10 * time.Minute
+	OAUTH_STATE_BYTES  = 32
+
+	MAX_OAUTH_USERNAME_CHARS = 30
+	OAUTH_USERNAME_ATTEMPTS  = 5
+)
+
+const OAUTH_IDENTITY_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "username": {
+                "type": "keyword"
+            },
+            "provider": {
+                "type": "keyword"
+            },
+            "created_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// OAuthIdentity is who the provider says the user is.
+type OAuthIdentity struct {
+	Provider      string
+	Subject       string // the provider's stable id of the account
+	Login         string // suggested username
+	Email         string
+	EmailVerified bool
+}
+
+// OAuthLink ties a provider account to a user; its document id is
+// "provider:subject".
+type OAuthLink struct {
+	Username  string    `json:"username"`
+	Provider  string    `json:"provider"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OAuthProvider is a configured login provider.
+type OAuthProvider struct {
+	config *oauth2.Config
+	// identity asks the provider, through a client carrying the user's
+	// token, who the user is.
+	identity func(ctx context.Context, client *http.Client) (*OAuthIdentity, error)
+}
+
+// oauthProviders are the providers with credentials, set up by setupOAuth.
+var oauthProviders = map[string]*OAuthProvider{}
+
+func setupOAuth() {
+	base := strings.TrimSuffix(OAUTH_BASE_URL, "/")
+	if GOOGLE_CLIENT_ID != "" {
+		oauthProviders["google"] = newGoogleProvider(GOOGLE_CLIENT_ID, GOOGLE_CLIENT_SECRET, base+"/auth/google/callback")
+	}
+	if GITHUB_CLIENT_ID != "" {
+		oauthProviders["github"] = newGitHubProvider(GITHUB_CLIENT_ID, GITHUB_CLIENT_SECRET, base+"/auth/github/callback")
+	}
+}
+
+// handleOAuthLogin sends the user to the provider. The state, tying the
+// callback to this browser, and the API version asked for are kept in a
+// short-lived cookie.
+func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one OAuth login request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	raw := make([]byte, OAUTH_STATE_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		fmt.Printf("Failed to generate OAuth state %v.\n", err)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     OAUTH_STATE_COOKIE,
+		Value:    state + "." + strconv.Itoa(apiVersion(r)),
+		Path:     "/auth/",
+		MaxAge:   int(OAUTH_STATE_TTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(OAUTH_BASE_URL, "https://"),
+		// the provider's redirect back is a cross-site navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.config.AuthCodeURL(state), http.StatusFound)
+}
+
+// handleOAuthCallback finishes a login started by handleOAuthLogin.
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one OAuth callback request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	name := mux.Vars(r)["provider"]
+	provider, ok := oauthProviders[name]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	version, ok := checkOAuthState(w, r)
+	if !ok {
+		http.Error(w, "Login expired or was started in another browser, please try again", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		http.Error(w, "Login was cancelled", http.StatusUnauthorized)
+		fmt.Printf("OAuth login with %s failed: %s.\n", name, reason)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), OAUTH_TIMEOUT)
+	defer cancel()
+	token, err := provider.config.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		http.Error(w, "Login with the provider failed, please try again", http.StatusUnauthorized)
+		fmt.Printf("Failed to exchange OAuth code with %s %v.\n", name, err)
+		return
+	}
+	identity, err := provider.identity(ctx, provider.config.Client(ctx, token))
+	if err != nil {
+		http.Error(w, "Login with the provider failed, please try again", http.StatusUnauthorized)
+		fmt.Printf("Failed to read identity from %s %v.\n", name, err)
+		return
+	}
+	identity.Provider = name
+
+	account, err := oauthAccount(ctx, identity)
+	if err != nil {
+		writeServiceError(w, err, "Failed to save to ElasticSearch")
+		if _, ok := err.(*ServiceError); !ok {
+			fmt.Printf("Failed to find account of %s identity %s %v.\n", name, identity.Subject, err)
+		}
+		return
+	}
+	if bans.Banned(account.Username) {
+		http.Error(w, errUserBanned.Error(), http.StatusForbidden)
+		return
+	}
+	fmt.Printf("Login in as %s with %s\n", account.Username, name)
+
+	writeLoginTokens(w, version, account)
+}
+
+// checkOAuthState compares the state of the callback with the cookie set by
+// handleOAuthLogin, which it clears, and returns the API version asked for.
+func checkOAuthState(w http.ResponseWriter, r *http.Request) (int, bool) {
+	cookie, err := r.Cookie(OAUTH_STATE_COOKIE)
+	if err != nil {
+		return 0, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: OAUTH_STATE_COOKIE, Path: "/auth/", MaxAge: -1})
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	state := r.URL.Query().Get("state")
+	if len(parts) != 2 || state == "" || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return 0, false
+	}
+	return supportedVersion(parts[1]), true
+}
+
+// oauthAccount returns the user linked to identity, linking or creating
+// one on the first login.
+func oauthAccount(ctx context.Context, identity *OAuthIdentity) (*User, error) {
+	client := esClient
+	linkId := identity.Provider + ":" + identity.Subject
+
+	result, err := client.Get().
+		Index(OAUTH_IDENTITY_INDEX).
+		Id(linkId).
+		Do(ctx)
+	if err == nil {
+		var link OAuthLink
+		if err := json.Unmarshal(result.Source, &link); err != nil {
+			return nil, err
+		}
+		user, err := getUser(link.Username)
+		if err != errUserNotFound {
+			if user != nil {
+				user.Password = ""
+			}
+			return user, err
+		}
+		// the account is gone, link the identity anew
+	} else if !elastic.IsNotFound(err) {
+		return nil, err
+	}
+
+	user, err := userByVerifiedEmail(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if user, err = createOAuthUser(identity); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = client.Index().
+		Index(OAUTH_IDENTITY_INDEX).
+		Id(linkId).
+		BodyJson(&OAuthLink{Username: user.Username, Provider: identity.Provider, CreatedAt: time.Now().UTC()}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Linked %s identity %s to %s\n", identity.Provider, identity.Subject, user.Username)
+	user.Password = ""
+	return user, nil
+}
+
+// userByVerifiedEmail finds the one account whose verified email address is
+// the verified address of identity, nil if there is none. Unverified
+// addresses on either side are never trusted, so an account can't be taken
+// over by claiming someone else's address.
+func userByVerifiedEmail(ctx context.Context, identity *OAuthIdentity) (*User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, nil
+	}
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(USER_INDEX).
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewTermQuery("email.keyword", identity.Email)).
+			Filter(elastic.NewTermQuery("email_verified", true))).
+		Size(2).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchResult.Hits.Hits) != 1 {
+		return nil, nil
+	}
+	var user User
+	if err := json.Unmarshal(searchResult.Hits.Hits[0].Source, &user); err != nil {
+		return nil, err
+	}
+	if user.Role == "" {
+		user.Role = ROLE_USER
+	}
+	return &user, nil
+}
+
+// createOAuthUser signs up a user for identity. The password is random, so
+// the account logs in through the provider until a password is set by a
+// reset.
+func createOAuthUser(identity *OAuthIdentity) (*User, error) {
+	raw := make([]byte, REFRESH_TOKEN_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	user := User{
+		Password:      base64.RawURLEncoding.EncodeToString(raw),
+		Role:          ROLE_USER,
+		EmailVerified: identity.EmailVerified && identity.Email != "",
+	}
+	if user.EmailVerified {
+		user.Email = identity.Email
+	}
+
+	base := oauthUsername(identity)
+	for attempt := 0; attempt < OAUTH_USERNAME_ATTEMPTS; attempt++ {
+		user.Username = base
+		if attempt > 0 {
+			suffix := make([]byte, 2)
+			if _, err := rand.Read(suffix); err != nil {
+				return nil, err
+			}
+			user.Username = fmt.Sprintf("%s_%d", base, int(suffix[0])<<8|int(suffix[1]))
+		}
+		err := addUser(user)
+		if err == nil {
+			return &user, nil
+		}
+		if err.Error() != "User already exists" {
+			return nil, err
+		}
+	}
+	return nil, serviceError(http.StatusConflict, "Failed to pick a username, please sign up instead")
+}
+
+// oauthUsername turns the provider login into a valid username.
+func oauthUsername(identity *OAuthIdentity) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(identity.Login) {
+		if b.Len() >= MAX_OAUTH_USERNAME_CHARS {
+			break
+		}
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_':
+			b.WriteRune(c)
+		case c == '-' || c == '.':
+			b.WriteByte('_')
+		}
+	}
+	// "me" is taken by the /user/me routes
+	if name := b.String(); name != "" && name != "me" {
+		return name
+	}
+	return identity.Provider + "_user"
+}
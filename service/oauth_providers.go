@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	GOOGLE_USERINFO_URL = "https://openidconnect.googleapis.com/v1/userinfo"
+	GITHUB_USER_URL     = "https://api.github.com/user"
+	GITHUB_EMAILS_URL   = "https://api.github.com/user/emails"
+)
+
+func newGoogleProvider(clientId, secret, redirectURL string) *OAuthProvider {
+	return &OAuthProvider{
+		config: &oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: secret,
+			Endpoint:     endpoints.Google,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "email"},
+		},
+		identity: googleIdentity,
+	}
+}
+
+func googleIdentity(ctx context.Context, client *http.Client) (*OAuthIdentity, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getProviderJSON(ctx, client, GOOGLE_USERINFO_URL, &info); err != nil {
+		return nil, err
+	}
+	if info.Sub == "" {
+		return nil, fmt.Errorf("google returned no subject")
+	}
+	return &OAuthIdentity{
+		Subject:       info.Sub,
+		Login:         strings.SplitN(info.Email, "@", 2)[0],
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+	}, nil
+}
+
+func newGitHubProvider(clientId, secret, redirectURL string) *OAuthProvider {
+	return &OAuthProvider{
+		config: &oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: secret,
+			Endpoint:     endpoints.GitHub,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		identity: gitHubIdentity,
+	}
+}
+
+// gitHubIdentity reads the user and their primary email address, which
+// the user endpoint leaves out when it is private.
+func gitHubIdentity(ctx context.Context, client *http.Client) (*OAuthIdentity, error) {
+	var user struct {
+		Id    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := getProviderJSON(ctx, client, GITHUB_USER_URL, &user); err != nil {
+		return nil, err
+	}
+	if user.Id == 0 {
+		return nil, fmt.Errorf("github returned no user id")
+	}
+	identity := &OAuthIdentity{Subject: strconv.FormatInt(user.Id, 10), Login: user.Login}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getProviderJSON(ctx, client, GITHUB_EMAILS_URL, &emails); err != nil {
+		return nil, err
+	}
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email, identity.EmailVerified = e.Email, e.Verified
+		}
+	}
+	return identity, nil
+}
+
+func getProviderJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
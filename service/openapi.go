@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI 3 description of the HTTP API, served at GET /openapi.json
+// for generating client SDKs. Operations are listed in apiOperations; the
+// schemas of their JSON bodies are derived from the Go types the handlers
+// read and write, so a field added to Post shows up without touching this
+// file. A new endpoint is documented by adding it to apiOperations.
+const OPENAPI_VERSION = "3.0.3"
+
+// apiParam is a query, path or form parameter. typ is a JSON schema type,
+// or "file" for an uploaded file.
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	description string
+	required    bool
+}
+
+type apiResponse struct {
+	status      int
+	description string
+	body        interface{} // a value of the JSON body type, nil for text
+}
+
+type apiOperation struct {
+	method  string
+	path    string // with mux-style {name} parameters, which OpenAPI shares
+	summary string
+	auth    bool // requires a bearer token
+	// publicRead drops the token requirement when PUBLIC_READ is set.
+	publicRead bool
+	params     []apiParam
+	// body is a value of the JSON request body type; form lists the fields
+	// of a multipart form body instead.
+	body      interface{}
+	form      []apiParam
+	responses []apiResponse
+}
+
+// SignupBody documents the fields of User that POST /signup reads.
+type SignupBody struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Age      int64  `json:"age,omitempty"`
+	Gender   string `json:"gender,omitempty"`
+}
+
+// LoginBody documents the fields of User that POST /login reads.
+type LoginBody struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var versionParam = apiParam{"v", "query", "integer", "API version: 1 for bare arrays and token strings, 2 for the shapes documented here", false}
+
+var paginationParams = []apiParam{
+	{"limit", "query", "integer", "page size, 1 to " + strconv.Itoa(MAX_PAGE_SIZE) + ", default " + strconv.Itoa(DEFAULT_PAGE_SIZE), false},
+	{"offset", "query", "integer", "posts to skip", false},
+}
+
+var postFormParams = []apiParam{
+	{"message", "form", "string", "", false},
+	{"lat", "form", "number", "-90 to 90", true},
+	{"lon", "form", "number", "-180 to 180", true},
+	{"lang", "form", "string", "language of the message, from Accept-Language when missing", false},
+	{"draft", "form", "boolean", "save without publishing", false},
+	{"fuzz_location", "form", "boolean", "show the location only approximately to others", false},
+	{"ttl", "form", "string", "delete the post this long after it is created, e.g. 24h", false},
+	{"publish_at", "form", "string", "RFC 3339 time to publish the post at, within 30 days", false},
+	{"channel", "form", "string", "id of a channel whose area holds lat and lon", false},
+	{"image", "form", "file", "the image, unless video or media_token is sent", false},
+	{"image[]", "form", "file", "up to 10 images, in order, instead of image", false},
+	{"video", "form", "file", "the video, unless image or media_token is sent", false},
+	{"media_token", "form", "string", "media uploaded before with POST /upload", false},
+}
+
+var apiOperations = []apiOperation{
+	{
+		method: "POST", path: "/post", summary: "Create a post", auth: true,
+		form: postFormParams,
+		responses: []apiResponse{
+			{http.StatusOK, "The created post", Post{}},
+			{http.StatusAccepted, "The post, queued to be indexed when an ingest queue is configured", Post{}},
+			{http.StatusBadRequest, "Invalid post, or filtered words in the message. Invalid coordinates and ttl come as an APIError", nil},
+			{http.StatusUnsupportedMediaType, "Unsupported image or video format", nil},
+		},
+	},
+	{
+		method: "POST", path: "/upload", summary: "Upload media to attach to a post later", auth: true,
+		form: []apiParam{
+			{"image", "form", "file", "the image, unless video is sent", false},
+			{"video", "form", "file", "the video, unless image is sent", false},
+		},
+		responses: []apiResponse{
+			{http.StatusCreated, "The token to send as media_token", UploadResponse{}},
+			{http.StatusBadRequest, "No media was sent", nil},
+		},
+	},
+	{
+		method: "GET", path: "/search", summary: "Search published posts around a point, nearest first", auth: true, publicRead: true,
+		params: append([]apiParam{
+			{"lat", "query", "number", "latitude of the center, -90 to 90; required without place, in or bbox", false},
+			{"lon", "query", "number", "longitude of the center, -180 to 180; required without place, in or bbox", false},
+			{"range", "query", "string", "radius in m, km or mi, e.g. 500m or 3mi; km without a unit. The configured distance by default", false},
+			{"place", "query", "string", "a place name to search around instead of lat and lon", false},
+			{"in", "query", "string", "a city or neighborhood, e.g. Brooklyn, to keep the posts in; searched around it without lat, lon and place", false},
+			{"bbox", "query", "string", "minLat,minLon,maxLat,maxLon of a map viewport, instead of a center", false},
+			{"since", "query", "string", "only posts created at or after this RFC 3339 time", false},
+			{"until", "query", "string", "only posts created at or before this RFC 3339 time", false},
+			versionParam,
+		}, paginationParams...),
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts", PostPage{}},
+			{http.StatusBadRequest, "Invalid parameters", APIError{}},
+		},
+	},
+	{
+		method: "GET", path: "/trending", summary: "Rank the recent posts around a point by likes, comments and age", auth: true, publicRead: true,
+		params: append([]apiParam{
+			{"lat", "query", "number", "latitude of the center, -90 to 90", true},
+			{"lon", "query", "number", "longitude of the center, -180 to 180", true},
+			{"range", "query", "string", "radius in m, km or mi, e.g. 500m or 3mi; km without a unit. The configured distance by default", false},
+		}, paginationParams...),
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts, hottest first", PostPage{}},
+			{http.StatusBadRequest, "Invalid parameters", APIError{}},
+		},
+	},
+	{
+		method: "DELETE", path: "/post/{id}", summary: "Move one of your posts to your trash", auth: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The post was moved to the trash", nil},
+			{http.StatusForbidden, "The post is someone else's", nil},
+			{http.StatusNotFound, "No such post, or it is in the trash", nil},
+		},
+	},
+	{
+		method: "POST", path: "/post/{id}/restore", summary: "Take one of your posts out of your trash", auth: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The post was restored", nil},
+			{http.StatusForbidden, "The post is someone else's", nil},
+			{http.StatusNotFound, "No such post", nil},
+			{http.StatusConflict, "The post is not in the trash", nil},
+		},
+	},
+	{
+		method: "GET", path: "/user/me/drafts", summary: "List your drafts, most recently updated first", auth: true,
+		params: paginationParams,
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts", PostPage{}},
+		},
+	},
+	{
+		method: "POST", path: "/post/{id}/publish", summary: "Publish one of your drafts", auth: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The post is published", nil},
+			{http.StatusForbidden, "The post is someone else's", nil},
+			{http.StatusNotFound, "No such post", nil},
+		},
+	},
+	{
+		method: "GET", path: "/user/me/trash", summary: "List your deleted posts, most recently deleted first", auth: true,
+		params: paginationParams,
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts", PostPage{}},
+		},
+	},
+	{
+		method: "POST", path: "/messages", summary: "Send a direct message to another user", auth: true,
+		body: NewMessage{},
+		responses: []apiResponse{
+			{http.StatusCreated, "The sent message", Message{}},
+			{http.StatusBadRequest, "Empty or too long message, filtered words, or no other user to send it to", nil},
+			{http.StatusNotFound, "No such user", nil},
+		},
+	},
+	{
+		method: "GET", path: "/conversations", summary: "List your conversations, most recent message first, with unread counts", auth: true,
+		params: paginationParams,
+		responses: []apiResponse{
+			{http.StatusOK, "A page of conversations", ConversationPage{}},
+		},
+	},
+	{
+		method: "GET", path: "/conversations/{id}/messages", summary: "List the messages of one of your conversations, newest first; the first page marks it read", auth: true,
+		params: append([]apiParam{{"id", "path", "string", "", true}}, paginationParams...),
+		responses: []apiResponse{
+			{http.StatusOK, "A page of messages", MessagePage{}},
+			{http.StatusNotFound, "No such conversation of yours", nil},
+		},
+	},
+	{
+		method: "POST", path: "/channels", summary: "Create a channel, a named circle posts can belong to", auth: true,
+		body: ChannelInput{},
+		responses: []apiResponse{
+			{http.StatusCreated, "The created channel", Channel{}},
+			{http.StatusBadRequest, "Invalid name, center or radius", nil},
+		},
+	},
+	{
+		method: "GET", path: "/channels", summary: "List the channels whose area holds a point, nearest first", auth: true, publicRead: true,
+		params: []apiParam{
+			{"lat", "query", "number", "latitude of the point, -90 to 90", true},
+			{"lon", "query", "number", "longitude of the point, -180 to 180", true},
+		},
+		responses: []apiResponse{
+			{http.StatusOK, "The channels", ChannelList{}},
+			{http.StatusBadRequest, "Invalid coordinates", APIError{}},
+		},
+	},
+	{
+		method: "GET", path: "/channel/{id}", summary: "Get a channel", auth: true, publicRead: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The channel", Channel{}},
+			{http.StatusNotFound, "No such channel", nil},
+		},
+	},
+	{
+		method: "PUT", path: "/channel/{id}", summary: "Edit one of your channels", auth: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		body:   ChannelInput{},
+		responses: []apiResponse{
+			{http.StatusOK, "The edited channel", Channel{}},
+			{http.StatusBadRequest, "Invalid name, center or radius", nil},
+			{http.StatusForbidden, "The channel is someone else's", nil},
+			{http.StatusNotFound, "No such channel", nil},
+		},
+	},
+	{
+		method: "DELETE", path: "/channel/{id}", summary: "Delete one of your channels, keeping its posts", auth: true,
+		params: []apiParam{{"id", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The channel was deleted", nil},
+			{http.StatusForbidden, "The channel is someone else's", nil},
+			{http.StatusNotFound, "No such channel", nil},
+		},
+	},
+	{
+		method: "GET", path: "/channel/{id}/posts", summary: "List the posts of a channel, newest first", auth: true, publicRead: true,
+		params: append([]apiParam{{"id", "path", "string", "", true}}, paginationParams...),
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts", PostPage{}},
+			{http.StatusNotFound, "No such channel", nil},
+		},
+	},
+	{
+		method: "GET", path: "/user/{username}/posts", summary: "List the posts of a user, newest first", auth: true, publicRead: true,
+		params: append([]apiParam{{"username", "path", "string", "", true}}, paginationParams...),
+		responses: []apiResponse{
+			{http.StatusOK, "A page of posts", PostPage{}},
+			{http.StatusNotFound, "No such user", nil},
+		},
+	},
+	{
+		method: "POST", path: "/devices", summary: "Register a device for push notifications", auth: true,
+		body: DeviceRegistration{},
+		responses: []apiResponse{
+			{http.StatusCreated, "The device was registered", nil},
+			{http.StatusBadRequest, "Invalid token, platform or location", nil},
+		},
+	},
+	{
+		method: "DELETE", path: "/devices/{token}", summary: "Stop pushes to one of your devices", auth: true,
+		params: []apiParam{{"token", "path", "string", "", true}},
+		responses: []apiResponse{
+			{http.StatusOK, "The device was unregistered", nil},
+			{http.StatusNotFound, "No such device of yours", nil},
+		},
+	},
+	{
+		method: "POST", path: "/signup", summary: "Create an account",
+		body: SignupBody{},
+		responses: []apiResponse{
+			{http.StatusOK, "The account was created", nil},
+			{http.StatusBadRequest, "Invalid username, password or email, or the user exists", nil},
+		},
+	},
+	{
+		method: "POST", path: "/login", summary: "Log in with a username and password",
+		params: []apiParam{versionParam},
+		body:   LoginBody{},
+		responses: []apiResponse{
+			{http.StatusOK, "An access and a refresh token", TokenPair{}},
+			{http.StatusUnauthorized, "Wrong username or password", nil},
+			{http.StatusForbidden, "The email address is not verified, or the account is banned", nil},
+		},
+	},
+	{
+		method: "POST", path: "/token/refresh", summary: "Trade a refresh token for a new token pair",
+		body: RefreshRequest{},
+		responses: []apiResponse{
+			{http.StatusOK, "A new access and refresh token", TokenPair{}},
+			{http.StatusUnauthorized, "The refresh token is invalid, expired or revoked", nil},
+		},
+	},
+	{
+		method: "POST", path: "/logout", summary: "Revoke a refresh token",
+		body: RefreshRequest{},
+		responses: []apiResponse{
+			{http.StatusOK, "Logged out", nil},
+		},
+	},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+	openAPIErr  error
+)
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for the OpenAPI document")
+
+	openAPIOnce.Do(func() {
+		openAPIJSON, openAPIErr = json.MarshalIndent(openAPIDocument(), "", "  ")
+	})
+	if openAPIErr != nil {
+		http.Error(w, "Failed to encode the OpenAPI document", http.StatusInternalServerError)
+		fmt.Printf("Failed to encode the OpenAPI document %v.\n", openAPIErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
+
+// openAPIDocument describes apiOperations.
+func openAPIDocument() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]interface{})
+		}
+		paths[op.path][strings.ToLower(op.method)] = op.describe(schemas)
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "Around API",
+			"version": strconv.Itoa(LATEST_API_VERSION),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// describe is the OpenAPI operation object of op, adding the schemas it
+// refers to to schemas.
+func (op *apiOperation) describe(schemas map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{"summary": op.summary}
+	if op.auth && !(op.publicRead && PUBLIC_READ) {
+		out["security"] = []map[string][]string{{"bearerAuth": {}}}
+	}
+
+	var params []map[string]interface{}
+	for _, p := range op.params {
+		param := map[string]interface{}{
+			"name":     p.name,
+			"in":       p.in,
+			"required": p.required || p.in == "path",
+			"schema":   map[string]interface{}{"type": p.typ},
+		}
+		if p.description != "" {
+			param["description"] = p.description
+		}
+		params = append(params, param)
+	}
+	if params != nil {
+		out["parameters"] = params
+	}
+
+	switch {
+	case op.body != nil:
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(reflect.TypeOf(op.body), schemas),
+		}
+	case op.form != nil:
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"multipart/form-data": map[string]interface{}{"schema": formSchema(op.form)},
+			},
+		}
+	}
+
+	responses := make(map[string]interface{})
+	for _, resp := range op.responses {
+		response := map[string]interface{}{"description": resp.description}
+		if resp.body != nil {
+			response["content"] = jsonContent(reflect.TypeOf(resp.body), schemas)
+		} else {
+			response["content"] = map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+		responses[strconv.Itoa(resp.status)] = response
+	}
+	out["responses"] = responses
+	return out
+}
+
+func jsonContent(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemaOf(t, schemas)},
+	}
+}
+
+func formSchema(fields []apiParam) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for _, f := range fields {
+		property := map[string]interface{}{"type": f.typ}
+		if f.typ == "file" {
+			property = map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		if f.description != "" {
+			property["description"] = f.description
+		}
+		properties[f.name] = property
+		if f.required {
+			required = append(required, f.name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf is the JSON schema of how encoding/json encodes t. Structs are
+// added to schemas under their type name and referred to.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		// registered before the fields, so recursive types terminate
+		schemas[t.Name()] = nil
+		schemas[t.Name()] = structSchema(t, schemas)
+		return ref
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema lists the fields of t as encoding/json names them. Fields
+// without omitempty are always present, so they are required.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma:]
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(options, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
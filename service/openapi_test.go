@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do(httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var doc struct {
+		OpenAPI    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+				Required   []string               `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if doc.OpenAPI != OPENAPI_VERSION {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+	if doc.Paths["/search"]["get"] == nil || doc.Paths["/post"]["post"] == nil {
+		t.Errorf("paths = %v", doc.Paths)
+	}
+
+	post := doc.Components.Schemas["Post"]
+	if post.Properties["media_type"] == nil || post.Properties["thumbnails"] == nil {
+		t.Errorf("Post properties = %v", post.Properties)
+	}
+	if strings.Join(post.Required, ",") != "location,message,timestamp,updated_at,url,user" {
+		t.Errorf("Post required = %v", post.Required)
+	}
+	if _, ok := doc.Components.Schemas["Thumbnail"]; !ok {
+		t.Error("Thumbnail schema is missing")
+	}
+}
+
+// TestOpenAPIRoutes checks that every documented operation is served.
+func TestOpenAPIRoutes(t *testing.T) {
+	s := newTestServer(t)
+	for _, op := range apiOperations {
+		path := strings.NewReplacer("{id}", "some-id", "{username}", "alice").Replace(op.path)
+		// no token and no body, so nothing is changed
+		w := s.do(httptest.NewRequest(op.method, path, nil))
+		if w.Code == http.StatusNotFound || w.Code == http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status = %d, the operation isn't routed", op.method, op.path, w.Code)
+		}
+	}
+}
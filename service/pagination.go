@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+	// MAX_RESULT_WINDOW is ElasticSearch's index.max_result_window, the
+	// deepest offset+limit a search may page to.
+	MAX_RESULT_WINDOW = 10000
+)
+
+// PostPage is the paginated envelope returned by list endpoints.
+type PostPage struct {
+	Total  int64  `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+	Posts  []Post `json:"posts"`
+}
+
+// parsePagination reads the optional limit and offset query parameters.
+func parsePagination(r *http.Request) (offset, limit int, err error) {
+	limit = DEFAULT_PAGE_SIZE
+	if val := r.URL.Query().Get("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit <= 0 || limit > MAX_PAGE_SIZE {
+			return 0, 0, errors.New("limit should be between 1 and " + strconv.Itoa(MAX_PAGE_SIZE))
+		}
+	}
+	if val := r.URL.Query().Get("offset"); val != "" {
+		offset, err = strconv.Atoi(val)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset should be a non-negative integer")
+		}
+	}
+	return offset, limit, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Password reset. POST /password/forgot mails the account's email address a
+// link to PASSWORD_RESET_URL, the page of the client where a new password
+// is chosen, carrying the username and a random token. Only the token's
+// hash is stored, in the user document, for PASSWORD_RESET_TTL. POST
+// /password/reset sets the new password with the token, which works once,
+// and logs the account out everywhere.
+var PASSWORD_RESET_URL = "http://localhost:3000/reset-password"
+
+const (
+	PASSWORD_RESET_TTL = time.Hour
+	// PASSWORD_RESET_INTERVAL is how long a reset link must be out before
+	// another one is mailed, so the endpoint can't flood a mailbox.
+	PASSWORD_RESET_INTERVAL = time.Minute
+	PASSWORD_RESET_BYTES    = 32
+)
+
+const passwordResetSubject = "Reset your password"
+
+var errInvalidResetToken = serviceError(http.StatusBadRequest, "Invalid or expired reset token")
+
+// ForgotPasswordRequest is the body of POST /password/forgot.
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+// ResetPasswordRequest is the body of POST /password/reset.
+type ResetPasswordRequest struct {
+	Username    string `json:"username"`
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// handleForgotPassword mails a reset link. It answers the same whether or
+// not the account exists, so it can't be used to find accounts.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one forgot password request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if mailer == nil {
+		http.Error(w, "Password reset is not available", http.StatusNotImplemented)
+		return
+	}
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	if err := requestPasswordReset(req.Username); err != nil {
+		http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to start password reset of %s %v.\n", req.Username, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account has an email address, a reset link is on its way."))
+}
+
+// requestPasswordReset stores a new reset token for username and mails it.
+// Unknown users and accounts without an email address are skipped quietly.
+func requestPasswordReset(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return nil
+	}
+	user, err := getUser(username)
+	if err != nil {
+		if err == errUserNotFound {
+			return nil
+		}
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	if user.ResetExpiresAt != nil && now.Before(user.ResetExpiresAt.Add(PASSWORD_RESET_INTERVAL-PASSWORD_RESET_TTL)) {
+		fmt.Printf("Skipped password reset of %s, one was just sent\n", username)
+		return nil
+	}
+
+	raw := make([]byte, PASSWORD_RESET_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expires := now.Add(PASSWORD_RESET_TTL)
+
+	client := esClient
+	_, err = client.Update().
+		Index(USER_INDEX).
+		Id(username).
+		Doc(map[string]interface{}{"reset_token_hash": hashToken(token), "reset_expires_at": expires}).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	link := PASSWORD_RESET_URL + "?username=" + url.QueryEscape(username) + "&token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nTo choose a new password for Around, open this link within %d minutes:\n\n%s\n\nIf you didn't ask for this, you can ignore this email; your password stays the same.\n",
+		username, int(PASSWORD_RESET_TTL/time.Minute), link)
+	email := user.Email
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MAILER_TIMEOUT)
+		defer cancel()
+		if err := mailer.Send(ctx, email, passwordResetSubject, body); err != nil {
+			fmt.Printf("Failed to send password reset email to %s %v.\n", username, err)
+			return
+		}
+		fmt.Printf("Sent password reset email to %s\n", username)
+	}()
+	return nil
+}
+
+// handleResetPassword sets a new password with a reset token.
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one password reset request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := resetPassword(req.Username, req.Token, req.NewPassword); err != nil {
+		writeServiceError(w, err, "Failed to save to ElasticSearch")
+		if _, ok := err.(*ServiceError); !ok {
+			fmt.Printf("Failed to reset password of %s %v.\n", req.Username, err)
+		}
+		return
+	}
+
+	w.Write([]byte("Password reset successfully, you can log in now."))
+}
+
+// resetPassword replaces the password of username if token is its current
+// reset token, then clears the token. Opening the link proves the email
+// address, so a pending verification is done too.
+func resetPassword(username, token, password string) error {
+	if token == "" || !usernamePattern.MatchString(username) {
+		return errInvalidResetToken
+	}
+
+	client := esClient
+	result, err := client.Get().
+		Index(USER_INDEX).
+		Id(username).
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return errInvalidResetToken
+		}
+		return err
+	}
+	var user User
+	if err := json.Unmarshal(result.Source, &user); err != nil {
+		return err
+	}
+	if user.ResetTokenHash == "" || user.ResetExpiresAt == nil || time.Now().After(*user.ResetExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(user.ResetTokenHash), []byte(hashToken(token))) != 1 {
+		return errInvalidResetToken
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	// only one of concurrent resets with the token gets through
+	_, err = client.Update().
+		Index(USER_INDEX).
+		Id(username).
+		IfSeqNo(*result.SeqNo).
+		IfPrimaryTerm(*result.PrimaryTerm).
+		Doc(map[string]interface{}{
+			"password":             hash,
+			"reset_token_hash":     nil,
+			"reset_expires_at":     nil,
+			"verification_pending": false,
+			"email_verified":       true,
+		}).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return errInvalidResetToken
+		}
+		return err
+	}
+	fmt.Printf("Password reset for %s\n", username)
+
+	if err := revokeRefreshTokens(username); err != nil {
+		fmt.Printf("Failed to revoke refresh tokens of %s %v.\n", username, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const POST_INDEX = "post" // ElasticSearch database
+
+var (
+	// INDEX_CODEC is the stored-fields codec of the post index, one of
+	// INDEX_CODECS. "best_compression" shrinks the index on disk at the
+	// cost of a bit more CPU when segments are merged. It only takes effect
+	// when the index is created; changing it for an existing index requires
+	// a reindex. Set with index_codec in the config.
+	INDEX_CODEC = "default"
+
+	// PUBLIC_READ lets visitors without a token use the read endpoints.
+	// Writes always require a token. Set with public_read in the config.
+	PUBLIC_READ = false
+)
+
+var INDEX_CODECS = []string{"default", "best_compression"}
+
+const (
+	STATUS_DRAFT     = "draft"
+	STATUS_PUBLISHED = "published"
+	STATUS_SCHEDULED = "scheduled" // published at publish_at, see startScheduler
+)
+
+var errPostNotFound = errors.New("Post does not exist")
+
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type Post struct {
+	Id            string      `json:"id,omitempty"`
+	User          string      `json:"user"`
+	Message       string      `json:"message"`
+	Location      Location    `json:"location"`
+	City          string      `json:"city,omitempty"`         // named by the geocoder, see enrichPlace
+	Neighborhood  string      `json:"neighborhood,omitempty"` // named by the geocoder, see enrichPlace
+	Url           string      `json:"url"`
+	MediaType     string      `json:"media_type,omitempty"`  // MEDIA_IMAGE or MEDIA_VIDEO
+	MediaKey      string      `json:"media_key,omitempty"`   // blob store key of the image or video
+	External      bool        `json:"external,omitempty"`    // url is hosted elsewhere, see handleBulkPosts
+	MediaState    string      `json:"media_state,omitempty"` // MEDIA_PENDING or MEDIA_FAILED until the media is stored
+	Thumbnails    []Thumbnail `json:"thumbnails,omitempty"`
+	Images        []PostImage `json:"images,omitempty"` // every image of a multi-image post, in order
+	Timestamp     time.Time   `json:"timestamp"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	ExpiresAt     *time.Time  `json:"expires_at,omitempty"` // deleted after, see startExpiryReaper
+	DeletedAt     *time.Time  `json:"deleted_at,omitempty"` // in the trash since, see trashPost
+	PublishAt     *time.Time  `json:"publish_at,omitempty"` // when a scheduled post is published
+	Channel       string      `json:"channel,omitempty"`    // id of the channel the post belongs to
+	Tags          []string    `json:"tags,omitempty"`
+	Hashtags      []string    `json:"hashtags,omitempty"` // parsed from the message, see extractHashtags
+	Status        string      `json:"status,omitempty"`
+	Lang          string      `json:"lang,omitempty"`
+	Masked        bool        `json:"masked,omitempty"` // filtered words were replaced
+	FuzzLocation  bool        `json:"fuzz_location,omitempty"`
+	ExactLocation *Location   `json:"exact_location,omitempty"` // only shown to the author
+	Restored      bool        `json:"restored,omitempty"`       // restored from the archive
+	Hidden        bool        `json:"hidden,omitempty"`         // hidden after too many reports
+	Labels        []string    `json:"labels,omitempty"`         // detected in the image, see analyzeImage
+	Faces         int         `json:"faces,omitempty"`          // faces detected in the image
+	ImageFlags    []string    `json:"image_flags,omitempty"`    // SafeSearch categories the image possibly falls in
+	Distance      *float64    `json:"distance,omitempty"`       // meters from the search point, search results only
+	Highlights    []string    `json:"highlights,omitempty"`     // matched message fragments, text search only
+	Likes         int64       `json:"likes,omitempty"`          // search results only
+	LikeCount     int64       `json:"like_count,omitempty"`     // kept for ranking, see bumpEngagement
+	CommentCount  int64       `json:"comment_count,omitempty"`  // kept for ranking, see bumpEngagement
+	LikedByMe     bool        `json:"liked_by_me,omitempty"`    // search results only
+	Reports       int64       `json:"reports,omitempty"`        // admin moderation listings only
+}
+
+// visibleTo reports whether viewer may see p; drafts, scheduled, hidden,
+// expired and deleted posts are only visible to their author.
+func (p *Post) visibleTo(viewer string) bool {
+	return p.User == viewer || (p.public() && !p.expired(time.Now()) && p.DeletedAt == nil)
+}
+
+// public reports whether p is published and not hidden.
+func (p *Post) public() bool {
+	return p.Status != STATUS_DRAFT && p.Status != STATUS_SCHEDULED && !p.Hidden
+}
+
+// expired reports whether p expired by now.
+func (p *Post) expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(now)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (a *App) handlePost(w http.ResponseWriter, r *http.Request) {
+	// Parse from body of request to get a json object.
+	reqLog := logFor(r.Context())
+	reqLog.Info("received post request")
+
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var in *NewPost
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		in = readJSONPost(w, r, claims.Username)
+	} else {
+		in = readFormPost(w, r, claims.Username)
+	}
+	if in == nil {
+		return
+	}
+	if file, ok := in.Media.(io.Closer); ok {
+		defer file.Close()
+	}
+	for _, image := range in.MoreImages {
+		if file, ok := image.Media.(io.Closer); ok {
+			defer file.Close()
+		}
+	}
+
+	p, err := a.createPost(r.Context(), in)
+	if err != nil {
+		writeServiceError(w, err, "Failed to save post")
+		return
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, "Failed to parse post into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse post into JSON format %v.\n", err)
+		return
+	}
+	if a.Ingest != nil {
+		// searchable once a consumer has indexed it
+		w.WriteHeader(http.StatusAccepted)
+	}
+	w.Write(js)
+}
+
+// readJSONPost reads a post sent as JSON, whose media was uploaded before
+// with POST /upload. On failure it writes the response and returns nil.
+func readJSONPost(w http.ResponseWriter, r *http.Request, user string) *NewPost {
+	var body JSONPost
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_JSON_POST_BYTES)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return nil
+	}
+	if body.MediaToken == "" {
+		http.Error(w, "media_token is required, upload the media with POST /upload first", http.StatusBadRequest)
+		return nil
+	}
+	if body.Lat == nil || body.Lon == nil {
+		writeServiceError(w, invalidParam(ERR_MISSING_COORDINATES, "lat and lon are required"), "")
+		return nil
+	}
+	loc := Location{Lat: *body.Lat, Lon: *body.Lon}
+	if err := validateLocation(loc); err != nil {
+		writeServiceError(w, err, "")
+		return nil
+	}
+	ttl, err := parsePostTTL(body.TTL)
+	if err != nil {
+		writeServiceError(w, err, "Failed to parse ttl")
+		return nil
+	}
+	publishAt, err := parsePublishAt(body.PublishAt, time.Now())
+	if err != nil {
+		writeServiceError(w, err, "")
+		return nil
+	}
+	lang := normalizeLang(body.Lang)
+	if lang == "" {
+		lang = postLanguage(r)
+	}
+	// like forms, which read it from the URL too
+	draft, _ := strconv.ParseBool(r.URL.Query().Get("draft"))
+	return &NewPost{
+		User:         user,
+		Message:      body.Message,
+		Lang:         lang,
+		Lat:          loc.Lat,
+		Lon:          loc.Lon,
+		Draft:        body.Draft || draft,
+		FuzzLocation: body.FuzzLocation,
+		TTL:          ttl,
+		PublishAt:    publishAt,
+		Channel:      body.Channel,
+		MediaToken:   body.MediaToken,
+	}
+}
+
+// readFormPost reads a post sent as a form carrying its media, or the
+// media_token of an upload. On failure it writes the response and returns
+// nil.
+func readFormPost(w http.ResponseWriter, r *http.Request, user string) *NewPost {
+	reqLog := logFor(r.Context())
+	if !limitUpload(w, r, MAX_UPLOAD_MEMORY) {
+		return nil
+	}
+	draft, _ := strconv.ParseBool(r.FormValue("draft"))
+	fuzz, _ := strconv.ParseBool(r.FormValue("fuzz_location"))
+	loc, err := parseLocation(r.FormValue("lat"), r.FormValue("lon"))
+	if err != nil {
+		writeServiceError(w, err, "")
+		return nil
+	}
+	ttl, err := parsePostTTL(r.FormValue("ttl"))
+	if err != nil {
+		writeServiceError(w, err, "Failed to parse ttl")
+		return nil
+	}
+	publishAt, err := parsePublishAt(r.FormValue("publish_at"), time.Now())
+	if err != nil {
+		writeServiceError(w, err, "")
+		return nil
+	}
+	in := &NewPost{
+		User:         user,
+		Message:      r.FormValue("message"),
+		Lang:         postLanguage(r),
+		Draft:        draft || r.FormValue("status") == STATUS_DRAFT,
+		FuzzLocation: fuzz,
+		Lat:          loc.Lat,
+		Lon:          loc.Lon,
+		TTL:          ttl,
+		PublishAt:    publishAt,
+		Channel:      r.FormValue("channel"),
+	}
+	if in.MediaToken = r.FormValue("media_token"); in.MediaToken != "" {
+		return in
+	}
+
+	// a post carries either images or a video
+	if !readFormImages(w, r, in) {
+		return nil
+	}
+	if in.Media != nil {
+		return in
+	}
+	in.MediaType = MEDIA_VIDEO
+	file, header, err := r.FormFile("video")
+	if err == http.ErrMissingFile {
+		in.MediaType = MEDIA_IMAGE
+		file, header, err = r.FormFile("image")
+	}
+	if err != nil {
+		http.Error(w, "Image or video is not available", http.StatusBadRequest)
+		reqLog.Warn("media is not available", "err", err)
+		return nil
+	}
+	in.Media, in.MediaSize = file, header.Size
+	return in
+}
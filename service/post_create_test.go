@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newPostRequest builds a POST /post form with the fields and, unless
+// media is nil, an image.
+func newPostRequest(t *testing.T, fields map[string]string, media []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if media != nil {
+		part, err := form.CreateFormFile("image", "photo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(media)
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/post", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandlePost(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "hello #sunset", "lat": "37.5", "lon": "-122.1"}, testPNG(t))
+
+	w := s.do(authorized(t, r, "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if p.Id == "" || p.User != "alice" || p.MediaType != MEDIA_IMAGE || p.Status != STATUS_PUBLISHED {
+		t.Errorf("post = %+v", p)
+	}
+	if len(p.Hashtags) != 1 || p.Hashtags[0] != "sunset" {
+		t.Errorf("hashtags = %v, want [sunset]", p.Hashtags)
+	}
+
+	stored, err := s.posts.Get(r.Context(), p.Id)
+	if err != nil {
+		t.Fatalf("post not stored: %v", err)
+	}
+	if stored.Location.Lat != 37.5 || stored.Location.Lon != -122.1 {
+		t.Errorf("location = %+v", stored.Location)
+	}
+	if !s.blobs.has(p.MediaKey) {
+		t.Errorf("media %q not stored", p.MediaKey)
+	}
+}
+
+func TestHandlePostDraft(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "not yet", "lat": "37.5", "lon": "-122.1", "draft": "true"}, testPNG(t))
+
+	w := s.do(authorized(t, r, "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.Status != STATUS_DRAFT {
+		t.Errorf("status = %q, want %q", p.Status, STATUS_DRAFT)
+	}
+}
+
+func TestPublishDraft(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "offline", "lat": "37.5", "lon": "-122.1"}, testPNG(t))
+	r.URL.RawQuery = "draft=true"
+
+	w := s.do(authorized(t, r, "yara"))
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Status != STATUS_DRAFT {
+		t.Fatalf("POST /post?draft=true = %d %s, want a draft", w.Code, w.Body)
+	}
+	if posts, _, _ := s.posts.Search(r.Context(), &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"}); len(posts) != 0 {
+		t.Errorf("search found the draft")
+	}
+
+	if w := s.do(authorized(t, httptest.NewRequest("POST", "/post/"+p.Id+"/publish", nil), "zoe")); w.Code != http.StatusForbidden {
+		t.Errorf("publish by another user = %d, want 403", w.Code)
+	}
+	if w := s.do(authorized(t, httptest.NewRequest("POST", "/post/"+p.Id+"/publish", nil), "yara")); w.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", w.Code, w.Body)
+	}
+	if posts, _, _ := s.posts.Search(r.Context(), &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"}); len(posts) != 1 || posts[0].Status != STATUS_PUBLISHED {
+		t.Errorf("search after publishing = %+v, want the post", posts)
+	}
+}
+
+func TestHandlePostRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		media  []byte
+		token  bool
+		want   int
+	}{
+		{"no token", map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}, testPNG(t), false, http.StatusUnauthorized},
+		{"no media", map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}, nil, true, http.StatusBadRequest},
+		{"not an image", map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}, []byte("plain text"), true, http.StatusUnsupportedMediaType},
+		{"filtered word", map[string]string{"message": "Damn it", "lat": "37.5", "lon": "-122.1"}, testPNG(t), true, http.StatusBadRequest},
+		{"no location", map[string]string{"message": "hi"}, testPNG(t), true, http.StatusBadRequest},
+		{"bad latitude", map[string]string{"message": "hi", "lat": "north", "lon": "-122.1"}, testPNG(t), true, http.StatusBadRequest},
+		{"latitude out of range", map[string]string{"message": "hi", "lat": "91", "lon": "-122.1"}, testPNG(t), true, http.StatusBadRequest},
+		{"longitude out of range", map[string]string{"message": "hi", "lat": "37.5", "lon": "-181"}, testPNG(t), true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			r := newPostRequest(t, tt.fields, tt.media)
+			if tt.token {
+				r = authorized(t, r, "alice")
+			}
+
+			w := s.do(r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if posts, _ := s.posts.Count(r.Context(), "alice"); posts != 0 {
+				t.Errorf("%d posts stored, want none", posts)
+			}
+		})
+	}
+}
+
+// failingSaves is a PostStore whose saves fail, after recording the post.
+type failingSaves struct {
+	PostStore
+	saved *Post
+}
+
+func (s *failingSaves) Save(ctx context.Context, id string, p *Post) error {
+	saved := *p
+	s.saved = &saved
+	return errors.New("index unavailable")
+}
+
+func TestPostMediaCleanedUpWhenSaveFails(t *testing.T) {
+	s := newTestServer(t)
+	store := &failingSaves{PostStore: s.posts}
+	s.Posts = store
+
+	fields := map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}
+	if w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "lou")); w.Code != http.StatusInternalServerError {
+		t.Fatalf("POST /post with a failing store = %d %s, want 500", w.Code, w.Body)
+	}
+	if store.saved == nil {
+		t.Fatal("the post never reached the store")
+	}
+	keys := mediaKeys(store.saved)
+	if len(keys) == 0 {
+		t.Fatal("the post had no media")
+	}
+	for _, key := range keys {
+		if s.blobs.has(key) {
+			t.Errorf("media %s was left behind", key)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// handleDeletePost moves one of the caller's posts to their trash, see
+// trashPost.
+func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for deleting a post")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err == nil && p.DeletedAt != nil {
+		// in the trash, restore it first
+		err = errPostNotFound
+	}
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return
+	}
+
+	if p.User != claims.Username {
+		http.Error(w, "Only the author can delete a post", http.StatusForbidden)
+		fmt.Printf("%s tried to delete post %s of %s\n", claims.Username, id, p.User)
+		return
+	}
+
+	p.Id = id
+	if err := a.trashPost(r.Context(), p); err != nil {
+		http.Error(w, "Failed to delete post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete post %s %v.\n", id, err)
+		return
+	}
+
+	w.Write([]byte("Post moved to the trash."))
+}
+
+// deletePost removes the post id, read as p, and everything attached to it,
+// for good. The BigTable copy, if enabled, is tombstoned.
+func (a *App) deletePost(ctx context.Context, id string, p *Post) error {
+	if err := a.Posts.Delete(ctx, id); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted post %s\n", id)
+
+	// the post is gone; media and BigTable failures leave only orphans
+	p.Id = id
+	owned := ownedMediaKeys(ctx, p)
+	for _, key := range owned {
+		if err := a.Blobs.Delete(ctx, key); err != nil {
+			fmt.Printf("Failed to delete media %s of post %s %v.\n", key, id, err)
+		}
+	}
+	deleteMediaRefs(id, owned)
+	go deleteLikes(id)
+	go deleteComments(id)
+	go deleteReports(id)
+	if ENABLE_BIGTABLE {
+		tombstoneBigTable(id)
+	}
+	return nil
+}
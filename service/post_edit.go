@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+// MAX_EDIT_MEMORY is how much of a multipart edit is kept in memory; the
+// rest of the image is buffered on disk.
+const MAX_EDIT_MEMORY = 32 << 20
+
+// handleEditPost lets the author change the message of a post and
+// optionally replace its image. The form fields are those of POST /post:
+// message and image, both optional, but at least one is required.
+func (a *App) handleEditPost(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for editing a post")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	if !limitUpload(w, r, MAX_EDIT_MEMORY) {
+		return
+	}
+	messages, hasMessage := r.PostForm["message"]
+	file, header, err := r.FormFile("image")
+	hasImage := err == nil
+	if hasImage {
+		defer file.Close()
+	}
+	if !hasMessage && !hasImage {
+		http.Error(w, "Nothing to update, send a message or an image", http.StatusBadRequest)
+		return
+	}
+	var contentType string
+	var image io.ReadSeeker
+	var imageSize int64
+	if hasImage {
+		contentType, err = checkImage(file, header.Size)
+		if err == nil {
+			image, imageSize, contentType, err = sanitizeImage(file, contentType)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), imageErrorStatus(err))
+			fmt.Printf("Rejected image %v.\n", err)
+			return
+		}
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err == nil && p.DeletedAt != nil {
+		// in the trash, restore it first
+		err = errPostNotFound
+	}
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return
+	}
+
+	if p.User != claims.Username {
+		http.Error(w, "Only the author can edit a post", http.StatusForbidden)
+		fmt.Printf("%s tried to edit post %s of %s\n", claims.Username, id, p.User)
+		return
+	}
+	p.Id = id
+
+	if hasMessage {
+		// filter spam
+		message, masked, ok := screenText(messages[0], p.Lang)
+		if !ok {
+			http.Error(w, "Sorry, the post contains filtered words. Please edit again. ", http.StatusBadRequest)
+			fmt.Printf("Sorry, the post contains filtered words. Please edit again. \n")
+			return
+		}
+		p.Message = message
+		p.Masked = masked
+		p.Hashtags = extractHashtags(message)
+	}
+
+	// a new image gets a new key so caches never serve the old one
+	oldPost := *p
+	if hasImage {
+		if err := a.analyzeImage(r.Context(), p, image, imageSize); err != nil {
+			writeServiceError(w, err, "Failed to read image")
+			return
+		}
+		key := uuid.New()
+		url, _, err := a.Blobs.Put(r.Context(), key, image, &PutOptions{
+			ContentType: contentType,
+			Size:        imageSize,
+		})
+		if err != nil {
+			http.Error(w, "Failed to save image", http.StatusInternalServerError)
+			fmt.Printf("Failed to save image %v.\n", err)
+			return
+		}
+		p.Url = url
+		p.MediaType = MEDIA_IMAGE
+		p.MediaKey = key
+		// the new image replaces all the images of a multi-image post
+		p.Images = nil
+		// a pending upload of the old media is dropped
+		p.MediaState = ""
+		p.Thumbnails, err = a.putThumbnails(r.Context(), key, image)
+		if err != nil {
+			fmt.Printf("Failed to generate thumbnails of %s %v.\n", key, err)
+		}
+	}
+
+	p.UpdatedAt = time.Now().UTC()
+	if err := a.Posts.Save(r.Context(), id, p); err != nil {
+		if hasImage {
+			for _, key := range mediaKeys(p) {
+				if err := a.Blobs.Delete(context.Background(), key); err != nil {
+					fmt.Printf("Failed to clean up image %s %v.\n", key, err)
+				}
+			}
+		}
+		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save post %s %v.\n", id, err)
+		return
+	}
+	fmt.Printf("Edited post %s\n", id)
+
+	if hasImage {
+		oldPost.Id = id
+		owned := ownedMediaKeys(context.Background(), &oldPost)
+		for _, key := range owned {
+			if err := a.Blobs.Delete(context.Background(), key); err != nil {
+				fmt.Printf("Failed to delete replaced image %s of post %s %v.\n", key, id, err)
+			}
+		}
+		deleteMediaRefs(id, owned)
+		go saveMediaRefs(p)
+	}
+	if ENABLE_BIGTABLE {
+		saveToBigTable(p, id)
+	}
+
+	// saveMediaRefs may still read p
+	out := []Post{*p}
+	signMediaURLs(out)
+	js, err := json.Marshal(&out[0])
+	if err != nil {
+		http.Error(w, "Failed to parse post into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse post into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
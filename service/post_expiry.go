@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Ephemeral posts. A post created with a ttl, e.g. "24h" for a story,
+// expires that long after it is created: searches leave it out right away,
+// only its author can still read it, and a background reaper deletes it
+// and its media within EXPIRY_REAP_INTERVAL.
+const (
+	MIN_POST_TTL         = time.Minute
+	MAX_POST_TTL         = 7 * 24 * time.Hour
+	EXPIRY_REAP_INTERVAL = time.Minute
+	EXPIRY_REAP_BATCH    = 100
+)
+
+// parsePostTTL parses the ttl of a new post, a duration such as "24h". An
+// empty ttl is zero: the post never expires.
+func parsePostTTL(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl < MIN_POST_TTL || ttl > MAX_POST_TTL {
+		return 0, invalidParam(ERR_INVALID_TTL, fmt.Sprintf("ttl should be a duration between %s and %s, e.g. 24h", MIN_POST_TTL, MAX_POST_TTL))
+	}
+	return ttl, nil
+}
+
+// startExpiryReaper deletes expired posts every EXPIRY_REAP_INTERVAL.
+func (a *App) startExpiryReaper() {
+	go func() {
+		ticker := time.NewTicker(EXPIRY_REAP_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if _, err := a.reapExpiredPosts(context.Background(), now); err != nil {
+				fmt.Printf("Failed to reap expired posts %v.\n", err)
+			}
+		}
+	}()
+}
+
+// reapExpiredPosts deletes up to EXPIRY_REAP_BATCH posts that expired
+// before now, with their media, and returns how many it deleted; the next
+// run takes the rest.
+func (a *App) reapExpiredPosts(ctx context.Context, now time.Time) (int, error) {
+	posts, err := a.Posts.Expired(ctx, now, EXPIRY_REAP_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for i := range posts {
+		p := &posts[i]
+		if err := a.deletePost(ctx, p.Id, p); err != nil {
+			// deleted concurrently by its author
+			if err != errPostNotFound {
+				fmt.Printf("Failed to delete expired post %s %v.\n", p.Id, err)
+			}
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		fmt.Printf("Deleted %d expired posts\n", deleted)
+	}
+	return deleted, nil
+}
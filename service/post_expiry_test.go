@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandlePostTTL(t *testing.T) {
+	s := newTestServer(t)
+	r := newPostRequest(t, map[string]string{"message": "story", "lat": "37.5", "lon": "-122.1", "ttl": "24h"}, testPNG(t))
+
+	before := time.Now()
+	w := s.do(authorized(t, r, "dave"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if p.ExpiresAt == nil || p.ExpiresAt.Before(before.Add(24*time.Hour)) || p.ExpiresAt.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("expires_at = %v, want in 24h", p.ExpiresAt)
+	}
+
+	for _, ttl := range []string{"soon", "1s", "720h"} {
+		r := newPostRequest(t, map[string]string{"message": "story", "lat": "37.5", "lon": "-122.1", "ttl": ttl}, testPNG(t))
+		if w := s.do(authorized(t, r, "dave")); w.Code != http.StatusBadRequest {
+			t.Errorf("ttl %q: status = %d, want 400", ttl, w.Code)
+		}
+	}
+}
+
+func TestReapExpiredPosts(t *testing.T) {
+	s := newTestServer(t)
+	seedPosts(t, s)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	expired := now.Add(-time.Minute)
+	story := &Post{User: "bob", Message: "story", Location: Location{Lat: 37.7955, Lon: -122.3937}, Timestamp: now.Add(-time.Hour), Status: STATUS_PUBLISHED, ExpiresAt: &expired, MediaKey: "story-media"}
+	if _, _, err := s.Blobs.Put(ctx, story.MediaKey, bytes.NewReader(testPNG(t)), &PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Posts.Save(ctx, "story", story); err != nil {
+		t.Fatal(err)
+	}
+
+	// searches leave it out before it is reaped
+	if got := searchIds(t, s, "lat=37.7955&lon=-122.3937&range=1"); len(got) != 1 || got[0] != "near" {
+		t.Errorf("ids = %v, want [near]", got)
+	}
+
+	n, err := s.reapExpiredPosts(ctx, now)
+	if err != nil || n != 1 {
+		t.Fatalf("reapExpiredPosts = %d, %v, want 1", n, err)
+	}
+	if _, err := s.Posts.Get(ctx, "story"); err != errPostNotFound {
+		t.Errorf("Get after reaping: err = %v, want errPostNotFound", err)
+	}
+	if s.blobs.has("story-media") {
+		t.Error("media of the expired post was kept")
+	}
+	if _, err := s.Posts.Get(ctx, "near"); err != nil {
+		t.Errorf("post without ttl reaped: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Multi-image posts. A form post may send up to MAX_POST_IMAGES files
+// under image[] instead of one image. They are checked like a single image
+// and stored concurrently, the first under the post id and the others
+// under id-2, id-3 and so on, and listed in Images in the order they were
+// sent. The first one is also the Url, MediaKey and Thumbnails of the post,
+// so clients that only know single images still show it.
+const (
+	MAX_POST_IMAGES               = 10
+	POST_IMAGE_UPLOAD_CONCURRENCY = 4
+)
+
+// PostImage is one of the images of a multi-image post.
+type PostImage struct {
+	Url        string      `json:"url"`
+	Key        string      `json:"key"` // blob store key
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+}
+
+// MediaFile is an image of a new multi-image post, read from the start and
+// rewound as needed.
+type MediaFile struct {
+	Media       io.ReadSeeker
+	Size        int64
+	ContentType string // sniffed by createPost
+}
+
+// readFormImages opens the files sent under image[]. On failure it writes
+// the response and returns false; the files opened are closed.
+func readFormImages(w http.ResponseWriter, r *http.Request, in *NewPost) bool {
+	if r.MultipartForm == nil {
+		return true
+	}
+	headers := r.MultipartForm.File["image[]"]
+	if len(headers) == 0 {
+		return true
+	}
+	if len(headers) > MAX_POST_IMAGES {
+		http.Error(w, fmt.Sprintf("A post has at most %d images", MAX_POST_IMAGES), http.StatusBadRequest)
+		return false
+	}
+	files := make([]multipart.File, 0, len(headers))
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			http.Error(w, "Image is not available", http.StatusBadRequest)
+			fmt.Printf("Failed to open image %s %v.\n", header.Filename, err)
+			return false
+		}
+		files = append(files, file)
+	}
+
+	in.MediaType = MEDIA_IMAGE
+	in.Media, in.MediaSize = files[0], headers[0].Size
+	for i, file := range files[1:] {
+		in.MoreImages = append(in.MoreImages, MediaFile{Media: file, Size: headers[i+1].Size})
+	}
+	return true
+}
+
+// imageKey is the blob store key of the image at index i of post id.
+func imageKey(id string, i int) string {
+	if i == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s-%d", id, i+1)
+}
+
+// putImages stores the images of the new post id concurrently, each with
+// its thumbnails, and lists them in order. Either every image is stored or
+// none is.
+func (a *App) putImages(ctx context.Context, id string, images []MediaFile) ([]PostImage, error) {
+	stored := make([]PostImage, len(images))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(POST_IMAGE_UPLOAD_CONCURRENCY)
+	for i := range images {
+		i, image := i, images[i]
+		g.Go(func() error {
+			key := imageKey(id, i)
+			url, _, err := a.Blobs.Put(gctx, key, image.Media, &PutOptions{
+				ContentType: image.ContentType,
+				Size:        image.Size,
+			})
+			if err != nil {
+				return fmt.Errorf("save image %d: %v", i+1, err)
+			}
+			stored[i] = PostImage{Url: url, Key: key}
+
+			// an image without thumbnails is still usable
+			thumbnails, err := a.putThumbnails(gctx, key, image.Media)
+			if err != nil {
+				logFor(ctx).Warn("failed to generate thumbnails", "id", id, "key", key, "err", err)
+			}
+			stored[i].Thumbnails = thumbnails
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		for _, image := range stored {
+			if image.Key == "" {
+				continue
+			}
+			if err := a.Blobs.Delete(context.Background(), image.Key); err != nil {
+				logFor(ctx).Error("failed to clean up image", "id", id, "key", image.Key, "err", err)
+			}
+			a.deleteThumbnails(image.Thumbnails)
+		}
+		return nil, err
+	}
+	return stored, nil
+}
+
+// checkMoreImages checks the images of in after the first one like the
+// first, and merges what the analyzer finds in them into p.
+func (a *App) checkMoreImages(ctx context.Context, p *Post, in *NewPost) error {
+	for i := range in.MoreImages {
+		image := &in.MoreImages[i]
+		contentType, err := checkImage(image.Media, image.Size)
+		if err == nil {
+			image.Media, image.Size, contentType, err = sanitizeImage(image.Media, contentType)
+		}
+		if err != nil {
+			logFor(ctx).Warn("rejected image", "index", i+2, "err", err)
+			if status := imageErrorStatus(err); status != http.StatusInternalServerError {
+				return serviceError(status, fmt.Sprintf("Image %d: %v", i+2, err))
+			}
+			return err
+		}
+		image.ContentType = contentType
+
+		analyzed := &Post{User: p.User}
+		if err := a.analyzeImage(ctx, analyzed, image.Media, image.Size); err != nil {
+			return err
+		}
+		p.ImageFlags = mergeStrings(p.ImageFlags, analyzed.ImageFlags)
+		sort.Strings(p.ImageFlags)
+		p.Labels = mergeStrings(p.Labels, analyzed.Labels)
+		p.Faces += analyzed.Faces
+	}
+	return nil
+}
+
+// mergeStrings appends the strings of more missing from list.
+func mergeStrings(list, more []string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, s := range list {
+		seen[s] = true
+	}
+	for _, s := range more {
+		if !seen[s] {
+			seen[s] = true
+			list = append(list, s)
+		}
+	}
+	return list
+}
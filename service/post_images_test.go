@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newImagesRequest builds a POST /post form with images under image[].
+func newImagesRequest(t *testing.T, images [][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("message", "album")
+	form.WriteField("lat", "37.5")
+	form.WriteField("lon", "-122.1")
+	for i, data := range images {
+		part, err := form.CreateFormFile("image[]", fmt.Sprintf("photo-%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/post", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+// coloredPNG is a 4x4 image of one shade, so images can be told apart.
+func coloredPNG(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.Gray{Y: shade})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandlePostImages(t *testing.T) {
+	s := newTestServer(t)
+	images := [][]byte{coloredPNG(t, 10), coloredPNG(t, 20), coloredPNG(t, 30)}
+
+	w := s.do(authorized(t, newImagesRequest(t, images), "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(p.Images) != len(images) {
+		t.Fatalf("images = %+v, want %d", p.Images, len(images))
+	}
+	if p.MediaKey != p.Id || p.Url != p.Images[0].Url {
+		t.Errorf("first image = %q %q, want the post's media", p.Images[0].Key, p.Images[0].Url)
+	}
+	// stored in the order they were sent
+	for i, image := range p.Images {
+		if image.Key != imageKey(p.Id, i) || !bytes.Equal(s.blobs.blobs[image.Key], images[i]) {
+			t.Errorf("image %d stored under %q doesn't match", i, image.Key)
+		}
+	}
+
+	if err := s.deletePost(context.Background(), p.Id, &p); err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range p.Images {
+		if s.blobs.has(image.Key) {
+			t.Errorf("image %q kept after delete", image.Key)
+		}
+	}
+}
+
+func TestHandlePostImagesRejected(t *testing.T) {
+	s := newTestServer(t)
+
+	tooMany := make([][]byte, MAX_POST_IMAGES+1)
+	for i := range tooMany {
+		tooMany[i] = testPNG(t)
+	}
+	if w := s.do(authorized(t, newImagesRequest(t, tooMany), "alice")); w.Code != http.StatusBadRequest {
+		t.Errorf("too many images: status = %d, want 400", w.Code)
+	}
+
+	// one bad image rejects the post and stores none
+	w := s.do(authorized(t, newImagesRequest(t, [][]byte{testPNG(t), []byte("plain text")}), "alice"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("bad image: status = %d, want 415: %s", w.Code, w.Body)
+	}
+	if len(s.blobs.blobs) != 0 {
+		t.Errorf("%d blobs stored, want none", len(s.blobs.blobs))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Post quotas discourage flooding: a user may create at most
+// POST_DAILY_LIMIT posts per UTC day, and must wait POST_COOLDOWN between
+// two posts; zero disables either. The counters are kept in Redis when
+// REDIS_URL is set, so every instance shares them, and in memory
+// otherwise. A post over the quota is refused with a 429 telling when the
+// quota resets. The variables are loaded from the ServiceConfig at
+// startup.
+var (
+	POST_DAILY_LIMIT = 0
+	POST_COOLDOWN    = time.Duration(0)
+)
+
+const POST_QUOTA_PREFIX = "around:quota:"
+
+// Error codes of posts refused by the quota.
+const (
+	ERR_POST_COOLDOWN    = "post_cooldown"
+	ERR_POST_DAILY_LIMIT = "post_daily_limit"
+)
+
+// PostQuota counts the posts of every user.
+type PostQuota interface {
+	// Take counts n posts of user at now, such as the posts of a bulk
+	// request, which the cooldown treats as one. When the posts are over
+	// the quota none is counted, and Take returns the code of the limit
+	// reached and when it resets.
+	Take(ctx context.Context, user string, n int, now time.Time) (limit string, reset time.Time, err error)
+}
+
+// newPostQuota returns the quota of POST_DAILY_LIMIT and POST_COOLDOWN,
+// nil when both are zero.
+func newPostQuota(ctx context.Context) (PostQuota, error) {
+	if POST_DAILY_LIMIT == 0 && POST_COOLDOWN == 0 {
+		return nil, nil
+	}
+	if REDIS_URL == "" {
+		return newMemoryPostQuota(POST_DAILY_LIMIT, POST_COOLDOWN), nil
+	}
+	opts, err := redis.ParseURL(REDIS_URL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to Redis at %s: %v", redactURL(REDIS_URL), err)
+	}
+	return &redisPostQuota{client: client, daily: POST_DAILY_LIMIT, cooldown: POST_COOLDOWN}, nil
+}
+
+// nextDay is the start of the UTC day after the one of now, when daily
+// counts reset.
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// takePostQuota counts n posts of user, or returns the 429 refusing them.
+// When the counters can't be read the posts are let through.
+func (a *App) takePostQuota(ctx context.Context, user string, n int, now time.Time) error {
+	if a.Quota == nil {
+		return nil
+	}
+	limit, reset, err := a.Quota.Take(ctx, user, n, now)
+	if err != nil {
+		logFor(ctx).Error("failed to check post quota", "user", user, "error", err)
+		return nil
+	}
+	switch limit {
+	case "":
+		return nil
+	case ERR_POST_COOLDOWN:
+		logFor(ctx).Info("post refused by cooldown", "user", user)
+		return &ServiceError{
+			Status:     http.StatusTooManyRequests,
+			Code:       limit,
+			Message:    fmt.Sprintf("Posting too fast, wait until %s", reset.Format(time.RFC3339)),
+			RetryAfter: reset.Sub(now),
+		}
+	default:
+		logFor(ctx).Info("post refused by daily limit", "user", user, "posts", n)
+		return &ServiceError{
+			Status:     http.StatusTooManyRequests,
+			Code:       limit,
+			Message:    fmt.Sprintf("Over the daily post limit of %d, it resets at %s", POST_DAILY_LIMIT, reset.Format(time.RFC3339)),
+			RetryAfter: reset.Sub(now),
+		}
+	}
+}
+
+// redisPostQuota keeps the count of a user's posts of a day in a key
+// expiring at the end of the day, and a key expiring after the cooldown
+// for their last post. postQuotaScript checks and updates both at once.
+type redisPostQuota struct {
+	client   *redis.Client
+	daily    int
+	cooldown time.Duration
+}
+
+var postQuotaScript = redis.NewScript(`
+local daily, dayMillis, cooldownMillis, n = tonumber(ARGV[1]), ARGV[2], tonumber(ARGV[3]), tonumber(ARGV[4])
+if cooldownMillis > 0 then
+	local wait = redis.call("PTTL", KEYS[2])
+	if wait > 0 then
+		return {1, wait}
+	end
+end
+if daily > 0 then
+	local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+	if count + n > daily then
+		return {2, redis.call("PTTL", KEYS[1])}
+	end
+	redis.call("INCRBY", KEYS[1], n)
+	redis.call("PEXPIRE", KEYS[1], dayMillis)
+end
+if cooldownMillis > 0 then
+	redis.call("SET", KEYS[2], "1", "PX", cooldownMillis)
+end
+return {0, 0}
+`)
+
+func (q *redisPostQuota) Take(ctx context.Context, user string, n int, now time.Time) (string, time.Time, error) {
+	day := now.UTC().Format("2006-01-02")
+	keys := []string{POST_QUOTA_PREFIX + "day:" + day + ":" + user, POST_QUOTA_PREFIX + "last:" + user}
+	res, err := postQuotaScript.Run(ctx, q.client, keys,
+		q.daily, nextDay(now).Sub(now).Milliseconds(), q.cooldown.Milliseconds(), n).Int64Slice()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	reset := now.Add(time.Duration(res[1]) * time.Millisecond)
+	switch res[0] {
+	case 1:
+		return ERR_POST_COOLDOWN, reset, nil
+	case 2:
+		return ERR_POST_DAILY_LIMIT, reset, nil
+	}
+	return "", time.Time{}, nil
+}
+
+// memoryPostQuota counts the posts made to this instance. The counts are
+// dropped when the day changes.
+type memoryPostQuota struct {
+	daily    int
+	cooldown time.Duration
+
+	mu     sync.Mutex
+	day    string
+	counts map[string]int
+	last   map[string]time.Time
+}
+
+func newMemoryPostQuota(daily int, cooldown time.Duration) *memoryPostQuota {
+	return &memoryPostQuota{daily: daily, cooldown: cooldown, counts: make(map[string]int), last: make(map[string]time.Time)}
+}
+
+func (q *memoryPostQuota) Take(ctx context.Context, user string, n int, now time.Time) (string, time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.counts = make(map[string]int)
+		for u, t := range q.last {
+			if now.Sub(t) >= q.cooldown {
+				delete(q.last, u)
+			}
+		}
+	}
+
+	if last, ok := q.last[user]; ok && q.cooldown > 0 && now.Sub(last) < q.cooldown {
+		return ERR_POST_COOLDOWN, last.Add(q.cooldown), nil
+	}
+	if q.daily > 0 && q.counts[user]+n > q.daily {
+		return ERR_POST_DAILY_LIMIT, nextDay(now), nil
+	}
+	q.counts[user] += n
+	if q.cooldown > 0 {
+		q.last[user] = now
+	}
+	return "", time.Time{}, nil
+}
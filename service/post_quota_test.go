@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryPostQuota(t *testing.T) {
+	q := newMemoryPostQuota(2, 30*time.Second)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 23, 58, 0, 0, time.UTC)
+
+	if limit, _, _ := q.Take(ctx, "tess", 1, now); limit != "" {
+		t.Fatalf("first post refused by %s", limit)
+	}
+	limit, reset, _ := q.Take(ctx, "tess", 1, now.Add(10*time.Second))
+	if limit != ERR_POST_COOLDOWN || !reset.Equal(now.Add(30*time.Second)) {
+		t.Errorf("post within the cooldown = %q until %v", limit, reset)
+	}
+	if limit, _, _ := q.Take(ctx, "uma", 1, now.Add(10*time.Second)); limit != "" {
+		t.Errorf("another user's post refused by %s", limit)
+	}
+	if limit, _, _ := q.Take(ctx, "tess", 1, now.Add(30*time.Second)); limit != "" {
+		t.Errorf("post after the cooldown refused by %s", limit)
+	}
+	limit, reset, _ = q.Take(ctx, "tess", 1, now.Add(time.Minute))
+	if limit != ERR_POST_DAILY_LIMIT || !reset.Equal(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("third post of the day = %q until %v", limit, reset)
+	}
+	if limit, _, _ := q.Take(ctx, "tess", 1, now.Add(3*time.Minute)); limit != "" {
+		t.Errorf("first post of the next day refused by %s", limit)
+	}
+}
+
+func TestHandlePostQuota(t *testing.T) {
+	s := newTestServer(t)
+	s.Quota = newMemoryPostQuota(0, time.Minute)
+
+	fields := map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}
+	if w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "vera")); w.Code != http.StatusOK {
+		t.Fatalf("first post = %d: %s", w.Code, w.Body)
+	}
+	w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "vera"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second post = %d, want 429: %s", w.Code, w.Body)
+	}
+	if retry := w.Header().Get("Retry-After"); retry == "" || retry == "0" {
+		t.Errorf("Retry-After = %q, want the seconds left", retry)
+	}
+	var body APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != ERR_POST_COOLDOWN {
+		t.Errorf("body %s, %v: want code %q", w.Body, err, ERR_POST_COOLDOWN)
+	}
+}
+
+func TestMemoryPostQuotaBatch(t *testing.T) {
+	q := newMemoryPostQuota(20, 0)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	if limit, _, _ := q.Take(ctx, "ivy", 15, now); limit != "" {
+		t.Fatalf("15 posts refused by %s", limit)
+	}
+	if limit, _, _ := q.Take(ctx, "ivy", 6, now); limit != ERR_POST_DAILY_LIMIT {
+		t.Errorf("6 more posts = %q, want %s", limit, ERR_POST_DAILY_LIMIT)
+	}
+	if limit, _, _ := q.Take(ctx, "ivy", 5, now); limit != "" {
+		t.Errorf("the 5 posts left refused by %s", limit)
+	}
+}
+
+func TestBulkPostQuota(t *testing.T) {
+	s := newTestServer(t)
+	s.Quota = newMemoryPostQuota(2, 0)
+
+	bulk := func(n int) *httptest.ResponseRecorder {
+		posts := make([]BulkPost, n)
+		for i := range posts {
+			posts[i] = BulkPost{Message: "hi", Lat: 37.5, Lon: -122.1}
+		}
+		js, _ := json.Marshal(posts)
+		return s.do(authorized(t, httptest.NewRequest("POST", "/posts/bulk", bytes.NewReader(js)), "ivy"))
+	}
+	w := bulk(3)
+	var body APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusTooManyRequests || body.Code != ERR_POST_DAILY_LIMIT {
+		t.Fatalf("3 bulk posts over a limit of 2 = %d %s, want 429 with code %s", w.Code, w.Body, ERR_POST_DAILY_LIMIT)
+	}
+	if w := bulk(2); w.Code != http.StatusOK {
+		t.Errorf("2 bulk posts = %d %s, want 200", w.Code, w.Body)
+	}
+	if limit, _, _ := s.Quota.Take(context.Background(), "ivy", 1, time.Now()); limit != ERR_POST_DAILY_LIMIT {
+		t.Errorf("a post after 2 bulk posts = %q, want %s", limit, ERR_POST_DAILY_LIMIT)
+	}
+}
+
+func TestPostQuotaTakenOnlyByValidPosts(t *testing.T) {
+	s := newTestServer(t)
+	s.Quota = newMemoryPostQuota(1, 0)
+
+	fields := map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1"}
+	draft := map[string]string{"message": "hi", "lat": "37.5", "lon": "-122.1", "draft": "true",
+		"publish_at": time.Now().Add(time.Hour).Format(time.RFC3339)}
+	if w := s.do(authorized(t, newPostRequest(t, draft, testPNG(t)), "ivy")); w.Code != http.StatusBadRequest {
+		t.Fatalf("scheduled draft = %d %s, want 400", w.Code, w.Body)
+	}
+	if w := s.do(authorized(t, newPostRequest(t, fields, []byte("not an image")), "ivy")); w.Code == http.StatusOK {
+		t.Fatalf("post of an invalid image = %d, want an error", w.Code)
+	}
+	if w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "ivy")); w.Code != http.StatusOK {
+		t.Errorf("first valid post = %d %s, want 200 as the invalid ones took no quota", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Post store backend, one of POST_STORE_BACKENDS, and the OpenSearch
+// endpoint of the "opensearch" backend. OpenSearch 1.x speaks the
+// ElasticSearch 7 API and also works with the "elasticsearch" backend. Both
+// are loaded from the ServiceConfig at startup.
+//
+// Only posts move to another backend: likes, comments, users and the other
+// indexes stay on ES_URL.
+var (
+	POST_STORE_BACKEND = "elasticsearch"
+	OPENSEARCH_URL     = "http://localhost:9200"
+)
+
+var POST_STORE_BACKENDS = []string{"elasticsearch", "opensearch", "memory"}
+
+// GeoQuery selects posts within Distance (e.g. "200km") of a point, nearest
+// first. With BBox, posts are selected within the box instead, and Lat, Lon
+// and Distance are its center and a circle covering it. Since and Until,
+// when set, bound the creation time of the posts, inclusively. Place, when
+// set, keeps the posts whose city or neighborhood it names, ignoring case.
+// Offset and Limit select a page; a zero Limit means DEFAULT_PAGE_SIZE.
+type GeoQuery struct {
+	Lat      float64
+	Lon      float64
+	Distance string
+	BBox     *BoundingBox
+	Since    time.Time
+	Until    time.Time
+	Place    string
+	// Exclude are the users whose posts are left out, see hiddenUsers.
+	Exclude []string
+	Offset  int
+	Limit   int
+}
+
+// query is the ElasticSearch query of q, drafts included.
+func (q *GeoQuery) query() elastic.Query {
+	var geo elastic.Query
+	if q.BBox != nil {
+		geo = q.BBox.query()
+	} else {
+		geo = newGeoDistanceQuery(q.Lat, q.Lon, q.Distance)
+	}
+	var filters []elastic.Query
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		created := elastic.NewRangeQuery("timestamp")
+		if !q.Since.IsZero() {
+			created = created.Gte(q.Since.Format(time.RFC3339Nano))
+		}
+		if !q.Until.IsZero() {
+			created = created.Lte(q.Until.Format(time.RFC3339Nano))
+		}
+		filters = append(filters, created)
+	}
+	if q.Place != "" {
+		filters = append(filters, elastic.NewBoolQuery().Should(
+			elastic.NewTermQuery("city", q.Place).CaseInsensitive(true),
+			elastic.NewTermQuery("neighborhood", q.Place).CaseInsensitive(true),
+		).MinimumNumberShouldMatch(1))
+	}
+	if len(filters) == 0 && len(q.Exclude) == 0 {
+		return geo
+	}
+	return excludeUsers(elastic.NewBoolQuery().Must(geo).Filter(filters...), q.Exclude)
+}
+
+// newBBoxQuery selects the posts within b, sorted around its center.
+func newBBoxQuery(b *BoundingBox) *GeoQuery {
+	lat, lon := b.center()
+	return &GeoQuery{
+		Lat:      lat,
+		Lon:      lon,
+		Distance: strconv.FormatFloat(math.Ceil(b.radiusKm()*1000)/1000, 'f', -1, 64) + "km",
+		BBox:     b,
+	}
+}
+
+// created reports whether p was created within the bounds of q.
+func (q *GeoQuery) created(p *Post) bool {
+	return (q.Since.IsZero() || !p.Timestamp.Before(q.Since)) &&
+		(q.Until.IsZero() || !p.Timestamp.After(q.Until))
+}
+
+// excludes reports whether q leaves out the posts of p's author.
+func (q *GeoQuery) excludes(p *Post) bool {
+	for _, u := range q.Exclude {
+		if p.User == u {
+			return true
+		}
+	}
+	return false
+}
+
+// inPlace reports whether p is in the place of q, if any.
+func (q *GeoQuery) inPlace(p *Post) bool {
+	return q.Place == "" || strings.EqualFold(p.City, q.Place) || strings.EqualFold(p.Neighborhood, q.Place)
+}
+
+// PostStore persists posts. Search only ever returns posts everyone may see.
+type PostStore interface {
+	Save(ctx context.Context, id string, p *Post) error
+	// SaveAll saves posts under ids at once. It fails as a whole only when
+	// nothing could be saved; otherwise it returns the error of each post.
+	SaveAll(ctx context.Context, ids []string, posts []*Post) ([]error, error)
+	Get(ctx context.Context, id string) (*Post, error)
+	Search(ctx context.Context, q *GeoQuery) ([]Post, int64, error)
+	Delete(ctx context.Context, id string) error
+	// Count returns the number of posts written by user.
+	Count(ctx context.Context, user string) (int64, error)
+	// Expired returns up to limit posts that expired before, drafts
+	// included, soonest expired first.
+	Expired(ctx context.Context, before time.Time, limit int) ([]Post, error)
+	// Trashed returns up to limit posts deleted before, soonest deleted
+	// first.
+	Trashed(ctx context.Context, before time.Time, limit int) ([]Post, error)
+	// Due returns up to limit scheduled posts to publish at before,
+	// soonest first.
+	Due(ctx context.Context, before time.Time, limit int) ([]Post, error)
+}
+
+// newPostStore returns the backend selected by POST_STORE_BACKEND.
+func newPostStore(ctx context.Context) (PostStore, error) {
+	switch POST_STORE_BACKEND {
+	case "elasticsearch":
+		return &esPostStore{}, nil
+	case "opensearch":
+		return newOpenSearchPostStore(ctx, OPENSEARCH_URL)
+	case "memory":
+		return newMemoryPostStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown post store backend %q", POST_STORE_BACKEND)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// esPostStore is the ElasticSearch backed PostStore.
+type esPostStore struct{}
+
+func (s *esPostStore) Save(ctx context.Context, id string, p *Post) error {
+	return saveToES(ctx, p, id)
+}
+
+func (s *esPostStore) SaveAll(ctx context.Context, ids []string, posts []*Post) ([]error, error) {
+	return saveAllToES(ctx, ids, posts)
+}
+
+func (s *esPostStore) Get(ctx context.Context, id string) (*Post, error) {
+	return getPostFromES(id)
+}
+
+func (s *esPostStore) Search(ctx context.Context, q *GeoQuery) ([]Post, int64, error) {
+	return readFromES(ctx, q)
+}
+
+func (s *esPostStore) Delete(ctx context.Context, id string) error {
+	return deleteFromES(id)
+}
+
+func (s *esPostStore) Count(ctx context.Context, user string) (int64, error) {
+	return countPostsByUser(user)
+}
+
+func (s *esPostStore) Expired(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	searchResult, err := esClient.Search().
+		Index(POST_INDEX).
+		Query(expiredPostsQuery(before)).
+		Sort("expires_at", true).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodePosts(searchResult), nil
+}
+
+func (s *esPostStore) Trashed(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	searchResult, err := esClient.Search().
+		Index(POST_INDEX).
+		Query(trashedPostsQuery(before)).
+		Sort("deleted_at", true).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodePosts(searchResult), nil
+}
+
+func (s *esPostStore) Due(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	searchResult, err := esClient.Search().
+		Index(POST_INDEX).
+		Query(duePostsQuery(before)).
+		Sort("publish_at", true).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodePosts(searchResult), nil
+}
+
+func saveToES(ctx context.Context, post *Post, id string) error {
+	if writeBatcher != nil {
+		return writeBatcher.Save(post, id)
+	}
+
+	client := esClient
+
+	start := time.Now()
+	err := withRetry(ctx, esBreaker, RETRY_ATTEMPTS, func() error {
+		_, err := client.Index().
+			Index(POST_INDEX).
+			Id(id).
+			Routing(postRouting(post, id)).
+			BodyJson(post).
+			Refresh("wait_for").
+			Do(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	observeQuery(ctx, "index", sinceMillis(start), map[string]interface{}{"id": id, "user": post.User})
+
+	logFor(ctx).Info("post saved to index", "id", id, "user", post.User)
+	return nil
+
+}
+
+// saveAllToES indexes posts under ids with one bulk request and one
+// refresh. It fails as a whole only when the request does; otherwise it
+// returns the error of each post, nil when it was saved.
+func saveAllToES(ctx context.Context, ids []string, posts []*Post) ([]error, error) {
+	client := esClient
+
+	bulk := client.Bulk().Refresh("wait_for")
+	for i, post := range posts {
+		bulk.Add(elastic.NewBulkIndexRequest().
+			Index(POST_INDEX).
+			Id(ids[i]).
+			Routing(postRouting(post, ids[i])).
+			Doc(post))
+	}
+
+	var resp *elastic.BulkResponse
+	err := withRetry(ctx, esBreaker, RETRY_ATTEMPTS, func() error {
+		var err error
+		resp, err = bulk.Do(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "bulk", int64(resp.Took), map[string]interface{}{"posts": len(posts)})
+
+	// items come back in request order
+	errs := make([]error, len(posts))
+	for i, id := range ids {
+		if i >= len(resp.Items) {
+			errs[i] = fmt.Errorf("no bulk result for post %s", id)
+			continue
+		}
+		for _, item := range resp.Items[i] {
+			if item.Error != nil {
+				errs[i] = fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)
+			}
+		}
+	}
+	return errs, nil
+}
+
+func readFromES(ctx context.Context, q *GeoQuery) ([]Post, int64, error) {
+	client := esClient
+
+	lat, lon, ran := q.Lat, q.Lon, q.Distance
+	query := q.query()
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+	search := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(publicPostsQuery(query)).
+		// nearest first, then a total order so pages neither skip nor
+		// repeat posts
+		SortBy(elastic.NewGeoDistanceSort("location").
+			Point(lat, lon).
+			Unit("m").
+			DistanceType(geoDistanceType(ran)).
+			Asc()).
+		Sort("timestamp", false).
+		Sort("id", true).
+		From(q.Offset).
+		Size(limit).
+		Pretty(true)
+	if km, err := parseKm(ran); err == nil {
+		if keys := searchRouting(lat, lon, km); keys != nil {
+			search = search.Routing(keys...)
+		}
+	}
+
+	var searchResult *elastic.SearchResult
+	err := withRetry(ctx, esBreaker, RETRY_ATTEMPTS, func() error {
+		var err error
+		searchResult, err = search.Do(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// searchResult is of type SearchResult and returns hits, suggestions,
+	// and all kinds of other information from Elasticsearch.
+	logFor(ctx).Info("search query", "took_ms", searchResult.TookInMillis, "hits", searchResult.TotalHits())
+	observeQuery(ctx, "search", searchResult.TookInMillis, map[string]interface{}{"lat": lat, "lon": lon, "range": ran, "offset": q.Offset, "limit": limit})
+
+	// the first sort value of each hit is its distance
+	distances := make(map[string]float64)
+	for _, hit := range searchResult.Hits.Hits {
+		if len(hit.Sort) > 0 {
+			if d, ok := hit.Sort[0].(float64); ok {
+				distances[hit.Id] = d
+			}
+		}
+	}
+
+	var posts []Post
+	for _, p := range decodePosts(searchResult) {
+		if d, ok := distances[p.Id]; ok {
+			p.Distance = &d
+		}
+		// filter spam
+		if screenPost(&p) {
+			posts = append(posts, p)
+		}
+	}
+
+	return posts, searchResult.TotalHits(), nil
+}
+
+// publicPostsQuery restricts query to posts everyone may see. Drafts,
+// scheduled, hidden, expired and deleted posts are excluded with must_not
+// rather than requiring
+// status:published so that posts indexed before the status field existed
+// stay visible.
+func publicPostsQuery(query elastic.Query) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Must(query).
+		MustNot(
+			elastic.NewTermQuery("status", STATUS_DRAFT),
+			elastic.NewTermQuery("status", STATUS_SCHEDULED),
+			elastic.NewTermQuery("hidden", true),
+			elastic.NewRangeQuery("expires_at").Lte("now"),
+			elastic.NewExistsQuery("deleted_at"),
+		)
+}
+
+// expiredPostsQuery selects the posts that expired before t.
+func expiredPostsQuery(t time.Time) elastic.Query {
+	return elastic.NewRangeQuery("expires_at").Lt(t.Format(time.RFC3339Nano))
+}
+
+// getPostFromES loads a single post by id.
+func getPostFromES(id string) (*Post, error) {
+	client := esClient
+
+	if ROUTING_MODE == "geohash" {
+		// the routing key depends on the location, which we don't know yet
+		searchResult, err := client.Search().
+			Index(POST_INDEX).
+			Query(elastic.NewIdsQuery().Ids(id)).
+			Do(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		posts := decodePosts(searchResult)
+		if len(posts) == 0 {
+			return nil, errPostNotFound
+		}
+		return &posts[0], nil
+	}
+
+	result, err := client.Get().
+		Index(POST_INDEX).
+		Id(id).
+		Routing(postRouting(nil, id)).
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errPostNotFound
+		}
+		return nil, err
+	}
+	if !result.Found || result.Source == nil {
+		return nil, errPostNotFound
+	}
+
+	var p Post
+	if err := json.Unmarshal(result.Source, &p); err != nil {
+		return nil, err
+	}
+	p.Id = result.Id
+	fillMediaType(&p)
+	return &p, nil
+}
+
+func deleteFromES(id string) error {
+	client := esClient
+
+	routing := postRouting(nil, id)
+	if ROUTING_MODE == "geohash" {
+		p, err := getPostFromES(id)
+		if err != nil {
+			return err
+		}
+		routing = postRouting(p, id)
+	}
+
+	_, err := client.Delete().
+		Index(POST_INDEX).
+		Id(id).
+		Routing(routing).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return errPostNotFound
+		}
+		return err
+	}
+
+	fmt.Printf("Post is deleted from index: %s\n", id)
+	return nil
+}
+
+// decodePosts unmarshals every hit of a search result into a Post and fills
+// in its Id from the document id. Hits that fail to deserialize are skipped.
+func decodePosts(searchResult *elastic.SearchResult) []Post {
+	var posts []Post
+	if searchResult.Hits == nil {
+		return posts
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			fmt.Printf("Failed to parse post %s %v.\n", hit.Id, err)
+			continue
+		}
+		p.Id = hit.Id
+		fillMediaType(&p)
+		posts = append(posts, p)
+	}
+	return posts
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const earthRadiusKm = 6371.0
+
+// memoryPostStore keeps posts in process memory, for tests and local
+// development. Geo search is a linear scan with haversine distances.
+type memoryPostStore struct {
+	mu    sync.RWMutex
+	posts map[string]Post
+}
+
+func newMemoryPostStore() *memoryPostStore {
+	return &memoryPostStore{posts: make(map[string]Post)}
+}
+
+func (s *memoryPostStore) Save(ctx context.Context, id string, p *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *p
+	saved.Id = id
+	s.posts[id] = saved
+	return nil
+}
+
+func (s *memoryPostStore) SaveAll(ctx context.Context, ids []string, posts []*Post) ([]error, error) {
+	errs := make([]error, len(posts))
+	for i, p := range posts {
+		errs[i] = s.Save(ctx, ids[i], p)
+	}
+	return errs, nil
+}
+
+func (s *memoryPostStore) Get(ctx context.Context, id string) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.posts[id]
+	if !ok {
+		return nil, errPostNotFound
+	}
+	return &p, nil
+}
+
+func (s *memoryPostStore) Search(ctx context.Context, q *GeoQuery) ([]Post, int64, error) {
+	km, err := parseKm(q.Distance)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var posts []Post
+	for _, p := range s.posts {
+		if !p.public() || p.expired(now) || p.DeletedAt != nil || !q.created(&p) || !q.inPlace(&p) || q.excludes(&p) {
+			continue
+		}
+		d := haversineKm(q.Lat, q.Lon, p.Location.Lat, p.Location.Lon)
+		if q.BBox != nil {
+			if !q.BBox.contains(p.Location.Lat, p.Location.Lon) {
+				continue
+			}
+		} else if d > km {
+			continue
+		}
+		meters := d * 1000
+		p.Distance = &meters
+		// filter spam
+		if screenPost(&p) {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if *posts[i].Distance != *posts[j].Distance {
+			return *posts[i].Distance < *posts[j].Distance
+		}
+		if !posts[i].Timestamp.Equal(posts[j].Timestamp) {
+			return posts[i].Timestamp.After(posts[j].Timestamp)
+		}
+		return posts[i].Id < posts[j].Id
+	})
+	total := int64(len(posts))
+	limit := q.Limit
+	if limit == 0 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+	if q.Offset >= len(posts) {
+		return nil, total, nil
+	}
+	posts = posts[q.Offset:]
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts, total, nil
+}
+
+func (s *memoryPostStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.posts[id]; !ok {
+		return errPostNotFound
+	}
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *memoryPostStore) Count(ctx context.Context, user string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int64
+	for _, p := range s.posts {
+		if p.User == user {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryPostStore) Expired(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var posts []Post
+	for _, p := range s.posts {
+		if p.ExpiresAt != nil && p.ExpiresAt.Before(before) {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].ExpiresAt.Before(*posts[j].ExpiresAt)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts, nil
+}
+
+func (s *memoryPostStore) Trashed(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var posts []Post
+	for _, p := range s.posts {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].DeletedAt.Before(*posts[j].DeletedAt)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts, nil
+}
+
+func (s *memoryPostStore) Due(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var posts []Post
+	for _, p := range s.posts {
+		if p.Status == STATUS_SCHEDULED && p.PublishAt != nil && !p.PublishAt.After(before) {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].PublishAt.Before(*posts[j].PublishAt)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts, nil
+}
+
+// haversineKm is the great-circle distance between two points in km.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/opensearch-project/opensearch-go/v4"
+	"github.com/opensearch-project/opensearch-go/v4/opensearchapi"
+)
+
+// opensearchPostStore keeps posts in OpenSearch 2+ through the OpenSearch
+// client, since olivere only follows ElasticSearch. Queries are still built
+// with the olivere DSL, which is the same JSON. Posts aren't routed by
+// ROUTING_MODE.
+type opensearchPostStore struct {
+	client *opensearchapi.Client
+}
+
+func newOpenSearchPostStore(ctx context.Context, url string) (*opensearchPostStore, error) {
+	client, err := opensearchapi.NewClient(opensearchapi.Config{
+		Client: opensearch.Config{Addresses: []string{url}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &opensearchPostStore{client: client}
+	if err := s.createIndex(ctx); err != nil {
+		return nil, fmt.Errorf("create index %s: %v", POST_INDEX, err)
+	}
+	return s, nil
+}
+
+// createIndex creates POST_INDEX with a typeless mapping unless it exists.
+func (s *opensearchPostStore) createIndex(ctx context.Context) error {
+	resp, err := s.client.Indices.Exists(ctx, opensearchapi.IndicesExistsReq{Indices: []string{POST_INDEX}})
+	if err == nil {
+		return nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	_, err = s.client.Indices.Create(ctx, opensearchapi.IndicesCreateReq{
+		Index: POST_INDEX,
+		Body:  strings.NewReader(postMapping()),
+	})
+	return err
+}
+
+func (s *opensearchPostStore) Save(ctx context.Context, id string, p *Post) error {
+	js, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Index(ctx, opensearchapi.IndexReq{
+		Index:      POST_INDEX,
+		DocumentID: id,
+		Body:       bytes.NewReader(js),
+		Params:     opensearchapi.IndexParams{Refresh: "wait_for"},
+	})
+	return err
+}
+
+func (s *opensearchPostStore) SaveAll(ctx context.Context, ids []string, posts []*Post) ([]error, error) {
+	var body bytes.Buffer
+	for i, p := range posts {
+		action, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": POST_INDEX, "_id": ids[i]}})
+		if err != nil {
+			return nil, err
+		}
+		js, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(js)
+		body.WriteByte('\n')
+	}
+
+	resp, err := s.client.Bulk(ctx, opensearchapi.BulkReq{
+		Body:   &body,
+		Params: opensearchapi.BulkParams{Refresh: "wait_for"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// items come back in request order
+	errs := make([]error, len(posts))
+	for i, id := range ids {
+		if i >= len(resp.Items) {
+			errs[i] = fmt.Errorf("no bulk result for post %s", id)
+			continue
+		}
+		for _, item := range resp.Items[i] {
+			if item.Error != nil {
+				errs[i] = fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)
+			}
+		}
+	}
+	return errs, nil
+}
+
+func (s *opensearchPostStore) Get(ctx context.Context, id string) (*Post, error) {
+	resp, err := s.client.Document.Get(ctx, opensearchapi.DocumentGetReq{Index: POST_INDEX, DocumentID: id})
+	if err != nil {
+		if resp != nil && resp.Inspect().Response != nil && resp.Inspect().Response.StatusCode == http.StatusNotFound {
+			return nil, errPostNotFound
+		}
+		return nil, err
+	}
+	if !resp.Found {
+		return nil, errPostNotFound
+	}
+
+	var p Post
+	if err := json.Unmarshal(resp.Source, &p); err != nil {
+		return nil, err
+	}
+	p.Id = resp.ID
+	fillMediaType(&p)
+	return &p, nil
+}
+
+func (s *opensearchPostStore) Search(ctx context.Context, q *GeoQuery) ([]Post, int64, error) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+	source, err := elastic.NewSearchSource().
+		Query(publicPostsQuery(q.query())).
+		SortBy(elastic.NewGeoDistanceSort("location").
+			Point(q.Lat, q.Lon).
+			Unit("m").
+			DistanceType(geoDistanceType(q.Distance)).
+			Asc()).
+		Sort("timestamp", false).
+		Sort("id", true).
+		From(q.Offset).
+		Size(limit).
+		TrackTotalHits(true).
+		Source()
+	if err != nil {
+		return nil, 0, err
+	}
+	js, err := json.Marshal(source)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := s.client.Search(ctx, &opensearchapi.SearchReq{
+		Indices: []string{POST_INDEX},
+		Body:    bytes.NewReader(js),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	observeQuery(ctx, "search", int64(resp.Took), map[string]interface{}{"lat": q.Lat, "lon": q.Lon, "range": q.Distance, "offset": q.Offset, "limit": limit})
+
+	var posts []Post
+	for _, hit := range resp.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			fmt.Printf("Failed to parse post %s %v.\n", hit.ID, err)
+			continue
+		}
+		p.Id = hit.ID
+		fillMediaType(&p)
+		// the first sort value of each hit is its distance
+		if len(hit.Sort) > 0 {
+			if d, ok := hit.Sort[0].(float64); ok {
+				p.Distance = &d
+			}
+		}
+		// filter spam
+		if screenPost(&p) {
+			posts = append(posts, p)
+		}
+	}
+	return posts, int64(resp.Hits.Total.Value), nil
+}
+
+func (s *opensearchPostStore) Delete(ctx context.Context, id string) error {
+	resp, err := s.client.Document.Delete(ctx, opensearchapi.DocumentDeleteReq{
+		Index:      POST_INDEX,
+		DocumentID: id,
+		Params:     opensearchapi.DocumentDeleteParams{Refresh: "wait_for"},
+	})
+	if err != nil {
+		if resp != nil && resp.Inspect().Response != nil && resp.Inspect().Response.StatusCode == http.StatusNotFound {
+			return errPostNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *opensearchPostStore) Count(ctx context.Context, user string) (int64, error) {
+	js, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"user": user}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Indices.Count(ctx, &opensearchapi.IndicesCountReq{
+		Indices: []string{POST_INDEX},
+		Body:    bytes.NewReader(js),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.Count), nil
+}
+
+func (s *opensearchPostStore) Expired(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	return s.oldest(ctx, expiredPostsQuery(before), "expires_at", limit)
+}
+
+func (s *opensearchPostStore) Trashed(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	return s.oldest(ctx, trashedPostsQuery(before), "deleted_at", limit)
+}
+
+func (s *opensearchPostStore) Due(ctx context.Context, before time.Time, limit int) ([]Post, error) {
+	return s.oldest(ctx, duePostsQuery(before), "publish_at", limit)
+}
+
+// oldest returns up to limit posts matching query, in ascending order of
+// the date field.
+func (s *opensearchPostStore) oldest(ctx context.Context, query elastic.Query, field string, limit int) ([]Post, error) {
+	source, err := elastic.NewSearchSource().
+		Query(query).
+		Sort(field, true).
+		Size(limit).
+		Source()
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Search(ctx, &opensearchapi.SearchReq{
+		Indices: []string{POST_INDEX},
+		Body:    bytes.NewReader(js),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	for _, hit := range resp.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			fmt.Printf("Failed to parse post %s %v.\n", hit.ID, err)
+			continue
+		}
+		p.Id = hit.ID
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
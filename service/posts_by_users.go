@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// MAX_USERS_PER_QUERY caps how many authors a single /posts request may ask for.
+const MAX_USERS_PER_QUERY = 50
+
+// handlePostsByUsers returns the most recent posts written by any of the
+// users given in the `users` parameter, which may be repeated
+// (?users=a&users=b) or comma-separated (?users=a,b).
+func handlePostsByUsers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for posts by users")
+	w.Header().Set("Content-Type", "application/json")
+
+	users, err := parseUsers(r.URL.Query()["users"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid users parameter %v.\n", err)
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readPostsByUsersFromES(users, false, hidden, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+
+	viewer := viewerName(r)
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// handleUserPosts returns the posts of one user, newest first, for their
+// profile page. Authors also see their drafts.
+func handleUserPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for posts of a user")
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	if _, err := getUser(username); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", username, err)
+		return
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+
+	viewer := viewerName(r)
+	page, err := readPostsByUsersFromES([]string{username}, viewer == username, nil, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// parseUsers flattens repeated and comma-separated values, drops duplicates
+// and validates every name against the signup username format.
+func parseUsers(values []string) ([]string, error) {
+	var users []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			if !usernamePattern.MatchString(name) {
+				return nil, fmt.Errorf("Invalid username %q", name)
+			}
+			seen[name] = true
+			users = append(users, name)
+		}
+	}
+
+	if len(users) == 0 {
+		return nil, errors.New("At least one user is required")
+	}
+	if len(users) > MAX_USERS_PER_QUERY {
+		return nil, fmt.Errorf("At most %d users can be queried at once", MAX_USERS_PER_QUERY)
+	}
+	return users, nil
+}
+
+// readPostsByUsersFromES returns the newest posts of users, but not of any
+// of hidden. Drafts are only included when withDrafts is set, which callers
+// must restrict to the author's own posts.
+func readPostsByUsersFromES(users []string, withDrafts bool, hidden []string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	var query elastic.Query
+	if len(users) == 1 {
+		query = elastic.NewTermQuery("user", users[0])
+	} else {
+		values := make([]interface{}, len(users))
+		for i, user := range users {
+			values[i] = user
+		}
+		query = elastic.NewTermsQuery("user", values...)
+	}
+	if withDrafts {
+		query = excludeUsers(elastic.NewBoolQuery().Must(query).MustNot(elastic.NewExistsQuery("deleted_at")), hidden)
+	} else {
+		query = excludeUsers(publicPostsQuery(query), hidden)
+	}
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(query).
+		SortBy(elastic.NewFieldSort("timestamp").Desc().Missing("_last")).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
+	observeQuery(context.Background(), "search", searchResult.TookInMillis, map[string]interface{}{"users": users, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if screenPost(&p) {
+			page.Posts = append(page.Posts, p)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Profile is the view of a user that is safe to return to clients; it never
+// includes the password.
+type Profile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	Bio         string `json:"bio"`
+	Age         int64  `json:"age"`
+	Gender      string `json:"gender"`
+	Role        string `json:"role"`
+	PostCount   int64  `json:"post_count"`
+	// only filled in for the caller's own profile
+	UnreadNotifications *int64 `json:"unread_notifications,omitempty"`
+}
+
+// PublicProfile is what anyone may see about a user.
+type PublicProfile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	Bio         string `json:"bio"`
+	PostCount   int64  `json:"post_count"`
+}
+
+// ProfileUpdate is the body of PUT /user/me. Missing fields are left
+// unchanged; an empty string clears a field.
+type ProfileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Bio         *string `json:"bio"`
+}
+
+const (
+	MAX_DISPLAY_NAME_CHARS = 50
+	MAX_BIO_CHARS          = 500
+	MAX_AVATAR_URL_CHARS   = 2048
+)
+
+func newProfile(user *User) *Profile {
+	return &Profile{
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		Bio:         user.Bio,
+		Age:         user.Age,
+		Gender:      user.Gender,
+		Role:        user.Role,
+	}
+}
+
+// handleMe returns the profile of the user the token was issued to.
+func (a *App) handleMe(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for me")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	user, err := getUser(claims.Username)
+	if err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", claims.Username, err)
+		return
+	}
+
+	profile := newProfile(user)
+	profile.PostCount, err = a.Posts.Count(r.Context(), user.Username)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count posts of %s %v.\n", user.Username, err)
+		return
+	}
+
+	unread, err := countUnreadNotifications(user.Username)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count notifications of %s %v.\n", user.Username, err)
+		return
+	}
+	profile.UnreadNotifications = &unread
+
+	js, err := json.Marshal(profile)
+	if err != nil {
+		http.Error(w, "Failed to parse profile into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse profile into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+func countPostsByUser(username string) (int64, error) {
+	client := esClient
+
+	start := time.Now()
+	count, err := client.Count(POST_INDEX).
+		Query(elastic.NewTermQuery("user", username)).
+		Do(context.Background())
+	observeQuery(context.Background(), "count", sinceMillis(start), map[string]interface{}{"user": username})
+	return count, err
+}
+
+// handleUserProfile returns the public profile of any user.
+func (a *App) handleUserProfile(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for a user profile")
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	user, err := getUser(username)
+	if err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", username, err)
+		return
+	}
+
+	profile := &PublicProfile{
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		Bio:         user.Bio,
+	}
+	profile.PostCount, err = a.Posts.Count(r.Context(), user.Username)
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to count posts of %s %v.\n", user.Username, err)
+		return
+	}
+
+	js, err := json.Marshal(profile)
+	if err != nil {
+		http.Error(w, "Failed to parse profile into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse profile into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleUpdateMe updates the profile fields of the caller.
+func (a *App) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for updating me")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var update ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	fields, err := update.fields()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fields) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	if err := updateUserFields(claims.Username, fields); err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to update profile of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	w.Write([]byte("Profile updated successfully."))
+}
+
+// fields validates the update and returns the user document fields to set.
+func (u *ProfileUpdate) fields() (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if u.DisplayName != nil {
+		name := strings.TrimSpace(*u.DisplayName)
+		if utf8.RuneCountInString(name) > MAX_DISPLAY_NAME_CHARS {
+			return nil, fmt.Errorf("display_name should be at most %d characters", MAX_DISPLAY_NAME_CHARS)
+		}
+		name, _, ok := screenText(name, "")
+		if !ok {
+			return nil, errors.New("display_name contains filtered words")
+		}
+		fields["display_name"] = name
+	}
+	if u.Bio != nil {
+		bio := strings.TrimSpace(*u.Bio)
+		if utf8.RuneCountInString(bio) > MAX_BIO_CHARS {
+			return nil, fmt.Errorf("bio should be at most %d characters", MAX_BIO_CHARS)
+		}
+		bio, _, ok := screenText(bio, "")
+		if !ok {
+			return nil, errors.New("bio contains filtered words")
+		}
+		fields["bio"] = bio
+	}
+	if u.AvatarURL != nil {
+		avatar := strings.TrimSpace(*u.AvatarURL)
+		if avatar != "" {
+			parsed, err := url.Parse(avatar)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || len(avatar) > MAX_AVATAR_URL_CHARS {
+				return nil, errors.New("avatar_url should be an http(s) URL")
+			}
+		}
+		fields["avatar_url"] = avatar
+	}
+	return fields, nil
+}
+
+func updateUserFields(username string, fields map[string]interface{}) error {
+	client := esClient
+
+	_, err := client.Update().
+		Index(USER_INDEX).
+		Id(username).
+		Doc(fields).
+		Refresh("wait_for").
+		Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return errUserNotFound
+	}
+	return err
+}
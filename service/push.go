@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Push notifications. Mobile clients register the token of their device
+// with POST /devices, and every notification of its user is also pushed to
+// it: Android devices through Firebase Cloud Messaging when FCM_PROJECT_ID
+// is set, iOS devices through APNs when APNS_KEY_FILE is. Pushes are sent
+// by PUSH_WORKERS in the background; when PUSH_QUEUE notifications are
+// already waiting, new ones are only recorded. All are loaded from the
+// ServiceConfig at startup.
+var (
+	FCM_PROJECT_ID = ""
+	APNS_KEY_FILE  = "" // .p8 token signing key
+	APNS_KEY_ID    = ""
+	APNS_TEAM_ID   = ""
+	APNS_TOPIC     = "" // bundle id of the app
+	APNS_SANDBOX   = false
+	PUSH_WORKERS   = 2
+)
+
+const (
+	DEVICE_INDEX = "device"
+
+	PUSH_QUEUE   = 1000
+	PUSH_TIMEOUT = 10 * time.Second
+	PUSH_TITLE   = "Around"
+
+	// Followers with a device within PUSH_NEARBY_RANGE of a new post are
+	// told about it, the first PUSH_MAX_FOLLOWERS followers of its author.
+	PUSH_NEARBY_RANGE  = "10km"
+	PUSH_MAX_FOLLOWERS = 1000
+
+	// MAX_DEVICES_PER_USER bounds the devices a notification is pushed
+	// to, the most recently registered ones.
+	MAX_DEVICES_PER_USER = 10
+	MAX_DEVICE_TOKEN_LEN = 4096
+)
+
+// Platforms of a device, which choose its PushProvider.
+const (
+	PLATFORM_ANDROID = "android"
+	PLATFORM_IOS     = "ios"
+)
+
+const DEVICE_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "token": {
+                "type": "keyword"
+            },
+            "platform": {
+                "type": "keyword"
+            },
+            "user": {
+                "type": "keyword"
+            },
+            "location": {
+                "type": "geo_point"
+            },
+            "updated_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+// Device is a phone of User that pushes are sent to. Location, where it
+// was when it last registered, is optional; devices without one aren't
+// told about nearby posts.
+type Device struct {
+	Token     string    `json:"token"`
+	Platform  string    `json:"platform"`
+	User      string    `json:"user"`
+	Location  *Location `json:"location,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// deviceId is the document id of the device with token. Tokens are long
+// and may contain characters ids shouldn't, so they are hashed.
+func deviceId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PushMessage is what a device shows, plus Data for the app to open the
+// right screen.
+type PushMessage struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+// PushProvider delivers messages to the devices of one platform.
+type PushProvider interface {
+	Send(ctx context.Context, token string, msg *PushMessage) error
+}
+
+// errDeviceGone is returned by a PushProvider when the token is no longer
+// valid, because the app was uninstalled or the token rotated.
+var errDeviceGone = errors.New("device token is no longer valid")
+
+// Pusher is the pool of workers pushing notifications.
+type Pusher struct {
+	providers map[string]PushProvider // by platform
+	queue     chan *Notification
+}
+
+// pusher is the Pusher in use, nil when no PushProvider is configured. It
+// is set up by setupPush.
+var pusher *Pusher
+
+func setupPush() error {
+	providers := make(map[string]PushProvider)
+	if FCM_PROJECT_ID != "" {
+		fcm, err := newFCMProvider(context.Background(), FCM_URL, FCM_PROJECT_ID)
+		if err != nil {
+			return err
+		}
+		providers[PLATFORM_ANDROID] = fcm
+	}
+	if APNS_KEY_FILE != "" {
+		url := APNS_URL
+		if APNS_SANDBOX {
+			url = APNS_SANDBOX_URL
+		}
+		apns, err := newAPNSProvider(url, APNS_KEY_FILE, APNS_KEY_ID, APNS_TEAM_ID, APNS_TOPIC)
+		if err != nil {
+			return err
+		}
+		providers[PLATFORM_IOS] = apns
+	}
+	if len(providers) == 0 {
+		pusher = nil
+		return nil
+	}
+	pusher = newPusher(providers)
+	pusher.start(PUSH_WORKERS)
+	fmt.Printf("Push notifications started with %d workers\n", PUSH_WORKERS)
+	return nil
+}
+
+func newPusher(providers map[string]PushProvider) *Pusher {
+	return &Pusher{providers: providers, queue: make(chan *Notification, PUSH_QUEUE)}
+}
+
+func (p *Pusher) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for n := range p.queue {
+				p.deliver(n)
+			}
+		}()
+	}
+}
+
+// enqueue hands n to a worker, or drops its push when the queue is full.
+func (p *Pusher) enqueue(n *Notification) {
+	select {
+	case p.queue <- n:
+	default:
+		fmt.Printf("Push queue is full, dropped %s push for %s\n", n.Type, n.User)
+	}
+}
+
+// deliver pushes n to the devices of its user.
+func (p *Pusher) deliver(n *Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), PUSH_TIMEOUT)
+	defer cancel()
+
+	devices, err := readDevices(ctx, n.User)
+	if err != nil {
+		fmt.Printf("Failed to read devices of %s %v.\n", n.User, err)
+		return
+	}
+	p.send(ctx, devices, pushMessage(n))
+}
+
+// send pushes msg to devices, forgetting the devices whose token is gone.
+func (p *Pusher) send(ctx context.Context, devices []*Device, msg *PushMessage) {
+	for _, d := range devices {
+		provider := p.providers[d.Platform]
+		if provider == nil {
+			continue
+		}
+		err := provider.Send(ctx, d.Token, msg)
+		switch {
+		case err == errDeviceGone:
+			fmt.Printf("Device of %s is gone, unregistering it\n", d.User)
+			if err := deleteDevice(ctx, d.Token, ""); err != nil {
+				fmt.Printf("Failed to delete device of %s %v.\n", d.User, err)
+			}
+		case err != nil:
+			fmt.Printf("Failed to push to %s device of %s %v.\n", d.Platform, d.User, err)
+		}
+	}
+}
+
+// pushMessage words the notification n.
+func pushMessage(n *Notification) *PushMessage {
+	var body string
+	switch n.Type {
+	case NOTIFY_LIKE:
+		body = n.Actor + " liked your post"
+	case NOTIFY_COMMENT:
+		body = n.Actor + " commented on your post"
+	case NOTIFY_FOLLOW:
+		body = n.Actor + " started following you"
+	case NOTIFY_NEARBY_POST:
+		body = n.Actor + " posted near you"
+	default:
+		body = "New activity from " + n.Actor
+	}
+	data := map[string]string{"type": n.Type, "actor": n.Actor}
+	if n.PostId != "" {
+		data["post_id"] = n.PostId
+	}
+	return &PushMessage{Title: PUSH_TITLE, Body: body, Data: data}
+}
+
+// notifyNearbyFollowers notifies, in the background, the followers of the
+// author of the new post p that have a device within PUSH_NEARBY_RANGE of
+// it.
+func notifyNearbyFollowers(p *Post) {
+	// the caller goes on with p
+	author, postId, loc := p.User, p.Id, p.Location
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), PUSH_TIMEOUT)
+		defer cancel()
+
+		users, err := readNearbyFollowers(ctx, author, loc)
+		if err != nil {
+			fmt.Printf("Failed to read followers of %s near post %s %v.\n", author, postId, err)
+			return
+		}
+		for _, user := range users {
+			notify(user, author, NOTIFY_NEARBY_POST, postId)
+		}
+	}()
+}
+
+// readNearbyFollowers returns the followers of user that have a device
+// within PUSH_NEARBY_RANGE of loc.
+func readNearbyFollowers(ctx context.Context, user string, loc Location) ([]string, error) {
+	client := esClient
+
+	followResult, err := client.Search().
+		Index(FOLLOW_INDEX).
+		Query(elastic.NewTermQuery("followee", user)).
+		Size(PUSH_MAX_FOLLOWERS).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var followers []interface{}
+	if followResult.Hits != nil {
+		for _, hit := range followResult.Hits.Hits {
+			var f Follow
+			if hit.Source == nil || json.Unmarshal(hit.Source, &f) != nil {
+				continue
+			}
+			followers = append(followers, f.Follower)
+		}
+	}
+	if len(followers) == 0 {
+		return nil, nil
+	}
+
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermsQuery("user", followers...)).
+		Filter(elastic.NewGeoDistanceQuery("location").Lat(loc.Lat).Lon(loc.Lon).Distance(PUSH_NEARBY_RANGE))
+	deviceResult, err := client.Search().
+		Index(DEVICE_INDEX).
+		Query(query).
+		Collapse(elastic.NewCollapseBuilder("user")).
+		Size(len(followers)).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, d := range decodeDevices(deviceResult) {
+		users = append(users, d.User)
+	}
+	return users, nil
+}
+
+// readDevices returns the most recently registered devices of user.
+func readDevices(ctx context.Context, user string) ([]*Device, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(DEVICE_INDEX).
+		Query(elastic.NewTermQuery("user", user)).
+		Sort("updated_at", false).
+		Size(MAX_DEVICES_PER_USER).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDevices(searchResult), nil
+}
+
+func decodeDevices(searchResult *elastic.SearchResult) []*Device {
+	var devices []*Device
+	if searchResult.Hits != nil {
+		for _, hit := range searchResult.Hits.Hits {
+			var d Device
+			if hit.Source == nil || json.Unmarshal(hit.Source, &d) != nil {
+				continue
+			}
+			devices = append(devices, &d)
+		}
+	}
+	return devices
+}
+
+// saveDevice stores d, taking the token over from any other user, since a
+// device belongs to whoever logged in on it last.
+func saveDevice(ctx context.Context, d *Device) error {
+	client := esClient
+
+	_, err := client.Index().
+		Index(DEVICE_INDEX).
+		Id(deviceId(d.Token)).
+		BodyJson(d).
+		Do(ctx)
+	return err
+}
+
+// deleteDevice removes the device with token, only if it is user's unless
+// user is empty. It returns errDeviceNotFound when there is none.
+func deleteDevice(ctx context.Context, token, user string) error {
+	client := esClient
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewIdsQuery().Ids(deviceId(token)))
+	if user != "" {
+		query = query.Filter(elastic.NewTermQuery("user", user))
+	}
+	resp, err := client.DeleteByQuery(DEVICE_INDEX).
+		Query(query).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+var errDeviceNotFound = errors.New("device not found")
+
+// DeviceRegistration is the body of POST /devices.
+type DeviceRegistration struct {
+	Token    string    `json:"token"`
+	Platform string    `json:"platform"`           // PLATFORM_ANDROID or PLATFORM_IOS
+	Location *Location `json:"location,omitempty"` // out of range fails to decode
+}
+
+// handleRegisterDevice registers a device of the caller for push
+// notifications. Registering again updates its location.
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for registering a device")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var req DeviceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" || len(req.Token) > MAX_DEVICE_TOKEN_LEN {
+		http.Error(w, fmt.Sprintf("token should be 1 to %d characters", MAX_DEVICE_TOKEN_LEN), http.StatusBadRequest)
+		return
+	}
+	if req.Platform != PLATFORM_ANDROID && req.Platform != PLATFORM_IOS {
+		http.Error(w, "platform should be "+PLATFORM_ANDROID+" or "+PLATFORM_IOS, http.StatusBadRequest)
+		return
+	}
+
+	d := &Device{
+		Token:     req.Token,
+		Platform:  req.Platform,
+		User:      claims.Username,
+		Location:  req.Location,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err := saveDevice(r.Context(), d); err != nil {
+		http.Error(w, "Failed to save device to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save device of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Device registered."))
+}
+
+// handleUnregisterDevice stops pushes to one of the caller's devices, on
+// logout.
+func handleUnregisterDevice(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for unregistering a device")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	err := deleteDevice(r.Context(), mux.Vars(r)["token"], claims.Username)
+	if err == errDeviceNotFound {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete device from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to delete device of %s %v.\n", claims.Username, err)
+		return
+	}
+
+	w.Write([]byte("Device unregistered."))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	APNS_URL         = "https://api.push.apple.com"
+	APNS_SANDBOX_URL = "https://api.sandbox.push.apple.com"
+
+	// Apple refuses provider tokens older than an hour, and too frequent
+	// new ones.
+	APNS_TOKEN_LIFETIME = 45 * time.Minute
+)
+
+// apnsProvider pushes to iOS devices with the APNs HTTP/2 API,
+// authenticated by tokens signed with the key keyID of team teamID.
+type apnsProvider struct {
+	url    string
+	topic  string
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	signedAt time.Time
+}
+
+func newAPNSProvider(baseURL, keyFile, keyID, teamID, topic string) (*apnsProvider, error) {
+	pem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %v", err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("apns key %s: %v", keyFile, err)
+	}
+	return &apnsProvider{
+		url:    baseURL,
+		topic:  topic,
+		keyID:  keyID,
+		teamID: teamID,
+		key:    key,
+		client: &http.Client{Timeout: PUSH_TIMEOUT},
+	}, nil
+}
+
+// providerToken returns the signed token, renewed every
+// APNS_TOKEN_LIFETIME.
+func (a *apnsProvider) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.signedAt) < APNS_TOKEN_LIFETIME {
+		return a.token, nil
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Issuer:   a.teamID,
+		IssuedAt: jwt.NewNumericDate(now),
+	})
+	token.Header["kid"] = a.keyID
+	signed, err := token.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.signedAt = signed, now
+	return signed, nil
+}
+
+type apnsAlert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type apnsAps struct {
+	Alert apnsAlert `json:"alert"`
+	Sound string    `json:"sound"`
+}
+
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+func (a *apnsProvider) Send(ctx context.Context, deviceToken string, msg *PushMessage) error {
+	// the custom data sits next to aps
+	payload := map[string]interface{}{
+		"aps": apnsAps{Alert: apnsAlert{Title: msg.Title, Body: msg.Body}, Sound: "default"},
+	}
+	for k, v := range msg.Data {
+		payload[k] = v
+	}
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	token, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", a.url+"/3/device/"+deviceToken, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body apnsError
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode == http.StatusGone || body.Reason == "BadDeviceToken" || body.Reason == "Unregistered" {
+		return errDeviceGone
+	}
+	return fmt.Errorf("apns returned %s: %s", resp.Status, body.Reason)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	FCM_URL   = "https://fcm.googleapis.com"
+	FCM_SCOPE = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// fcmProvider pushes to Android devices with the Firebase Cloud Messaging
+// HTTP v1 API, authenticated by the application default credentials.
+type fcmProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newFCMProvider(ctx context.Context, baseURL, projectID string) (*fcmProvider, error) {
+	client, err := google.DefaultClient(ctx, FCM_SCOPE)
+	if err != nil {
+		return nil, fmt.Errorf("fcm credentials: %v", err)
+	}
+	client.Timeout = PUSH_TIMEOUT
+	return &fcmProvider{url: baseURL + "/v1/projects/" + projectID + "/messages:send", client: client}, nil
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification fcmNotification   `json:"notification"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+func (f *fcmProvider) Send(ctx context.Context, token string, msg *PushMessage) error {
+	js, err := json.Marshal(&fcmRequest{Message: fcmMessage{
+		Token:        token,
+		Notification: fcmNotification{Title: msg.Title, Body: msg.Body},
+		Data:         msg.Data,
+	}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	// tokens of uninstalled apps are UNREGISTERED, with a 404
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(body, []byte("UNREGISTERED")) {
+		return errDeviceGone
+	}
+	return fmt.Errorf("fcm returned %s: %s", resp.Status, bytes.TrimSpace(body))
+}
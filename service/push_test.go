@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// recordingProvider is a PushProvider keeping what it is asked to send.
+type recordingProvider struct {
+	mu   sync.Mutex
+	sent map[string]*PushMessage // by token
+	gone map[string]bool
+}
+
+func (p *recordingProvider) Send(ctx context.Context, token string, msg *PushMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gone[token] {
+		return errDeviceGone
+	}
+	if p.sent == nil {
+		p.sent = make(map[string]*PushMessage)
+	}
+	p.sent[token] = msg
+	return nil
+}
+
+func TestHandleRegisterDevice(t *testing.T) {
+	s := newTestServer(t)
+
+	register := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/devices", strings.NewReader(body))
+		return s.do(authorized(t, r, "devon"))
+	}
+
+	if w := register(`{"token": "abc", "platform": "ios", "location": {"lat": 40.7, "lon": -74.0}}`); w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want 201: %s", w.Code, w.Body)
+	}
+	for _, body := range []string{
+		`{"platform": "android"}`,
+		`{"token": "abc", "platform": "windows"}`,
+		`{"token": "` + strings.Repeat("a", MAX_DEVICE_TOKEN_LEN+1) + `", "platform": "android"}`,
+		`{"token": "abc", "platform": "android", "location": {"lat": 91, "lon": 0}}`,
+		`not json`,
+	} {
+		if w := register(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestPusherSend(t *testing.T) {
+	android := &recordingProvider{gone: map[string]bool{"stale": true}}
+	ios := &recordingProvider{}
+	p := newPusher(map[string]PushProvider{PLATFORM_ANDROID: android, PLATFORM_IOS: ios})
+
+	msg := pushMessage(&Notification{User: "bob", Actor: "alice", Type: NOTIFY_COMMENT, PostId: "p1"})
+	if msg.Body != "alice commented on your post" || msg.Data["post_id"] != "p1" || msg.Data["type"] != NOTIFY_COMMENT {
+		t.Errorf("message = %+v", msg)
+	}
+
+	p.send(context.Background(), []*Device{
+		{Token: "phone", Platform: PLATFORM_ANDROID, User: "bob"},
+		{Token: "stale", Platform: PLATFORM_ANDROID, User: "bob"},
+		{Token: "tablet", Platform: PLATFORM_IOS, User: "bob"},
+		{Token: "watch", Platform: "tizen", User: "bob"},
+	}, msg)
+	if len(android.sent) != 1 || android.sent["phone"] != msg {
+		t.Errorf("android sent %v", android.sent)
+	}
+	if len(ios.sent) != 1 || ios.sent["tablet"] != msg {
+		t.Errorf("ios sent %v", ios.sent)
+	}
+}
+
+func TestFCMProvider(t *testing.T) {
+	var got fcmRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.Message.Token == "stale" {
+			http.Error(w, `{"error": {"status": "NOT_FOUND", "details": [{"errorCode": "UNREGISTERED"}]}}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"name": "projects/p/messages/1"}`))
+	}))
+	defer srv.Close()
+	fcm := &fcmProvider{url: srv.URL, client: srv.Client()}
+
+	msg := &PushMessage{Title: PUSH_TITLE, Body: "alice liked your post", Data: map[string]string{"type": NOTIFY_LIKE}}
+	if err := fcm.Send(context.Background(), "phone", msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.Message.Token != "phone" || got.Message.Notification.Body != msg.Body || got.Message.Data["type"] != NOTIFY_LIKE {
+		t.Errorf("request = %+v", got)
+	}
+	if err := fcm.Send(context.Background(), "stale", msg); err != errDeviceGone {
+		t.Errorf("Send to a stale token = %v, want errDeviceGone", err)
+	}
+}
+
+func TestAPNSProvider(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3/device/gone" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason": "Unregistered"}`))
+			return
+		}
+		token, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil || token.Header["kid"] != "KEY" || r.URL.Path != "/3/device/phone" || r.Header.Get("apns-topic") != "com.example.around" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason": "InvalidProviderToken"}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	apns, err := newAPNSProvider(srv.URL, keyFile, "KEY", "TEAM", "com.example.around")
+	if err != nil {
+		t.Fatalf("newAPNSProvider: %v", err)
+	}
+	msg := &PushMessage{Title: PUSH_TITLE, Body: "alice posted near you", Data: map[string]string{"post_id": "p1"}}
+	if err := apns.Send(context.Background(), "phone", msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	aps, _ := got["aps"].(map[string]interface{})
+	if aps == nil || got["post_id"] != "p1" {
+		t.Errorf("payload = %v", got)
+	}
+	if err := apns.Send(context.Background(), "gone", msg); err != errDeviceGone {
+		t.Errorf("Send to a gone token = %v, want errDeviceGone", err)
+	}
+}
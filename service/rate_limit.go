@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token-bucket rate limiting of abuse-prone routes, per client IP and, on
+// authenticated routes, per user. A bucket holds up to Burst requests and
+// refills at PerMinute requests a minute.
+//
+// Behind a load balancer RemoteAddr is the balancer; set
+// TRUSTED_PROXY_HOPS to the number of proxies that append to
+// X-Forwarded-For so the client IP is read from it. Entries further left
+// are client-supplied and never trusted.
+const (
+	ENABLE_RATE_LIMIT         = true
+	TRUSTED_PROXY_HOPS        = 0
+	RATE_LIMIT_SWEEP_INTERVAL = 10 * time.Minute
+)
+
+type Rate struct {
+	PerMinute float64
+	Burst     int
+}
+
+type RateLimit struct {
+	PerIP   Rate
+	PerUser Rate // only checked on authenticated routes
+}
+
+// rateLimits are the limits of each rate-limited route; a zero Rate is
+// unlimited.
+var rateLimits = map[string]RateLimit{
+	"post":            {PerIP: Rate{PerMinute: 30, Burst: 10}, PerUser: Rate{PerMinute: 10, Burst: 5}},
+	"signup":          {PerIP: Rate{PerMinute: 5, Burst: 5}},
+	"login":           {PerIP: Rate{PerMinute: 20, Burst: 10}},
+	"password":        {PerIP: Rate{PerMinute: 5, Burst: 5}},
+	"password_change": {PerIP: Rate{PerMinute: 5, Burst: 5}, PerUser: Rate{PerMinute: 5, Burst: 5}},
+	"refresh":         {PerIP: Rate{PerMinute: 30, Burst: 10}},
+	"bulk":            {PerIP: Rate{PerMinute: 10, Burst: 5}, PerUser: Rate{PerMinute: 5, Burst: 2}},
+	"report":          {PerIP: Rate{PerMinute: 30, Burst: 10}, PerUser: Rate{PerMinute: 10, Burst: 5}},
+	"message":         {PerIP: Rate{PerMinute: 60, Burst: 20}, PerUser: Rate{PerMinute: 30, Burst: 10}},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets of one Rate by key.
+type rateLimiter struct {
+	rate    Rate
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate Rate) *rateLimiter {
+	l := &rateLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+	go func() {
+		for range time.Tick(RATE_LIMIT_SWEEP_INTERVAL) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// allow takes a token from the bucket of key. When it is empty, allow
+// returns false and how long until the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	perSecond := l.rate.PerMinute / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely.
+func (l *rateLimiter) sweep() {
+	full := time.Duration(float64(l.rate.Burst) / (l.rate.PerMinute / 60) * float64(time.Second))
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// routeLimiter holds the buckets of one rate-limited route. The HTTP and
+// gRPC APIs share them, so a client can't double its budget by switching.
+type routeLimiter struct {
+	perIP, perUser *rateLimiter
+}
+
+var (
+	routeLimitersMu sync.Mutex
+	routeLimiters   = make(map[string]*routeLimiter)
+)
+
+// limiterFor returns the limiter of route name, or nil when the route is
+// not limited.
+func limiterFor(name string) *routeLimiter {
+	limit, ok := rateLimits[name]
+	if !ENABLE_RATE_LIMIT || !ok {
+		return nil
+	}
+
+	routeLimitersMu.Lock()
+	defer routeLimitersMu.Unlock()
+	if l, ok := routeLimiters[name]; ok {
+		return l
+	}
+	l := &routeLimiter{}
+	if limit.PerIP.PerMinute > 0 {
+		l.perIP = newRateLimiter(limit.PerIP)
+	}
+	if limit.PerUser.PerMinute > 0 {
+		l.perUser = newRateLimiter(limit.PerUser)
+	}
+	routeLimiters[name] = l
+	return l
+}
+
+// allow takes a token of ip and, unless user is "", of user.
+func (l *routeLimiter) allow(ip, user string, now time.Time) (bool, time.Duration) {
+	if l.perIP != nil {
+		if ok, retry := l.perIP.allow(ip, now); !ok {
+			return false, retry
+		}
+	}
+	if l.perUser != nil && user != "" {
+		if ok, retry := l.perUser.allow(user, now); !ok {
+			return false, retry
+		}
+	}
+	return true, 0
+}
+
+// rateLimited applies the limits of route name to next. Wrap it inside the
+// JWT middleware so the per-user limit can see the token.
+func rateLimited(name string, next http.Handler) http.Handler {
+	l := limiterFor(name)
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user string
+		if claims, err := claimsFromRequest(r); err == nil {
+			user = claims.Username
+		}
+		if ok, retry := l.allow(clientIP(r), user, time.Now()); !ok {
+			writeRateLimited(w, name, retry)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeRateLimited(w http.ResponseWriter, name string, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeAPIError(w, http.StatusTooManyRequests, "rate_limited",
+		fmt.Sprintf("Too many %s requests, retry in %d seconds", name, seconds))
+}
+
+// clientIP is the address of the client, see TRUSTED_PROXY_HOPS.
+func clientIP(r *http.Request) string {
+	if TRUSTED_PROXY_HOPS > 0 {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if i := len(hops) - TRUSTED_PROXY_HOPS; i >= 0 && i < len(hops) {
+			if ip := strings.TrimSpace(hops[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Users report posts with POST /post/{id}/report. Reports are kept in their
+// own index, one document per user and post, so a user counts once however
+// often they report. Once REPORT_HIDE_THRESHOLD users reported a post it is
+// hidden from everyone but its author until an admin dismisses the reports.
+const (
+	REPORT_INDEX            = "report"
+	REPORT_HIDE_THRESHOLD   = 5
+	MAX_REPORT_DETAIL_CHARS = 500
+
+	DEFAULT_REPORTED_POSTS = 20
+	MAX_REPORTED_POSTS     = 100
+
+	// REPORT_SYSTEM_ACTOR is the actor of moderation actions taken on
+	// reports without an admin.
+	REPORT_SYSTEM_ACTOR = "system"
+)
+
+const REPORT_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "post_id": {
+                "type": "keyword"
+            },
+            "reporter": {
+                "type": "keyword"
+            },
+            "reason": {
+                "type": "keyword"
+            },
+            "timestamp": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+var reportReasons = map[string]bool{
+	"spam":       true,
+	"harassment": true,
+	"explicit":   true,
+	"violence":   true,
+	"other":      true,
+}
+
+// Report records that Reporter reported post PostId. Its document id is
+// reportId.
+type Report struct {
+	PostId    string    `json:"post_id"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReportedPost is a post in GET /admin/reports with its report counts.
+type ReportedPost struct {
+	PostId  string           `json:"post_id"`
+	Reports int64            `json:"reports"`
+	Reasons map[string]int64 `json:"reasons"`
+	Post    *Post            `json:"post,omitempty"` // nil if it was deleted since
+}
+
+// reportId is the document id of user's report of a post. Usernames can't
+// contain ':'.
+func reportId(postId, user string) string {
+	return postId + ":" + user
+}
+
+// handleReport lets the caller report a post with a body such as
+// {"reason": "spam", "detail": "..."}. Reporting a post twice is a no-op.
+func (a *App) handleReport(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for reporting a post")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+	if !reportReasons[report.Reason] {
+		reasons := make([]string, 0, len(reportReasons))
+		for reason := range reportReasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		http.Error(w, "reason should be one of "+strings.Join(reasons, ", "), http.StatusBadRequest)
+		return
+	}
+	if len([]rune(report.Detail)) > MAX_REPORT_DETAIL_CHARS {
+		http.Error(w, "detail should be at most "+strconv.Itoa(MAX_REPORT_DETAIL_CHARS)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p := a.readablePost(w, r, id, claims.Username)
+	if p == nil {
+		return
+	}
+	if p.User == claims.Username {
+		http.Error(w, "You can't report your own post", http.StatusBadRequest)
+		return
+	}
+
+	report.PostId = id
+	report.Reporter = claims.Username
+	report.Timestamp = time.Now().UTC()
+	created, err := saveReport(r.Context(), &report)
+	if err != nil {
+		http.Error(w, "Failed to save report to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to save report of post %s by %s %v.\n", id, claims.Username, err)
+		return
+	}
+	if created && !p.Hidden {
+		a.hideIfReported(r.Context(), id, p)
+	}
+
+	w.Write([]byte("Post reported successfully."))
+}
+
+// hideIfReported hides the post id, read as p, once enough users reported
+// it. Failures are only logged, the next report tries again.
+func (a *App) hideIfReported(ctx context.Context, id string, p *Post) {
+	count, err := countReports(ctx, id)
+	if err != nil {
+		fmt.Printf("Failed to count reports of post %s %v.\n", id, err)
+		return
+	}
+	if count < REPORT_HIDE_THRESHOLD {
+		return
+	}
+
+	p.Hidden = true
+	p.UpdatedAt = time.Now().UTC()
+	if err := a.Posts.Save(ctx, id, p); err != nil {
+		fmt.Printf("Failed to hide post %s %v.\n", id, err)
+		return
+	}
+	writeModerationLog(&ModerationEntry{
+		Actor:  REPORT_SYSTEM_ACTOR,
+		Action: MOD_HIDE_POST,
+		Target: id,
+		Detail: map[string]interface{}{"user": p.User, "reports": count},
+	})
+}
+
+// saveReport stores report and reports whether it is new. The write is
+// visible to searches before it returns, so the count that follows
+// includes it.
+func saveReport(ctx context.Context, report *Report) (bool, error) {
+	client := esClient
+
+	_, err := client.Index().
+		Index(REPORT_INDEX).
+		Id(reportId(report.PostId, report.Reporter)).
+		OpType("create").
+		BodyJson(report).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		if elastic.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func countReports(ctx context.Context, postId string) (int64, error) {
+	client := esClient
+
+	return client.Count(REPORT_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Do(ctx)
+}
+
+// deleteReports drops the reports of a post; failures are only logged.
+func deleteReports(postId string) {
+	client := esClient
+
+	_, err := client.DeleteByQuery(REPORT_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Refresh("true").
+		Do(context.Background())
+	if err != nil {
+		fmt.Printf("Failed to delete reports of post %s %v.\n", postId, err)
+	}
+}
+
+// annotateReports fills in the report count of posts, with one aggregation
+// over the report index.
+func annotateReports(ctx context.Context, posts []Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(posts))
+	for i := range posts {
+		ids[i] = posts[i].Id
+	}
+
+	client := esClient
+	searchResult, err := client.Search().
+		Index(REPORT_INDEX).
+		Query(elastic.NewTermsQuery("post_id", ids...)).
+		Size(0).
+		Aggregation("reports", elastic.NewTermsAggregation().Field("post_id").Size(len(posts))).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	observeQuery(ctx, "reports", searchResult.TookInMillis, map[string]interface{}{"posts": len(posts)})
+
+	counts := make(map[string]int64)
+	if agg, found := searchResult.Aggregations.Terms("reports"); found {
+		for _, bucket := range agg.Buckets {
+			if key, ok := bucket.Key.(string); ok {
+				counts[key] = bucket.DocCount
+			}
+		}
+	}
+	for i := range posts {
+		posts[i].Reports = counts[posts[i].Id]
+	}
+	return nil
+}
+
+// handleReportedPosts lists the limit most reported posts, with their
+// report count per reason.
+func (a *App) handleReportedPosts(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for reported posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	limit := DEFAULT_REPORTED_POSTS
+	if val := r.URL.Query().Get("limit"); val != "" {
+		var err error
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit <= 0 || limit > MAX_REPORTED_POSTS {
+			http.Error(w, "limit should be between 1 and "+strconv.Itoa(MAX_REPORTED_POSTS), http.StatusBadRequest)
+			return
+		}
+	}
+
+	client := esClient
+	searchResult, err := client.Search().
+		Index(REPORT_INDEX).
+		Size(0).
+		Aggregation("posts", elastic.NewTermsAggregation().
+			Field("post_id").
+			Size(limit).
+			SubAggregation("reasons", elastic.NewTermsAggregation().Field("reason").Size(len(reportReasons)))).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read reports %v.\n", err)
+		return
+	}
+	observeQuery(r.Context(), "aggregation", searchResult.TookInMillis, map[string]interface{}{"limit": limit})
+
+	reported := []*ReportedPost{}
+	if agg, found := searchResult.Aggregations.Terms("posts"); found {
+		for _, bucket := range agg.Buckets {
+			rp := &ReportedPost{PostId: fmt.Sprint(bucket.Key), Reports: bucket.DocCount, Reasons: make(map[string]int64)}
+			if reasons, found := bucket.Aggregations.Terms("reasons"); found {
+				for _, reason := range reasons.Buckets {
+					rp.Reasons[fmt.Sprint(reason.Key)] = reason.DocCount
+				}
+			}
+			p, err := a.Posts.Get(r.Context(), rp.PostId)
+			if err != nil && err != errPostNotFound {
+				http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+				fmt.Printf("Failed to read post %s %v.\n", rp.PostId, err)
+				return
+			}
+			if p != nil {
+				posts := []Post{*p}
+				signMediaURLs(posts)
+				rp.Post = &posts[0]
+				rp.Post.Reports = rp.Reports
+			}
+			reported = append(reported, rp)
+		}
+	}
+
+	js, err := json.Marshal(reported)
+	if err != nil {
+		http.Error(w, "Failed to parse reports into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse reports into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
+
+// handleDismissReports drops the reports of a post and shows it again if
+// they hid it.
+func (a *App) handleDismissReports(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for dismissing reports")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+	reason, ok := moderationReason(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return
+	}
+
+	deleteReports(id)
+	if p.Hidden {
+		p.Hidden = false
+		p.UpdatedAt = time.Now().UTC()
+		if err := a.Posts.Save(r.Context(), id, p); err != nil {
+			http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
+			fmt.Printf("Failed to unhide post %s %v.\n", id, err)
+			return
+		}
+	}
+
+	writeModerationLog(&ModerationEntry{
+		Actor:  claims.Username,
+		Action: MOD_DISMISS_REPORTS,
+		Target: id,
+		Reason: reason,
+	})
+	w.Write([]byte("Reports dismissed successfully."))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Retries and circuit breakers around ElasticSearch and the blob store. A
+// call failing with a transient error, such as a dropped connection or a
+// 5xx, is retried up to RETRY_ATTEMPTS times in all, waiting from
+// RETRY_MIN_BACKOFF doubling up to RETRY_MAX_BACKOFF, with jitter. After
+// BREAKER_FAILURES calls in a row fail that way the breaker of the
+// dependency opens: calls fail fast with a 503 for BREAKER_OPEN_DURATION,
+// then a single trial call decides whether it closes again. All are loaded
+// from the ServiceConfig at startup.
+var (
+	RETRY_ATTEMPTS        = 3
+	RETRY_MIN_BACKOFF     = 100 * time.Millisecond
+	RETRY_MAX_BACKOFF     = 2 * time.Second
+	BREAKER_FAILURES      = 5
+	BREAKER_OPEN_DURATION = 30 * time.Second
+)
+
+// Breaker states, also the values of the around_circuit_breaker_state
+// gauge.
+const (
+	BREAKER_CLOSED = iota
+	BREAKER_HALF_OPEN
+	BREAKER_OPEN
+)
+
+var errCircuitOpen = serviceError(http.StatusServiceUnavailable, "Service is temporarily unavailable, please try again later")
+
+var (
+	esBreaker   = newCircuitBreaker("elasticsearch")
+	blobBreaker = newCircuitBreaker("blob")
+)
+
+// CircuitBreaker tracks the health of one dependency.
+type CircuitBreaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial call is in flight
+}
+
+func newCircuitBreaker(name string) *CircuitBreaker {
+	b := &CircuitBreaker{name: name}
+	breakerState.WithLabelValues(name).Set(BREAKER_CLOSED)
+	return b
+}
+
+// allow reports whether a call may go ahead.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < BREAKER_OPEN_DURATION {
+			return false
+		}
+		b.setState(BREAKER_HALF_OPEN)
+		b.trial = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call; only transient
+// errors count as failures.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !isTransient(err) {
+		b.failures = 0
+		b.setState(BREAKER_CLOSED)
+		return
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || b.failures >= BREAKER_FAILURES {
+		if b.state != BREAKER_OPEN {
+			logger.Warn("circuit breaker opened", "dependency", b.name, "failures", b.failures, "err", err)
+		}
+		b.openedAt = time.Now()
+		b.setState(BREAKER_OPEN)
+	}
+}
+
+func (b *CircuitBreaker) setState(state int) {
+	if b.state == BREAKER_OPEN && state == BREAKER_CLOSED {
+		logger.Info("circuit breaker closed", "dependency", b.name)
+	}
+	b.state = state
+	breakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+// withRetry calls fn through the breaker b, making up to attempts calls
+// while it fails with transient errors.
+func withRetry(ctx context.Context, b *CircuitBreaker, attempts int, fn func() error) error {
+	backoff := RETRY_MIN_BACKOFF
+	for attempt := 1; ; attempt++ {
+		if !b.allow() {
+			breakerRejections.WithLabelValues(b.name).Inc()
+			return errCircuitOpen
+		}
+		err := fn()
+		b.record(err)
+		if err == nil || !isTransient(err) || attempt >= attempts {
+			return err
+		}
+
+		// full jitter keeps retrying clients from moving in lockstep
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logFor(ctx).Warn("retrying after transient error", "dependency", b.name, "attempt", attempt, "wait_ms", wait.Milliseconds(), "err", err)
+		retries.WithLabelValues(b.name).Inc()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+// isTransient reports whether err is worth retrying: a network failure, a
+// 429 or 5xx from the dependency, or its gRPC equivalent.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) {
+		return retryableStatus(esErr.Status)
+	}
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) {
+		return retryableStatus(gcsErr.Code)
+	}
+	// S3 response errors
+	var withStatus interface{ HTTPStatusCode() int }
+	if errors.As(err, &withStatus) {
+		return retryableStatus(withStatus.HTTPStatusCode())
+	}
+	// BigTable errors
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded, codes.Internal:
+			return true
+		}
+	}
+	if elastic.IsConnErr(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// resilientBlobStore retries the calls of another BlobStore through
+// blobBreaker. Uploads are only retried when their reader can be rewound.
+type resilientBlobStore struct {
+	BlobStore
+}
+
+func (s *resilientBlobStore) Put(ctx context.Context, key string, r io.Reader, opts *PutOptions) (string, int64, error) {
+	attempts := 1
+	seeker, ok := r.(io.Seeker)
+	var start int64
+	if ok {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err == nil {
+			attempts = RETRY_ATTEMPTS
+		}
+	}
+
+	var url string
+	var size int64
+	first := true
+	err := withRetry(ctx, blobBreaker, attempts, func() error {
+		if !first {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		var err error
+		url, size, err = s.BlobStore.Put(ctx, key, r, opts)
+		return err
+	})
+	return url, size, err
+}
+
+func (s *resilientBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := withRetry(ctx, blobBreaker, RETRY_ATTEMPTS, func() error {
+		var err error
+		body, err = s.BlobStore.Get(ctx, key)
+		return err
+	})
+	return body, err
+}
+
+func (s *resilientBlobStore) Delete(ctx context.Context, key string) error {
+	return withRetry(ctx, blobBreaker, RETRY_ATTEMPTS, func() error {
+		return s.BlobStore.Delete(ctx, key)
+	})
+}
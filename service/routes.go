@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// routes is the HTTP API of the service, served from the backends of a.
+func (a *App) routes() http.Handler {
+	// use jwdmiddleware to help send and protect the token
+	jwtMiddleware := newJWTMiddleware(false)
+	// read endpoints still identify the caller when a token is sent
+	readMiddleware := jwtMiddleware
+	if PUBLIC_READ {
+		readMiddleware = newJWTMiddleware(true)
+	}
+
+	r := mux.NewRouter()
+
+	r.Handle("/post", jwtMiddleware.Handler(rateLimited("post", http.HandlerFunc(a.handlePost)))).Methods("POST")
+	r.Handle("/upload", jwtMiddleware.Handler(rateLimited("post", http.HandlerFunc(a.handleUpload)))).Methods("POST")
+	r.Handle("/posts/bulk", jwtMiddleware.Handler(rateLimited("bulk", http.HandlerFunc(a.handleBulkPosts)))).Methods("POST")
+	r.Handle("/search", readMiddleware.Handler(http.HandlerFunc(a.handleSearch))).Methods("GET")
+	r.Handle("/search/text", readMiddleware.Handler(http.HandlerFunc(handleTextSearch))).Methods("GET")
+	r.Handle("/search/tag/{tag}", readMiddleware.Handler(http.HandlerFunc(handleTagSearch))).Methods("GET")
+	r.Handle("/tags/trending", readMiddleware.Handler(http.HandlerFunc(handleTrendingTags))).Methods("GET")
+	r.Handle("/trending", readMiddleware.Handler(http.HandlerFunc(handleTrending))).Methods("GET")
+	r.Handle("/live", jwtMiddleware.Handler(http.HandlerFunc(a.handleLive))).Methods("GET")
+	r.Handle("/ws", newWSJWTMiddleware().Handler(http.HandlerFunc(a.handleWebSocket))).Methods("GET")
+	r.Handle("/heatmap", readMiddleware.Handler(http.HandlerFunc(handleHeatmap))).Methods("GET")
+	r.Handle("/posts", readMiddleware.Handler(http.HandlerFunc(handlePostsByUsers))).Methods("GET")
+	r.Handle("/posts/delta", readMiddleware.Handler(http.HandlerFunc(handlePostsDelta))).Methods("GET")
+	r.Handle("/posts/mine", jwtMiddleware.Handler(http.HandlerFunc(handleMyPosts))).Methods("GET")
+	r.Handle("/post/{id}", jwtMiddleware.Handler(http.HandlerFunc(a.handleDeletePost))).Methods("DELETE")
+	r.Handle("/post/{id}", jwtMiddleware.Handler(http.HandlerFunc(a.handleEditPost))).Methods("PUT")
+	r.Handle("/post/{id}/restore", jwtMiddleware.Handler(http.HandlerFunc(a.handleRestorePost))).Methods("POST")
+	r.Handle("/post/{id}/publish", jwtMiddleware.Handler(http.HandlerFunc(a.handlePublishPost))).Methods("POST")
+	r.Handle("/post/{id}/like", jwtMiddleware.Handler(http.HandlerFunc(a.handleLike))).Methods("POST")
+	r.Handle("/post/{id}/like", jwtMiddleware.Handler(http.HandlerFunc(a.handleUnlike))).Methods("DELETE")
+	r.Handle("/post/{id}/comment", jwtMiddleware.Handler(http.HandlerFunc(a.handleComment))).Methods("POST")
+	r.Handle("/post/{id}/report", jwtMiddleware.Handler(rateLimited("report", http.HandlerFunc(a.handleReport)))).Methods("POST")
+	r.Handle("/post/{id}/comments", readMiddleware.Handler(http.HandlerFunc(a.handleComments))).Methods("GET")
+	r.Handle("/comment/{id}", jwtMiddleware.Handler(http.HandlerFunc(handleDeleteComment))).Methods("DELETE")
+	r.Handle("/messages", jwtMiddleware.Handler(rateLimited("message", http.HandlerFunc(a.handleSendMessage)))).Methods("POST")
+	r.Handle("/conversations", jwtMiddleware.Handler(http.HandlerFunc(handleConversations))).Methods("GET")
+	r.Handle("/conversations/{id}/messages", jwtMiddleware.Handler(http.HandlerFunc(handleConversationMessages))).Methods("GET")
+	r.Handle("/channels", jwtMiddleware.Handler(http.HandlerFunc(handleCreateChannel))).Methods("POST")
+	r.Handle("/channels", readMiddleware.Handler(http.HandlerFunc(handleChannelsAt))).Methods("GET")
+	r.Handle("/channel/{id}", readMiddleware.Handler(http.HandlerFunc(handleChannel))).Methods("GET")
+	r.Handle("/channel/{id}", jwtMiddleware.Handler(http.HandlerFunc(handleUpdateChannel))).Methods("PUT")
+	r.Handle("/channel/{id}", jwtMiddleware.Handler(http.HandlerFunc(handleDeleteChannel))).Methods("DELETE")
+	r.Handle("/channel/{id}/posts", readMiddleware.Handler(http.HandlerFunc(handleChannelPosts))).Methods("GET")
+	r.Handle("/me", jwtMiddleware.Handler(http.HandlerFunc(a.handleMe))).Methods("GET")
+	r.Handle("/notifications", jwtMiddleware.Handler(http.HandlerFunc(handleNotifications))).Methods("GET")
+	r.Handle("/notifications/read", jwtMiddleware.Handler(http.HandlerFunc(handleReadNotifications))).Methods("POST")
+	r.Handle("/devices", jwtMiddleware.Handler(http.HandlerFunc(handleRegisterDevice))).Methods("POST")
+	r.Handle("/devices/{token}", jwtMiddleware.Handler(http.HandlerFunc(handleUnregisterDevice))).Methods("DELETE")
+	r.Handle("/config", jwtMiddleware.Handler(http.HandlerFunc(handleConfig))).Methods("GET")
+	r.Handle("/stats", jwtMiddleware.Handler(http.HandlerFunc(a.handleStats))).Methods("GET")
+	r.Handle("/admin/flags", jwtMiddleware.Handler(http.HandlerFunc(handleGetFlags))).Methods("GET")
+	r.Handle("/admin/flags/{name}", jwtMiddleware.Handler(http.HandlerFunc(handleSetFlag))).Methods("POST")
+	r.Handle("/admin/filters", jwtMiddleware.Handler(http.HandlerFunc(handleGetFilters))).Methods("GET")
+	r.Handle("/admin/filters/{lang}", jwtMiddleware.Handler(http.HandlerFunc(handlePutFilter))).Methods("PUT")
+	r.Handle("/admin/archive", jwtMiddleware.Handler(http.HandlerFunc(handleListArchive))).Methods("GET")
+	r.Handle("/admin/archive/restore", jwtMiddleware.Handler(http.HandlerFunc(a.handleRestoreArchive))).Methods("POST")
+	r.Handle("/admin/media-refs/rebuild", jwtMiddleware.Handler(http.HandlerFunc(handleRebuildMediaRefs))).Methods("POST")
+	r.Handle("/admin/posts/tags", jwtMiddleware.Handler(http.HandlerFunc(handleRetagPosts))).Methods("POST")
+	r.Handle("/admin/posts/flagged", jwtMiddleware.Handler(http.HandlerFunc(handleFlaggedPosts))).Methods("GET")
+	r.Handle("/admin/posts/{id}/reports", jwtMiddleware.Handler(http.HandlerFunc(a.handleDismissReports))).Methods("DELETE")
+	r.Handle("/admin/reports", jwtMiddleware.Handler(http.HandlerFunc(a.handleReportedPosts))).Methods("GET")
+	r.Handle("/admin/posts/{id}", jwtMiddleware.Handler(http.HandlerFunc(a.handleForceDeletePost))).Methods("DELETE")
+	r.Handle("/admin/users/{username}/ban", jwtMiddleware.Handler(http.HandlerFunc(handleBanUser))).Methods("POST")
+	r.Handle("/admin/users/{username}/ban", jwtMiddleware.Handler(http.HandlerFunc(handleUnbanUser))).Methods("DELETE")
+	r.Handle("/admin/audit", jwtMiddleware.Handler(http.HandlerFunc(handleAuditLog))).Methods("GET")
+	r.Handle("/admin/moderation/log", jwtMiddleware.Handler(http.HandlerFunc(handleModerationLog))).Methods("GET")
+	r.Handle("/signup", rateLimited("signup", http.HandlerFunc(handlerRegister))).Methods("POST")
+	r.Handle("/login", rateLimited("login", http.HandlerFunc(handlerLogin))).Methods("POST")
+	r.Handle("/verify", rateLimited("login", http.HandlerFunc(handleVerify))).Methods("GET")
+	r.Handle("/password/forgot", rateLimited("password", http.HandlerFunc(handleForgotPassword))).Methods("POST")
+	r.Handle("/password/reset", rateLimited("password", http.HandlerFunc(handleResetPassword))).Methods("POST")
+	r.Handle("/auth/{provider}/login", rateLimited("login", http.HandlerFunc(handleOAuthLogin))).Methods("GET")
+	r.Handle("/auth/{provider}/callback", rateLimited("login", http.HandlerFunc(handleOAuthCallback))).Methods("GET")
+	r.Handle("/token/refresh", rateLimited("refresh", http.HandlerFunc(handleRefreshToken))).Methods("POST")
+	r.Handle("/logout", http.HandlerFunc(handleLogout)).Methods("POST")
+	r.Handle("/user/me", jwtMiddleware.Handler(http.HandlerFunc(a.handleMe))).Methods("GET")
+	r.Handle("/user/me", jwtMiddleware.Handler(http.HandlerFunc(a.handleUpdateMe))).Methods("PUT")
+	r.Handle("/user/me/drafts", jwtMiddleware.Handler(http.HandlerFunc(handleDrafts))).Methods("GET")
+	r.Handle("/user/me/trash", jwtMiddleware.Handler(http.HandlerFunc(handleTrash))).Methods("GET")
+	r.Handle("/user/{username}", readMiddleware.Handler(http.HandlerFunc(a.handleUserProfile))).Methods("GET")
+	r.Handle("/user/{username}/posts", readMiddleware.Handler(http.HandlerFunc(handleUserPosts))).Methods("GET")
+	r.Handle("/user/password", jwtMiddleware.Handler(rateLimited("password_change", http.HandlerFunc(handlerChangePassword)))).Methods("POST")
+	r.Handle("/user/{username}/follow", jwtMiddleware.Handler(http.HandlerFunc(handleFollow))).Methods("POST")
+	r.Handle("/user/{username}/follow", jwtMiddleware.Handler(http.HandlerFunc(handleUnfollow))).Methods("DELETE")
+	r.Handle("/user/{username}/block", jwtMiddleware.Handler(http.HandlerFunc(handleBlock))).Methods("POST")
+	r.Handle("/user/{username}/block", jwtMiddleware.Handler(http.HandlerFunc(handleUnblock))).Methods("DELETE")
+	r.Handle("/user/{username}/mute", jwtMiddleware.Handler(http.HandlerFunc(handleMute))).Methods("POST")
+	r.Handle("/user/{username}/mute", jwtMiddleware.Handler(http.HandlerFunc(handleUnmute))).Methods("DELETE")
+	r.Handle("/feed", jwtMiddleware.Handler(http.HandlerFunc(handleFeed))).Methods("GET")
+
+	if ENABLE_GRAPHQL {
+		// anonymous callers may sign up, log in and, with PUBLIC_READ, query
+		r.Handle("/graphql", newJWTMiddleware(true).Handler(a.newGraphQLHandler())).Methods("GET", "POST")
+	}
+	r.Handle("/stats/clients", jwtMiddleware.Handler(http.HandlerFunc(handleClientStats))).Methods("GET")
+	r.Handle(METRICS_PATH, promhttp.Handler()).Methods("GET")
+	r.Handle("/openapi.json", http.HandlerFunc(handleOpenAPI)).Methods("GET")
+	r.Handle("/healthz", http.HandlerFunc(handleHealthz)).Methods("GET")
+	r.Handle("/readyz", http.HandlerFunc(a.handleReadyz)).Methods("GET")
+	r.Use(requestIDMiddleware)
+	r.Use(metricsMiddleware)
+	r.Use(clientVersionMiddleware)
+	if STORAGE_BACKEND == "local" {
+		r.PathPrefix(LOCAL_MEDIA_PATH).Handler(http.StripPrefix(LOCAL_MEDIA_PATH, http.FileServer(http.Dir(LOCAL_STORAGE_DIR))))
+	}
+
+	return corsMiddleware(r)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Shard routing of post documents. By default ("") ElasticSearch spreads
+// posts over shards by document id.
+//
+//   - "geohash" routes each post by the geohash prefix of its location, so a
+//     geo search only touches the shards holding its cells. This improves
+//     locality, but a busy city lands on a single shard and can unbalance
+//     the cluster; pick a short ROUTING_GEOHASH_PRECISION.
+//   - "id" routes by a hash of the id into ROUTING_ID_BUCKETS buckets,
+//     which keeps writes evenly spread like the default while making the
+//     routing explicit and stable across reindexes.
+//
+// Changing the mode requires reindexing existing posts.
+const (
+	ROUTING_MODE              = ""
+	ROUTING_GEOHASH_PRECISION = 2
+	ROUTING_ID_BUCKETS        = 64
+	// Geo searches covering more cells than this fan out to every shard.
+	ROUTING_MAX_READ_KEYS = 16
+)
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// encodeGeohash returns the geohash of a point with precision characters.
+func encodeGeohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+	for len(hash) < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if lon >= mid {
+				ch |= 1 << uint(4-bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				ch |= 1 << uint(4-bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// decodeGeohash returns the center of a geohash cell.
+func decodeGeohash(hash string) (float64, float64, error) {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(geohashBase32, hash[i])
+		if ch < 0 {
+			return 0, 0, fmt.Errorf("invalid geohash %q", hash)
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if ch&(1<<uint(bit)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, nil
+}
+
+// geohashCellDegrees is the height and width in degrees of a geohash cell.
+func geohashCellDegrees(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lonBits))
+}
+
+// postRouting is the routing key a post is indexed with, or "" when routing
+// is disabled. p may be nil for modes that only depend on the id.
+func postRouting(p *Post, id string) string {
+	switch ROUTING_MODE {
+	case "geohash":
+		if p == nil {
+			return ""
+		}
+		return encodeGeohash(p.Location.Lat, p.Location.Lon, ROUTING_GEOHASH_PRECISION)
+	case "id":
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return strconv.Itoa(int(h.Sum32() % ROUTING_ID_BUCKETS))
+	default:
+		return ""
+	}
+}
+
+// searchRouting returns the routing keys of every cell a geo search of km
+// around lat/lon may touch, or nil to search all shards.
+func searchRouting(lat, lon, km float64) []string {
+	if ROUTING_MODE != "geohash" {
+		return nil
+	}
+
+	dLat := km / 111.32
+	cosLat := math.Cos(lat * math.Pi / 180)
+	if cosLat < 0.01 || dLat >= 90 {
+		return nil
+	}
+	dLon := km / (111.32 * cosLat)
+	if dLon >= 180 {
+		return nil
+	}
+	minLat, maxLat := math.Max(-90, lat-dLat), math.Min(90, lat+dLat)
+	minLon, maxLon := lon-dLon, lon+dLon
+
+	// sampling the bounding box at cell-sized steps hits every cell it
+	// overlaps
+	cellLat, cellLon := geohashCellDegrees(ROUTING_GEOHASH_PRECISION)
+	seen := make(map[string]bool)
+	var keys []string
+	for y := minLat; ; y += cellLat {
+		y = math.Min(y, maxLat)
+		for x := minLon; ; x += cellLon {
+			x = math.Min(x, maxLon)
+			key := encodeGeohash(y, math.Mod(x+540, 360)-180, ROUTING_GEOHASH_PRECISION)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+				if len(keys) > ROUTING_MAX_READ_KEYS {
+					return nil
+				}
+			}
+			if x >= maxLon {
+				break
+			}
+		}
+		if y >= maxLat {
+			break
+		}
+	}
+	fmt.Printf("Search routed to %d geohash cells\n", len(keys))
+	return keys
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Scheduled posts. A post created with a publish_at time is indexed right
+// away with the scheduled status, which keeps it out of searches, feeds
+// and listings of others like a draft. A background scheduler publishes it
+// within SCHEDULE_INTERVAL of that time: the post takes publish_at as its
+// timestamp and is announced like a new post, to live clients and nearby
+// followers.
+const (
+	SCHEDULE_INTERVAL  = 30 * time.Second
+	SCHEDULE_BATCH     = 100
+	MAX_SCHEDULE_AHEAD = 30 * 24 * time.Hour
+)
+
+// parsePublishAt parses the publish_at of a new post, an RFC 3339 time
+// after now and within MAX_SCHEDULE_AHEAD. An empty publish_at is nil: the
+// post isn't scheduled.
+func parsePublishAt(raw string, now time.Time) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil || !t.After(now) || t.Sub(now) > MAX_SCHEDULE_AHEAD {
+		return nil, invalidParam(ERR_INVALID_PUBLISH_AT, fmt.Sprintf("publish_at should be an RFC 3339 time in the next %s", MAX_SCHEDULE_AHEAD))
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// duePostsQuery selects the scheduled posts to publish at t.
+func duePostsQuery(t time.Time) elastic.Query {
+	return elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("status", STATUS_SCHEDULED),
+		elastic.NewRangeQuery("publish_at").Lte(t.Format(time.RFC3339Nano)))
+}
+
+// startScheduler publishes due posts every SCHEDULE_INTERVAL.
+func (a *App) startScheduler() {
+	go func() {
+		ticker := time.NewTicker(SCHEDULE_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if _, err := a.publishDuePosts(context.Background(), now); err != nil {
+				fmt.Printf("Failed to publish scheduled posts %v.\n", err)
+			}
+		}
+	}()
+}
+
+// publishDuePosts publishes up to SCHEDULE_BATCH posts scheduled at or
+// before now, and returns how many it published; the next run takes the
+// rest.
+func (a *App) publishDuePosts(ctx context.Context, now time.Time) (int, error) {
+	posts, err := a.Posts.Due(ctx, now, SCHEDULE_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	published := 0
+	for i := range posts {
+		p := &posts[i]
+		p.Status = STATUS_PUBLISHED
+		if p.PublishAt != nil {
+			p.Timestamp = *p.PublishAt
+		}
+		p.PublishAt = nil
+		p.UpdatedAt = now.UTC()
+		if err := a.Posts.Save(ctx, p.Id, p); err != nil {
+			fmt.Printf("Failed to publish scheduled post %s %v.\n", p.Id, err)
+			continue
+		}
+		fmt.Printf("Published scheduled post %s\n", p.Id)
+		a.announcePost(ctx, p)
+		published++
+	}
+	return published, nil
+}
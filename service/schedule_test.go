@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestScheduledPost(t *testing.T) {
+	s := newTestServer(t)
+	publishAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	fields := map[string]string{"message": "later", "lat": "37.5", "lon": "-122.1", "publish_at": publishAt.Format(time.RFC3339), "ttl": "24h"}
+
+	r := newPostRequest(t, fields, testPNG(t))
+	w := s.do(authorized(t, r, "abe"))
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Status != STATUS_SCHEDULED {
+		t.Fatalf("POST /post = %d %s, want a scheduled post", w.Code, w.Body)
+	}
+	if p.ExpiresAt == nil || !p.ExpiresAt.Equal(publishAt.Add(24*time.Hour)) {
+		t.Errorf("expires_at = %v, want a day after publish_at", p.ExpiresAt)
+	}
+	search := &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"}
+	if posts, _, _ := s.posts.Search(r.Context(), search); len(posts) != 0 {
+		t.Error("search found the post before its publish_at")
+	}
+
+	if n, err := s.publishDuePosts(r.Context(), time.Now()); n != 0 || err != nil {
+		t.Errorf("publishDuePosts before publish_at = %d, %v", n, err)
+	}
+	if n, err := s.publishDuePosts(r.Context(), publishAt); n != 1 || err != nil {
+		t.Fatalf("publishDuePosts at publish_at = %d, %v, want 1", n, err)
+	}
+	posts, _, _ := s.posts.Search(r.Context(), search)
+	if len(posts) != 1 || posts[0].Status != STATUS_PUBLISHED || !posts[0].Timestamp.Equal(publishAt) || posts[0].PublishAt != nil {
+		t.Errorf("search after publish_at = %+v, want the post timestamped at publish_at", posts)
+	}
+}
+
+func TestScheduledPostInvalid(t *testing.T) {
+	s := newTestServer(t)
+	soon := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for _, fields := range []map[string]string{
+		{"publish_at": "tomorrow"},
+		{"publish_at": time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		{"publish_at": time.Now().Add(MAX_SCHEDULE_AHEAD + time.Hour).Format(time.RFC3339)},
+		{"publish_at": soon, "draft": "true"},
+	} {
+		fields["lat"], fields["lon"] = "37.5", "-122.1"
+		w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "abe"))
+		var body APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest || body.Code != ERR_INVALID_PUBLISH_AT {
+			t.Errorf("%v: %d %s, want 400 with code %s", fields, w.Code, w.Body, ERR_INVALID_PUBLISH_AT)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (a *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	reqLog := logFor(r.Context())
+	reqLog.Info("received search request")
+	w.Header().Set("Content-Type", "application/json")
+
+	var lat, lon float64
+	place := strings.TrimSpace(r.URL.Query().Get("place"))
+	in := strings.TrimSpace(r.URL.Query().Get("in"))
+	bbox := r.URL.Query().Get("bbox")
+	hasCenter := r.URL.Query().Get("lat") != "" || r.URL.Query().Get("lon") != ""
+	for _, name := range []string{place, in} {
+		if name == "" {
+			continue
+		}
+		if !requireFlag(w, FLAG_PLACE_SEARCH) {
+			return
+		}
+		if len(name) > MAX_PLACE_QUERY_CHARS {
+			http.Error(w, "Place is too long", http.StatusBadRequest)
+			return
+		}
+	}
+	if bbox == "" && place == "" && (in == "" || hasCenter) {
+		loc, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lon"))
+		if err != nil {
+			writeServiceError(w, err, "")
+			return
+		}
+		lat, lon = loc.Lat, loc.Lon
+	}
+	// a place name, if given, is resolved to the center of the search; so
+	// is the city or neighborhood of in without a center
+	center := place
+	if center == "" && !hasCenter {
+		center = in
+	}
+	if center != "" && bbox == "" {
+		loc, err := a.Geo.Forward(r.Context(), center)
+		if err == errPlaceNotFound {
+			http.Error(w, "Could not resolve place", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to geocode place", http.StatusBadGateway)
+			reqLog.Error("failed to geocode place", "place", center, "err", err)
+			return
+		}
+		lat, lon = loc.Lat, loc.Lon
+	}
+	ran, err := rangeParam(r)
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+	// the city or neighborhood bounds the search, not the default range
+	if in != "" && r.URL.Query().Get("range") == "" {
+		ran = PLACE_SEARCH_RANGE
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_PAGINATION, err.Error())
+		return
+	}
+	q := &GeoQuery{Lat: lat, Lon: lon, Distance: ran}
+	// a map viewport replaces the point and range
+	if bbox != "" {
+		for _, name := range []string{"lat", "lon", "range", "place"} {
+			if r.URL.Query().Get(name) != "" {
+				writeAPIError(w, http.StatusBadRequest, ERR_INVALID_BBOX, "bbox can't be combined with lat, lon, range or place")
+				return
+			}
+		}
+		box, err := parseBBox(bbox)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_BBOX, err.Error())
+			return
+		}
+		q = newBBoxQuery(box)
+	}
+	q.Place = in
+	q.Offset, q.Limit = offset, limit
+	// since and until optionally bound when the posts were created
+	for name, bound := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if val := r.URL.Query().Get(name); val != "" {
+			if *bound, err = parseTimeParam(name, val); err != nil {
+				writeAPIError(w, http.StatusBadRequest, ERR_INVALID_TIME, err.Error())
+				return
+			}
+		}
+	}
+
+	// Read posts from ElasticSearch
+	posts, total, err := a.searchPosts(r.Context(), q, viewerName(r))
+	if err != nil {
+		writeServiceError(w, err, "Failed to read post from ElasticSearch")
+		if _, ok := err.(*ServiceError); !ok {
+			reqLog.Error("failed to read posts from ElasticSearch", "err", err)
+		}
+		return
+	}
+
+	// convert post to JSON format, in the shape the client negotiated
+	var body interface{} = posts
+	version := apiVersion(r)
+	if version >= API_V2 {
+		if posts == nil {
+			posts = []Post{}
+		}
+		body = &PostPage{Total: total, Offset: offset, Limit: limit, Posts: posts}
+	}
+	setAPIVersion(w, version)
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		reqLog.Error("failed to encode posts", "err", err)
+		return
+	}
+
+	w.Write(js)
+
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// Search cache. With REDIS_URL set, pages of search results are cached in
+// Redis for SEARCH_CACHE_TTL, keyed by the query with its center rounded
+// to SEARCH_CACHE_PRECISION decimals, so searches from nearby points share
+// an entry. What is searched is the exact query; an entry can be off at
+// the edge of its range by the rounding, so searches over less than
+// SEARCH_CACHE_MIN_KM, where that matters, bypass the cache. Every entry is
+// registered under the SEARCH_CACHE_CELL_DEGREES grid cells its area
+// overlaps, and a post published in a cell drops the entries of that cell.
+// The cache only holds what the PostStore returned: likes, signed URLs and
+// redactions are still applied for each viewer.
+var (
+	REDIS_URL        = ""
+	SEARCH_CACHE_TTL = 30 * time.Second
+)
+
+const (
+	SEARCH_CACHE_PRECISION    = 2 // decimals of the center, about 1km
+	SEARCH_CACHE_MIN_KM       = 10
+	SEARCH_CACHE_CELL_DEGREES = 1.0
+	// SEARCH_CACHE_MAX_CELLS keeps searches over huge areas, which any
+	// new post would invalidate anyway, out of the cache.
+	SEARCH_CACHE_MAX_CELLS = 64
+	SEARCH_CACHE_PREFIX    = "around:search:"
+)
+
+var searchCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "around_search_cache_requests_total",
+	Help: "Search cache lookups by result: hit, miss or error.",
+}, []string{"result"})
+
+// SearchCache caches pages of search results by key.
+type SearchCache interface {
+	// Get returns the entry under key, nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key, to be dropped when one of cells is
+	// invalidated.
+	Set(ctx context.Context, key string, value []byte, cells []string) error
+	// Invalidate drops the entries of cell.
+	Invalidate(ctx context.Context, cell string) error
+	Check(ctx context.Context) error
+}
+
+// cachedPage is a page of search results as the PostStore returned it.
+type cachedPage struct {
+	Posts []Post `json:"posts"`
+	Total int64  `json:"total"`
+}
+
+// newSearchCache connects to REDIS_URL, nil when it isn't set.
+func newSearchCache(ctx context.Context) (SearchCache, error) {
+	if REDIS_URL == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(REDIS_URL)
+	if err != nil {
+		return nil, err
+	}
+	cache := &redisSearchCache{client: redis.NewClient(opts), ttl: SEARCH_CACHE_TTL}
+	if err := cache.Check(ctx); err != nil {
+		cache.client.Close()
+		return nil, fmt.Errorf("connect to Redis at %s: %v", redactURL(REDIS_URL), err)
+	}
+	return cache, nil
+}
+
+// redisSearchCache keeps entries as strings expiring after ttl, and the
+// keys registered in a cell as a set named after the cell.
+type redisSearchCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func (c *redisSearchCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, SEARCH_CACHE_PREFIX+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (c *redisSearchCache) Set(ctx context.Context, key string, value []byte, cells []string) error {
+	pipe := c.client.TxPipeline()
+	pipe.Set(ctx, SEARCH_CACHE_PREFIX+key, value, c.ttl)
+	for _, cell := range cells {
+		set := SEARCH_CACHE_PREFIX + "cell:" + cell
+		pipe.SAdd(ctx, set, SEARCH_CACHE_PREFIX+key)
+		pipe.Expire(ctx, set, c.ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *redisSearchCache) Invalidate(ctx context.Context, cell string) error {
+	set := SEARCH_CACHE_PREFIX + "cell:" + cell
+	keys, err := c.client.SMembers(ctx, set).Result()
+	if err != nil {
+		return err
+	}
+	return c.client.Del(ctx, append(keys, set)...).Err()
+}
+
+func (c *redisSearchCache) Check(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// searchCacheKey is the cache key of q, with its center rounded.
+func searchCacheKey(q *GeoQuery) string {
+	scale := math.Pow(10, SEARCH_CACHE_PRECISION)
+	lat := math.Round(q.Lat*scale) / scale
+	lon := math.Round(q.Lon*scale) / scale
+
+	parts := []string{
+		strconv.FormatFloat(lat, 'f', -1, 64),
+		strconv.FormatFloat(lon, 'f', -1, 64),
+		q.Distance,
+		strconv.Itoa(q.Offset),
+		strconv.Itoa(q.Limit),
+	}
+	if q.BBox != nil {
+		b := q.BBox
+		parts = append(parts, fmt.Sprintf("bbox=%g,%g,%g,%g", b.MinLat, b.MinLon, b.MaxLat, b.MaxLon))
+	}
+	if !q.Since.IsZero() {
+		parts = append(parts, "since="+q.Since.Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		parts = append(parts, "until="+q.Until.Format(time.RFC3339Nano))
+	}
+	if q.Place != "" {
+		parts = append(parts, "in="+strings.ToLower(q.Place))
+	}
+	return strings.Join(parts, ":")
+}
+
+// searchCacheCell is the grid cell of a point.
+func searchCacheCell(lat, lon float64) string {
+	row := int(math.Floor(lat / SEARCH_CACHE_CELL_DEGREES))
+	col := int(math.Floor(lon / SEARCH_CACHE_CELL_DEGREES))
+	return strconv.Itoa(row) + "," + strconv.Itoa(col)
+}
+
+// searchCacheCells lists the grid cells the area of q overlaps, nil when
+// they are more than SEARCH_CACHE_MAX_CELLS.
+func searchCacheCells(q *GeoQuery) []string {
+	b := q.BBox
+	if b == nil {
+		km, err := parseKm(q.Distance)
+		if err != nil {
+			return nil
+		}
+		dLat := km / 111.32
+		dLon := 360.0
+		if cos := math.Cos(q.Lat * math.Pi / 180); cos > 0.01 {
+			dLon = math.Min(dLat/cos, 360)
+		}
+		b = &BoundingBox{MinLat: q.Lat - dLat, MinLon: q.Lon - dLon, MaxLat: q.Lat + dLat, MaxLon: q.Lon + dLon}
+	}
+	minRow := int(math.Floor(math.Max(b.MinLat, -90) / SEARCH_CACHE_CELL_DEGREES))
+	maxRow := int(math.Floor(math.Min(b.MaxLat, 90) / SEARCH_CACHE_CELL_DEGREES))
+	minCol := int(math.Floor(b.MinLon / SEARCH_CACHE_CELL_DEGREES))
+	maxCol := int(math.Floor(b.MaxLon / SEARCH_CACHE_CELL_DEGREES))
+	if (maxRow-minRow+1)*(maxCol-minCol+1) > SEARCH_CACHE_MAX_CELLS {
+		return nil
+	}
+
+	cols := int(360 / SEARCH_CACHE_CELL_DEGREES)
+	var cells []string
+	for row := minRow; row <= maxRow; row++ {
+		for col := minCol; col <= maxCol; col++ {
+			// wrap around the antimeridian into [-180, 180)
+			wrapped := ((col+cols/2)%cols+cols)%cols - cols/2
+			cells = append(cells, strconv.Itoa(row)+","+strconv.Itoa(wrapped))
+		}
+	}
+	return cells
+}
+
+// cachedSearch runs q through a.Cache when there is a cache. Cache
+// failures fall back to the PostStore. Searches leaving out the posts of
+// blocked or muted users are the viewer's own and not cached.
+func (a *App) cachedSearch(ctx context.Context, q *GeoQuery) ([]Post, int64, error) {
+	if a.Cache == nil || len(q.Exclude) > 0 {
+		return a.Posts.Search(ctx, q)
+	}
+	if km, err := parseKm(q.Distance); q.BBox == nil && (err != nil || km < SEARCH_CACHE_MIN_KM) {
+		return a.Posts.Search(ctx, q)
+	}
+	key := searchCacheKey(q)
+	cells := searchCacheCells(q)
+	if cells == nil {
+		return a.Posts.Search(ctx, q)
+	}
+
+	cached, err := a.Cache.Get(ctx, key)
+	if err != nil {
+		searchCacheRequests.WithLabelValues("error").Inc()
+		logFor(ctx).Warn("failed to read search cache", "err", err)
+	} else if cached != nil {
+		var page cachedPage
+		if err := json.Unmarshal(cached, &page); err == nil {
+			searchCacheRequests.WithLabelValues("hit").Inc()
+			return page.Posts, page.Total, nil
+		}
+	} else {
+		searchCacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	posts, total, err := a.Posts.Search(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	if value, err := json.Marshal(&cachedPage{Posts: posts, Total: total}); err == nil {
+		if err := a.Cache.Set(ctx, key, value, cells); err != nil {
+			logFor(ctx).Warn("failed to write search cache", "err", err)
+		}
+	}
+	return posts, total, nil
+}
+
+// invalidateSearchCache drops the cached searches p just showed up in.
+func (a *App) invalidateSearchCache(ctx context.Context, p *Post) {
+	if a.Cache == nil {
+		return
+	}
+	if err := a.Cache.Invalidate(ctx, searchCacheCell(p.Location.Lat, p.Location.Lon)); err != nil {
+		logFor(ctx).Warn("failed to invalidate search cache", "id", p.Id, "err", err)
+	}
+}
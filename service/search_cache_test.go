@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// memSearchCache is a SearchCache in a map.
+type memSearchCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	cells   map[string][]string
+}
+
+func newMemSearchCache() *memSearchCache {
+	return &memSearchCache{entries: map[string][]byte{}, cells: map[string][]string{}}
+}
+
+func (c *memSearchCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key], nil
+}
+
+func (c *memSearchCache) Set(ctx context.Context, key string, value []byte, cells []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = value
+	for _, cell := range cells {
+		c.cells[cell] = append(c.cells[cell], key)
+	}
+	return nil
+}
+
+func (c *memSearchCache) Invalidate(ctx context.Context, cell string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.cells[cell] {
+		delete(c.entries, key)
+	}
+	delete(c.cells, cell)
+	return nil
+}
+
+func (c *memSearchCache) Check(ctx context.Context) error {
+	return nil
+}
+
+func TestSearchCache(t *testing.T) {
+	s := newTestServer(t)
+	s.Cache = newMemSearchCache()
+	seedPosts(t, s)
+
+	query := "lat=37.7955&lon=-122.3937&range=20"
+	if got := searchIds(t, s, query); len(got) != 2 {
+		t.Fatalf("ids = %v, want [near close]", got)
+	}
+
+	// served from the cache, the deletion doesn't show
+	if err := s.Posts.Delete(context.Background(), "close"); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIds(t, s, query); len(got) != 2 {
+		t.Errorf("cached ids = %v, want [near close]", got)
+	}
+	// a nearby point shares the entry
+	if got := searchIds(t, s, "lat=37.7951&lon=-122.3941&range=20"); len(got) != 2 {
+		t.Errorf("ids near by = %v, want [near close]", got)
+	}
+
+	// a new post in the area drops the entry
+	r := newPostRequest(t, map[string]string{"message": "hello", "lat": "37.79", "lon": "-122.39"}, testPNG(t))
+	if w := s.do(authorized(t, r, "carol")); w.Code != http.StatusOK {
+		t.Fatalf("post status = %d: %s", w.Code, w.Body)
+	}
+	got := searchIds(t, s, query)
+	if len(got) != 2 || got[0] != "near" {
+		t.Errorf("ids after post = %v, want [near <new post>]", got)
+	}
+}
+
+func TestSearchCacheSmallRange(t *testing.T) {
+	s := newTestServer(t)
+	s.Cache = newMemSearchCache()
+	seedPosts(t, s)
+
+	// "near" is about 440m from here, and the rounded center, 37.8,-122.39,
+	// about 600m from it, so searching that would find nothing
+	query := "lat=37.7995&lon=-122.3937&range=500m"
+	if got := searchIds(t, s, query); len(got) != 1 || got[0] != "near" {
+		t.Errorf("ids = %v, want [near]", got)
+	}
+	// moved just out of range
+	if got := searchIds(t, s, "lat=37.8005&lon=-122.3937&range=500m"); len(got) != 0 {
+		t.Errorf("ids out of range = %v, want none", got)
+	}
+	if n := len(s.Cache.(*memSearchCache).entries); n != 0 {
+		t.Errorf("cached %d entries of searches under %gkm", n, float64(SEARCH_CACHE_MIN_KM))
+	}
+}
+
+func TestSearchCacheCells(t *testing.T) {
+	tests := []struct {
+		name string
+		q    GeoQuery
+		want []string
+	}{
+		{"one cell", GeoQuery{Lat: 37.5, Lon: -122.5, Distance: "10km"}, []string{"37,-123"}},
+		{"bbox", GeoQuery{BBox: &BoundingBox{MinLat: 37.2, MinLon: -122.8, MaxLat: 38.1, MaxLon: -122.1}}, []string{"37,-123", "38,-123"}},
+		{"antimeridian", GeoQuery{BBox: &BoundingBox{MinLat: 10.5, MinLon: 179.5, MaxLat: 10.6, MaxLon: 180.5}}, []string{"10,179", "10,-180"}},
+		{"too large", GeoQuery{Lat: 37.5, Lon: -122.5, Distance: "2000km"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := searchCacheCells(&tt.q)
+			if len(got) != len(tt.want) {
+				t.Fatalf("cells = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("cells = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
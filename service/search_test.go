@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// seedPosts stores posts around San Francisco and one in New York.
+func seedPosts(t *testing.T, s *testServer) {
+	t.Helper()
+	now := time.Now().UTC()
+	posts := map[string]*Post{
+		"near":  {User: "bob", Message: "Ferry building", Location: Location{Lat: 37.7955, Lon: -122.3937}, City: "San Francisco", Neighborhood: "Embarcadero", Timestamp: now, Status: STATUS_PUBLISHED},
+		"close": {User: "bob", Message: "Golden Gate", Location: Location{Lat: 37.8199, Lon: -122.4783}, City: "San Francisco", Neighborhood: "Presidio", Timestamp: now, Status: STATUS_PUBLISHED},
+		"draft": {User: "bob", Message: "draft", Location: Location{Lat: 37.7749, Lon: -122.4194}, City: "San Francisco", Timestamp: now, Status: STATUS_DRAFT},
+		"far":   {User: "bob", Message: "Times Square", Location: Location{Lat: 40.758, Lon: -73.9855}, City: "New York", Neighborhood: "Manhattan", Timestamp: now, Status: STATUS_PUBLISHED},
+	}
+	for id, p := range posts {
+		if err := s.Posts.Save(context.Background(), id, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func searchIds(t *testing.T, s *testServer, query string) []string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/search?v=2&"+query, nil)
+	w := s.do(authorized(t, r, "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var page PostPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if page.Total != int64(len(page.Posts)) {
+		t.Errorf("total = %d, got %d posts", page.Total, len(page.Posts))
+	}
+	var ids []string
+	for _, p := range page.Posts {
+		ids = append(ids, p.Id)
+	}
+	return ids
+}
+
+func TestHandleSearch(t *testing.T) {
+	s := newTestServer(t)
+	seedPosts(t, s)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"nearest first", "lat=37.7955&lon=-122.3937&range=20", []string{"near", "close"}},
+		{"within range", "lat=37.7955&lon=-122.3937&range=1", []string{"near"}},
+		{"meters", "lat=37.7955&lon=-122.3937&range=1000m", []string{"near"}},
+		{"miles", "lat=37.7955&lon=-122.3937&range=6mi", []string{"near", "close"}},
+		{"other coast", "lat=40.75&lon=-73.98&range=10", []string{"far"}},
+		{"place", "place=San+Francisco&range=20", []string{"near", "close"}},
+		{"in", "in=San+Francisco", []string{"near", "close"}},
+		{"in range", "in=San+Francisco&range=1", []string{}},
+		{"neighborhood around a point", "in=manhattan&lat=37.7955&lon=-122.3937", []string{"far"}},
+		{"in around a place", "in=presidio&place=San+Francisco&range=20", []string{"close"}},
+		{"in bbox", "in=presidio&bbox=37.7,-122.5,37.9,-122.3", []string{"close"}},
+		{"bbox", "bbox=37.8,-122.5,37.9,-122.4", []string{"close"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := searchIds(t, s, tt.query)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ids = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("ids = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSearchBadRequest(t *testing.T) {
+	s := newTestServer(t)
+	for _, query := range []string{
+		"lat=37.7&lon=-122.4&range=-5",
+		"lat=37.7&lon=-122.4&range=5ft",
+		"lat=37.7&lon=-122.4&range=NaN",
+		"lat=37.7&lon=-122.4&range=30000km",
+		"lat=37.7&lon=-122.4&limit=100000",
+		"bbox=37.8,-122.5,37.9,-122.4&lat=37.7",
+		"place=Atlantis",
+		"lat=37.7&lon=-122.4&since=2024-02-01T00:00:00Z&until=2024-01-01T00:00:00Z",
+	} {
+		r := httptest.NewRequest("GET", "/search?"+query, nil)
+		if w := s.do(authorized(t, r, "alice")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400: %s", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestHandleSearchErrorCodes(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		query, code string
+	}{
+		{"range=20", ERR_MISSING_COORDINATES},
+		{"lat=37.7", ERR_MISSING_COORDINATES},
+		{"lat=north&lon=-122.4", ERR_INVALID_LATITUDE},
+		{"lat=-90.5&lon=-122.4", ERR_INVALID_LATITUDE},
+		{"lat=37.7&lon=180.1", ERR_INVALID_LONGITUDE},
+		{"lat=37.7&lon=-122.4&range=far", ERR_INVALID_RANGE},
+		{"bbox=1,2,3", ERR_INVALID_BBOX},
+		{"lat=37.7&lon=-122.4&limit=0", ERR_INVALID_PAGINATION},
+		{"lat=37.7&lon=-122.4&since=yesterday", ERR_INVALID_TIME},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/search?"+tt.query, nil)
+		w := s.do(authorized(t, r, "alice"))
+		var body APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest || body.Code != tt.code {
+			t.Errorf("%s: %d %s, want 400 with code %s", tt.query, w.Code, w.Body, tt.code)
+		}
+	}
+}
+
+func TestHandlePostsDeltaErrorCodes(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		query, code string
+	}{
+		{"since=0", ERR_MISSING_COORDINATES},
+		{"since=0&lat=37.7", ERR_MISSING_COORDINATES},
+		{"since=0&lat=north&lon=-122.4", ERR_INVALID_LATITUDE},
+		{"since=0&lat=91&lon=-122.4", ERR_INVALID_LATITUDE},
+		{"since=0&lat=37.7&lon=east", ERR_INVALID_LONGITUDE},
+		{"since=0&lat=37.7&lon=-122.4&range=far", ERR_INVALID_RANGE},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/posts/delta?"+tt.query, nil)
+		w := s.do(authorized(t, r, "alice"))
+		var body APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest || body.Code != tt.code {
+			t.Errorf("%s: %d %s, want 400 with code %s", tt.query, w.Code, w.Body, tt.code)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		val, want string
+	}{
+		{"20", "20km"},
+		{"20km", "20km"},
+		{"500m", "0.5km"},
+		{"2.5 KM", "2.5km"},
+		{"3mi", "4.828032km"},
+	}
+	for _, tt := range tests {
+		if got, err := parseRange(tt.val); err != nil || got != tt.want {
+			t.Errorf("parseRange(%q) = %q, %v, want %q", tt.val, got, err, tt.want)
+		}
+	}
+	for _, val := range []string{"", "km", "0", "-1km", "5ft", "1e9m", "Inf"} {
+		if got, err := parseRange(val); err == nil {
+			t.Errorf("parseRange(%q) = %q, want an error", val, got)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// The operations shared by the HTTP and gRPC APIs. They take plain values
+// rather than requests, and fail with a ServiceError when the caller is at
+// fault, so each API can map the failure to its own status codes.
+
+// ServiceError is a failure with an HTTP status and a message meant for the
+// client. Any other error is an internal one. Failures with a Code are
+// answered over HTTP with an APIError body.
+type ServiceError struct {
+	Status  int
+	Code    string
+	Message string
+	// RetryAfter, when set, is sent as the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+func serviceError(status int, message string) *ServiceError {
+	return &ServiceError{Status: status, Message: message}
+}
+
+// writeServiceError answers an HTTP request that failed with err, using
+// internal as the message for internal errors.
+func writeServiceError(w http.ResponseWriter, err error, internal string) {
+	if serr, ok := err.(*ServiceError); ok {
+		if serr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(serr.RetryAfter.Seconds()))))
+		}
+		if serr.Code != "" {
+			writeAPIError(w, serr.Status, serr.Code, serr.Message)
+			return
+		}
+		http.Error(w, serr.Message, serr.Status)
+		return
+	}
+	http.Error(w, internal, http.StatusInternalServerError)
+}
+
+// NewPost is a post to be created. Media is its image or video, read from
+// the start and rewound as needed, unless MediaToken names media already
+// stored by POST /upload.
+type NewPost struct {
+	User         string
+	Message      string
+	Lang         string
+	Lat          float64
+	Lon          float64
+	Draft        bool
+	FuzzLocation bool
+	// TTL, when set, is how long after its creation the post expires.
+	TTL time.Duration
+	// PublishAt, when set, schedules the post, see startScheduler.
+	PublishAt *time.Time
+	// Channel, when set, is the id of the channel the post belongs to.
+	Channel string
+
+	MediaType string // MEDIA_IMAGE or MEDIA_VIDEO
+	Media     io.ReadSeeker
+	MediaSize int64
+	// MoreImages follow Media in a multi-image post, in order.
+	MoreImages []MediaFile
+
+	MediaToken string
+}
+
+// createPost validates, stores and publishes a new post.
+func (a *App) createPost(ctx context.Context, in *NewPost) (*Post, error) {
+	reqLog := logFor(ctx)
+
+	// filter spam
+	message, masked, ok := screenText(in.Message, in.Lang)
+	if !ok {
+		reqLog.Info("post rejected by spam filter", "user", in.User)
+		return nil, serviceError(http.StatusBadRequest, "Sorry, the post contains filtered words. Please edit again. ")
+	}
+	if in.Media == nil && in.MediaToken == "" {
+		return nil, serviceError(http.StatusBadRequest, "Image or video is not available")
+	}
+	if err := validateLocation(Location{Lat: in.Lat, Lon: in.Lon}); err != nil {
+		return nil, err
+	}
+	if in.Channel != "" {
+		if _, err := channelOfPost(ctx, in.Channel, Location{Lat: in.Lat, Lon: in.Lon}); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	p := &Post{
+		User:     in.User,
+		Message:  message,
+		Masked:   masked,
+		Hashtags: extractHashtags(message),
+		Location: Location{
+			Lat: in.Lat,
+			Lon: in.Lon,
+		},
+		Timestamp: now,
+		UpdatedAt: now,
+		Status:    STATUS_PUBLISHED,
+		Lang:      in.Lang,
+		MediaType: in.MediaType,
+		Channel:   in.Channel,
+	}
+	if in.Draft {
+		p.Status = STATUS_DRAFT
+	}
+	if in.PublishAt != nil {
+		if in.Draft {
+			return nil, invalidParam(ERR_INVALID_PUBLISH_AT, "a draft can't be scheduled, publish it instead")
+		}
+		p.Status = STATUS_SCHEDULED
+		p.PublishAt = in.PublishAt
+	}
+	if in.TTL > 0 {
+		// stories of scheduled posts run from their publication
+		expires := now.Add(in.TTL)
+		if p.PublishAt != nil {
+			expires = p.PublishAt.Add(in.TTL)
+		}
+		p.ExpiresAt = &expires
+	}
+
+	// fuzz the indexed location once, at write time, so it is stable
+	if in.FuzzLocation {
+		exact := p.Location
+		p.FuzzLocation = true
+		p.ExactLocation = &exact
+		p.Location = fuzzLocation(exact, LOCATION_FUZZ_RADIUS_METERS)
+	}
+	a.enrichPlace(ctx, p)
+
+	if in.MediaToken != "" {
+		// before the upload is claimed, which a refused post would waste
+		if err := a.takePostQuota(ctx, in.User, 1, now); err != nil {
+			return nil, err
+		}
+		upload, err := claimUpload(ctx, in.MediaToken, in.User)
+		if err != nil {
+			return nil, err
+		}
+		p.Id = uuid.New()
+		upload.attach(p)
+		return a.savePost(ctx, p, upload.ContentType)
+	}
+
+	var contentType string
+	var err error
+	switch p.MediaType {
+	case MEDIA_IMAGE:
+		contentType, err = checkImage(in.Media, in.MediaSize)
+		if err == nil {
+			in.Media, in.MediaSize, contentType, err = sanitizeImage(in.Media, contentType)
+		}
+		if err != nil {
+			reqLog.Warn("rejected image", "err", err)
+			if status := imageErrorStatus(err); status != http.StatusInternalServerError {
+				return nil, serviceError(status, err.Error())
+			}
+			return nil, err
+		}
+		if err := a.analyzeImage(ctx, p, in.Media, in.MediaSize); err != nil {
+			return nil, err
+		}
+		if err := a.checkMoreImages(ctx, p, in); err != nil {
+			return nil, err
+		}
+	case MEDIA_VIDEO:
+		contentType, err = detectVideoType(in.Media)
+		if err != nil {
+			reqLog.Warn("failed to read video", "err", err)
+			return nil, serviceError(http.StatusBadRequest, "Failed to read video")
+		}
+		if contentType == "" {
+			return nil, serviceError(http.StatusUnsupportedMediaType, "Unsupported video format, upload MP4, QuickTime or WebM")
+		}
+	default:
+		return nil, serviceError(http.StatusBadRequest, fmt.Sprintf("Unknown media type %q", p.MediaType))
+	}
+
+	// only a valid post counts, before its media is stored
+	if err := a.takePostQuota(ctx, in.User, 1, now); err != nil {
+		return nil, err
+	}
+	id := uuid.New()
+	p.Id = id
+	if len(in.MoreImages) > 0 {
+		images := append([]MediaFile{{Media: in.Media, Size: in.MediaSize, ContentType: contentType}}, in.MoreImages...)
+		p.Images, err = a.putImages(ctx, id, images)
+		if err != nil {
+			reqLog.Error("failed to save images", "id", id, "err", err)
+			return nil, err
+		}
+		p.Url, p.MediaKey, p.Thumbnails = p.Images[0].Url, p.Images[0].Key, p.Images[0].Thumbnails
+		return a.savePost(ctx, p, contentType)
+	}
+	if a.Uploads != nil {
+		upload, err := a.Uploads.stage(id, p.MediaType, contentType, in.Media, in.MediaSize)
+		if err == nil {
+			return a.createPendingPost(ctx, p, upload)
+		}
+		reqLog.Warn("failed to stage media, uploading inline", "id", id, "err", err)
+	}
+	url, _, err := a.Blobs.Put(ctx, id, in.Media, &PutOptions{
+		ContentType: contentType,
+		Size:        in.MediaSize,
+	})
+	if err != nil {
+		reqLog.Error("failed to save media", "media_type", p.MediaType, "err", err)
+		return nil, fmt.Errorf("save %s: %v", p.MediaType, err)
+	}
+	p.Url = url
+	p.MediaKey = id
+
+	// a post without thumbnails is still usable, clients fall back to the url
+	if p.MediaType == MEDIA_IMAGE {
+		p.Thumbnails, err = a.putThumbnails(ctx, id, in.Media)
+		if err != nil {
+			reqLog.Warn("failed to generate thumbnails", "id", id, "err", err)
+		}
+	}
+	return a.savePost(ctx, p, contentType)
+}
+
+// savePost stores and publishes the new post p, whose media of contentType
+// is stored already, or queues it with an INGEST_QUEUE. The media is
+// deleted if p can't be saved.
+func (a *App) savePost(ctx context.Context, p *Post, contentType string) (*Post, error) {
+	if a.Ingest != nil {
+		return a.queuePost(ctx, p, contentType)
+	}
+	reqLog := logFor(ctx)
+	id := p.Id
+
+	if err := a.Posts.Save(ctx, id, p); err != nil {
+		// don't leave world-readable images behind for a post that doesn't exist
+		for _, key := range mediaKeys(p) {
+			if err := a.Blobs.Delete(context.Background(), key); err != nil {
+				reqLog.Error("failed to clean up image", "id", id, "key", key, "err", err)
+			}
+		}
+		reqLog.Error("failed to save post to ElasticSearch", "id", id, "err", err)
+		return nil, err
+	}
+	reqLog.Info("saved post", "id", id, "user", p.User, "status", p.Status)
+	return a.finishPost(ctx, p, contentType), nil
+}
+
+// finishPost does what follows the indexing of the new post p: it records
+// its media, tells live clients and followers about it and writes it to
+// BigTable. It returns a signed copy of p.
+func (a *App) finishPost(ctx context.Context, p *Post, contentType string) *Post {
+	go saveMediaRefs(p)
+	if p.MediaType == MEDIA_VIDEO {
+		go triggerTranscode(p, contentType)
+	}
+
+	// hand out a signed copy, the goroutines above still read p
+	out := []Post{*p}
+	signMediaURLs(out)
+	if p.Status == STATUS_PUBLISHED {
+		a.Live.Publish(out[0])
+		a.invalidateSearchCache(ctx, p)
+		notifyNearbyFollowers(p)
+	}
+
+	if ENABLE_BIGTABLE {
+		saveToBigTable(p, p.Id)
+	}
+	trackPostCreated(p)
+	return &out[0]
+}
+
+// announcePost tells live clients, the search cache and nearby followers
+// about p, just published.
+func (a *App) announcePost(ctx context.Context, p *Post) {
+	out := []Post{*p}
+	signMediaURLs(out)
+	a.Live.Publish(out[0])
+	a.invalidateSearchCache(ctx, p)
+	notifyNearbyFollowers(p)
+}
+
+// searchPosts returns a page of the published posts matching q, nearest
+// first, as viewer may see them, and the total number of matches.
+func (a *App) searchPosts(ctx context.Context, q *GeoQuery, viewer string) ([]Post, int64, error) {
+	if q.Offset < 0 || q.Limit < 0 || q.Limit > MAX_PAGE_SIZE {
+		return nil, 0, serviceError(http.StatusBadRequest, "limit should be between 1 and "+strconv.Itoa(MAX_PAGE_SIZE))
+	}
+	if q.Offset+q.Limit > MAX_RESULT_WINDOW {
+		return nil, 0, serviceError(http.StatusBadRequest, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW))
+	}
+	if km, err := parseKm(q.Distance); err != nil || km <= 0 {
+		return nil, 0, serviceError(http.StatusBadRequest, "range should be a positive number of km")
+	}
+	if err := validateLocation(Location{Lat: q.Lat, Lon: q.Lon}); err != nil {
+		return nil, 0, err
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && q.Until.Before(q.Since) {
+		return nil, 0, invalidParam(ERR_INVALID_TIME, "until should not be before since")
+	}
+
+	hidden, err := hiddenUsers(ctx, viewer)
+	if err != nil {
+		return nil, 0, err
+	}
+	q.Exclude = hidden
+
+	posts, total, err := a.cachedSearch(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	trackSearch(q, viewer, total)
+
+	redactPosts(posts, viewer)
+	signMediaURLs(posts)
+	if err := annotateLikes(ctx, posts, viewer); err != nil {
+		logFor(ctx).Warn("failed to read likes", "err", err)
+	}
+	return posts, total, nil
+}
+
+// signup creates an account for user with the ROLE_USER role.
+func signup(user User) error {
+	fmt.Printf("Signup of %s\n", user.Username)
+	// "me" is taken by the /user/me routes
+	if user.Username == "" || user.Password == "" || len(user.Password) > MAX_PASSWORD_BYTES || !usernamePattern.MatchString(user.Username) || user.Username == "me" {
+		fmt.Printf("Invalid username or password. Username should be characters from a-z, 0-9 \n")
+		return serviceError(http.StatusBadRequest, "Invalid username or password")
+	}
+
+	// roles are granted by operators, never chosen at signup
+	user.Role = ROLE_USER
+	// profile fields are validated by PUT /user/me
+	user.DisplayName, user.AvatarURL, user.Bio = "", "", ""
+
+	if user.Email != "" || mailer != nil {
+		if err := validateEmail(user.Email); err != nil {
+			return serviceError(http.StatusBadRequest, err.Error())
+		}
+	}
+	user.VerificationPending, user.EmailVerified = mailer != nil, false
+	user.ResetTokenHash, user.ResetExpiresAt = "", nil
+
+	if err := addUser(user); err != nil {
+		if err.Error() == "User already exists" {
+			return serviceError(http.StatusBadRequest, "User already exists")
+		}
+		return err
+	}
+	if user.VerificationPending {
+		sendVerification(&user)
+	}
+	return nil
+}
+
+// login checks the credentials and returns the account they belong to.
+// Callers issue the tokens.
+func login(username, password string) (*User, error) {
+	account, err := checkUser(username, password)
+	if err != nil {
+		if err == errWrongPassword {
+			return nil, serviceError(http.StatusUnauthorized, "Wrong username or password")
+		}
+		return nil, err
+	}
+	if bans.Banned(account.Username) {
+		return nil, serviceError(http.StatusForbidden, errUserBanned.Error())
+	}
+	if account.VerificationPending {
+		sendVerification(account)
+		return nil, errEmailNotVerified
+	}
+	return account, nil
+}
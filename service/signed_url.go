@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SIGNED_URL_CACHE_SIZE bounds the signed URLs kept for reuse. Signing can
+// be a remote call, e.g. to the IAM API when GCS credentials have no key.
+const SIGNED_URL_CACHE_SIZE = 10000
+
+// mediaSigner signs the media URLs handed to clients when
+// SIGNED_MEDIA_URLS is set. It is the App's BlobStore, set by newApp.
+var mediaSigner BlobStore
+
+var signedURLs = struct {
+	sync.Mutex
+	entries map[string]signedURL
+}{entries: make(map[string]signedURL)}
+
+type signedURL struct {
+	url     string
+	expires time.Time
+}
+
+// signMediaURLs replaces the stored media and thumbnail URLs of posts with
+// fresh signed URLs, keyed by their blob keys. Posts read from a store
+// keep their unsigned URLs, so call it right before handing posts out.
+func signMediaURLs(posts []Post) {
+	if !SIGNED_MEDIA_URLS || mediaSigner == nil {
+		return
+	}
+	for i := range posts {
+		p := &posts[i]
+		// the thumbnails and images may be shared with a stored copy of
+		// the post
+		p.Thumbnails = append([]Thumbnail(nil), p.Thumbnails...)
+		p.Images = append([]PostImage(nil), p.Images...)
+		for j := range p.Images {
+			p.Images[j].Thumbnails = append([]Thumbnail(nil), p.Images[j].Thumbnails...)
+		}
+		for _, key := range mediaKeys(p) {
+			url, err := signMediaURL(key)
+			if err != nil {
+				fmt.Printf("Failed to sign URL of %s %v.\n", key, err)
+				continue
+			}
+			setMediaURL(p, key, url)
+		}
+	}
+}
+
+// signMediaURL returns a signed URL for key, reusing one signed less than
+// half of SIGNED_URL_EXPIRY ago so clients always get some time to use it.
+func signMediaURL(key string) (string, error) {
+	now := time.Now()
+	signedURLs.Lock()
+	entry, ok := signedURLs.entries[key]
+	signedURLs.Unlock()
+	if ok && now.Add(SIGNED_URL_EXPIRY/2).Before(entry.expires) {
+		return entry.url, nil
+	}
+
+	url, err := mediaSigner.SignedURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	signedURLs.Lock()
+	defer signedURLs.Unlock()
+	if len(signedURLs.entries) >= SIGNED_URL_CACHE_SIZE {
+		signedURLs.entries = make(map[string]signedURL)
+	}
+	signedURLs.entries[key] = signedURL{url: url, expires: now.Add(SIGNED_URL_EXPIRY)}
+	return url, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Tokens are signed with HS256. With SigningKeys set, the first key signs
+// and every key verifies; tokens name their key in the `kid` header, so a
+// key can be rotated by putting a new one first and dropping the old one
+// once its tokens have expired. SIGNING_KEYS_FILE, a YAML list of keys such
+// as a secret mounted from a secret manager, replaces SigningKeys and is
+// reloaded when it changes. Tokens without a `kid`, issued before
+// rotation, verify with the legacy signing_key.
+var SIGNING_KEYS_FILE = ""
+
+const (
+	SIGNING_KEYS_RELOAD_INTERVAL = time.Minute
+	// MIN_SIGNING_KEY_BYTES is the size of an HS256 hash; shorter keys are
+	// easier to guess than the signature.
+	MIN_SIGNING_KEY_BYTES = 32
+)
+
+var signingKeyIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// SigningKey is a named key; the name goes into the `kid` header.
+type SigningKey struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+// Keyring holds the keys tokens are signed and verified with.
+type Keyring struct {
+	mu     sync.RWMutex
+	active string // id of the signing key, "" to sign with legacy
+	keys   map[string][]byte
+	legacy []byte // verifies tokens without a kid, nil to refuse them
+}
+
+var signingKeys = &Keyring{legacy: []byte(SECRET)}
+
+// validateSigningKeys checks a list of keys before it is used.
+func validateSigningKeys(keys []SigningKey) error {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !signingKeyIdPattern.MatchString(k.ID) {
+			return fmt.Errorf("signing key id %q should be letters, digits, '.', '_' or '-'", k.ID)
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("signing key id %q is used twice", k.ID)
+		}
+		seen[k.ID] = true
+		if len(k.Key) < MIN_SIGNING_KEY_BYTES {
+			return fmt.Errorf("signing key %q should have at least %d bytes", k.ID, MIN_SIGNING_KEY_BYTES)
+		}
+	}
+	return nil
+}
+
+// set replaces all keys: the first of keys signs, or legacy when there
+// are none. An empty legacy refuses tokens without a kid.
+func (k *Keyring) set(keys []SigningKey, legacy string) {
+	k.mu.Lock()
+	k.legacy = nil
+	if legacy != "" {
+		k.legacy = []byte(legacy)
+	}
+	k.mu.Unlock()
+	k.setKeys(keys)
+}
+
+// setKeys replaces the keys with a kid, keeping the legacy key.
+func (k *Keyring) setKeys(keys []SigningKey) {
+	byId := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		byId[key.ID] = []byte(key.Key)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.active = byId, ""
+	if len(keys) > 0 {
+		k.active = keys[0].ID
+	}
+}
+
+// ids returns the id of the signing key and of all keys.
+func (k *Keyring) ids() (string, []string) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	return k.active, ids
+}
+
+// sign signs claims with the active key.
+func (k *Keyring) sign(claims jwt.MapClaims) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if k.active == "" {
+		return token.SignedString(k.legacy)
+	}
+	token.Header["kid"] = k.active
+	return token.SignedString(k.keys[k.active])
+}
+
+// key returns the key that verifies token, as a jwt.Keyfunc.
+func (k *Keyring) key(token *jwt.Token) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	kid, ok := token.Header["kid"]
+	if !ok {
+		if k.legacy == nil {
+			return nil, errors.New("token has no key id")
+		}
+		return k.legacy, nil
+	}
+	id, _ := kid.(string)
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	return key, nil
+}
+
+// parseToken verifies a token issued by the service, with keyFunc picking
+// the key.
+func parseToken(tokenString string, keyFunc jwt.Keyfunc) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired())
+}
+
+// setupSigningKeys loads SIGNING_KEYS_FILE, if set, and reloads it when it
+// changes. A file that fails to load later keeps the keys loaded last.
+func setupSigningKeys() error {
+	if SIGNING_KEYS_FILE == "" {
+		return nil
+	}
+	version, err := loadSigningKeys(SIGNING_KEYS_FILE, "")
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(SIGNING_KEYS_RELOAD_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			loaded, err := loadSigningKeys(SIGNING_KEYS_FILE, version)
+			if err != nil {
+				fmt.Printf("Failed to reload signing keys from %s %v.\n", SIGNING_KEYS_FILE, err)
+				continue
+			}
+			if loaded != version {
+				version = loaded
+				active, _ := signingKeys.ids()
+				fmt.Printf("Reloaded signing keys from %s, signing with %s\n", SIGNING_KEYS_FILE, active)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadSigningKeys reads the keys at path into signingKeys unless the file
+// is still at version, and returns the version it read.
+func loadSigningKeys(path, version string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return version, err
+	}
+	current := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	if current == version {
+		return version, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return version, err
+	}
+	var keys []SigningKey
+	if err := yaml.UnmarshalStrict(data, &keys); err != nil {
+		return version, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(keys) == 0 {
+		return version, fmt.Errorf("%s: no signing keys", path)
+	}
+	if err := validateSigningKeys(keys); err != nil {
+		return version, fmt.Errorf("%s: %v", path, err)
+	}
+	signingKeys.setKeys(keys)
+	return current, nil
+}
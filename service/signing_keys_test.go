@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	keyA = SigningKey{ID: "a", Key: strings.Repeat("a", MIN_SIGNING_KEY_BYTES)}
+	keyB = SigningKey{ID: "b", Key: strings.Repeat("b", MIN_SIGNING_KEY_BYTES)}
+)
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{"username": "alice", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	k := &Keyring{}
+	k.set(nil, "legacy secret")
+	legacy, err := k.sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.set([]SigningKey{keyA}, "legacy secret")
+	old, _ := k.sign(testClaims())
+	k.set([]SigningKey{keyB, keyA}, "legacy secret")
+	current, _ := k.sign(testClaims())
+
+	for name, token := range map[string]string{"legacy": legacy, "old": old, "current": current} {
+		if _, err := parseToken(token, k.key); err != nil {
+			t.Errorf("%s token rejected after rotation: %v", name, err)
+		}
+	}
+	parsed, _ := parseToken(current, k.key)
+	if kid := parsed.Header["kid"]; kid != "b" {
+		t.Errorf("kid = %v, want b", kid)
+	}
+
+	// dropping a key, or the legacy key, refuses its tokens
+	k.set([]SigningKey{keyB}, "")
+	for name, token := range map[string]string{"legacy": legacy, "old": old} {
+		if _, err := parseToken(token, k.key); err == nil {
+			t.Errorf("%s token accepted after its key was dropped", name)
+		}
+	}
+	if _, err := parseToken(current, k.key); err != nil {
+		t.Errorf("current token rejected: %v", err)
+	}
+}
+
+func TestValidateSigningKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []SigningKey
+		ok   bool
+	}{
+		{"valid", []SigningKey{keyA, keyB}, true},
+		{"duplicate id", []SigningKey{keyA, keyA}, false},
+		{"bad id", []SigningKey{{ID: "a b", Key: keyA.Key}}, false},
+		{"short key", []SigningKey{{ID: "a", Key: "short"}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateSigningKeys(tt.keys); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	saved := signingKeys
+	signingKeys = &Keyring{}
+	defer func() { signingKeys = saved }()
+
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("- id: a\n  key: " + keyA.Key + "\n")
+	version, err := loadSigningKeys(path, "")
+	if err != nil {
+		t.Fatalf("loadSigningKeys: %v", err)
+	}
+	if active, _ := signingKeys.ids(); active != "a" {
+		t.Errorf("active = %q, want a", active)
+	}
+
+	// a broken file keeps the keys loaded last
+	write("- id: b\n  key: short\n")
+	if _, err := loadSigningKeys(path, version); err == nil {
+		t.Error("loaded a short key")
+	}
+	if active, _ := signingKeys.ids(); active != "a" {
+		t.Errorf("active = %q after a failed load, want a", active)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	// ElasticSearch operations slower than this are counted and logged.
+	SLOW_QUERY_THRESHOLD_MS = 500
+	// Fraction of slow operations that are logged; all of them are counted.
+	SLOW_QUERY_LOG_SAMPLE_RATE = 1.0
+)
+
+// observeQuery reports an ElasticSearch operation that took tookMs
+// milliseconds; operation names the kind of call (search, count,
+// aggregation, index, ...) and params what it was asked for. Slow
+// operations are logged with the request id of ctx; all of them are
+// recorded in the ElasticSearch latency histogram.
+func observeQuery(ctx context.Context, operation string, tookMs int64, params map[string]interface{}) {
+	esDuration.WithLabelValues(operation).Observe(float64(tookMs) / 1000)
+	if tookMs < SLOW_QUERY_THRESHOLD_MS {
+		return
+	}
+	stats.recordSlowQuery(operation)
+
+	if rand.Float64() >= SLOW_QUERY_LOG_SAMPLE_RATE {
+		return
+	}
+	logFor(ctx).Warn("slow ElasticSearch query",
+		"operation", operation,
+		"took_ms", tookMs,
+		"params", params)
+}
+
+// sinceMillis is the wall time in milliseconds since start, for calls whose
+// response doesn't report how long they took.
+func sinceMillis(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
@@ -1,19 +1,153 @@
 package main
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
 
-func hasFilteredWord(s *string) bool {
-	filterWords := []string{
-		"fck",
-		"fuck",
-		"Damn",
-		// could be more....
+	"github.com/gorilla/mux"
+)
+
+// FILTER_MODE decides what happens to text the moderation engine flags:
+// "reject" refuses new posts and hides stored ones, "mask" accepts them with
+// the offending words replaced by asterisks.
+const (
+	FILTER_MODE_REJECT = "reject"
+	FILTER_MODE_MASK   = "mask"
+
+	FILTER_MODE = FILTER_MODE_REJECT
+)
+
+var langPattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// screenText applies FILTER_MODE to user-written text. It returns the text
+// to store, whether it was masked, and false if the text must be rejected.
+// Text flagged as a whole can't be masked and is rejected in either mode.
+func screenText(s string, lang string) (string, bool, bool) {
+	result := checkText(s, lang)
+	if !result.Flagged {
+		return s, false, true
+	}
+	if FILTER_MODE == FILTER_MODE_MASK && len(result.Matches) > 0 {
+		return maskMatches(s, result.Matches), true, true
+	}
+	return s, false, false
+}
+
+// maskText masks the offending words of s, for fragments of text that was
+// masked when stored.
+func maskText(s string, lang string) string {
+	return maskMatches(s, checkText(s, lang).Matches)
+}
+
+// screenPost applies FILTER_MODE to a stored post on its way to a client,
+// returning false if it must be hidden. Engines too slow to run on every
+// read only judge posts when they are written.
+func screenPost(p *Post) bool {
+	if !moderationOnRead {
+		return true
+	}
+	message, masked, ok := screenText(p.Message, p.Lang)
+	if !ok {
+		return false
+	}
+	if masked {
+		p.Message = message
+		p.Masked = true
+		p.Hashtags = extractHashtags(message)
+	}
+	return true
+}
+
+// postLanguage returns the language of a new post: the explicit `lang` form
+// value if given, otherwise the primary language of the Accept-Language
+// header, or "" when neither names a valid language.
+func postLanguage(r *http.Request) string {
+	if lang := normalizeLang(r.FormValue("lang")); lang != "" {
+		return lang
+	}
+	first := strings.SplitN(r.Header.Get("Accept-Language"), ",", 2)[0]
+	return normalizeLang(strings.SplitN(first, ";", 2)[0])
+}
+
+// normalizeLang reduces a language tag like "es-MX" to "es".
+func normalizeLang(tag string) string {
+	lang := strings.ToLower(strings.TrimSpace(strings.SplitN(tag, "-", 2)[0]))
+	if !langPattern.MatchString(lang) {
+		return ""
+	}
+	return lang
+}
+
+// activeWordlist returns the wordlist engine, or writes a 409 and returns
+// nil when another engine is in use.
+func activeWordlist(w http.ResponseWriter) *wordlistModeration {
+	wl, ok := moderation.(*wordlistModeration)
+	if !ok {
+		http.Error(w, "Word lists are only used by the wordlist moderation engine", http.StatusConflict)
+		return nil
+	}
+	return wl
+}
+
+// handleGetFilters returns every word list keyed by language.
+func handleGetFilters(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for filter lists")
+	w.Header().Set("Content-Type", "application/json")
+
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	wl := activeWordlist(w)
+	if wl == nil {
+		return
 	}
 
-	for _, word := range filterWords {
-		if strings.Contains(*s, word) {
-			return true
-		}
+	js, err := json.Marshal(wl.lists())
+	if err != nil {
+		http.Error(w, "Failed to parse filters into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse filters into JSON format %v.\n", err)
+		return
 	}
-	return false
+
+	w.Write(js)
+}
+
+// handlePutFilter replaces the word list of one language, or of every
+// language when lang is "*". An empty list removes the language. Changes
+// only reach this instance, and are lost when MODERATION_SOURCE is
+// reloaded.
+func handlePutFilter(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for updating a filter list")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireAdmin(w, r)
+	if claims == nil {
+		return
+	}
+	wl := activeWordlist(w)
+	if wl == nil {
+		return
+	}
+
+	lang := mux.Vars(r)["lang"]
+	if lang != UNIVERSAL_FILTER && !langPattern.MatchString(lang) {
+		http.Error(w, "Invalid language", http.StatusBadRequest)
+		return
+	}
+
+	var words []string
+	if err := json.NewDecoder(r.Body).Decode(&words); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	cleaned := cleanWords(words)
+	wl.set(lang, cleaned)
+
+	writeAudit(claims.Username, "update_filter", map[string]interface{}{"lang": lang, "words": len(cleaned)})
+	w.Write([]byte("Filter list updated successfully."))
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServiceStats holds operator-facing runtime statistics served by /stats.
+type ServiceStats struct {
+	mu                 sync.Mutex
+	startedAt          time.Time
+	forcemergeLastRun  time.Time
+	forcemergeDuration time.Duration
+	slowQueries        map[string]int64
+	archiveLastRun     time.Time
+	archiveLast        ArchiveRun
+}
+
+// StatsSnapshot is the JSON shape of /stats.
+type StatsSnapshot struct {
+	StartedAt   time.Time        `json:"started_at"`
+	Forcemerge  *ForcemergeStats `json:"forcemerge"`
+	SlowQueries map[string]int64 `json:"slow_queries"`
+	Live        *LiveStats       `json:"live"`
+	Archive     *ArchiveStats    `json:"archive"`
+}
+
+type ArchiveStats struct {
+	Enabled bool        `json:"enabled"`
+	LastRun *time.Time  `json:"last_run,omitempty"`
+	Result  *ArchiveRun `json:"result,omitempty"`
+}
+
+type ForcemergeStats struct {
+	Enabled    bool       `json:"enabled"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	DurationMs int64      `json:"duration_ms"`
+}
+
+var stats = &ServiceStats{
+	startedAt:   time.Now().UTC(),
+	slowQueries: make(map[string]int64),
+}
+
+func (s *ServiceStats) recordSlowQuery(operation string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slowQueries[operation]++
+}
+
+func (s *ServiceStats) recordForcemerge(start time.Time, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forcemergeLastRun = start.UTC()
+	s.forcemergeDuration = took
+}
+
+func (s *ServiceStats) recordArchive(start time.Time, run *ArchiveRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archiveLastRun = start.UTC()
+	s.archiveLast = *run
+}
+
+func (s *ServiceStats) lastForcemerge() (time.Time, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forcemergeLastRun, s.forcemergeDuration
+}
+
+func (s *ServiceStats) snapshot() *StatsSnapshot {
+	lastRun, took := s.lastForcemerge()
+	snapshot := &StatsSnapshot{
+		StartedAt: s.startedAt,
+		Forcemerge: &ForcemergeStats{
+			Enabled:    ENABLE_FORCEMERGE,
+			DurationMs: int64(took / time.Millisecond),
+		},
+	}
+	if !lastRun.IsZero() {
+		snapshot.Forcemerge.LastRun = &lastRun
+	}
+
+	s.mu.Lock()
+	snapshot.Archive = &ArchiveStats{Enabled: flags.Enabled(FLAG_ARCHIVAL)}
+	if !s.archiveLastRun.IsZero() {
+		lastRun, result := s.archiveLastRun, s.archiveLast
+		snapshot.Archive.LastRun = &lastRun
+		snapshot.Archive.Result = &result
+	}
+	snapshot.SlowQueries = make(map[string]int64, len(s.slowQueries))
+	for operation, count := range s.slowQueries {
+		snapshot.SlowQueries[operation] = count
+	}
+	s.mu.Unlock()
+	return snapshot
+}
+
+func (a *App) handleStats(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for stats")
+	w.Header().Set("Content-Type", "application/json")
+
+	snapshot := stats.snapshot()
+	snapshot.Live = a.Live.Stats()
+
+	js, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "Failed to parse stats into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse stats into JSON format %v.\n", err)
+		return
+	}
+
+	w.Write(js)
+}
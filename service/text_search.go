@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Full-text search over post messages. Matched terms are returned as
+// highlighted fragments, HTML-escaped with the matches wrapped in <em>.
+const (
+	MAX_TEXT_QUERY_CHARS          = 200
+	TEXT_HIGHLIGHT_FRAGMENTS      = 3
+	TEXT_HIGHLIGHT_FRAGMENT_CHARS = 100
+)
+
+// handleTextSearch returns the posts whose message matches q, best match
+// first. lat and lon, when both given, restrict the search to range km
+// (DISTANCE by default) around that point.
+func handleTextSearch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for text search")
+	w.Header().Set("Content-Type", "application/json")
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || len(q) > MAX_TEXT_QUERY_CHARS {
+		http.Error(w, "q should be between 1 and "+strconv.Itoa(MAX_TEXT_QUERY_CHARS)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	var geo *GeoQuery
+	if r.URL.Query().Get("lat") != "" && r.URL.Query().Get("lon") != "" {
+		lat, err1 := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		lon, err2 := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "lat and lon should be numbers", http.StatusBadRequest)
+			return
+		}
+		ran, err := rangeParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		geo = &GeoQuery{Lat: lat, Lon: lon, Distance: ran}
+	}
+
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readTextSearchFromES(q, geo, hidden, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		return
+	}
+
+	viewer := viewerName(r)
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+	if err := annotateLikes(r.Context(), page.Posts, viewer); err != nil {
+		fmt.Printf("Failed to read likes %v.\n", err)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+func readTextSearchFromES(q string, geo *GeoQuery, hidden []string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	query := elastic.NewBoolQuery().Must(elastic.NewMatchQuery("message", q).Operator("and"))
+	if geo != nil {
+		query = query.Filter(newGeoDistanceQuery(geo.Lat, geo.Lon, geo.Distance))
+	}
+	highlight := elastic.NewHighlight().
+		Field("message").
+		Encoder("html").
+		NumOfFragments(TEXT_HIGHLIGHT_FRAGMENTS).
+		FragmentSize(TEXT_HIGHLIGHT_FRAGMENT_CHARS)
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(publicPostsQuery(excludeUsers(query, hidden))).
+		Highlight(highlight).
+		SortBy(elastic.NewScoreSort(), elastic.NewFieldSort("timestamp").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
+	observeQuery(context.Background(), "text_search", searchResult.TookInMillis, map[string]interface{}{"q": q, "offset": offset, "limit": limit})
+
+	highlights := make(map[string][]string)
+	for _, hit := range searchResult.Hits.Hits {
+		highlights[hit.Id] = hit.Highlight["message"]
+	}
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if !screenPost(&p) {
+			continue
+		}
+		for _, fragment := range highlights[p.Id] {
+			if p.Masked {
+				fragment = maskText(fragment, p.Lang)
+			}
+			p.Highlights = append(p.Highlights, fragment)
+		}
+		page.Posts = append(page.Posts, p)
+	}
+	return page, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// Thumbnails let feed views skip the full-size image. Every uploaded image
+// is scaled down to each of THUMBNAIL_SIZES, keeping its aspect ratio, and
+// stored as a JPEG next to the original. Images that are already narrower
+// than a size don't get that thumbnail; clients fall back to the original.
+var THUMBNAIL_SIZES = []ThumbnailSize{
+	{Name: "small", Width: 200},
+	{Name: "medium", Width: 800},
+}
+
+const (
+	THUMBNAIL_JPEG_QUALITY = 80
+	// larger images are stored without thumbnails rather than decoded
+	THUMBNAIL_MAX_PIXELS = 50 * 1000 * 1000
+)
+
+type ThumbnailSize struct {
+	Name  string
+	Width int
+}
+
+// Thumbnail is a scaled-down copy of a post's image.
+type Thumbnail struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Url    string `json:"url"`
+	Key    string `json:"key"` // blob store key
+}
+
+func thumbnailKey(mediaKey string, size ThumbnailSize) string {
+	return fmt.Sprintf("%s_%s", mediaKey, size.Name)
+}
+
+// putThumbnails decodes the image in src and stores its thumbnails under
+// keys derived from mediaKey. Either every thumbnail is stored or none is.
+func (a *App) putThumbnails(ctx context.Context, mediaKey string, src io.ReadSeeker) ([]Thumbnail, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > THUMBNAIL_MAX_PIXELS {
+		return nil, fmt.Errorf("image of %dx%d is too large for thumbnails", config.Width, config.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var thumbnails []Thumbnail
+	for _, size := range THUMBNAIL_SIZES {
+		bounds := img.Bounds()
+		if bounds.Dx() <= size.Width {
+			continue
+		}
+		height := bounds.Dy() * size.Width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+
+		// JPEG has no alpha, so transparent pixels are flattened onto white
+		dst := image.NewRGBA(image.Rect(0, 0, size.Width, height))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: THUMBNAIL_JPEG_QUALITY}); err != nil {
+			a.deleteThumbnails(thumbnails)
+			return nil, err
+		}
+		key := thumbnailKey(mediaKey, size)
+		url, _, err := a.Blobs.Put(ctx, key, &buf, &PutOptions{
+			ContentType: "image/jpeg",
+			Size:        int64(buf.Len()),
+		})
+		if err != nil {
+			a.deleteThumbnails(thumbnails)
+			return nil, err
+		}
+		thumbnails = append(thumbnails, Thumbnail{
+			Name:   size.Name,
+			Width:  size.Width,
+			Height: height,
+			Url:    url,
+			Key:    key,
+		})
+	}
+	return thumbnails, nil
+}
+
+func (a *App) deleteThumbnails(thumbnails []Thumbnail) {
+	for _, t := range thumbnails {
+		if err := a.Blobs.Delete(context.Background(), t.Key); err != nil {
+			fmt.Printf("Failed to clean up thumbnail %s %v.\n", t.Key, err)
+		}
+	}
+}
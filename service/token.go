@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/olivere/elastic/v7"
+)
+
+// Clients that negotiate API_V2 at /login get a short-lived access token
+// and a refresh token. The refresh token is an opaque random string; only
+// its SHA-256 is stored, in REFRESH_TOKEN_INDEX, so it can be revoked by
+// POST /logout. Every refresh rotates it. API_V1 clients keep getting a
+// single LEGACY_TOKEN_TTL access token as plain text.
+const (
+	ACCESS_TOKEN_TTL  = 15 * time.Minute
+	REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+	LEGACY_TOKEN_TTL  = 24 * time.Hour
+
+	REFRESH_TOKEN_INDEX = "refresh_token"
+	REFRESH_TOKEN_BYTES = 32
+)
+
+const REFRESH_TOKEN_MAPPING = `{
+    "mappings": {
+        "properties": {
+            "username": {
+                "type": "keyword"
+            },
+            "expires_at": {
+                "type": "date"
+            }
+        }
+    }
+}`
+
+var errInvalidRefreshToken = errors.New("Invalid or expired refresh token")
+
+// RefreshToken is the stored record of a refresh token; its document id is
+// the token's hash.
+type RefreshToken struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenPair is the JSON body returned by /login (v2) and /token/refresh.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+}
+
+// RefreshRequest is the body of /token/refresh and /logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newAccessToken(user *User, ttl time.Duration) (string, error) {
+	return signingKeys.sign(jwt.MapClaims{
+		"username": user.Username,
+		"role":     user.Role,
+		"exp":      time.Now().Add(ttl).Unix(),
+	})
+}
+
+// hashToken is what gets stored of an opaque token: its SHA-256, in hex.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenPair issues an access token and stores a new refresh token.
+func newTokenPair(user *User) (*TokenPair, error) {
+	access, err := newAccessToken(user, ACCESS_TOKEN_TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, REFRESH_TOKEN_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now().UTC()
+	_, err = esClient.Index().
+		Index(REFRESH_TOKEN_INDEX).
+		Id(hashToken(refresh)).
+		BodyJson(&RefreshToken{Username: user.Username, CreatedAt: now, ExpiresAt: now.Add(REFRESH_TOKEN_TTL)}).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int64(ACCESS_TOKEN_TTL / time.Second)}, nil
+}
+
+// consumeRefreshToken deletes a refresh token and returns its record. A
+// token can be used once; errInvalidRefreshToken means it is unknown,
+// already used or expired.
+func consumeRefreshToken(token string) (*RefreshToken, error) {
+	id := hashToken(token)
+	result, err := esClient.Get().
+		Index(REFRESH_TOKEN_INDEX).
+		Id(id).
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, err
+	}
+	var record RefreshToken
+	if !result.Found || result.Source == nil || json.Unmarshal(result.Source, &record) != nil {
+		return nil, errInvalidRefreshToken
+	}
+
+	// only the request that deletes the token may use it
+	_, err = esClient.Delete().
+		Index(REFRESH_TOKEN_INDEX).
+		Id(id).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+	return &record, nil
+}
+
+// handleRefreshToken trades a refresh token for a new token pair.
+func handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one token refresh request")
+	w.Header().Set("Content-Type", "application/json")
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	record, err := consumeRefreshToken(req.RefreshToken)
+	if err != nil {
+		if err == errInvalidRefreshToken {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to refresh token %v.\n", err)
+		return
+	}
+
+	// reload the user so role changes and deleted accounts take effect
+	user, err := getUser(record.Username)
+	if err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User does not exist", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read user %s %v.\n", record.Username, err)
+		return
+	}
+	if user.Role == "" {
+		user.Role = ROLE_USER
+	}
+	if bans.Banned(user.Username) {
+		http.Error(w, errUserBanned.Error(), http.StatusForbidden)
+		fmt.Printf("Refused to refresh token of banned %s\n", user.Username)
+		return
+	}
+
+	pair, err := newTokenPair(user)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		fmt.Printf("Failed to generate token %v.\n", err)
+		return
+	}
+
+	js, err := json.Marshal(pair)
+	if err != nil {
+		http.Error(w, "Failed to parse token into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse token into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// revokeRefreshTokens revokes every refresh token of username, logging
+// them out everywhere once their access tokens expire.
+func revokeRefreshTokens(username string) error {
+	client := esClient
+
+	_, err := client.DeleteByQuery(REFRESH_TOKEN_INDEX).
+		Query(elastic.NewTermQuery("username", username)).
+		Refresh("true").
+		Do(context.Background())
+	return err
+}
+
+// handleLogout revokes a refresh token. Access tokens already issued stay
+// valid until they expire, at most ACCESS_TOKEN_TTL.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one logout request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	_, err := esClient.Delete().
+		Index(REFRESH_TOKEN_INDEX).
+		Id(hashToken(req.RefreshToken)).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil && !elastic.IsNotFound(err) {
+		http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to revoke refresh token %v.\n", err)
+		return
+	}
+
+	w.Write([]byte("Logged out successfully."))
+}
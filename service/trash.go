@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+)
+
+// Trash. Deleting a post only moves it to its author's trash: it gets a
+// deleted_at time, searches leave it out, and its media, likes and
+// comments are kept, so POST /post/{id}/restore brings it back as it was.
+// A background janitor purges posts TRASH_RETENTION after they were
+// deleted, the way deletePost removes them.
+const (
+	TRASH_RETENTION      = 30 * 24 * time.Hour
+	TRASH_PURGE_INTERVAL = time.Hour
+	TRASH_PURGE_BATCH    = 100
+)
+
+// trashedPostsQuery selects the posts deleted before t.
+func trashedPostsQuery(t time.Time) elastic.Query {
+	return elastic.NewRangeQuery("deleted_at").Lt(t.Format(time.RFC3339Nano))
+}
+
+// trashPost moves p, one of the posts, to the trash.
+func (a *App) trashPost(ctx context.Context, p *Post) error {
+	now := time.Now().UTC()
+	p.DeletedAt = &now
+	p.UpdatedAt = now
+	if err := a.Posts.Save(ctx, p.Id, p); err != nil {
+		return err
+	}
+	fmt.Printf("Moved post %s to the trash\n", p.Id)
+	if p.Status == STATUS_PUBLISHED {
+		a.invalidateSearchCache(ctx, p)
+	}
+	return nil
+}
+
+// handleRestorePost takes one of the caller's posts out of the trash.
+func (a *App) handleRestorePost(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for restoring a post")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	p, err := a.Posts.Get(r.Context(), id)
+	if err != nil {
+		if err == errPostNotFound {
+			http.Error(w, "Post does not exist", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		}
+		fmt.Printf("Failed to read post %s %v.\n", id, err)
+		return
+	}
+	if p.User != claims.Username {
+		http.Error(w, "Only the author can restore a post", http.StatusForbidden)
+		fmt.Printf("%s tried to restore post %s of %s\n", claims.Username, id, p.User)
+		return
+	}
+	if p.DeletedAt == nil {
+		http.Error(w, "Post is not in the trash", http.StatusConflict)
+		return
+	}
+
+	p.Id = id
+	p.DeletedAt = nil
+	p.UpdatedAt = time.Now().UTC()
+	if err := a.Posts.Save(r.Context(), id, p); err != nil {
+		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to restore post %s %v.\n", id, err)
+		return
+	}
+	fmt.Printf("Restored post %s from the trash\n", id)
+	if p.Status == STATUS_PUBLISHED {
+		a.invalidateSearchCache(r.Context(), p)
+	}
+	w.Write([]byte("Post restored successfully."))
+}
+
+// handleTrash lists the caller's deleted posts, most recently deleted
+// first, each with the deleted_at time it is purged TRASH_RETENTION after.
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for the trash")
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Printf("Invalid pagination parameters %v.\n", err)
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		http.Error(w, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW), http.StatusBadRequest)
+		return
+	}
+
+	page, err := readTrashFromES(claims.Username, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read trash from ElasticSearch %v.\n", err)
+		return
+	}
+	signMediaURLs(page.Posts)
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+func readTrashFromES(user string, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("user", user),
+			elastic.NewExistsQuery("deleted_at"))).
+		SortBy(elastic.NewFieldSort("deleted_at").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(context.Background(), "trash", searchResult.TookInMillis, map[string]interface{}{"user": user, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  decodePosts(searchResult),
+	}
+	if page.Posts == nil {
+		page.Posts = []Post{}
+	}
+	return page, nil
+}
+
+// startTrashJanitor purges the trash every TRASH_PURGE_INTERVAL.
+func (a *App) startTrashJanitor() {
+	go func() {
+		ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if _, err := a.purgeTrash(context.Background(), now); err != nil {
+				fmt.Printf("Failed to purge the trash %v.\n", err)
+			}
+		}
+	}()
+}
+
+// purgeTrash deletes up to TRASH_PURGE_BATCH posts deleted more than
+// TRASH_RETENTION before now, and returns how many it deleted; the next
+// run takes the rest.
+func (a *App) purgeTrash(ctx context.Context, now time.Time) (int, error) {
+	posts, err := a.Posts.Trashed(ctx, now.Add(-TRASH_RETENTION), TRASH_PURGE_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for i := range posts {
+		p := &posts[i]
+		if err := a.deletePost(ctx, p.Id, p); err != nil {
+			// purged by another instance or deleted by an admin
+			if err != errPostNotFound {
+				fmt.Printf("Failed to purge post %s %v.\n", p.Id, err)
+			}
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		fmt.Printf("Purged %d posts from the trash\n", purged)
+	}
+	return purged, nil
+}
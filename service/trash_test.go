@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	fields := map[string]string{"message": "oops", "lat": "37.5", "lon": "-122.1"}
+	if w := s.do(authorized(t, newPostRequest(t, fields, testPNG(t)), "wren")); w.Code != http.StatusOK {
+		t.Fatalf("post = %d: %s", w.Code, w.Body)
+	}
+	posts, _, _ := s.posts.Search(ctx, &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"})
+	if len(posts) != 1 {
+		t.Fatalf("search found %d posts, want 1", len(posts))
+	}
+	id, created := posts[0].Id, posts[0].UpdatedAt
+
+	if w := s.do(authorized(t, httptest.NewRequest("DELETE", "/post/"+id, nil), "xan")); w.Code != http.StatusForbidden {
+		t.Errorf("delete by another user = %d, want 403", w.Code)
+	}
+	if w := s.do(authorized(t, httptest.NewRequest("DELETE", "/post/"+id, nil), "wren")); w.Code != http.StatusOK {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+	if posts, _, _ := s.posts.Search(ctx, &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"}); len(posts) != 0 {
+		t.Errorf("search found %d posts in the trash", len(posts))
+	}
+	p, err := s.posts.Get(ctx, id)
+	if err != nil || p.DeletedAt == nil || !s.blobs.has(id) {
+		t.Fatalf("trashed post = %+v, %v: want it kept with its media", p, err)
+	}
+	deleted := *p.DeletedAt
+	if !p.UpdatedAt.Equal(deleted) || p.UpdatedAt.Before(created) {
+		t.Errorf("trashed post updated_at = %v, want its deleted_at %v", p.UpdatedAt, deleted)
+	}
+	if w := s.do(authorized(t, httptest.NewRequest("DELETE", "/post/"+id, nil), "wren")); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a trashed post = %d, want 404", w.Code)
+	}
+
+	if w := s.do(authorized(t, httptest.NewRequest("POST", "/post/"+id+"/restore", nil), "wren")); w.Code != http.StatusOK {
+		t.Fatalf("restore = %d: %s", w.Code, w.Body)
+	}
+	if posts, _, _ := s.posts.Search(ctx, &GeoQuery{Lat: 37.5, Lon: -122.1, Distance: "1km"}); len(posts) != 1 {
+		t.Errorf("search found %d posts after the restore, want 1", len(posts))
+	}
+	if p, err := s.posts.Get(ctx, id); err != nil || p.UpdatedAt.Before(deleted) {
+		t.Errorf("restored post = %+v, %v: want updated_at after %v", p, err, deleted)
+	}
+	if w := s.do(authorized(t, httptest.NewRequest("POST", "/post/"+id+"/restore", nil), "wren")); w.Code != http.StatusConflict {
+		t.Errorf("restoring a post not in the trash = %d, want 409", w.Code)
+	}
+}
+
+func TestTrashInvalidatesSearchCache(t *testing.T) {
+	s := newTestServer(t)
+	s.Cache = newMemSearchCache()
+	seedPosts(t, s)
+
+	query := "lat=37.7955&lon=-122.3937&range=20"
+	if got := searchIds(t, s, query); len(got) != 2 {
+		t.Fatalf("ids = %v, want [near close]", got)
+	}
+	w := s.do(authorized(t, httptest.NewRequest("DELETE", "/post/close", nil), "bob"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+	if got := searchIds(t, s, query); len(got) != 1 || got[0] != "near" {
+		t.Errorf("ids after the delete = %v, want [near]", got)
+	}
+
+	w = s.do(authorized(t, httptest.NewRequest("POST", "/post/close/restore", nil), "bob"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore = %d: %s", w.Code, w.Body)
+	}
+	if got := searchIds(t, s, query); len(got) != 2 {
+		t.Errorf("ids after the restore = %v, want [near close]", got)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	old, recent := now.Add(-TRASH_RETENTION-time.Hour), now.Add(-time.Hour)
+	s.posts.Save(ctx, "old", &Post{User: "wren", DeletedAt: &old})
+	s.posts.Save(ctx, "recent", &Post{User: "wren", DeletedAt: &recent})
+	s.posts.Save(ctx, "live", &Post{User: "wren"})
+
+	n, err := s.purgeTrash(ctx, now)
+	if n != 1 || err != nil {
+		t.Fatalf("purgeTrash = %d, %v, want 1", n, err)
+	}
+	if _, err := s.posts.Get(ctx, "old"); err != errPostNotFound {
+		t.Errorf("Get(old) = %v, want errPostNotFound", err)
+	}
+	for _, id := range []string{"recent", "live"} {
+		if _, err := s.posts.Get(ctx, id); err != nil {
+			t.Errorf("Get(%s) = %v, want it kept", id, err)
+		}
+	}
+}
+
+func TestPostsDeltaTombstones(t *testing.T) {
+	deleted := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_search") {
+			fakeES(w, r)
+			return
+		}
+		live, _ := json.Marshal(&Post{User: "yara", Message: "still here", Location: Location{Lat: 37.5, Lon: -122.1}, Status: STATUS_PUBLISHED, UpdatedAt: deleted.Add(-time.Hour)})
+		gone, _ := json.Marshal(&Post{User: "yara", Message: "secret", Location: Location{Lat: 37.5, Lon: -122.1}, Status: STATUS_PUBLISHED, UpdatedAt: deleted, DeletedAt: &deleted})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"took": 1,
+			"hits": map[string]interface{}{
+				"total": map[string]interface{}{"value": 2, "relation": "eq"},
+				"hits": []map[string]interface{}{
+					{"_index": POST_INDEX, "_id": "live", "_source": json.RawMessage(live)},
+					{"_index": POST_INDEX, "_id": "gone", "_source": json.RawMessage(gone)},
+				},
+			},
+		})
+	}))
+	defer es.Close()
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := esClient
+	esClient = client
+	defer func() { esClient = saved }()
+
+	s := newTestServer(t)
+	r := httptest.NewRequest("GET", "/posts/delta?since=0&lat=37.5&lon=-122.1", nil)
+	w := s.do(authorized(t, r, "zoe"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delta = %d: %s", w.Code, w.Body)
+	}
+	var delta struct {
+		Posts         []Post                   `json:"posts"`
+		Deleted       []map[string]interface{} `json:"deleted"`
+		HighWaterMark time.Time                `json:"high_water_mark"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &delta); err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Posts) != 1 || delta.Posts[0].Id != "live" {
+		t.Errorf("posts = %+v, want only live", delta.Posts)
+	}
+	if len(delta.Deleted) != 1 || len(delta.Deleted[0]) != 2 || delta.Deleted[0]["id"] != "gone" || delta.Deleted[0]["deleted_at"] != deleted.Format(time.RFC3339) {
+		t.Errorf("deleted = %v, want a tombstone with only the id and deleted_at of gone", delta.Deleted)
+	}
+	if !delta.HighWaterMark.Equal(deleted) {
+		t.Errorf("high water mark = %v, want the deletion %v", delta.HighWaterMark, deleted)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Trending posts are the posts of the last TRENDING_WINDOW around a point,
+// ranked by engagement and recency for a "hot near you" tab. A post scores
+//
+//	(1 + log(1 + likes) + TRENDING_COMMENT_WEIGHT * log(1 + comments)) * recency
+//
+// where recency halves every TRENDING_HALF_LIFE of age, on a bell curve.
+// The like and comment counts are kept on the post document by the like
+// and comment handlers, see bumpEngagement, so ElasticSearch ranks posts
+// with a function_score query.
+const (
+	TRENDING_WINDOW         = 48 * time.Hour
+	TRENDING_HALF_LIFE      = "6h"
+	TRENDING_COMMENT_WEIGHT = 2.0
+)
+
+// Engagement counters of the post document.
+const (
+	FIELD_LIKE_COUNT    = "like_count"
+	FIELD_COMMENT_COUNT = "comment_count"
+)
+
+// handleTrending returns the trending posts within range of lat and lon,
+// hottest first.
+func handleTrending(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for trending posts")
+	w.Header().Set("Content-Type", "application/json")
+
+	loc, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lon"))
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+	ran, err := rangeParam(r)
+	if err != nil {
+		writeServiceError(w, err, "")
+		return
+	}
+	offset, limit, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_PAGINATION, err.Error())
+		return
+	}
+	if offset+limit > MAX_RESULT_WINDOW {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_PAGINATION, "offset+limit should be at most "+strconv.Itoa(MAX_RESULT_WINDOW))
+		return
+	}
+
+	hidden, ok := readHiddenUsers(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := readTrendingFromES(r.Context(), loc, ran, hidden, time.Now(), offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to read trending posts from ElasticSearch %v.\n", err)
+		return
+	}
+
+	viewer := viewerName(r)
+	redactPosts(page.Posts, viewer)
+	signMediaURLs(page.Posts)
+	if err := annotateLikes(r.Context(), page.Posts, viewer); err != nil {
+		fmt.Printf("Failed to read likes %v.\n", err)
+	}
+
+	js, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
+		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		return
+	}
+
+	setAPIVersion(w, API_V2)
+	w.Write(js)
+}
+
+// trendingQuery scores the posts created within TRENDING_WINDOW before now
+// and within ran of loc, leaving out those of hidden.
+func trendingQuery(loc Location, ran string, hidden []string, now time.Time) elastic.Query {
+	recent := elastic.NewBoolQuery().
+		Filter(newGeoDistanceQuery(loc.Lat, loc.Lon, ran)).
+		Filter(elastic.NewRangeQuery("timestamp").Gte(now.Add(-TRENDING_WINDOW).Format(time.RFC3339Nano)))
+
+	engagement := elastic.NewFunctionScoreQuery().
+		Query(elastic.NewConstantScoreQuery(publicPostsQuery(excludeUsers(recent, hidden)))).
+		AddScoreFunc(elastic.NewWeightFactorFunction(1)).
+		AddScoreFunc(elastic.NewFieldValueFactorFunction().Field(FIELD_LIKE_COUNT).Modifier("log1p").Missing(0)).
+		AddScoreFunc(elastic.NewFieldValueFactorFunction().Field(FIELD_COMMENT_COUNT).Modifier("log1p").Missing(0).Weight(TRENDING_COMMENT_WEIGHT)).
+		ScoreMode("sum").
+		BoostMode("replace")
+
+	return elastic.NewFunctionScoreQuery().
+		Query(engagement).
+		AddScoreFunc(elastic.NewGaussDecayFunction().
+			FieldName("timestamp").
+			Origin(now.Format(time.RFC3339Nano)).
+			Scale(TRENDING_HALF_LIFE).
+			Decay(0.5)).
+		BoostMode("multiply")
+}
+
+func readTrendingFromES(ctx context.Context, loc Location, ran string, hidden []string, now time.Time, offset, limit int) (*PostPage, error) {
+	client := esClient
+
+	search := client.Search().
+		Index(POST_INDEX).
+		TrackTotalHits(true).
+		Query(trendingQuery(loc, ran, hidden, now)).
+		SortBy(elastic.NewScoreSort(), elastic.NewFieldSort("timestamp").Desc(), elastic.NewFieldSort("id").Asc()).
+		From(offset).
+		Size(limit)
+	if km, err := parseKm(ran); err == nil {
+		if keys := searchRouting(loc.Lat, loc.Lon, km); keys != nil {
+			search = search.Routing(keys...)
+		}
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeQuery(ctx, "trending", searchResult.TookInMillis, map[string]interface{}{"lat": loc.Lat, "lon": loc.Lon, "range": ran, "offset": offset, "limit": limit})
+
+	page := &PostPage{
+		Total:  searchResult.TotalHits(),
+		Offset: offset,
+		Limit:  limit,
+		Posts:  []Post{},
+	}
+	for _, p := range decodePosts(searchResult) {
+		// filter spam
+		if screenPost(&p) {
+			page.Posts = append(page.Posts, p)
+		}
+	}
+	return page, nil
+}
+
+// bumpEngagement adds delta to the counter field of the post p in place,
+// never going below zero. The like and comment indexes stay the source of
+// truth; a failed bump only skews the ranking, so it is only logged.
+func bumpEngagement(ctx context.Context, p *Post, field string, delta int) {
+	client := esClient
+
+	script := elastic.NewScript("def n = ctx._source[params.field]; ctx._source[params.field] = Math.max(0, (n == null ? 0 : n) + params.delta)").
+		Param("field", field).
+		Param("delta", delta)
+	_, err := client.Update().
+		Index(POST_INDEX).
+		Id(p.Id).
+		Routing(postRouting(p, p.Id)).
+		Script(script).
+		RetryOnConflict(3).
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		fmt.Printf("Failed to update %s of post %s %v.\n", field, p.Id, err)
+	}
+}
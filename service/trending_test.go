@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrendingQuery(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	src, err := trendingQuery(Location{Lat: 37.7, Lon: -122.4}, "10km", []string{"mallory"}, now).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"field":"like_count"`,
+		`"field":"comment_count"`,
+		`"modifier":"log1p"`,
+		`"score_mode":"sum"`,
+		`"boost_mode":"multiply"`,
+		`"gauss":{"timestamp":{"decay":0.5,"origin":"2024-05-01T12:00:00Z","scale":"6h"}}`,
+		`"timestamp":{"from":"2024-04-29T12:00:00Z"`,
+		`"distance":"10km"`,
+		`"status":"draft"`,
+		`"terms":{"user":["mallory"]}`,
+	} {
+		if !strings.Contains(string(js), want) {
+			t.Errorf("query lacks %s: %s", want, js)
+		}
+	}
+}
+
+func TestHandleTrending(t *testing.T) {
+	s := newTestServer(t)
+
+	r := httptest.NewRequest("GET", "/trending?lat=37.7&lon=-122.4&range=5km", nil)
+	w := s.do(authorized(t, r, "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var page PostPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.Posts == nil {
+		t.Errorf("body %s, %v: want a page", w.Body, err)
+	}
+
+	for query, code := range map[string]string{
+		"lon=-122.4":                    ERR_MISSING_COORDINATES,
+		"lat=37.7&lon=-122.4&range=far": ERR_INVALID_RANGE,
+		"lat=37.7&lon=-122.4&limit=0":   ERR_INVALID_PAGINATION,
+	} {
+		r := httptest.NewRequest("GET", "/trending?"+query, nil)
+		w := s.do(authorized(t, r, "alice"))
+		var body APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest || body.Code != code {
+			t.Errorf("%s: %d %s, want 400 with code %s", query, w.Code, w.Body, code)
+		}
+	}
+}
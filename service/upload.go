@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Upload limits. The whole body of a post or edit is capped at
+// MAX_UPLOAD_BYTES, which has to fit a video; images are held to
+// MAX_IMAGE_BYTES. Both are set from the configuration at startup.
+var (
+	MAX_UPLOAD_BYTES int64 = 100 << 20
+	MAX_IMAGE_BYTES  int64 = 10 << 20
+)
+
+// MAX_IMAGE_DIMENSION bounds the width and height of an image in pixels.
+const MAX_IMAGE_DIMENSION = 8192
+
+// allowedImageTypes are the image formats accepted, keyed by the content
+// type sniffed from the upload, not the one the client declares.
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var (
+	errUnsupportedImage = errors.New("Unsupported image format, upload JPEG, PNG, GIF or WebP")
+	errImageTooLarge    = errors.New("Image is too large")
+	errImageDimensions  = fmt.Errorf("Image should be at most %dx%d pixels", MAX_IMAGE_DIMENSION, MAX_IMAGE_DIMENSION)
+)
+
+// limitUpload caps the request body at MAX_UPLOAD_BYTES and parses the
+// form, keeping up to maxMemory of a multipart form in memory. On failure
+// it writes the response and returns false.
+func limitUpload(w http.ResponseWriter, r *http.Request, maxMemory int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_BYTES)
+	err := r.ParseMultipartForm(maxMemory)
+	if err == nil || err == http.ErrNotMultipart {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Upload should be at most %d bytes", MAX_UPLOAD_BYTES), http.StatusRequestEntityTooLarge)
+	} else {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	}
+	fmt.Printf("Failed to parse form %v.\n", err)
+	return false
+}
+
+// checkImage validates an uploaded image of size bytes by its content and
+// returns its sniffed content type. f is rewound.
+func checkImage(f io.ReadSeeker, size int64) (string, error) {
+	if size > MAX_IMAGE_BYTES {
+		return "", errImageTooLarge
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !allowedImageTypes[contentType] {
+		return "", errUnsupportedImage
+	}
+
+	// the header is enough to know the dimensions, the pixels aren't decoded
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", errUnsupportedImage
+	}
+	if config.Width > MAX_IMAGE_DIMENSION || config.Height > MAX_IMAGE_DIMENSION {
+		return "", errImageDimensions
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+// imageErrorStatus is the response status for an error of checkImage.
+func imageErrorStatus(err error) int {
+	switch err {
+	case errUnsupportedImage:
+		return http.StatusUnsupportedMediaType
+	case errImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errImageDimensions:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -2,73 +2,131 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"reflect"
 	"regexp"
+	"strings"
 	"time"
+	"unicode"
 
-	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/olivere/elastic"
+	"github.com/olivere/elastic/v7"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	USER_INDEX = "user"
-	USER_TYPE  = "user"
 )
 
 const SECRET = "secret"
 
+const (
+	ROLE_USER  = "user"
+	ROLE_ADMIN = "admin"
+)
+
+var errUserNotFound = errors.New("User does not exist")
+
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Age      int64  `json:"age"`
 	Gender   string `json:"gender"`
+	Role     string `json:"role,omitempty"`
+
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+
+	Email string `json:"email,omitempty"`
+	// EmailVerified is set once the user proved they own Email, by a
+	// verification or reset link or by logging in with a provider that
+	// vouches for it.
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// VerificationPending blocks login until the email address is
+	// verified.
+	VerificationPending bool `json:"verification_pending,omitempty"`
+	// ResetTokenHash is the hash of the password reset token mailed last,
+	// good until ResetExpiresAt.
+	ResetTokenHash string     `json:"reset_token_hash,omitempty"`
+	ResetExpiresAt *time.Time `json:"reset_expires_at,omitempty"`
 }
 
-var mySigningKey = []byte(SECRET)
+// usernamePattern is the format every username must match at signup.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
 
-func checkUser(username, password string) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return err
-	}
+const MIN_PASSWORD_LENGTH = 8
 
-	// select * from users where username = ?
-	fmt.Printf("query username is %v\n", username)
-	query := elastic.NewTermQuery("username", username)
+// Passwords are stored as bcrypt hashes, which salt every password and
+// only look at the first MAX_PASSWORD_BYTES bytes.
+const (
+	BCRYPT_COST        = 12
+	MAX_PASSWORD_BYTES = 72
+)
 
-	searchResult, err := client.Search().
-		Index(USER_INDEX).
-		Type(USER_TYPE).
-		Query(query).
-		Pretty(true).
-		Do(context.Background())
+var errWrongPassword = errors.New("Wrong username or password")
+
+// checkUser verifies the password of username. Accounts created before
+// passwords were hashed still hold the plaintext; on their first successful
+// login the password is hashed in place.
+func checkUser(username, password string) (*User, error) {
+	u, err := getUser(username)
 	if err != nil {
-		return err
+		if err == errUserNotFound {
+			return nil, errWrongPassword
+		}
+		return nil, err
 	}
 
-	var utyp User
-	// fmt.Printf("searchResult total hits, %v\n", searchResult.TotalHits())
-	for _, item := range searchResult.Each(reflect.TypeOf(utyp)) {
-		if u, ok := item.(User); ok {
-			if username == u.Username && password == u.Password {
-				fmt.Printf("Login in as %s\n", username)
-				return nil
-			}
+	if isPasswordHash(u.Password) {
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+			return nil, errWrongPassword
+		}
+		if cost, err := bcrypt.Cost([]byte(u.Password)); err == nil && cost < BCRYPT_COST {
+			rehashPassword(username, password)
 		}
+	} else {
+		if subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) != 1 {
+			return nil, errWrongPassword
+		}
+		rehashPassword(username, password)
 	}
 
-	return errors.New("Wrong username or password")
+	fmt.Printf("Login in as %s\n", username)
+	if u.Role == "" {
+		u.Role = ROLE_USER
+	}
+	u.Password = ""
+	return u, nil
 }
 
-func addUser(user User) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+// isPasswordHash tells a bcrypt hash from a legacy plaintext password.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return string(hash), nil
+}
+
+// rehashPassword upgrades the stored password after a successful login;
+// a failure only means it is retried on the next login.
+func rehashPassword(username, password string) {
+	if err := updatePassword(username, password); err != nil {
+		fmt.Printf("Failed to rehash password of %s %v.\n", username, err)
+		return
+	}
+	fmt.Printf("Rehashed password of %s\n", username)
+}
+
+func addUser(user User) error {
+	client := esClient
 
 	// select * from users where username = ?
 	query := elastic.NewTermQuery("username", user.Username)
@@ -86,9 +144,14 @@ func addUser(user User) error {
 		return errors.New("User already exists")
 	}
 
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+
 	_, err = client.Index().
 		Index(USER_INDEX).
-		Type(USER_TYPE).
 		Id(user.Username).
 		BodyJson(user).
 		Refresh("wait_for").
@@ -102,14 +165,40 @@ func addUser(user User) error {
 
 }
 
+// getUser loads a user document by username, which is also its id.
+func getUser(username string) (*User, error) {
+	client := esClient
+
+	result, err := client.Get().
+		Index(USER_INDEX).
+		Id(username).
+		Do(context.Background())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, errUserNotFound
+		}
+		return nil, err
+	}
+	if !result.Found || result.Source == nil {
+		return nil, errUserNotFound
+	}
+
+	var user User
+	if err := json.Unmarshal(result.Source, &user); err != nil {
+		return nil, err
+	}
+	if user.Role == "" {
+		user.Role = ROLE_USER
+	}
+	return &user, nil
+}
+
 func handlerLogin(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received one login request")
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	fmt.Println("Received one login request")
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	decoder := json.NewDecoder(r.Body)
 	var user User
@@ -119,21 +208,38 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := checkUser(user.Username, user.Password); err != nil {
-		if err.Error() == "Wrong username or password" {
-			http.Error(w, "Wrong username or password", http.StatusUnauthorized)
-		} else {
-			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
-		}
+	account, err := login(user.Username, user.Password)
+	if err != nil {
+		writeServiceError(w, err, "Failed to read from ElasticSearch")
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+	writeLoginTokens(w, apiVersion(r), account)
+}
+
+// writeLoginTokens answers a successful login of account: API_V2 clients
+// get a token pair, older ones a single access token as plain text.
+func writeLoginTokens(w http.ResponseWriter, version int, account *User) {
+	if version >= API_V2 {
+		pair, err := newTokenPair(account)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			fmt.Printf("Failed to generate token %v.\n", err)
+			return
+		}
+		js, err := json.Marshal(pair)
+		if err != nil {
+			http.Error(w, "Failed to parse token into JSON format", http.StatusInternalServerError)
+			fmt.Printf("Failed to parse token into JSON format %v.\n", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setAPIVersion(w, API_V2)
+		w.Write(js)
+		return
+	}
 
-	tokenString, err := token.SignedString(mySigningKey)
+	tokenString, err := newAccessToken(account, LEGACY_TOKEN_TTL)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		fmt.Printf("Failed to generate token %v.\n", err)
@@ -146,7 +252,6 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 func handlerRegister(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received one signup request")
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	decoder := json.NewDecoder(r.Body)
 	var user User
@@ -156,22 +261,109 @@ func handlerRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf(user.Username + "," + user.Password + "\n")
-	if user.Username == "" || user.Password == "" || !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(user.Username) {
-		http.Error(w, "Invalid username or password", http.StatusBadRequest)
-		fmt.Printf("Invalid username or password. Username should be characters from a-z, 0-9 \n")
+	if err := signup(user); err != nil {
+		writeServiceError(w, err, "Failed to save to ElasticSearch")
+		return
+	}
+
+	if mailer != nil {
+		w.Write([]byte("User added successfully. Please check your email to verify your account."))
 		return
 	}
+	w.Write([]byte("User added successfully."))
+
+}
 
-	if err := addUser(user); err != nil {
-		if err.Error() == "User already exists" {
-			http.Error(w, "User already exists", http.StatusBadRequest)
+// validatePassword checks that a new password is strong enough: at least
+// MIN_PASSWORD_LENGTH characters mixing letters and digits.
+func validatePassword(password string) error {
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return fmt.Errorf("Password should have at least %d characters", MIN_PASSWORD_LENGTH)
+	}
+	if len(password) > MAX_PASSWORD_BYTES {
+		return fmt.Errorf("Password should have at most %d bytes", MAX_PASSWORD_BYTES)
+	}
+
+	var hasLetter, hasDigit bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("Password should contain both letters and digits")
+	}
+	return nil
+}
+
+func updatePassword(username, password string) error {
+	client := esClient
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = client.Update().
+		Index(USER_INDEX).
+		Id(username).
+		Doc(map[string]interface{}{"password": hash}).
+		Refresh("wait_for").
+		Do(context.Background())
+	return err
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// handlerChangePassword lets a logged-in user replace their password after
+// proving they know the current one.
+func handlerChangePassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one password change request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var change PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
+		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		return
+	}
+
+	if _, err := checkUser(claims.Username, change.CurrentPassword); err != nil {
+		if err == errWrongPassword {
+			http.Error(w, "Current password is wrong", http.StatusUnauthorized)
 		} else {
-			http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
 		}
+		fmt.Printf("Failed to verify current password of %s %v.\n", claims.Username, err)
 		return
 	}
 
-	w.Write([]byte("User added successfully."))
+	if err := validatePassword(change.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := updatePassword(claims.Username, change.NewPassword); err != nil {
+		http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+		fmt.Printf("Failed to update password of %s %v.\n", claims.Username, err)
+		return
+	}
+	fmt.Printf("Password changed for %s\n", claims.Username)
+
+	// sessions signed in with the old password end with it
+	if err := revokeRefreshTokens(claims.Username); err != nil {
+		fmt.Printf("Failed to revoke refresh tokens of %s %v.\n", claims.Username, err)
+	}
 
+	w.Write([]byte("Password changed successfully."))
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// userES is fakeES holding user documents, which applies and counts their
+// updates, and refresh tokens.
+type userES struct {
+	mu      sync.Mutex
+	users   map[string]*User
+	updates int
+	refresh map[string]json.RawMessage
+}
+
+func (e *userES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == REFRESH_TOKEN_INDEX {
+		e.serveRefreshTokens(w, r, parts)
+		return
+	}
+	if len(parts) == 3 && parts[0] == USER_INDEX {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		u, ok := e.users[parts[2]]
+		switch {
+		case parts[1] == "_doc" && r.Method == "GET" && ok:
+			source, _ := json.Marshal(u)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"_index": USER_INDEX, "_id": parts[2], "found": true, "_source": json.RawMessage(source)})
+			return
+		case parts[1] == "_update" && ok:
+			var body struct {
+				Doc json.RawMessage `json:"doc"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			json.Unmarshal(body.Doc, u)
+			e.updates++
+		}
+	}
+	fakeES(w, r)
+}
+
+// serveRefreshTokens indexes, gets and deletes refresh tokens by id, and
+// deletes those of a user by query.
+func (e *userES) serveRefreshTokens(w http.ResponseWriter, r *http.Request, parts []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.refresh == nil {
+		e.refresh = make(map[string]json.RawMessage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(parts) == 2 && parts[1] == "_delete_by_query" {
+		var body struct {
+			Query struct {
+				Term map[string]string `json:"term"`
+			} `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		deleted := 0
+		for id, source := range e.refresh {
+			var record RefreshToken
+			if json.Unmarshal(source, &record) == nil && record.Username == body.Query.Term["username"] {
+				delete(e.refresh, id)
+				deleted++
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+		return
+	}
+	if len(parts) != 3 || parts[1] != "_doc" {
+		fakeES(w, r)
+		return
+	}
+	id := parts[2]
+	source, ok := e.refresh[id]
+	switch r.Method {
+	case "PUT", "POST":
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		e.refresh[id] = body
+		json.NewEncoder(w).Encode(map[string]interface{}{"_index": REFRESH_TOKEN_INDEX, "_id": id, "result": "created"})
+	case "GET":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"_index": REFRESH_TOKEN_INDEX, "_id": id, "found": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"_index": REFRESH_TOKEN_INDEX, "_id": id, "found": true, "_source": source})
+	case "DELETE":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"_index": REFRESH_TOKEN_INDEX, "_id": id, "result": "not_found"})
+			return
+		}
+		delete(e.refresh, id)
+		json.NewEncoder(w).Encode(map[string]interface{}{"_index": REFRESH_TOKEN_INDEX, "_id": id, "result": "deleted"})
+	}
+}
+
+// withUsers points esClient at a userES holding users until the test ends.
+func withUsers(t *testing.T, users ...*User) *userES {
+	t.Helper()
+	e := &userES{users: make(map[string]*User)}
+	for _, u := range users {
+		e.users[u.Username] = u
+	}
+	es := httptest.NewServer(e)
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := esClient
+	esClient = client
+	t.Cleanup(func() {
+		esClient = saved
+		es.Close()
+	})
+	return e
+}
+
+func TestChangePasswordWrongCurrent(t *testing.T) {
+	hash, err := hashPassword("old-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := withUsers(t, &User{Username: "kit", Password: hash})
+	s := newTestServer(t)
+
+	change := func(current string) *httptest.ResponseRecorder {
+		body := `{"current_password":"` + current + `","new_password":"new-secret-123"}`
+		return s.do(authorized(t, httptest.NewRequest("POST", "/user/password", strings.NewReader(body)), "kit"))
+	}
+	if w := change("guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong current password = %d %s, want 401", w.Code, w.Body)
+	}
+	es.mu.Lock()
+	if es.users["kit"].Password != hash || es.updates != 0 {
+		t.Errorf("the password was updated %d times after a wrong current password", es.updates)
+	}
+	es.mu.Unlock()
+
+	// guessing the current password is rate limited like a login
+	var w *httptest.ResponseRecorder
+	for i := 0; i < rateLimits["password_change"].PerUser.Burst; i++ {
+		w = change("guess")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("guess past the burst = %d, want 429", w.Code)
+	}
+}
+
+func TestChangePasswordRevokesRefreshTokens(t *testing.T) {
+	hash, err := hashPassword("old-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "kit", Password: hash}
+	withUsers(t, user)
+	s := newTestServer(t)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return s.do(httptest.NewRequest("POST", "/token/refresh", strings.NewReader(`{"refresh_token":"`+token+`"}`)))
+	}
+	pair, err := newTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := refresh(pair.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh before the change = %d %s, want 200", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"current_password":"old-secret","new_password":"new-secret-123"}`
+	if w := s.do(authorized(t, httptest.NewRequest("POST", "/user/password", strings.NewReader(body)), "kit")); w.Code != http.StatusOK {
+		t.Fatalf("change password = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := refresh(pair.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token issued before the change = %d %s, want 401", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Codes of the invalid request parameters, answered with a 400 and an
+// APIError body.
+const (
+	ERR_MISSING_COORDINATES = "missing_coordinates"
+	ERR_INVALID_LATITUDE    = "invalid_latitude"
+	ERR_INVALID_LONGITUDE   = "invalid_longitude"
+	ERR_INVALID_RANGE       = "invalid_range"
+	ERR_INVALID_BBOX        = "invalid_bbox"
+	ERR_INVALID_PAGINATION  = "invalid_pagination"
+	ERR_INVALID_TIME        = "invalid_time"
+	ERR_INVALID_TTL         = "invalid_ttl"
+	ERR_INVALID_PUBLISH_AT  = "invalid_publish_at"
+)
+
+// invalidParam is the failure of a request parameter the client got wrong.
+func invalidParam(code, message string) *ServiceError {
+	return &ServiceError{Status: http.StatusBadRequest, Code: code, Message: message}
+}
+
+// parseLocation parses the lat and lon of a request, which are both
+// required.
+func parseLocation(latVal, lonVal string) (Location, error) {
+	latVal, lonVal = strings.TrimSpace(latVal), strings.TrimSpace(lonVal)
+	if latVal == "" || lonVal == "" {
+		return Location{}, invalidParam(ERR_MISSING_COORDINATES, "lat and lon are required")
+	}
+	lat, err := strconv.ParseFloat(latVal, 64)
+	if err != nil {
+		return Location{}, invalidParam(ERR_INVALID_LATITUDE, "lat should be a number")
+	}
+	lon, err := strconv.ParseFloat(lonVal, 64)
+	if err != nil {
+		return Location{}, invalidParam(ERR_INVALID_LONGITUDE, "lon should be a number")
+	}
+	loc := Location{Lat: lat, Lon: lon}
+	if err := validateLocation(loc); err != nil {
+		return Location{}, err
+	}
+	return loc, nil
+}
+
+// validateLocation checks that loc is a point on the earth.
+func validateLocation(loc Location) *ServiceError {
+	if math.IsNaN(loc.Lat) || loc.Lat < -90 || loc.Lat > 90 {
+		return invalidParam(ERR_INVALID_LATITUDE, "lat should be between -90 and 90")
+	}
+	if math.IsNaN(loc.Lon) || loc.Lon < -180 || loc.Lon > 180 {
+		return invalidParam(ERR_INVALID_LONGITUDE, "lon should be between -180 and 180")
+	}
+	return nil
+}
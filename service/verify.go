@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Email verification. When a MAILER is set, signup takes an email address
+// and mails a link to VERIFY_URL carrying a token signed like the access
+// tokens. The account can't log in until GET /verify gets the token; a
+// login attempt before that mails a fresh link. Accounts created without a
+// mailer, including those from before verification, are never blocked.
+var VERIFY_URL = "http://localhost:8080/verify"
+
+const (
+	VERIFY_TOKEN_TTL = 48 * time.Hour
+	// VERIFY_PURPOSE tells verification tokens from access tokens, which
+	// carry a username claim instead of a subject.
+	VERIFY_PURPOSE = "verify_email"
+
+	MAX_EMAIL_CHARS = 254
+)
+
+const verifySubject = "Verify your email address"
+
+var errInvalidVerifyToken = serviceError(http.StatusBadRequest, "Invalid or expired verification link")
+
+var errEmailNotVerified = serviceError(http.StatusForbidden, "Please verify your email address first, we sent you a new link")
+
+// validateEmail accepts a bare address such as name@example.com.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > MAX_EMAIL_CHARS {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+func newVerifyToken(user *User) (string, error) {
+	return signingKeys.sign(jwt.MapClaims{
+		"purpose": VERIFY_PURPOSE,
+		"sub":     user.Username,
+		"email":   user.Email,
+		"exp":     time.Now().Add(VERIFY_TOKEN_TTL).Unix(),
+	})
+}
+
+// parseVerifyToken returns the username and email address a verification
+// token was issued for.
+func parseVerifyToken(tokenString string) (string, string, error) {
+	token, err := parseToken(tokenString, signingKeys.key)
+	if err != nil || !token.Valid {
+		return "", "", errInvalidVerifyToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", "", errInvalidVerifyToken
+	}
+	purpose, _ := claims["purpose"].(string)
+	username, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if purpose != VERIFY_PURPOSE || username == "" || email == "" {
+		return "", "", errInvalidVerifyToken
+	}
+	return username, email, nil
+}
+
+// sendVerification mails user a verification link in the background;
+// failures are only logged, the next login attempt sends another.
+func sendVerification(user *User) {
+	if mailer == nil {
+		return
+	}
+	token, err := newVerifyToken(user)
+	if err != nil {
+		fmt.Printf("Failed to generate verification token for %s %v.\n", user.Username, err)
+		return
+	}
+	link := VERIFY_URL + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address for Around by opening this link within %d hours:\n\n%s\n\nIf you didn't sign up, you can ignore this email.\n",
+		user.Username, int(VERIFY_TOKEN_TTL/time.Hour), link)
+
+	username, email := user.Username, user.Email
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MAILER_TIMEOUT)
+		defer cancel()
+		if err := mailer.Send(ctx, email, verifySubject, body); err != nil {
+			fmt.Printf("Failed to send verification email to %s %v.\n", username, err)
+			return
+		}
+		fmt.Printf("Sent verification email to %s\n", username)
+	}()
+}
+
+// verifyEmail marks the account of a verification token as verified. A
+// token for an address the account no longer has is refused.
+func verifyEmail(tokenString string) error {
+	username, email, err := parseVerifyToken(tokenString)
+	if err != nil {
+		return err
+	}
+	user, err := getUser(username)
+	if err != nil {
+		if err == errUserNotFound {
+			return errInvalidVerifyToken
+		}
+		return err
+	}
+	if user.Email != email {
+		return errInvalidVerifyToken
+	}
+	if !user.VerificationPending && user.EmailVerified {
+		return nil
+	}
+
+	client := esClient
+	_, err = client.Update().
+		Index(USER_INDEX).
+		Id(username).
+		Doc(map[string]interface{}{"verification_pending": false, "email_verified": true}).
+		Refresh("wait_for").
+		Do(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified email of %s\n", username)
+	return nil
+}
+
+// handleVerify is where verification links lead.
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one email verification request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	if err := verifyEmail(r.URL.Query().Get("token")); err != nil {
+		writeServiceError(w, err, "Failed to save to ElasticSearch")
+		if _, ok := err.(*ServiceError); !ok {
+			fmt.Printf("Failed to verify email %v.\n", err)
+		}
+		return
+	}
+	w.Write([]byte("Email verified successfully, you can log in now."))
+}
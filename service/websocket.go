@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /ws is the WebSocket flavor of /live: the client subscribes to an area
+// and is pushed every new post in it. Unlike /live it can move the area
+// without reconnecting by sending another subscribe message. The direct
+// messages sent to the user while connected are pushed too.
+const (
+	WS_WRITE_TIMEOUT = 10 * time.Second
+	WS_PONG_TIMEOUT  = 60 * time.Second
+	WS_PING_INTERVAL = WS_PONG_TIMEOUT * 9 / 10
+	WS_MAX_MESSAGE   = 1024
+
+	// Browsers can't set headers on a WebSocket handshake, so the token
+	// may also be passed in this query parameter.
+	WS_TOKEN_PARAM = "access_token"
+)
+
+// WSSubscribe is the message a client sends to choose its area. Range is
+// in km and defaults to DISTANCE.
+type WSSubscribe struct {
+	Type  string  `json:"type"` // "subscribe"
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Range float64 `json:"range,omitempty"`
+}
+
+// WSMessage is what the server pushes: a new post, a direct message, or an
+// error about the last message of the client.
+type WSMessage struct {
+	Type    string   `json:"type"` // "subscribed", "post", "message" or "error"
+	Post    *Post    `json:"post,omitempty"`
+	Message *Message `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		// clients other than browsers send no origin
+		origin := r.Header.Get("Origin")
+		return origin == "" || corsAllowedOrigin(origin) != ""
+	},
+}
+
+// newWSJWTMiddleware is the JWT middleware of /ws, which also accepts the
+// token in WS_TOKEN_PARAM.
+func newWSJWTMiddleware() *JWTMiddleware {
+	m := newJWTMiddleware(false)
+	m.extract = firstToken(tokenFromAuthHeader, tokenFromParameter(WS_TOKEN_PARAM))
+	return m
+}
+
+// handleWebSocket upgrades the request and pushes new posts in the
+// subscribed area until either side closes. The initial area may be given
+// as lat, lon and range query parameters. The posts of the users the
+// caller blocked or muted are left out, as of their last subscribe.
+func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Received one request for a live WebSocket")
+
+	if !requireFlag(w, FLAG_LIVE) {
+		return
+	}
+	claims := requireClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	var initial *WSSubscribe
+	if r.URL.Query().Get("lat") != "" || r.URL.Query().Get("lon") != "" {
+		initial = &WSSubscribe{Type: "subscribe"}
+		initial.Lat, _ = strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		initial.Lon, _ = strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+		initial.Range, _ = strconv.ParseFloat(r.URL.Query().Get("range"), 64)
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has written the error response
+		fmt.Printf("Failed to upgrade to WebSocket %v.\n", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(WS_MAX_MESSAGE)
+
+	// the reader forwards subscribe messages, the loop below owns writes
+	requests := make(chan *WSSubscribe, 1)
+	if initial != nil {
+		requests <- initial
+	}
+	closed := make(chan struct{}) // the reader is done
+	done := make(chan struct{})   // the writer is done
+	defer close(done)
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+		})
+		for {
+			var msg WSSubscribe
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			select {
+			case requests <- &msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var sub *Subscriber
+	defer func() {
+		if sub != nil {
+			a.Live.Unsubscribe(sub)
+		}
+	}()
+	var posts <-chan Post // nil until subscribed
+	hidden := make(map[string]bool)
+	inbox := a.Live.Listen(claims.Username)
+	defer a.Live.Unlisten(claims.Username, inbox)
+	ping := time.NewTicker(WS_PING_INTERVAL)
+	defer ping.Stop()
+
+	for {
+		var out *WSMessage
+		select {
+		case <-closed:
+			return
+		case <-serverClosing:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(WS_WRITE_TIMEOUT))
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+			continue
+		case req := <-requests:
+			km := req.Range
+			if km == 0 {
+				km, _ = parseKm(DISTANCE)
+			}
+			if req.Type != "subscribe" || km < 0 || req.Lat < -90 || req.Lat > 90 || req.Lon < -180 || req.Lon > 180 {
+				out = &WSMessage{Type: "error", Error: "send {\"type\": \"subscribe\", \"lat\": ..., \"lon\": ..., \"range\": km}"}
+				break
+			}
+			users, err := hiddenUsers(r.Context(), claims.Username)
+			if err != nil {
+				fmt.Printf("Failed to read blocks of %s %v.\n", claims.Username, err)
+				out = &WSMessage{Type: "error", Error: "Failed to read blocks, subscribe again"}
+				break
+			}
+			hidden = make(map[string]bool, len(users))
+			for _, u := range users {
+				hidden[u] = true
+			}
+			if sub != nil {
+				a.Live.Unsubscribe(sub)
+			}
+			sub = a.Live.Subscribe(req.Lat, req.Lon, km)
+			posts = sub.C
+			out = &WSMessage{Type: "subscribed"}
+		case p := <-posts:
+			if hidden[p.User] {
+				continue
+			}
+			batch := []Post{p}
+			redactPosts(batch, claims.Username)
+			out = &WSMessage{Type: "post", Post: &batch[0]}
+		case m := <-inbox:
+			out = &WSMessage{Type: "message", Message: &m}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+		if err := conn.WriteJSON(out); err != nil {
+			fmt.Printf("Failed to write to WebSocket %v.\n", err)
+			return
+		}
+	}
+}
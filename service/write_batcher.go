@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Coalescing of post writes. Every post is indexed with Refresh("wait_for"),
+// so a burst of posts serializes on refreshes. With batching enabled, posts
+// arriving within WRITE_BATCH_MAX_DELAY of each other are indexed with one
+// bulk request and one refresh, up to WRITE_BATCH_MAX_SIZE at a time. A post
+// arriving when nothing else is queued is flushed right away, so quiet
+// periods pay no extra latency. Callers still only return once their post
+// is searchable, and each gets its own error.
+const (
+	ENABLE_WRITE_BATCHING = false
+	WRITE_BATCH_MAX_DELAY = 50 * time.Millisecond
+	WRITE_BATCH_MAX_SIZE  = 50
+)
+
+type writeRequest struct {
+	post   *Post
+	id     string
+	result chan error
+}
+
+type WriteBatcher struct {
+	requests chan *writeRequest
+}
+
+var writeBatcher *WriteBatcher
+
+func startWriteBatcher() {
+	if !ENABLE_WRITE_BATCHING {
+		return
+	}
+	writeBatcher = &WriteBatcher{requests: make(chan *writeRequest, WRITE_BATCH_MAX_SIZE*4)}
+	go writeBatcher.run()
+	fmt.Printf("Write batching started, up to %d posts per %v\n", WRITE_BATCH_MAX_SIZE, WRITE_BATCH_MAX_DELAY)
+}
+
+// Save queues a post and waits until the batch holding it is committed.
+func (b *WriteBatcher) Save(post *Post, id string) error {
+	req := &writeRequest{post: post, id: id, result: make(chan error, 1)}
+	b.requests <- req
+	return <-req.result
+}
+
+func (b *WriteBatcher) run() {
+	for first := range b.requests {
+		batch := []*writeRequest{first}
+
+		// only wait for company when others are already queued
+		if len(b.requests) > 0 {
+			timer := time.NewTimer(WRITE_BATCH_MAX_DELAY)
+		collect:
+			for len(batch) < WRITE_BATCH_MAX_SIZE {
+				select {
+				case req := <-b.requests:
+					batch = append(batch, req)
+				case <-timer.C:
+					break collect
+				}
+			}
+			timer.Stop()
+		}
+
+		b.flush(batch)
+	}
+}
+
+func (b *WriteBatcher) flush(batch []*writeRequest) {
+	fail := func(err error) {
+		for _, req := range batch {
+			req.result <- err
+		}
+	}
+
+	ids := make([]string, len(batch))
+	posts := make([]*Post, len(batch))
+	for i, req := range batch {
+		ids[i], posts[i] = req.id, req.post
+	}
+
+	errs, err := saveAllToES(context.Background(), ids, posts)
+	if err != nil {
+		fail(err)
+		return
+	}
+	for i, req := range batch {
+		req.result <- errs[i]
+	}
+	fmt.Printf("Saved a batch of %d posts to index\n", len(batch))
+}